@@ -0,0 +1,10 @@
+// Command patchserver serves game patches and launcher images for the
+// MHFZ-Launcher. Forks that add handlers or middleware can build their own
+// command around patchserver.New instead of patching this one.
+package main
+
+import "mhf-patch-server/patchserver"
+
+func main() {
+    patchserver.Main()
+}
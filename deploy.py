@@ -49,6 +49,8 @@ def prepare_common(target: Path):
     log("Copia file comuni...", "INFO")
     copytree(ROOT / "game", target / "game", dirs_exist_ok=True)
     copytree(ROOT / "images", target / "images", dirs_exist_ok=True)
+    if (ROOT / "news").exists():
+        copytree(ROOT / "news", target / "news", dirs_exist_ok=True)
     copy2(ROOT / "launcher.json", target / "launcher.json")
     copy2(ROOT / "patch_config.json", target / "patch_config.json")
     log("File comuni copiati ✓", "SUCCESS")
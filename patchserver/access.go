@@ -0,0 +1,173 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "sync"
+    "sync/atomic"
+)
+
+// AccessRules restricts which clients a listener serves. Deny wins over
+// Allow; an empty Allow admits every address not denied. Entries are CIDRs
+// or bare IPs.
+type AccessRules struct {
+    Allow []string `json:"Allow"`
+    Deny  []string `json:"Deny"`
+}
+
+// accessList is the parsed form of AccessRules, swapped whole on changes
+type accessList struct {
+    rules AccessRules
+    allow []*net.IPNet
+    deny  []*net.IPNet
+}
+
+func newAccessList(rules AccessRules) (*accessList, error) {
+    allow, err := parseCIDRs(rules.Allow)
+    if err != nil {
+        return nil, fmt.Errorf("Allow: %w", err)
+    }
+    deny, err := parseCIDRs(rules.Deny)
+    if err != nil {
+        return nil, fmt.Errorf("Deny: %w", err)
+    }
+    if rules.Allow == nil {
+        rules.Allow = []string{}
+    }
+    if rules.Deny == nil {
+        rules.Deny = []string{}
+    }
+    return &accessList{rules: rules, allow: allow, deny: deny}, nil
+}
+
+func (l *accessList) admits(ip net.IP) bool {
+    if ip == nil {
+        return len(l.allow) == 0 && len(l.deny) == 0
+    }
+    if containsIP(l.deny, ip) {
+        return false
+    }
+    return len(l.allow) == 0 || containsIP(l.allow, ip)
+}
+
+// accessState holds the access rules of the two listeners
+type accessState struct {
+    accessLists   map[string]*atomic.Pointer[accessList] // "patch" and "image"
+    accessMu      sync.Mutex                             // serializes admin edits
+    accessBlocked atomic.Int64
+}
+
+// loadAccessRules installs PatchAccess and ImageAccess
+func (s *Server) loadAccessRules() error {
+    for name, rules := range map[string]AccessRules{"patch": s.config.PatchAccess, "image": s.config.ImageAccess} {
+        l, err := newAccessList(rules)
+        if err != nil {
+            return fmt.Errorf("%sAccess: %w", name, err)
+        }
+        s.accessLists[name].Store(l)
+    }
+    return nil
+}
+
+// accessGate answers 403 to clients the rules of listener do not admit.
+// It runs after realIP so proxied clients are judged by their own address.
+func (s *Server) accessGate(listener string, h http.Handler) http.Handler {
+    rules := s.accessLists[listener]
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !rules.Load().admits(remoteIP(r)) {
+            s.accessBlocked.Add(1)
+            http.Error(w, "access denied", http.StatusForbidden)
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
+
+// adminAccessHandler lists the access rules of both listeners on GET. A
+// POST with listener (default patch), list (allow or deny), action (add or
+// remove) and cidr edits them until the next restart.
+func (s *Server) adminAccessHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method == http.MethodPost {
+        if err := s.editAccess(r); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    } else if r.Method != http.MethodGet {
+        requirePost(w, r)
+        return
+    }
+    out := map[string]AccessRules{}
+    for name, l := range s.accessLists {
+        out[name] = l.Load().rules
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(out)
+}
+
+func (s *Server) editAccess(r *http.Request) (err error) {
+    listener, list, action, cidr := r.FormValue("listener"), r.FormValue("list"), r.FormValue("action"), r.FormValue("cidr")
+    if listener == "" {
+        listener = "patch"
+    }
+    // bans get their own audit action so they are easy to find
+    auditAction := map[string]string{"deny add": "ban", "deny remove": "unban"}[list+" "+action]
+    if auditAction == "" {
+        auditAction = "access"
+    }
+    defer func() {
+        s.audit(adminActor(r), auditAction, listener, fmt.Sprintf("%s %s %s", list, action, cidr), err)
+    }()
+
+    rules, ok := s.accessLists[listener]
+    if !ok {
+        return fmt.Errorf("listener must be patch or image")
+    }
+    if _, err := parseCIDRs([]string{cidr}); err != nil || cidr == "" {
+        return fmt.Errorf("invalid cidr %q", cidr)
+    }
+    s.accessMu.Lock()
+    defer s.accessMu.Unlock()
+    current := rules.Load().rules
+    var entries *[]string
+    switch list {
+    case "allow":
+        entries = &current.Allow
+    case "deny":
+        entries = &current.Deny
+    default:
+        return fmt.Errorf("list must be allow or deny")
+    }
+    kept := []string{}
+    for _, e := range *entries {
+        if e != cidr {
+            kept = append(kept, e)
+        }
+    }
+    switch action {
+    case "add":
+        kept = append(kept, cidr)
+    case "remove":
+        if len(kept) == len(*entries) {
+            return fmt.Errorf("%s is not in the %s list", cidr, list)
+        }
+    default:
+        return fmt.Errorf("action must be add or remove")
+    }
+    *entries = kept
+    l, err := newAccessList(current)
+    if err != nil {
+        return err
+    }
+    rules.Store(l)
+    return nil
+}
+
+// registerAccess adds /admin/access and the refused request counter
+func (s *Server) registerAccess() {
+    s.adminMux.HandleFunc("/admin/access", s.adminAccessHandler)
+    s.registerMetric("patch_access_denied_total", "counter", "Requests refused by PatchAccess or ImageAccess", func() float64 {
+        return float64(s.accessBlocked.Load())
+    })
+}
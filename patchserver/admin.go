@@ -0,0 +1,98 @@
+package patchserver
+
+import (
+    "crypto/subtle"
+    "fmt"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// adminState holds the routes of the admin API
+type adminState struct {
+    // adminMux holds the operator endpoints under /admin/, enabled by
+    // AdminToken or AdminAuth
+    adminMux *http.ServeMux
+}
+
+// adminEnabled reports whether /admin/ has a way to log in
+func (s *Server) adminEnabled() bool {
+    return s.config.AdminToken != "" || len(s.config.AdminAuth) > 0
+}
+
+// requireAdmin accepts AdminToken as a bearer token or as the password of
+// HTTP basic auth, so the dashboard also works from a browser, or
+// credentials accepted by the AdminAuth backends
+func (s *Server) requireAdmin(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if !ok {
+            _, token, _ = r.BasicAuth()
+        }
+        if s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1 {
+            h.ServeHTTP(w, withActor(r, tokenID(token)))
+            return
+        }
+        if actor, ok := s.authenticate(r, s.config.AdminAuth); ok {
+            h.ServeHTTP(w, withActor(r, actor))
+            return
+        }
+        w.Header().Set("WWW-Authenticate", `Basic realm="patch server admin"`)
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+    })
+}
+
+// registerAdminRoutes mounts /metrics and, when AdminToken or AdminAuth is
+// set, /admin/
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+    mux.HandleFunc("/metrics", s.metricsHandler)
+    if s.adminEnabled() {
+        mux.Handle("/admin/", s.requireAdmin(s.failoverGate(s.adminMux)))
+    }
+}
+
+// listenAdmin opens AdminListen, either "unix:/path/to.sock" (created with
+// AdminSocketMode) or a loopback TCP address
+func (s *Server) listenAdmin(addr string) (net.Listener, error) {
+    sock, ok := strings.CutPrefix(addr, "unix:")
+    if !ok {
+        return net.Listen("tcp", addr)
+    }
+    if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    l, err := net.Listen("unix", sock)
+    if err != nil {
+        return nil, err
+    }
+    mode, _ := strconv.ParseUint(s.config.AdminSocketMode, 8, 32)
+    if err := os.Chmod(sock, os.FileMode(mode)); err != nil {
+        l.Close()
+        return nil, err
+    }
+    return l, nil
+}
+
+// validateAdminListen only allows unix sockets and loopback addresses so a
+// firewall mistake cannot expose the admin API
+func validateAdminListen(addr, mode string) error {
+    if _, ok := strings.CutPrefix(addr, "unix:"); ok {
+        if _, err := strconv.ParseUint(mode, 8, 32); err != nil {
+            return fmt.Errorf("AdminSocketMode %q is not an octal mode", mode)
+        }
+        return nil
+    }
+    host, _, err := net.SplitHostPort(addr)
+    if err != nil {
+        return err
+    }
+    if host == "localhost" {
+        return nil
+    }
+    if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+        return fmt.Errorf("%s is not a loopback address", addr)
+    }
+    return nil
+}
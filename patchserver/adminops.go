@@ -0,0 +1,99 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+)
+
+// requirePost rejects anything but POST, returning false when it did
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return false
+    }
+    return true
+}
+
+// rescanChannels rescans the given channels on behalf of actor, auditing
+// the rescan and every resulting publish
+func (s *Server) rescanChannels(actor string, list []*channel) map[string]string {
+    results := map[string]string{}
+    for _, ch := range withLocales(list) {
+        results[ch.name] = s.rescanChannel(actor, ch)
+    }
+    return results
+}
+
+// rescanChannel rescans ch, auditing the rescan and the publish when the
+// manifest changed, and returns the new ETag or the error
+func (s *Server) rescanChannel(actor string, ch *channel) string {
+    before := ch.data.Load()
+    err := s.loadChannel(ch)
+    s.audit(actor, "rescan", ch.name, "", err)
+    if err != nil {
+        return err.Error()
+    }
+    after := ch.data.Load()
+    if before == nil || before.ChecksumHeader != after.ChecksumHeader {
+        s.audit(actor, "publish", ch.name, after.ChecksumHeader, nil)
+    }
+    return after.ChecksumHeader
+}
+
+// allChannels returns every channel sorted by name
+func (s *Server) allChannels() []*channel {
+    list := make([]*channel, 0, len(s.channels))
+    for _, ch := range s.channels {
+        list = append(list, ch)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+    return list
+}
+
+// adminRescanHandler rescans one channel, or all when none is given
+func (s *Server) adminRescanHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    list := s.allChannels()
+    if r.FormValue("channel") != "" {
+        ch, ok := s.adminChannel(w, r)
+        if !ok {
+            return
+        }
+        list = []*channel{ch}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(s.rescanChannels(adminActor(r), list))
+}
+
+// adminForceHandler toggles a channel's Force flag at runtime
+func (s *Server) adminForceHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    force, err := strconv.ParseBool(r.FormValue("force"))
+    if err != nil {
+        s.audit(adminActor(r), "force", ch.name, r.FormValue("force"), err)
+        http.Error(w, "force must be true or false", http.StatusBadRequest)
+        return
+    }
+    ch.force.Store(force)
+    s.audit(adminActor(r), "force", ch.name, fmt.Sprint(force), nil)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"channel": ch.name, "force": force})
+}
+
+// registerAdminOps adds the rescan and force admin endpoints
+func (s *Server) registerAdminOps() {
+    s.adminMux.HandleFunc("/admin/rescan", s.adminRescanHandler)
+    s.adminMux.HandleFunc("/admin/force", s.adminForceHandler)
+}
@@ -0,0 +1,140 @@
+package patchserver
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// auditMemory is how many entries are kept when no AuditLogFile is set
+const auditMemory = 1000
+
+// AuditEntry records one administrative action
+type AuditEntry struct {
+    Time   int64  `json:"time"`
+    Actor  string `json:"actor"`
+    Action string `json:"action"`
+    Target string `json:"target,omitempty"`
+    Detail string `json:"detail,omitempty"`
+    Result string `json:"result"` // "ok" or the error
+}
+
+// auditState holds the most recent audit entries
+type auditState struct {
+    auditMu     sync.Mutex
+    auditRecent []AuditEntry
+}
+
+type actorKey struct{}
+
+// tokenID identifies a secret in logs without revealing it
+func tokenID(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return "token:" + hex.EncodeToString(sum[:4])
+}
+
+func withActor(r *http.Request, actor string) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), actorKey{}, actor))
+}
+
+// adminActor returns the identity requireAdmin attached to the request
+func adminActor(r *http.Request) string {
+    if actor, ok := r.Context().Value(actorKey{}).(string); ok {
+        return actor
+    }
+    return "unknown"
+}
+
+// audit appends an entry to AuditLogFile (one JSON object per line) and the
+// in-memory history
+func (s *Server) audit(actor, action, target, detail string, err error) {
+    e := AuditEntry{Time: time.Now().Unix(), Actor: actor, Action: action, Target: target, Detail: detail, Result: "ok"}
+    if err != nil {
+        e.Result = err.Error()
+    }
+    s.auditMu.Lock()
+    defer s.auditMu.Unlock()
+    s.auditRecent = append(s.auditRecent, e)
+    if len(s.auditRecent) > auditMemory {
+        s.auditRecent = s.auditRecent[len(s.auditRecent)-auditMemory:]
+    }
+    if s.config.AuditLogFile == "" {
+        return
+    }
+    f, ferr := os.OpenFile(s.config.AuditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if ferr != nil {
+        log.Printf("audit log: %v", ferr)
+        return
+    }
+    defer f.Close()
+    line, _ := json.Marshal(e)
+    if _, ferr := f.Write(append(line, '\n')); ferr != nil {
+        log.Printf("audit log: %v", ferr)
+    }
+}
+
+// auditEntries returns the history, from AuditLogFile when configured
+func (s *Server) auditEntries() ([]AuditEntry, error) {
+    s.auditMu.Lock()
+    defer s.auditMu.Unlock()
+    if s.config.AuditLogFile == "" {
+        return append([]AuditEntry(nil), s.auditRecent...), nil
+    }
+    f, err := os.Open(s.config.AuditLogFile)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    var entries []AuditEntry
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var e AuditEntry
+        if json.Unmarshal(scanner.Bytes(), &e) == nil {
+            entries = append(entries, e)
+        }
+    }
+    return entries, scanner.Err()
+}
+
+// adminAuditHandler lists the newest entries first, filtered by action,
+// actor and since (unix seconds), at most limit (default 100)
+func (s *Server) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+    entries, err := s.auditEntries()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    q := r.URL.Query()
+    limit, err := strconv.Atoi(q.Get("limit"))
+    if err != nil || limit <= 0 {
+        limit = 100
+    }
+    since, _ := strconv.ParseInt(q.Get("since"), 10, 64)
+    out := []AuditEntry{}
+    for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+        e := entries[i]
+        if (q.Get("action") != "" && e.Action != q.Get("action")) ||
+            (q.Get("actor") != "" && e.Actor != q.Get("actor")) || e.Time < since {
+            continue
+        }
+        out = append(out, e)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(out)
+}
+
+// registerAudit adds /admin/audit
+func (s *Server) registerAudit() {
+    s.adminMux.HandleFunc("/admin/audit", s.adminAuditHandler)
+}
@@ -0,0 +1,460 @@
+package patchserver
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Authentication backend kinds
+const (
+    AuthStatic = "static"
+    AuthLDAP   = "ldap"
+    AuthOAuth  = "oauth"
+)
+
+// maxAuthCache bounds the cached authentications
+const maxAuthCache = 10000
+
+// StaticToken is a token of a static backend, stored as the hex SHA-256
+// printed by "patchserver hash-token" so the config holds no secret
+type StaticToken struct {
+    User   string `json:"User"`
+    SHA256 string `json:"SHA256"`
+}
+
+// AuthBackendConfig is an identity source for the admin API (AdminAuth)
+// and gated channels (a channel's Auth), referenced by Name:
+//
+//   - static accepts the Tokens, as a bearer token, X-Patch-Token or
+//     basic auth password
+//   - ldap binds to URL (ldap:// with StartTLS, or ldaps://) as BindDN,
+//     where {user} is the basic auth user name, with the basic auth
+//     password; RequireAttribute ("memberOf=cn=admins,...") must then
+//     match the user's entry
+//   - oauth accepts bearer access tokens that UserInfoURL (OpenID Connect
+//     userinfo or compatible) answers for, from AllowedUsers.
+//     With ClientID, DeviceAuthURL and TokenURL, /auth/device and
+//     /auth/token run the device flow for launchers and scripts.
+//
+// Named in AdminAuth or a channel's Auth, an ldap backend needs
+// RequireAttribute and an oauth backend AllowedUsers, so that not every
+// account of the directory or provider gets in. Accepted ldap and oauth
+// credentials are remembered for CacheSeconds (default 60).
+type AuthBackendConfig struct {
+    Name             string        `json:"Name"`
+    Kind             string        `json:"Kind"`
+    Tokens           []StaticToken `json:"Tokens"`
+    URL              string        `json:"URL"`
+    StartTLS         bool          `json:"StartTLS"`
+    BindDN           string        `json:"BindDN"`
+    RequireAttribute string        `json:"RequireAttribute"`
+    ClientID         string        `json:"ClientID"`
+    ClientSecret     string        `json:"ClientSecret"`
+    DeviceAuthURL    string        `json:"DeviceAuthURL"`
+    TokenURL         string        `json:"TokenURL"`
+    UserInfoURL      string        `json:"UserInfoURL"`
+    Scopes           []string      `json:"Scopes"`
+    AllowedUsers     []string      `json:"AllowedUsers"`
+    CacheSeconds     int           `json:"CacheSeconds"`
+}
+
+// credentials are what a request offers to authenticate with
+type credentials struct {
+    token          string // bearer token or X-Patch-Token
+    user, password string // basic auth
+}
+
+func requestCredentials(r *http.Request) credentials {
+    var c credentials
+    c.token = r.Header.Get("X-Patch-Token")
+    if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && c.token == "" {
+        c.token = bearer
+    }
+    c.user, c.password, _ = r.BasicAuth()
+    return c
+}
+
+// authBackend checks credentials, returning the user they belong to, or
+// false without error when it refuses them
+type authBackend interface {
+    authenticate(c credentials) (string, bool, error)
+}
+
+type staticAuth struct{ tokens []StaticToken }
+
+func (a staticAuth) authenticate(c credentials) (string, bool, error) {
+    for _, secret := range []string{c.token, c.password} {
+        if secret == "" {
+            continue
+        }
+        sum := sha256.Sum256([]byte(secret))
+        hash := hex.EncodeToString(sum[:])
+        for _, t := range a.tokens {
+            if subtle.ConstantTimeCompare([]byte(hash), []byte(t.SHA256)) == 1 {
+                if t.User == "" {
+                    return tokenID(secret), true, nil
+                }
+                return t.User, true, nil
+            }
+        }
+    }
+    return "", false, nil
+}
+
+type ldapAuth struct{ cfg AuthBackendConfig }
+
+func (a ldapAuth) authenticate(c credentials) (string, bool, error) {
+    // An empty password is an unauthenticated bind, which servers accept
+    if c.user == "" || c.password == "" {
+        return "", false, nil
+    }
+    conn, err := dialLDAP(a.cfg.URL, a.cfg.StartTLS, 10*time.Second)
+    if err != nil {
+        return "", false, err
+    }
+    defer conn.close()
+    dn := strings.ReplaceAll(a.cfg.BindDN, "{user}", escapeDN(c.user))
+    if ok, err := conn.bind(dn, c.password); !ok || err != nil {
+        return "", false, err
+    }
+    if a.cfg.RequireAttribute != "" {
+        attr, value, _ := strings.Cut(a.cfg.RequireAttribute, "=")
+        if ok, err := conn.hasAttribute(dn, attr, value); !ok || err != nil {
+            return "", false, err
+        }
+    }
+    return c.user, true, nil
+}
+
+type oauthAuth struct{ cfg AuthBackendConfig }
+
+var authClient = &http.Client{Timeout: 10 * time.Second}
+
+func (a oauthAuth) authenticate(c credentials) (string, bool, error) {
+    if c.token == "" {
+        return "", false, nil
+    }
+    req, err := http.NewRequest(http.MethodGet, a.cfg.UserInfoURL, nil)
+    if err != nil {
+        return "", false, err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.token)
+    req.Header.Set("Accept", "application/json")
+    resp, err := authClient.Do(req)
+    if err != nil {
+        return "", false, err
+    }
+    defer resp.Body.Close()
+    switch {
+    case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+        return "", false, nil
+    case resp.StatusCode != http.StatusOK:
+        return "", false, fmt.Errorf("userinfo: %s", resp.Status)
+    }
+    var info map[string]any
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info); err != nil {
+        return "", false, fmt.Errorf("userinfo: %w", err)
+    }
+    // login is GitHub's
+    var user string
+    for _, k := range []string{"preferred_username", "login", "email", "sub"} {
+        if v, ok := info[k].(string); ok && v != "" {
+            user = v
+            break
+        }
+    }
+    if user == "" {
+        return "", false, errors.New("userinfo names no user")
+    }
+    if len(a.cfg.AllowedUsers) > 0 && !containsString(a.cfg.AllowedUsers, user) {
+        return "", false, nil
+    }
+    return user, true, nil
+}
+
+// cachedAuth is an accepted authentication
+type cachedAuth struct {
+    user    string
+    expires time.Time
+}
+
+// authState holds the AuthBackends by name and the cached logins
+type authState struct {
+    authBackends map[string]authBackend
+    authConfigs  map[string]AuthBackendConfig
+    authCacheMu  sync.Mutex
+    authCache    map[[32]byte]cachedAuth
+    authErrors   atomic.Int64
+}
+
+// loadAuthBackends sets up AuthBackends, already validated
+func (s *Server) loadAuthBackends() {
+    for _, b := range s.config.AuthBackends {
+        s.authConfigs[b.Name] = b
+        switch b.Kind {
+        case AuthStatic:
+            s.authBackends[b.Name] = staticAuth{b.Tokens}
+        case AuthLDAP:
+            s.authBackends[b.Name] = ldapAuth{b}
+        case AuthOAuth:
+            s.authBackends[b.Name] = oauthAuth{b}
+        }
+    }
+}
+
+// authenticate tries the backends names in order, returning the actor of
+// the first accepting the request's credentials, "<backend>:<user>"
+func (s *Server) authenticate(r *http.Request, names []string) (string, bool) {
+    if len(names) == 0 {
+        return "", false
+    }
+    c := requestCredentials(r)
+    if c.token == "" && c.password == "" {
+        return "", false
+    }
+    for _, name := range names {
+        cfg := s.authConfigs[name]
+        key := sha256.Sum256([]byte(name + "\x00" + c.token + "\x00" + c.user + "\x00" + c.password))
+        now := time.Now()
+        s.authCacheMu.Lock()
+        hit, ok := s.authCache[key]
+        s.authCacheMu.Unlock()
+        if ok && now.Before(hit.expires) {
+            return name + ":" + hit.user, true
+        }
+        user, ok, err := s.authBackends[name].authenticate(c)
+        if err != nil {
+            s.authErrors.Add(1)
+            logRequest(r, "Auth backend %s: %v", name, err)
+            continue
+        }
+        if !ok {
+            continue
+        }
+        if cfg.Kind != AuthStatic {
+            s.authCacheMu.Lock()
+            if len(s.authCache) >= maxAuthCache {
+                s.authCache = map[[32]byte]cachedAuth{}
+            }
+            s.authCache[key] = cachedAuth{user: user, expires: now.Add(time.Duration(cfg.CacheSeconds) * time.Second)}
+            s.authCacheMu.Unlock()
+        }
+        return name + ":" + user, true
+    }
+    return "", false
+}
+
+// validateAuth checks AuthBackends and the names referring to them
+func validateAuth(cfg *Config) []error {
+    var errs []error
+    known := map[string]bool{}
+    // open holds the ldap and oauth backends accepting every user of the
+    // directory or identity provider, which cannot gate anything
+    open := map[string]string{}
+    for i := range cfg.AuthBackends {
+        b := &cfg.AuthBackends[i]
+        where := fmt.Sprintf("AuthBackends[%d]", i)
+        if b.Name == "" || strings.Contains(b.Name, ":") || known[b.Name] {
+            errs = append(errs, fmt.Errorf("%s: missing, duplicate or invalid Name %q", where, b.Name))
+        }
+        known[b.Name] = true
+        if b.CacheSeconds <= 0 {
+            b.CacheSeconds = 60
+        }
+        switch b.Kind {
+        case AuthStatic:
+            if len(b.Tokens) == 0 {
+                errs = append(errs, fmt.Errorf("%s: a static backend needs Tokens", where))
+            }
+            for j, t := range b.Tokens {
+                if sum, err := hex.DecodeString(t.SHA256); err != nil || len(sum) != sha256.Size {
+                    errs = append(errs, fmt.Errorf("%s.Tokens[%d].SHA256 is not a hex SHA-256, see patchserver hash-token", where, j))
+                }
+                b.Tokens[j].SHA256 = strings.ToLower(t.SHA256)
+            }
+        case AuthLDAP:
+            u, err := url.Parse(b.URL)
+            if err != nil || u.Scheme != "ldap" && u.Scheme != "ldaps" || u.Hostname() == "" {
+                errs = append(errs, fmt.Errorf("%s.URL must be ldap://host or ldaps://host, got %q", where, b.URL))
+            } else if u.Scheme == "ldap" && !b.StartTLS {
+                log.Printf("Warning: %s sends passwords in clear text, use ldaps:// or StartTLS", where)
+            }
+            if !strings.Contains(b.BindDN, "{user}") {
+                errs = append(errs, fmt.Errorf("%s.BindDN must contain {user}", where))
+            }
+            if attr, value, ok := strings.Cut(b.RequireAttribute, "="); b.RequireAttribute != "" && (!ok || attr == "" || value == "") {
+                errs = append(errs, fmt.Errorf("%s.RequireAttribute must be attribute=value", where))
+            }
+            if b.RequireAttribute == "" {
+                open[b.Name] = "an ldap backend without RequireAttribute accepts every user of the directory"
+            }
+        case AuthOAuth:
+            if b.UserInfoURL == "" {
+                errs = append(errs, fmt.Errorf("%s: an oauth backend needs UserInfoURL", where))
+            }
+            if (b.DeviceAuthURL != "" || b.TokenURL != "") && (b.ClientID == "" || b.DeviceAuthURL == "" || b.TokenURL == "") {
+                errs = append(errs, fmt.Errorf("%s: the device flow needs ClientID, DeviceAuthURL and TokenURL", where))
+            }
+            if len(b.AllowedUsers) == 0 {
+                open[b.Name] = "an oauth backend without AllowedUsers accepts every account of the provider"
+            }
+        default:
+            errs = append(errs, fmt.Errorf("%s.Kind must be %s, %s or %s, got %q", where, AuthStatic, AuthLDAP, AuthOAuth, b.Kind))
+        }
+    }
+    check := func(where string, names []string) {
+        for _, name := range names {
+            if !known[name] {
+                errs = append(errs, fmt.Errorf("%s: unknown auth backend %q", where, name))
+            } else if reason := open[name]; reason != "" {
+                errs = append(errs, fmt.Errorf("%s: %q cannot gate access, %s", where, name, reason))
+            }
+        }
+    }
+    check("AdminAuth", cfg.AdminAuth)
+    for i, c := range cfg.Channels {
+        check(fmt.Sprintf("Channels[%d].Auth", i), c.Auth)
+    }
+    for i, t := range cfg.Tenants {
+        for j, c := range t.Channels {
+            check(fmt.Sprintf("Tenants[%d].Channels[%d].Auth", i, j), c.Auth)
+        }
+    }
+    return errs
+}
+
+// deviceBackend returns the oauth backend with a device flow named by the
+// backend form value, which may be left out when there is one
+func (s *Server) deviceBackend(w http.ResponseWriter, r *http.Request) (AuthBackendConfig, bool) {
+    var found []AuthBackendConfig
+    for _, b := range s.config.AuthBackends {
+        if b.Kind == AuthOAuth && b.DeviceAuthURL != "" && (r.FormValue("backend") == "" || r.FormValue("backend") == b.Name) {
+            found = append(found, b)
+        }
+    }
+    if len(found) != 1 {
+        http.Error(w, "unknown backend, give one with a device flow in backend", http.StatusNotFound)
+        return AuthBackendConfig{}, false
+    }
+    return found[0], true
+}
+
+// relayOAuth posts form to the identity provider's endpoint and passes its
+// JSON answer on
+func (s *Server) relayOAuth(w http.ResponseWriter, r *http.Request, endpoint string, form url.Values) {
+    req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    resp, err := authClient.Do(req)
+    if err != nil {
+        s.authErrors.Add(1)
+        logRequest(r, "Device flow: %v", err)
+        http.Error(w, "identity provider unreachable", http.StatusBadGateway)
+        return
+    }
+    defer resp.Body.Close()
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(resp.StatusCode)
+    io.Copy(w, io.LimitReader(resp.Body, 1<<20))
+}
+
+// authDeviceHandler starts a device flow: the client shows the answer's
+// user_code and verification_uri, then polls /auth/token
+func (s *Server) authDeviceHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    b, ok := s.deviceBackend(w, r)
+    if !ok {
+        return
+    }
+    s.relayOAuth(w, r, b.DeviceAuthURL, url.Values{
+        "client_id": {b.ClientID},
+        "scope":     {strings.Join(b.Scopes, " ")},
+    })
+}
+
+// authTokenHandler polls the device flow started with device_code, giving
+// the access token once the user approved it
+func (s *Server) authTokenHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    b, ok := s.deviceBackend(w, r)
+    if !ok {
+        return
+    }
+    if r.FormValue("device_code") == "" {
+        http.Error(w, "device_code is required", http.StatusBadRequest)
+        return
+    }
+    form := url.Values{
+        "grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+        "device_code": {r.FormValue("device_code")},
+        "client_id":   {b.ClientID},
+    }
+    if b.ClientSecret != "" {
+        form.Set("client_secret", b.ClientSecret)
+    }
+    s.relayOAuth(w, r, b.TokenURL, form)
+}
+
+// deviceFlowEnabled reports whether an oauth backend has a device flow
+func (s *Server) deviceFlowEnabled() bool {
+    for _, b := range s.config.AuthBackends {
+        if b.Kind == AuthOAuth && b.DeviceAuthURL != "" {
+            return true
+        }
+    }
+    return false
+}
+
+// hashTokenCommand prints the SHA256 of static backend Tokens, given as
+// arguments or, kept out of the shell history, one per line on stdin
+func hashTokenCommand(args []string) {
+    show := func(token string) {
+        sum := sha256.Sum256([]byte(token))
+        fmt.Println(hex.EncodeToString(sum[:]))
+    }
+    if len(args) > 0 {
+        for _, token := range args {
+            show(token)
+        }
+        return
+    }
+    scanner := bufio.NewScanner(os.Stdin)
+    for scanner.Scan() {
+        if token := strings.TrimSpace(scanner.Text()); token != "" {
+            show(token)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// registerAuth adds the backend error counter
+func (s *Server) registerAuth() {
+    s.registerMetric("patch_auth_backend_errors_total", "counter", "Authentications that failed because a backend was unreachable or answered an error", func() float64 {
+        return float64(s.authErrors.Load())
+    })
+}
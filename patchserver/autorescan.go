@@ -0,0 +1,286 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ScheduledRescan rescans Channels (all when empty) whenever Cron matches.
+// Cron has the five crontab fields, minute hour day month weekday, in local
+// time, or one of @hourly, @daily, @weekly and @monthly. With AutoPublish
+// false the rescan only reports whether the folder changed, leaving the
+// publish to an operator.
+type ScheduledRescan struct {
+    Cron        string   `json:"Cron"`
+    Channels    []string `json:"Channels"`
+    AutoPublish bool     `json:"AutoPublish"`
+}
+
+// ClockWindow is a daily time span, "HH:MM" local time, wrapping past
+// midnight when End < Start
+type ClockWindow struct {
+    Start string `json:"Start"`
+    End   string `json:"End"`
+}
+
+var cronMacros = map[string]string{
+    "@hourly":  "0 * * * *",
+    "@daily":   "0 0 * * *",
+    "@weekly":  "0 0 * * 0",
+    "@monthly": "0 0 1 * *",
+}
+
+// cronSchedule is a parsed Cron, one bit per allowed value of each field
+type cronSchedule struct {
+    minute, hour, day, month, weekday uint64
+    // anyDay and anyWeekday are set for fields starting with *, like */2;
+    // as in crontab, a day matches when either restricted field does
+    anyDay, anyWeekday bool
+}
+
+// parseCronField parses a comma separated list of *, n, a-b with an
+// optional /step into a bit set of the values in [lo, hi]
+func parseCronField(s string, lo, hi int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(s, ",") {
+        spec, stepText, hasStep := strings.Cut(part, "/")
+        step := 1
+        if hasStep {
+            n, err := strconv.Atoi(stepText)
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step in %q", part)
+            }
+            step = n
+        }
+        from, to := lo, hi
+        if spec != "*" {
+            a, b, isRange := strings.Cut(spec, "-")
+            var err error
+            if from, err = strconv.Atoi(a); err != nil {
+                return 0, fmt.Errorf("invalid value %q", part)
+            }
+            to = from
+            if isRange {
+                if to, err = strconv.Atoi(b); err != nil {
+                    return 0, fmt.Errorf("invalid range %q", part)
+                }
+            } else if hasStep {
+                to = hi
+            }
+        }
+        if from < lo || to > hi || from > to {
+            return 0, fmt.Errorf("%q is outside %d-%d", part, lo, hi)
+        }
+        for v := from; v <= to; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func parseCron(s string) (*cronSchedule, error) {
+    if macro, ok := cronMacros[s]; ok {
+        s = macro
+    }
+    fields := strings.Fields(s)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron %q must have 5 fields", s)
+    }
+    c := &cronSchedule{anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*")}
+    var err error
+    for _, f := range []struct {
+        bits   *uint64
+        lo, hi int
+    }{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.day, 1, 31}, {&c.month, 1, 12}, {&c.weekday, 0, 7}} {
+        if *f.bits, err = parseCronField(fields[0], f.lo, f.hi); err != nil {
+            return nil, fmt.Errorf("cron %q: %w", s, err)
+        }
+        fields = fields[1:]
+    }
+    // 7 is Sunday too
+    if c.weekday&(1<<7) != 0 {
+        c.weekday |= 1
+    }
+    return c, nil
+}
+
+// matches reports whether the minute of t is scheduled
+func (c *cronSchedule) matches(t time.Time) bool {
+    if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 || c.month&(1<<uint(t.Month())) == 0 {
+        return false
+    }
+    day := c.day&(1<<uint(t.Day())) != 0
+    weekday := c.weekday&(1<<uint(t.Weekday())) != 0
+    if c.anyDay || c.anyWeekday {
+        return day && weekday
+    }
+    return day || weekday
+}
+
+// next returns the first scheduled minute after t, zero when there is
+// none within a year (e.g. February 30)
+func (c *cronSchedule) next(t time.Time) time.Time {
+    t = t.Truncate(time.Minute).Add(time.Minute)
+    for end := t.AddDate(1, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+        if c.matches(t) {
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+func unixOrZero(t time.Time) int64 {
+    if t.IsZero() {
+        return 0
+    }
+    return t.Unix()
+}
+
+// inQuietHours reports whether now is inside RescanQuietHours
+func (s *Server) inQuietHours(now time.Time) bool {
+    minute := now.Hour()*60 + now.Minute()
+    for _, w := range s.config.RescanQuietHours {
+        start, _ := parseClock(w.Start)
+        end, _ := parseClock(w.End)
+        if inClockWindow(start, end, minute) {
+            return true
+        }
+    }
+    return false
+}
+
+// scheduledRescanStatus is one RescanSchedule entry in /admin/rescans
+type scheduledRescanStatus struct {
+    ScheduledRescan
+    Next     int64             `json:"next,omitempty"`
+    Deferred bool              `json:"deferred"` // due, waiting for quiet hours to end
+    LastRun  int64             `json:"last_run,omitempty"`
+    Results  map[string]string `json:"results,omitempty"`
+}
+
+// rescanScheduleState holds the parsed RescanSchedule and its last runs
+type rescanScheduleState struct {
+    rescanScheduleMu sync.Mutex
+    rescanSchedules  []*cronSchedule
+    rescanStatus     []scheduledRescanStatus
+    // pendingAudited is the pending ETag last audited per channel, so a
+    // change left unpublished is audited once
+    pendingAudited sync.Map
+}
+
+// scheduledChannels resolves the channel names of a schedule
+func (s *Server) scheduledChannels(names []string) []*channel {
+    if len(names) == 0 {
+        return s.allChannels()
+    }
+    var list []*channel
+    for _, name := range names {
+        if ch, ok := s.channels[name]; ok {
+            list = append(list, ch)
+        } else {
+            log.Printf("RescanSchedule: unknown channel %q", name)
+        }
+    }
+    return list
+}
+
+// runScheduledRescan rescans, or with AutoPublish false only checks, the
+// channels of a schedule. Rolled back channels are skipped: they keep
+// their version until the rollback is cleared.
+func (s *Server) runScheduledRescan(sched ScheduledRescan) map[string]string {
+    results := map[string]string{}
+    for _, ch := range withLocales(s.scheduledChannels(sched.Channels)) {
+        if id := s.pinnedVersion(ch); id != "" {
+            results[ch.name] = "skipped, rolled back to " + id
+            continue
+        }
+        if sched.AutoPublish {
+            results[ch.name] = s.rescanChannel("schedule", ch)
+            continue
+        }
+        s.rescanMu.Lock()
+        data, err := ch.buildManifest()
+        s.rescanMu.Unlock()
+        switch {
+        case err != nil:
+            results[ch.name] = err.Error()
+        case data.ChecksumHeader == ch.data.Load().ChecksumHeader:
+            results[ch.name] = "unchanged"
+        default:
+            results[ch.name] = "changes pending " + data.ChecksumHeader
+            if prev, _ := s.pendingAudited.Swap(ch.name, data.ChecksumHeader); prev != data.ChecksumHeader {
+                s.audit("schedule", "changes_pending", ch.name, data.ChecksumHeader, nil)
+            }
+        }
+    }
+    return results
+}
+
+// rescanScheduleLoop runs RescanSchedule at the start of every minute. A
+// rescan due in quiet hours, or on a passive failover instance, waits until
+// they are over.
+func (s *Server) rescanScheduleLoop() {
+    for {
+        now := time.Now()
+        time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+        now = time.Now()
+        quiet := s.inQuietHours(now) || s.passive()
+        for i, c := range s.rescanSchedules {
+            s.rescanScheduleMu.Lock()
+            st := &s.rescanStatus[i]
+            due := c.matches(now) || st.Deferred
+            if due && quiet && !st.Deferred {
+                log.Printf("Scheduled rescan %q deferred until quiet hours end", st.Cron)
+            }
+            st.Deferred = due && quiet
+            st.Next = unixOrZero(c.next(now))
+            sched := st.ScheduledRescan
+            s.rescanScheduleMu.Unlock()
+            if !due || quiet {
+                continue
+            }
+            results := s.runScheduledRescan(sched)
+            for name, result := range results {
+                log.Printf("Scheduled rescan %s: %s", name, result)
+            }
+            s.rescanScheduleMu.Lock()
+            st.LastRun, st.Results = now.Unix(), results
+            s.rescanScheduleMu.Unlock()
+        }
+    }
+}
+
+// startRescanSchedule parses RescanSchedule, already validated, and starts
+// its loop
+func (s *Server) startRescanSchedule() {
+    now := time.Now()
+    for _, sched := range s.config.RescanSchedule {
+        c, _ := parseCron(sched.Cron)
+        s.rescanSchedules = append(s.rescanSchedules, c)
+        s.rescanStatus = append(s.rescanStatus, scheduledRescanStatus{ScheduledRescan: sched, Next: unixOrZero(c.next(now))})
+    }
+    go s.rescanScheduleLoop()
+}
+
+func (s *Server) adminRescansHandler(w http.ResponseWriter, r *http.Request) {
+    s.rescanScheduleMu.Lock()
+    list := append([]scheduledRescanStatus{}, s.rescanStatus...)
+    s.rescanScheduleMu.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{
+        "schedules":   list,
+        "quiet_hours": s.config.RescanQuietHours,
+        "quiet_now":   s.inQuietHours(time.Now()),
+    })
+}
+
+// registerRescanSchedule adds /admin/rescans
+func (s *Server) registerRescanSchedule() {
+    s.adminMux.HandleFunc("/admin/rescans", s.adminRescansHandler)
+}
@@ -0,0 +1,212 @@
+package patchserver
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+    "log"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+// bodyChunkSize is the size of the pieces manifest bodies are kept in in
+// StoreFile, so serving one never holds a read transaction for long
+const bodyChunkSize = 64 << 10
+
+var bucketBodies = []byte("bodies")
+
+var errBodyPruned = errors.New("manifest body is no longer in the store")
+
+// manifestBlob is a rendered manifest body, in memory (a *bytes.Reader) or
+// in StoreFile (a storedBlob)
+type manifestBlob interface {
+    io.ReaderAt
+    Size() int64
+}
+
+// readBlob returns the whole of b
+func readBlob(b manifestBlob) ([]byte, error) {
+    if b.Size() == 0 {
+        return nil, nil
+    }
+    buf := make([]byte, b.Size())
+    if _, err := b.ReadAt(buf, 0); err != nil {
+        return nil, err
+    }
+    return buf, nil
+}
+
+// bodyStore keeps the bodies of one manifest in StoreFile, under
+// channels/<channel>/bodies/<generation>/<name> with one key per chunk.
+// Every manifest gets a new generation, so requests still reading a
+// replaced one are not served a mix of both.
+type bodyStore struct {
+    db      *bolt.DB
+    channel []byte
+    gen     []byte
+}
+
+// bucket returns the chunks of the body name, nil once they are pruned
+func (bs *bodyStore) bucket(tx *bolt.Tx, name string) *bolt.Bucket {
+    bodies, _ := channelBucket(tx, bs.channel, bucketBodies)
+    if bodies == nil {
+        return nil
+    }
+    if gen := bodies.Bucket(bs.gen); gen != nil {
+        return gen.Bucket([]byte(name))
+    }
+    return nil
+}
+
+// put writes the encodings of a body to the store as name, name.gz and
+// name.zz, returning them read from there
+func (bs *bodyStore) put(name string, enc encodedBody) (encodedBody, error) {
+    var stored encodedBody
+    err := bs.db.Update(func(tx *bolt.Tx) error {
+        bodies, err := channelBucket(tx, bs.channel, bucketBodies)
+        if err != nil {
+            return err
+        }
+        gen, err := bodies.CreateBucketIfNotExists(bs.gen)
+        if err != nil {
+            return err
+        }
+        for _, part := range []struct {
+            name string
+            src  manifestBlob
+            dst  *manifestBlob
+        }{
+            {name, enc.plain, &stored.plain},
+            {name + ".gz", enc.gzip, &stored.gzip},
+            {name + ".zz", enc.deflate, &stored.deflate},
+        } {
+            body, err := readBlob(part.src)
+            if err != nil {
+                return err
+            }
+            chunks, err := gen.CreateBucket([]byte(part.name))
+            if err != nil {
+                return err
+            }
+            for i := 0; i*bodyChunkSize < len(body); i++ {
+                chunk := body[i*bodyChunkSize : min((i+1)*bodyChunkSize, len(body))]
+                if err := chunks.Put(binary.BigEndian.AppendUint64(nil, uint64(i)), chunk); err != nil {
+                    return err
+                }
+            }
+            *part.dst = storedBlob{bs, part.name, int64(len(body))}
+        }
+        return nil
+    })
+    return stored, err
+}
+
+// storedBlob is one body of a bodyStore
+type storedBlob struct {
+    bs   *bodyStore
+    name string
+    size int64
+}
+
+func (b storedBlob) Size() int64 { return b.size }
+
+// ReadAt reads the chunks p covers in one read transaction
+func (b storedBlob) ReadAt(p []byte, off int64) (int, error) {
+    if off >= b.size {
+        return 0, io.EOF
+    }
+    n := 0
+    err := b.bs.db.View(func(tx *bolt.Tx) error {
+        chunks := b.bs.bucket(tx, b.name)
+        if chunks == nil {
+            return errBodyPruned
+        }
+        for n < len(p) && off+int64(n) < b.size {
+            pos := off + int64(n)
+            chunk := chunks.Get(binary.BigEndian.AppendUint64(nil, uint64(pos/bodyChunkSize)))
+            skip := int(pos % bodyChunkSize)
+            if skip >= len(chunk) {
+                return errBodyPruned
+            }
+            n += copy(p[n:], chunk[skip:])
+        }
+        return nil
+    })
+    if err == nil && n < len(p) {
+        err = io.EOF
+    }
+    return n, err
+}
+
+// storeBodies moves the /check and /check/v2 bodies of data, about to be
+// served on ch, to StoreFile, leaving only its entries and path index in
+// memory. Without a store they stay in memory.
+func (s *Server) storeBodies(ch *channel, data *DirData) error {
+    if s.store == nil {
+        return nil
+    }
+    bs := &bodyStore{db: s.store, channel: []byte(ch.name)}
+    err := s.store.Update(func(tx *bolt.Tx) error {
+        bodies, err := channelBucket(tx, bs.channel, bucketBodies)
+        if err != nil {
+            return err
+        }
+        seq, err := bodies.NextSequence()
+        bs.gen = binary.BigEndian.AppendUint64(nil, seq)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    checksums, err := bs.put("check", data.checksums)
+    if err != nil {
+        return err
+    }
+    v2, err := bs.put("v2", data.v2)
+    if err != nil {
+        return err
+    }
+    data.checksums, data.v2, data.stored = checksums, v2, bs
+    return nil
+}
+
+// pruneBodies drops the stored bodies of ch that are no longer served: all
+// but those of its manifest, of old, which requests may still be reading,
+// and of the version a rollout holds clients on
+func (s *Server) pruneBodies(ch *channel, old *DirData) {
+    if s.store == nil {
+        return
+    }
+    held := []*DirData{ch.data.Load(), old}
+    if ro := ch.rollout.Load(); ro != nil {
+        held = append(held, ro.from)
+    }
+    keep := map[string]bool{}
+    for _, d := range held {
+        if d != nil && d.stored != nil {
+            keep[string(d.stored.gen)] = true
+        }
+    }
+    err := s.store.Update(func(tx *bolt.Tx) error {
+        bodies, err := channelBucket(tx, []byte(ch.name), bucketBodies)
+        if err != nil {
+            return err
+        }
+        var drop [][]byte
+        bodies.ForEach(func(k, v []byte) error {
+            if v == nil && !keep[string(k)] {
+                drop = append(drop, append([]byte(nil), k...))
+            }
+            return nil
+        })
+        for _, k := range drop {
+            if err := bodies.DeleteBucket(k); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Pruning stored %s manifests: %v", ch.name, err)
+    }
+}
@@ -0,0 +1,66 @@
+package patchserver
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// diffBundleHandler serves /bundle/diff/{fromEtag}: a zip of only the files
+// added or changed since the archived version fromEtag, listing removed
+// files in its ".deleted" member, so launchers that prefer one download
+// over many requests still skip what they already have
+func (s *Server) diffBundleHandler(w http.ResponseWriter, r *http.Request) {
+    id := versionID(strings.TrimPrefix(r.URL.Path, "/bundle/"+DiffBundle+"/"))
+    if s.config.KeepVersions <= 0 || id == "" || strings.ContainsAny(id, `/\`) {
+        http.NotFound(w, r)
+        return
+    }
+    ch, data := s.manifestFor(r)
+    old := data.Entries
+    if id != versionID(data.ChecksumHeader) {
+        v, err := s.findVersion(ch, id)
+        if errors.Is(err, errUnknownVersion) {
+            http.Error(w, "unknown version, download the files listed by /check instead", http.StatusNotFound)
+            return
+        }
+        if err != nil {
+            logRequest(r, "Diff bundle from %s of %s: %v", id, ch.name, err)
+            http.Error(w, "reading version failed", http.StatusInternalServerError)
+            return
+        }
+        old = v.Files
+    }
+
+    known := make(map[string]string, len(old))
+    for _, e := range old {
+        known[e.Path] = e.SHA256
+    }
+    var entries []ManifestEntry
+    var size int64
+    for _, e := range data.Entries {
+        if known[e.Path] != e.SHA256 {
+            entries = append(entries, e)
+            size += e.Size
+        }
+        delete(known, e.Path)
+    }
+    deleted := make([]string, 0, len(known))
+    for p := range known {
+        deleted = append(deleted, p)
+    }
+    sort.Strings(deleted)
+
+    if !s.allowDownload(w, r, "/bundle/"+DiffBundle+"/"+id, size) {
+        return
+    }
+    etag := fmt.Sprintf("\"%s-%s\"", id, versionID(data.ChecksumHeader))
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("X-Version-Base", versionBase(data))
+    writeBundle(w, r, ch, data, "diff-"+id[:min(len(id), 12)], etag, entries, deleted)
+}
@@ -0,0 +1,109 @@
+package patchserver
+
+import (
+    "bytes"
+    "container/list"
+    "io/fs"
+    "net/http"
+    "path"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+// fileCache is an LRU cache of small file contents bounded by total size
+type fileCache struct {
+    mu       sync.Mutex
+    maxBytes int64
+    maxFile  int64
+    size     int64
+    ll       *list.List
+    items    map[string]*list.Element
+}
+
+type cacheEntry struct {
+    name    string // absolute path on disk
+    data    []byte
+    modTime time.Time
+}
+
+func newFileCache(maxBytes, maxFile int64) *fileCache {
+    return &fileCache{
+        maxBytes: maxBytes,
+        maxFile:  maxFile,
+        ll:       list.New(),
+        items:    make(map[string]*list.Element),
+    }
+}
+
+func (c *fileCache) get(name string) (*cacheEntry, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    el, ok := c.items[name]
+    if !ok {
+        return nil, false
+    }
+    c.ll.MoveToFront(el)
+    return el.Value.(*cacheEntry), true
+}
+
+func (c *fileCache) add(e *cacheEntry) {
+    if int64(len(e.data)) > c.maxBytes {
+        return
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if el, ok := c.items[e.name]; ok {
+        c.size -= int64(len(el.Value.(*cacheEntry).data))
+        c.ll.Remove(el)
+        delete(c.items, e.name)
+    }
+    c.items[e.name] = c.ll.PushFront(e)
+    c.size += int64(len(e.data))
+    for c.size > c.maxBytes && c.ll.Len() > 0 {
+        el := c.ll.Back()
+        old := el.Value.(*cacheEntry)
+        c.ll.Remove(el)
+        delete(c.items, old.name)
+        c.size -= int64(len(old.data))
+    }
+}
+
+// purge drops every entry; called whenever the manifest is rebuilt
+func (c *fileCache) purge() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.ll.Init()
+    c.items = make(map[string]*list.Element)
+    c.size = 0
+}
+
+// cachedFileServer serves small files of fsys, the folder root, from the
+// cache, falling back to next for misses that are too large to cache
+func cachedFileServer(root string, fsys fs.FS, c *fileCache, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            next.ServeHTTP(w, r)
+            return
+        }
+        name := fsName(path.Clean("/" + r.URL.Path))
+        full := filepath.Join(root, filepath.FromSlash(name))
+        if e, ok := c.get(full); ok {
+            http.ServeContent(w, r, e.name, e.modTime, bytes.NewReader(e.data))
+            return
+        }
+        info, err := fs.Stat(fsys, name)
+        if err != nil || !info.Mode().IsRegular() || info.Size() > c.maxFile {
+            next.ServeHTTP(w, r)
+            return
+        }
+        data, err := fs.ReadFile(fsys, name)
+        if err != nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        e := &cacheEntry{name: full, data: data, modTime: info.ModTime()}
+        c.add(e)
+        http.ServeContent(w, r, e.name, e.modTime, bytes.NewReader(e.data))
+    })
+}
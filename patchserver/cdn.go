@@ -0,0 +1,250 @@
+package patchserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// cloudflarePurgeBatch is the most URLs Cloudflare accepts per purge call
+const cloudflarePurgeBatch = 30
+
+// CDNPurgeConfig is a CDN to purge when Channel publishes. BaseURL is the
+// public URL the CDN serves the channel at (including any channel prefix);
+// Kind is "cloudflare" (ZoneID, Token), "bunny" (Token is the account API
+// key) or "json", the default (POSTs {"urls": [...]} to URL with Token as
+// bearer).
+type CDNPurgeConfig struct {
+    Kind    string `json:"Kind"`
+    Channel string `json:"Channel"` // qualified channel name, default "stable"
+    BaseURL string `json:"BaseURL"`
+    ZoneID  string `json:"ZoneID"`
+    URL     string `json:"URL"`
+    Token   string `json:"Token"`
+}
+
+var cdnClient = &http.Client{Timeout: 30 * time.Second}
+
+// versionBase is the prefix of the immutable URLs of data's files
+func versionBase(data *DirData) string {
+    return "/v/" + strings.Trim(data.ChecksumHeader, `"`)
+}
+
+// purgePaths returns the unversioned paths a publish from prev to data
+// makes stale: the manifests, their signatures and the signing keys plus
+// every updated, deleted or renamed file
+func purgePaths(prev, data *DirData) []string {
+    paths := []string{"/check", "/check.sig", "/check.sigs", "/keys", "/check/v2"}
+    for _, c := range diffManifests(prev, data.Entries) {
+        switch c.Action {
+        case ActionUpdate, ActionDelete:
+            paths = append(paths, c.Path)
+        case ActionRename:
+            paths = append(paths, c.From)
+        }
+    }
+    return paths
+}
+
+// purgeCDNs purges the stale URLs of ch from every CDN configured for it
+func (s *Server) purgeCDNs(ch *channel, prev, data *DirData) {
+    if prev == nil {
+        return
+    }
+    var urls []string
+    for _, p := range purgePaths(prev, data) {
+        urls = append(urls, (&url.URL{Path: p}).EscapedPath())
+    }
+    for _, cdn := range s.config.CDNPurge {
+        name := cdn.Channel
+        if name == "" {
+            name = DefaultChannelName
+        }
+        if name != ch.name {
+            continue
+        }
+        full := make([]string, len(urls))
+        for i, u := range urls {
+            full[i] = strings.TrimSuffix(cdn.BaseURL, "/") + u
+        }
+        go func(cdn CDNPurgeConfig) {
+            if err := purgeCDN(cdn, full); err != nil {
+                log.Printf("CDN purge (%s) for %s failed: %v", cdn.Kind, ch.name, err)
+                return
+            }
+            log.Printf("CDN purge (%s) for %s: %d URLs", cdn.Kind, ch.name, len(full))
+        }(cdn)
+    }
+}
+
+func purgeCDN(cdn CDNPurgeConfig, urls []string) error {
+    switch cdn.Kind {
+    case "cloudflare":
+        endpoint := "https://api.cloudflare.com/client/v4/zones/" + url.PathEscape(cdn.ZoneID) + "/purge_cache"
+        for start := 0; start < len(urls); start += cloudflarePurgeBatch {
+            batch := urls[start:min(start+cloudflarePurgeBatch, len(urls))]
+            if err := postPurge(endpoint, map[string]any{"files": batch}, "Authorization", "Bearer "+cdn.Token); err != nil {
+                return err
+            }
+        }
+    case "bunny":
+        for _, u := range urls {
+            if err := postPurge("https://api.bunny.net/purge?url="+url.QueryEscape(u), nil, "AccessKey", cdn.Token); err != nil {
+                return err
+            }
+        }
+    default:
+        return postPurge(cdn.URL, map[string]any{"urls": urls}, "Authorization", "Bearer "+cdn.Token)
+    }
+    return nil
+}
+
+func postPurge(endpoint string, payload any, authHeader, auth string) error {
+    var body []byte
+    if payload != nil {
+        var err error
+        if body, err = json.Marshal(payload); err != nil {
+            return err
+        }
+    }
+    req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    if payload != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set(authHeader, auth)
+    resp, err := cdnClient.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+    }
+    return nil
+}
+
+// versionedHandler serves /v/{etag}/{path}: the file as it was in that
+// manifest version, cacheable forever. Versions other than the current one
+// come from the version archive when KeepVersions is set. A current file
+// served from the live folder is only marked immutable once its bytes are
+// checked against the manifest, since it may have changed since the scan.
+func (s *Server) versionedHandler(w http.ResponseWriter, r *http.Request) {
+    etag, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v/"), "/")
+    p := "/" + rest
+    ch, data := s.manifestFor(r)
+    if versionBase(data) == "/v/"+etag {
+        e, ok := data.Resolve(p)
+        if !ok {
+            http.NotFound(w, r)
+            return
+        }
+        if !s.allowDownload(w, r, e.Path, e.Size) {
+            return
+        }
+        if s.originEnabled() {
+            if err := s.originFile(r.Context(), ch, e); err != nil {
+                if r.Context().Err() != nil {
+                    return
+                }
+                logRequest(r, "Fetching %s from origin: %v", e.Path, err)
+                http.Error(w, "file unavailable from origin", http.StatusBadGateway)
+                return
+            }
+        }
+        if s.shared(data) && !verifiedFile(ch, data, e) {
+            // Changed since the scan: only the archive still has this
+            // version's bytes
+            w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+            s.serveObject(w, r, e)
+            return
+        }
+        w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+        s.filePolicyFiles(s.channelFiles)(w, withPath(r, e.Path))
+        return
+    }
+    e, ok := s.archivedEntry(ch, etag, p)
+    if !ok {
+        http.NotFound(w, r)
+        return
+    }
+    if !s.allowDownload(w, r, e.Path, e.Size) {
+        return
+    }
+    w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+    s.serveObject(w, r, e)
+}
+
+// serveObject serves e from the version archive, or 503 until the next
+// rescan when it is not archived
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, e ManifestEntry) {
+    f, err := os.Open(filepath.Join(s.objectsDir(), e.SHA256))
+    if err != nil || s.config.KeepVersions == 0 {
+        w.Header().Set("Cache-Control", "no-store")
+        w.Header().Set("Retry-After", "60")
+        http.Error(w, "file changed since this version was published", http.StatusServiceUnavailable)
+        return
+    }
+    defer f.Close()
+    http.ServeContent(w, r, path.Base(e.Path), time.Unix(e.ModTime, 0), f)
+}
+
+// verifiedFile reports whether the file of e on disk still holds the bytes
+// data was built from. The scan hashed it at its size and mtime, so it is
+// trusted while they stay the same. A file touched since is hashed again
+// in the background, once per mtime, and reported changed until that
+// confirms it, so no request waits for a large file to be hashed.
+func verifiedFile(ch *channel, data *DirData, e ManifestEntry) bool {
+    info, err := ch.stat(data, e)
+    if err != nil || info.Size() != e.Size {
+        return false
+    }
+    stamp := info.ModTime().UnixNano()
+    if stamp == e.modTimeNano {
+        return true
+    }
+    if data.verified == nil {
+        // a lookup-only index, see indexEntries
+        return false
+    }
+    if v, ok := data.verified.Load(e.Path); ok && v.(int64) == stamp {
+        return true
+    }
+    if _, busy := data.hashing.LoadOrStore(e.Path, true); !busy {
+        go func() {
+            defer data.hashing.Delete(e.Path)
+            if sum, err := ch.hash(data, e); err == nil && sum == e.SHA256 {
+                data.verified.Store(e.Path, stamp)
+            }
+        }()
+    }
+    return false
+}
+
+// shared reports whether data is served from files the operator can still
+// write to: the game folder, or snapshots hard linked to it
+func (s *Server) shared(d *DirData) bool {
+    return d.ObjectDir == "" || (d.ObjectDir == s.config.SnapshotFolder && s.config.SnapshotMode == SnapshotHardlink)
+}
+
+// archivedEntry finds p in the archived version etag of ch
+func (s *Server) archivedEntry(ch *channel, etag, p string) (ManifestEntry, bool) {
+    if s.config.KeepVersions == 0 {
+        return ManifestEntry{}, false
+    }
+    data, err := s.archivedData(ch, etag)
+    if err != nil {
+        return ManifestEntry{}, false
+    }
+    return data.Resolve(p)
+}
@@ -0,0 +1,204 @@
+package patchserver
+
+import (
+    "context"
+    "crypto/subtle"
+    "io/fs"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+)
+
+// DefaultChannelName is the channel served from GameFolder
+const DefaultChannelName = "stable"
+
+// ChannelConfig is an extra patch channel (e.g. beta or PTR) with its own
+// game root, selected by path prefix (/beta/check) or X-Patch-Channel. When
+// Tokens or Auth is set, clients must send one of the Tokens in
+// X-Patch-Token or as a bearer token, or credentials accepted by one of
+// the AuthBackends named in Auth.
+type ChannelConfig struct {
+    Name       string         `json:"Name"`
+    GameFolder string         `json:"GameFolder"`
+    Force      bool           `json:"Force"`
+    Tokens     []string       `json:"Tokens"`
+    Auth       []string       `json:"Auth"`
+    Locales    []LocaleConfig `json:"Locales"`
+}
+
+type channel struct {
+    srv    *Server
+    name   string // qualified with the tenant name outside the default tenant
+    root   string
+    fsys   fs.FS // root through the FileSource
+    force  atomic.Bool
+    tokens []string
+    auth   []string // AuthBackends names
+    data   *atomic.Pointer[DirData]
+    files  http.Handler
+    // rollout is the staged publish in progress, see RolloutMinutes
+    rollout atomic.Pointer[rollout]
+    // base is the channel a locale overlay (root) is laid over, locales
+    // the overlays of a base channel by lowercase name
+    base    *channel
+    locales map[string]*channel
+}
+
+type channelKey struct{}
+
+// manifestKey overrides the manifest a request is served, see withManifest
+type manifestKey struct{}
+
+// channelState holds the channels of every tenant
+type channelState struct {
+    defaultChannel *channel
+    // channels holds the channels of every tenant by qualified name
+    channels map[string]*channel
+}
+
+// folderFiles returns the file system of a game root and the handler
+// serving its downloads
+type folderFiles func(root string) (fs.FS, http.Handler)
+
+// newChannels creates the stable channel for root plus the extra configured
+// ones, registering them and their locale overlays in channels under
+// prefix+name
+func (s *Server) newChannels(prefix, root string, force bool, locales []LocaleConfig, extra []ChannelConfig, data *atomic.Pointer[DirData], folder folderFiles) map[string]*channel {
+    stable := &channel{
+        srv:  s,
+        name: prefix + DefaultChannelName,
+        root: root,
+        data: data,
+    }
+    stable.fsys, stable.files = folder(root)
+    stable.force.Store(force)
+    s.addLocales(stable, locales, folder)
+    byName := map[string]*channel{DefaultChannelName: stable}
+    s.channels[stable.name] = stable
+    for _, c := range extra {
+        ch := &channel{
+            srv:    s,
+            name:   prefix + c.Name,
+            root:   c.GameFolder,
+            tokens: c.Tokens,
+            auth:   c.Auth,
+            data:   new(atomic.Pointer[DirData]),
+        }
+        ch.fsys, ch.files = folder(c.GameFolder)
+        ch.force.Store(c.Force)
+        s.addLocales(ch, c.Locales, folder)
+        byName[c.Name] = ch
+        s.channels[ch.name] = ch
+    }
+    return byName
+}
+
+// channelFor returns the channel selected by channelRouter
+func (s *Server) channelFor(r *http.Request) *channel {
+    if ch, ok := r.Context().Value(channelKey{}).(*channel); ok {
+        return ch
+    }
+    return s.defaultChannel
+}
+
+// manifestFor returns the manifest of the request's channel
+func (s *Server) manifestFor(r *http.Request) (*channel, *DirData) {
+    ch := s.channelFor(r)
+    if data, ok := r.Context().Value(manifestKey{}).(*DirData); ok {
+        return ch, data
+    }
+    return ch, ch.dataFor(r)
+}
+
+// withManifest returns r served from data, e.g. an archived version,
+// rather than the channel's current manifest
+func withManifest(r *http.Request, data *DirData) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), manifestKey{}, data))
+}
+
+func (ch *channel) authorized(r *http.Request) bool {
+    s := ch.srv
+    if len(ch.tokens) == 0 && len(ch.auth) == 0 {
+        return true
+    }
+    token := r.Header.Get("X-Patch-Token")
+    if token == "" {
+        token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    }
+    for _, t := range ch.tokens {
+        if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+            return true
+        }
+    }
+    _, ok := s.authenticate(r, ch.auth)
+    return ok
+}
+
+// withPath returns a shallow copy of r with its URL path replaced
+func withPath(r *http.Request, p string) *http.Request {
+    r2 := new(http.Request)
+    *r2 = *r
+    u := *r.URL
+    u.Path = p
+    u.RawPath = ""
+    r2.URL = &u
+    return r2
+}
+
+// channelRouter resolves the tenant's channel from the first path segment
+// or the X-Patch-Channel header, strips the prefix and enforces channel
+// tokens
+func (s *Server) channelRouter(t *tenant, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ch := t.defaultChannel
+        first, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+        if c, ok := t.channels[first]; ok && c != t.defaultChannel {
+            ch = c
+            r = withPath(r, "/"+rest)
+        } else if name := r.Header.Get("X-Patch-Channel"); name != "" {
+            if ch, ok = t.channels[name]; !ok {
+                http.Error(w, "unknown channel", http.StatusNotFound)
+                return
+            }
+        }
+        if !ch.authorized(r) {
+            http.Error(w, "channel token required", http.StatusUnauthorized)
+            return
+        }
+        ch = ch.localeFor(w, r)
+        h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), channelKey{}, ch)))
+    })
+}
+
+// channelFiles serves game files from the request's channel root, or from
+// the version archive after a rollback, preferring a precompressed variant
+func (s *Server) channelFiles(w http.ResponseWriter, r *http.Request) {
+    ch, data := s.manifestFor(r)
+    if s.servePrecompressed(w, r, data) {
+        return
+    }
+    if data.ObjectDir != "" {
+        s.serveArchived(w, r, data)
+        return
+    }
+    if ch.base != nil {
+        if e, ok := data.Lookup(r.URL.Path); ok && e.inherited {
+            ch.base.files.ServeHTTP(w, r)
+            return
+        }
+    }
+    ch.files.ServeHTTP(w, r)
+}
+
+// filePath returns where the file of e is stored on disk for data. With a
+// FileSource other than the OS file system it only names the file.
+func (ch *channel) filePath(data *DirData, e ManifestEntry) string {
+    if data.ObjectDir != "" {
+        return filepath.Join(data.ObjectDir, e.SHA256)
+    }
+    if e.inherited {
+        return filepath.Join(ch.base.root, filepath.FromSlash(e.Path))
+    }
+    return filepath.Join(ch.root, filepath.FromSlash(e.Path))
+}
@@ -0,0 +1,115 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "io/fs"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ChunkManifest lists the hashes of the fixed-size chunks of one file
+type ChunkManifest struct {
+    Path      string   `json:"path"`
+    SHA256    string   `json:"sha256"`
+    Size      int64    `json:"size"`
+    ChunkSize int64    `json:"chunk_size"`
+    Chunks    []string `json:"chunks"`
+}
+
+// chunkState memoises chunk manifests keyed by file, size and mtime so an
+// edited file is re-chunked automatically
+type chunkState struct {
+    chunkCache sync.Map
+}
+
+type chunkKey struct {
+    file    string
+    size    int64
+    modTime time.Time
+}
+
+func (s *Server) chunkSize() int64 {
+    return int64(s.config.ChunkSizeMB) << 20
+}
+
+func (s *Server) buildChunkManifest(ch *channel, data *DirData, e ManifestEntry, info fs.FileInfo) (*ChunkManifest, error) {
+    key := chunkKey{ch.filePath(data, e), info.Size(), info.ModTime()}
+    if m, ok := s.chunkCache.Load(key); ok {
+        return m.(*ChunkManifest), nil
+    }
+    f, err := ch.open(data, e)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    m := &ChunkManifest{Path: e.Path, SHA256: e.SHA256, Size: info.Size(), ChunkSize: s.chunkSize(), Chunks: []string{}}
+    for off := int64(0); off < info.Size(); off += m.ChunkSize {
+        h := sha256.New()
+        if _, err := io.CopyN(h, f, m.ChunkSize); err != nil && err != io.EOF {
+            return nil, err
+        }
+        m.Chunks = append(m.Chunks, hex.EncodeToString(h.Sum(nil)))
+    }
+    s.chunkCache.Store(key, m)
+    return m, nil
+}
+
+// chunksHandler serves /chunks/{path}/manifest and /chunks/{path}/{index}
+// for files listed in the request channel's manifest
+func (s *Server) chunksHandler(w http.ResponseWriter, r *http.Request) {
+    rest := strings.TrimPrefix(r.URL.Path, "/chunks")
+    dir, last := path.Split(rest)
+    name := path.Clean(dir)
+    ch, data := s.manifestFor(r)
+    e, ok := data.Resolve(name)
+    if !ok || name == "/" {
+        http.NotFound(w, r)
+        return
+    }
+    info, err := ch.stat(data, e)
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    m, err := s.buildChunkManifest(ch, data, e, info)
+    if err != nil {
+        http.Error(w, "failed to read file", http.StatusInternalServerError)
+        return
+    }
+
+    if last == "manifest" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(m)
+        return
+    }
+    index, err := strconv.Atoi(last)
+    if err != nil || index < 0 || index >= len(m.Chunks) {
+        http.NotFound(w, r)
+        return
+    }
+    if !s.allowDownload(w, r, e.Path, e.Size) {
+        return
+    }
+    f, err := ch.open(data, e)
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    defer f.Close()
+    chunk, err := sectionReader(f, int64(index)*m.ChunkSize, m.ChunkSize)
+    if err != nil {
+        logRequest(r, "Chunk of %s: %v", e.Path, err)
+        http.Error(w, "failed to read file", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("ETag", `"`+m.Chunks[index]+`"`)
+    w.Header().Set("Content-Type", "application/octet-stream")
+    http.ServeContent(w, r, "", info.ModTime(), chunk)
+}
@@ -0,0 +1,325 @@
+package patchserver
+
+import (
+    "bufio"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// partSuffix marks a download that has not been verified yet
+const partSuffix = ".part"
+
+// journalSaveEvery is how often the journal is saved during a large
+// download
+const journalSaveEvery = 16 << 20
+
+// SyncJournal records what a sync already has, so an interrupted patch
+// resumes where it stopped instead of hashing the whole folder again
+type SyncJournal struct {
+    ETag  string                  `json:"etag"`
+    Files map[string]*JournalFile `json:"files"`
+}
+
+// JournalFile is a file with the hash it was verified against. A file
+// whose size and mtime still match is not hashed again. Partial marks a
+// download in progress in the .part file, Bytes long when last saved.
+type JournalFile struct {
+    SHA256  string `json:"sha256"`
+    Size    int64  `json:"size"`
+    ModTime int64  `json:"mtime"`
+    Partial bool   `json:"partial,omitempty"`
+    Bytes   int64  `json:"bytes,omitempty"`
+}
+
+type syncClient struct {
+    base    string
+    dir     string
+    headers http.Header
+    http    *http.Client
+    journal *SyncJournal
+    jpath   string
+}
+
+func (c *syncClient) saveJournal() {
+    if err := writeJSONFile(c.jpath+".tmp", c.journal, 0644); err != nil {
+        log.Printf("Saving journal: %v", err)
+        return
+    }
+    if err := os.Rename(c.jpath+".tmp", c.jpath); err != nil {
+        log.Printf("Saving journal: %v", err)
+    }
+}
+
+func (c *syncClient) get(p string, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequest(http.MethodGet, c.base+(&url.URL{Path: p}).EscapedPath(), nil)
+    if err != nil {
+        return nil, err
+    }
+    for k, v := range c.headers {
+        req.Header[k] = v
+    }
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    return c.http.Do(req)
+}
+
+// localPath maps a manifest path to the sync folder, refusing paths that
+// would leave it
+func (c *syncClient) localPath(p string) (string, error) {
+    if !safePath(p) {
+        return "", fmt.Errorf("unsafe path %q in manifest", p)
+    }
+    return filepath.Join(c.dir, filepath.FromSlash(path.Clean(p))), nil
+}
+
+// upToDate reports whether the file at name holds sha, trusting the journal
+// while its size and mtime are unchanged
+func (c *syncClient) upToDate(p, name, sha string) bool {
+    info, err := os.Stat(name)
+    if err != nil || info.IsDir() {
+        return false
+    }
+    if j := c.journal.Files[p]; j != nil && !j.Partial && j.SHA256 == sha && j.Size == info.Size() && j.ModTime == info.ModTime().UnixNano() {
+        return true
+    }
+    got, err := hashFile(name)
+    if err != nil || got != sha {
+        return false
+    }
+    c.journal.Files[p] = &JournalFile{SHA256: sha, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+    return true
+}
+
+// download fetches p into its .part file, resuming with a Range request
+// when the journal shows a partial download of the same version, then
+// verifies and installs it
+func (c *syncClient) download(p, name, sha string) (int64, error) {
+    part := name + partSuffix
+    var offset int64
+    if j := c.journal.Files[p]; j != nil && j.Partial && j.SHA256 == sha {
+        if info, err := os.Stat(part); err == nil {
+            offset = info.Size()
+        }
+    }
+    if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+        return 0, err
+    }
+    header := http.Header{}
+    if offset > 0 {
+        header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+    resp, err := c.get(p, header)
+    if err != nil {
+        return 0, err
+    }
+    defer resp.Body.Close()
+    flags := os.O_WRONLY | os.O_CREATE
+    switch {
+    case resp.StatusCode == http.StatusPartialContent && offset > 0:
+        flags |= os.O_APPEND
+    case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+        // The part is already complete, or longer than the file: verify
+        // what is there and start over if it is wrong
+        resp.Body.Close()
+        if got, err := hashFile(part); err == nil && got == sha {
+            return 0, c.install(p, name, sha)
+        }
+        os.Remove(part)
+        delete(c.journal.Files, p)
+        return c.download(p, name, sha)
+    case resp.StatusCode == http.StatusOK:
+        flags |= os.O_TRUNC
+        offset = 0
+    default:
+        return 0, fmt.Errorf("%s: %s", p, resp.Status)
+    }
+    f, err := os.OpenFile(part, flags, 0644)
+    if err != nil {
+        return 0, err
+    }
+    entry := &JournalFile{SHA256: sha, Partial: true, Bytes: offset}
+    c.journal.Files[p] = entry
+    c.saveJournal()
+    var n int64
+    buf := make([]byte, 256<<10)
+    for {
+        m, rerr := resp.Body.Read(buf)
+        if m > 0 {
+            if _, err := f.Write(buf[:m]); err != nil {
+                f.Close()
+                return n, err
+            }
+            n += int64(m)
+            before := entry.Bytes
+            entry.Bytes += int64(m)
+            if before/journalSaveEvery != entry.Bytes/journalSaveEvery {
+                c.saveJournal()
+            }
+        }
+        if rerr == io.EOF {
+            break
+        }
+        if rerr != nil {
+            f.Close()
+            c.saveJournal()
+            return n, rerr
+        }
+    }
+    if err := f.Close(); err != nil {
+        return n, err
+    }
+    got, err := hashFile(part)
+    if err != nil {
+        return n, err
+    }
+    if got != sha {
+        os.Remove(part)
+        delete(c.journal.Files, p)
+        c.saveJournal()
+        return n, fmt.Errorf("%s: downloaded SHA-256 %s, manifest has %s", p, got, sha)
+    }
+    return n, c.install(p, name, sha)
+}
+
+// install moves a verified .part file into place and records it
+func (c *syncClient) install(p, name, sha string) error {
+    if err := os.Rename(name+partSuffix, name); err != nil {
+        return err
+    }
+    info, err := os.Stat(name)
+    if err != nil {
+        return err
+    }
+    c.journal.Files[p] = &JournalFile{SHA256: sha, Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+    c.saveJournal()
+    return nil
+}
+
+// syncCommand is the built-in client: it brings a folder up to date with a
+// patch server channel, keeping a journal so an interrupted run resumes
+func syncCommand(args []string) {
+    fset := flag.NewFlagSet("sync", flag.ExitOnError)
+    target := fset.String("url", defaultPatchURL, "patch server base URL, including any channel prefix")
+    dir := fset.String("dir", ".", "folder to bring up to date")
+    journal := fset.String("journal", "", "journal file, default <dir>/.patch-journal.json")
+    verify := fset.Bool("verify", false, "hash every file again after downloading, ignoring the journal")
+    retries := fset.Int("retries", 3, "attempts per file")
+    token := fset.String("token", "", "channel token (X-Patch-Token)")
+    userAgent := fset.String("user-agent", "mhf-patch-sync", "User-Agent sent to the server")
+    fset.Parse(args)
+
+    c := &syncClient{
+        base:    strings.TrimSuffix(*target, "/"),
+        dir:     *dir,
+        headers: http.Header{"User-Agent": {*userAgent}},
+        http:    &http.Client{},
+        journal: &SyncJournal{Files: map[string]*JournalFile{}},
+        jpath:   *journal,
+    }
+    if *token != "" {
+        c.headers.Set("X-Patch-Token", *token)
+    }
+    if c.jpath == "" {
+        c.jpath = filepath.Join(*dir, ".patch-journal.json")
+    }
+    if err := readJSONFile(c.jpath, c.journal); err != nil && !errors.Is(err, os.ErrNotExist) {
+        log.Printf("Ignoring unreadable journal: %v", err)
+        c.journal = &SyncJournal{Files: map[string]*JournalFile{}}
+    }
+    if c.journal.Files == nil {
+        c.journal.Files = map[string]*JournalFile{}
+    }
+
+    resp, err := c.get("/check", nil)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if resp.StatusCode != http.StatusOK {
+        log.Fatalf("/check: %s", resp.Status)
+    }
+    var files []loadFile
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        if sha, p, ok := strings.Cut(scanner.Text(), "\t"); ok {
+            files = append(files, loadFile{p, sha})
+        }
+    }
+    resp.Body.Close()
+    if err := scanner.Err(); err != nil {
+        log.Fatalf("/check: %v", err)
+    }
+    etag := resp.Header.Get("ETag")
+    if c.journal.ETag != etag {
+        log.Printf("Syncing %s (%d files) into %s", etag, len(files), *dir)
+    } else {
+        log.Printf("Resuming %s (%d files) into %s", etag, len(files), *dir)
+    }
+    c.journal.ETag = etag
+
+    start := time.Now()
+    var downloaded, total int64
+    var fetched, failed int
+    for _, f := range files {
+        name, err := c.localPath(f.path)
+        if err != nil {
+            log.Fatal(err)
+        }
+        if c.upToDate(f.path, name, f.sha) {
+            continue
+        }
+        for attempt := 1; ; attempt++ {
+            n, err := c.download(f.path, name, f.sha)
+            downloaded += n
+            if err == nil {
+                fetched++
+                break
+            }
+            if attempt >= *retries {
+                log.Printf("Giving up on %s: %v", f.path, err)
+                failed++
+                break
+            }
+            log.Printf("Retrying %s: %v", f.path, err)
+            time.Sleep(time.Duration(attempt) * time.Second)
+        }
+    }
+    c.saveJournal()
+
+    mismatched := 0
+    if *verify {
+        for _, f := range files {
+            name, _ := c.localPath(f.path)
+            got, err := hashFile(name)
+            if err == nil && got == f.sha {
+                info, _ := os.Stat(name)
+                total += info.Size()
+                continue
+            }
+            if err != nil {
+                log.Printf("Verify %s: %v", f.path, err)
+            } else {
+                log.Printf("Verify %s: SHA-256 %s, manifest has %s", f.path, got, f.sha)
+            }
+            delete(c.journal.Files, f.path)
+            mismatched++
+        }
+        c.saveJournal()
+        log.Printf("Verified %d files (%.1f MB), %d bad", len(files)-mismatched, float64(total)/(1<<20), mismatched)
+    }
+    log.Printf("Downloaded %d files (%.1f MB) in %s", fetched, float64(downloaded)/(1<<20), time.Since(start).Round(time.Millisecond))
+    if failed+mismatched > 0 {
+        log.Printf("%d files failed, run again to resume", failed+mismatched)
+        os.Exit(1)
+    }
+}
@@ -0,0 +1,68 @@
+package patchserver
+
+import (
+    "bytes"
+    "compress/gzip"
+    "compress/zlib"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// encodedBody holds a manifest body with its precomputed encodings, built
+// on each rescan so /check never compresses per request. They are in
+// memory until storeBodies moves them to StoreFile.
+type encodedBody struct {
+    plain   manifestBlob
+    gzip    manifestBlob
+    deflate manifestBlob
+}
+
+func encodeBody(body []byte) encodedBody {
+    var gz, fl bytes.Buffer
+    gw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+    gw.Write(body)
+    gw.Close()
+    zw, _ := zlib.NewWriterLevel(&fl, zlib.BestCompression)
+    zw.Write(body)
+    zw.Close()
+    return encodedBody{bytes.NewReader(body), bytes.NewReader(gz.Bytes()), bytes.NewReader(fl.Bytes())}
+}
+
+// acceptsEncoding reports whether the client listed enc in Accept-Encoding
+// without refusing it through q=0
+func acceptsEncoding(r *http.Request, enc string) bool {
+    for _, item := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+        name, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+        if !strings.EqualFold(strings.TrimSpace(name), enc) {
+            continue
+        }
+        q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+        if !ok {
+            return true
+        }
+        v, err := strconv.ParseFloat(q, 64)
+        return err != nil || v > 0
+    }
+    return false
+}
+
+// writeEncoded writes enc with status 200 in the best encoding the client
+// accepts, gzip before deflate
+func writeEncoded(w http.ResponseWriter, r *http.Request, contentType string, enc encodedBody) {
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Add("Vary", "Accept-Encoding")
+    body := enc.plain
+    switch {
+    case acceptsEncoding(r, "gzip"):
+        w.Header().Set("Content-Encoding", "gzip")
+        body = enc.gzip
+    case acceptsEncoding(r, "deflate"):
+        w.Header().Set("Content-Encoding", "deflate")
+        body = enc.deflate
+    }
+    w.Header().Set("Content-Length", strconv.FormatInt(body.Size(), 10))
+    w.WriteHeader(http.StatusOK)
+    io.Copy(w, io.NewSectionReader(body, 0, body.Size()))
+}
@@ -0,0 +1,792 @@
+package patchserver
+
+import (
+    "crypto/ed25519"
+    "crypto/tls"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "os"
+    "path"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// Config fields tagged with env can be overridden by that environment
+// variable, which takes precedence over the JSON file
+type Config struct {
+    ConfigVersion int `json:"ConfigVersion"` // layout version, see CurrentConfigVersion
+    PatchPort     int `json:"PatchPort" env:"PATCH_PORT"`
+    ImagePort     int `json:"ImagePort" env:"IMAGE_PORT"`
+    // PatchListen and ImageListen bind explicit addresses (e.g.
+    // "192.0.2.1:8094", "[::1]:8094") instead of all interfaces on the port
+    PatchListen []string `json:"PatchListen" env:"PATCH_LISTEN"`
+    ImageListen []string `json:"ImageListen" env:"IMAGE_LISTEN"`
+    // PatchHTTP3Listen and ImageHTTP3Listen serve HTTP/3 (QUIC) on UDP
+    // addresses next to the TCP listeners, using TLSCertFile and TLSKeyFile;
+    // TCP responses advertise them in Alt-Svc
+    PatchHTTP3Listen []string `json:"PatchHTTP3Listen" env:"PATCH_HTTP3_LISTEN"`
+    ImageHTTP3Listen []string `json:"ImageHTTP3Listen" env:"IMAGE_HTTP3_LISTEN"`
+    TLSCertFile      string   `json:"TLSCertFile" env:"TLS_CERT_FILE"`
+    TLSKeyFile       string   `json:"TLSKeyFile" env:"TLS_KEY_FILE"`
+    GameFolder       string   `json:"GameFolder" env:"GAME_FOLDER"`
+    ImageFolder      string   `json:"ImageFolder" env:"IMAGE_FOLDER"`
+    Force            bool     `json:"Force" env:"FORCE"`
+    MaxClients       int      `json:"MaxClients" env:"MAX_CLIENTS"`
+    CacheSizeMB      int      `json:"CacheSizeMB" env:"CACHE_SIZE_MB"` // 0 disables the file cache
+    CacheFileMaxKB   int      `json:"CacheFileMaxKB" env:"CACHE_FILE_MAX_KB"`
+    SigningKeyFile   string   `json:"SigningKeyFile" env:"SIGNING_KEY_FILE"` // optional Ed25519 key for /check.sig
+    // SigningCertFile is the certificate of SigningKeyFile from certify;
+    // SigningKeys sign the manifest too, for /check.sigs during a rotation.
+    // RevocationFile (from revoke) is served at /keys, and certificates and
+    // the list are checked against the base64 RootKeys when given.
+    SigningCertFile string             `json:"SigningCertFile" env:"SIGNING_CERT_FILE"`
+    SigningKeys     []SigningKeyConfig `json:"SigningKeys"`
+    RevocationFile  string             `json:"RevocationFile" env:"REVOCATION_FILE"`
+    RootKeys        []string           `json:"RootKeys" env:"ROOT_KEYS"`
+    HashWorkers     int                `json:"HashWorkers" env:"HASH_WORKERS"`    // 0 uses one per CPU
+    ScanLogEvery    int                `json:"ScanLogEvery" env:"SCAN_LOG_EVERY"` // progress log interval, 0 disables
+    // A file a scan cannot read, e.g. one locked on Windows, is retried
+    // ScanRetries times, ScanRetryMillis (default 500) apart and doubling;
+    // then ScanErrors "fail" (default) keeps the previous manifest and "warn"
+    // publishes keeping the file's previous entry. SkipEmptyFiles leaves zero-byte files, often
+    // still being copied, out of manifests.
+    ScanErrors      string `json:"ScanErrors" env:"SCAN_ERRORS"`
+    ScanRetries     int    `json:"ScanRetries" env:"SCAN_RETRIES"`
+    ScanRetryMillis int    `json:"ScanRetryMillis" env:"SCAN_RETRY_MILLIS"`
+    SkipEmptyFiles  bool   `json:"SkipEmptyFiles" env:"SKIP_EMPTY_FILES"`
+    // Requests beyond MaxClients wait in a queue of QueueSize (0 = unbounded)
+    // for up to QueueWaitSeconds (0 = forever) before getting a 503
+    QueueSize        int `json:"QueueSize" env:"QUEUE_SIZE"`
+    QueueWaitSeconds int `json:"QueueWaitSeconds" env:"QUEUE_WAIT_SECONDS"`
+    // LightMaxClients is a separate pool for manifest and news requests so
+    // they never queue behind file downloads, which keep MaxClients
+    LightMaxClients int `json:"LightMaxClients" env:"LIGHT_MAX_CLIENTS"`
+    // SessionWindowSeconds lets clients that sent a request within that
+    // many seconds skip ahead of new arrivals for a free slot, 0 disables
+    // patch sessions
+    SessionWindowSeconds int `json:"SessionWindowSeconds" env:"SESSION_WINDOW_SECONDS"`
+    // Clients must send their request headers within HeaderTimeoutSeconds
+    // (default 10) and idle keep-alive connections are closed after
+    // IdleTimeoutSeconds (default 120). Downloads sending less than
+    // MinSpeedKBps over MinSpeedSeconds (default 30) are dropped, 0
+    // disables it.
+    HeaderTimeoutSeconds int             `json:"HeaderTimeoutSeconds" env:"HEADER_TIMEOUT_SECONDS"`
+    IdleTimeoutSeconds   int             `json:"IdleTimeoutSeconds" env:"IDLE_TIMEOUT_SECONDS"`
+    MinSpeedKBps         int             `json:"MinSpeedKBps" env:"MIN_SPEED_KBPS"`
+    MinSpeedSeconds      int             `json:"MinSpeedSeconds" env:"MIN_SPEED_SECONDS"`
+    Webhooks             []WebhookConfig `json:"Webhooks"`
+    Hooks                []HookConfig    `json:"Hooks"` // scripts run on publish and rescan
+    // Failover runs this instance as the primary or standby of a pair
+    // sharing GameFolder, see FailoverConfig
+    Failover FailoverConfig `json:"Failover"`
+    // Origin makes this server a caching edge of another patch server,
+    // see OriginConfig
+    Origin OriginConfig `json:"Origin"`
+    // WebhookErrorThreshold fires an error_spike webhook once this many 5xx
+    // responses are sent within a minute, 0 disables it
+    WebhookErrorThreshold int `json:"WebhookErrorThreshold" env:"WEBHOOK_ERROR_THRESHOLD"`
+    // TelemetryPerMinute caps the /telemetry/error reports accepted per
+    // client IP (default 20); TelemetryAlertClients fires a file_errors
+    // webhook once that many clients failed on the same current file, 0
+    // disables it
+    TelemetryPerMinute    int             `json:"TelemetryPerMinute" env:"TELEMETRY_PER_MINUTE"`
+    TelemetryAlertClients int             `json:"TelemetryAlertClients" env:"TELEMETRY_ALERT_CLIENTS"`
+    NewsFolder            string          `json:"NewsFolder" env:"NEWS_FOLDER"` // *.json news items for /news, optional
+    NewsDefaultLocale     string          `json:"NewsDefaultLocale" env:"NEWS_DEFAULT_LOCALE"`
+    Channels              []ChannelConfig `json:"Channels"` // extra channels next to stable
+    // Locales overlay regional files on GameFolder, see LocaleConfig
+    Locales []LocaleConfig `json:"Locales"`
+    // Every SelfCheckIntervalSeconds (0 disables) re-hash SelfCheckSampleSize
+    // random files per channel (0 = all) and warn below MinFreeDiskMB
+    SelfCheckIntervalSeconds int    `json:"SelfCheckIntervalSeconds" env:"SELF_CHECK_INTERVAL_SECONDS"`
+    SelfCheckSampleSize      int    `json:"SelfCheckSampleSize" env:"SELF_CHECK_SAMPLE_SIZE"`
+    MinFreeDiskMB            int    `json:"MinFreeDiskMB" env:"MIN_FREE_DISK_MB"`
+    AdminToken               string `json:"AdminToken" env:"ADMIN_TOKEN"`    // enables /admin/, empty disables it
+    ChunkSizeMB              int    `json:"ChunkSizeMB" env:"CHUNK_SIZE_MB"` // enables /chunks/, 0 disables it
+    // TrustedProxies are CIDRs whose X-Forwarded-For is believed; BasePath
+    // is stripped from every request on both servers (e.g. "/mhf")
+    TrustedProxies []string `json:"TrustedProxies" env:"TRUSTED_PROXIES"`
+    BasePath       string   `json:"BasePath" env:"BASE_PATH"`
+    // KeepVersions published manifests and their files are archived in
+    // VersionsFolder for rollbacks, 0 disables it
+    KeepVersions   int    `json:"KeepVersions" env:"KEEP_VERSIONS"`
+    VersionsFolder string `json:"VersionsFolder" env:"VERSIONS_FOLDER"`
+    // RolloutMinutes stages every publish: RolloutStartPercent (default 10)
+    // of clients by IP get the new manifest at once, the rest the previous
+    // version from VersionsFolder, ramping to all of them over the window
+    RolloutMinutes      int `json:"RolloutMinutes" env:"ROLLOUT_MINUTES"`
+    RolloutStartPercent int `json:"RolloutStartPercent" env:"ROLLOUT_START_PERCENT"`
+    // AdminListen moves /admin/ and /metrics off the public listeners to a
+    // loopback address or "unix:/path.sock" created with AdminSocketMode
+    AdminListen string `json:"AdminListen" env:"ADMIN_LISTEN"`
+    // AuthBackends are identity sources (static hashed tokens, LDAP, OAuth)
+    // that AdminAuth and channels' Auth name; AdminAuth enables /admin/
+    // like AdminToken
+    AuthBackends    []AuthBackendConfig `json:"AuthBackends"`
+    AdminAuth       []string            `json:"AdminAuth"`
+    AdminSocketMode string              `json:"AdminSocketMode" env:"ADMIN_SOCKET_MODE"`
+    // Image server policy: Content-Type and Cache-Control max-age (seconds,
+    // 0 = no-cache) per lowercase extension, "*" being the default max-age
+    ImageContentTypes map[string]string `json:"ImageContentTypes"`
+    ImageCacheMaxAge  map[string]int    `json:"ImageCacheMaxAge"`
+    ImageCORSOrigins  []string          `json:"ImageCORSOrigins" env:"IMAGE_CORS_ORIGINS"`
+    ImageDirListing   bool              `json:"ImageDirListing" env:"IMAGE_DIR_LISTING"`
+    GameDirListing    bool              `json:"GameDirListing" env:"GAME_DIR_LISTING"`
+    // Headers are set on every response of both servers, e.g. HSTS or
+    // X-Content-Type-Options, overriding the server's own; HeaderRules set
+    // more per server and path. An empty value removes a header.
+    Headers     map[string]string `json:"Headers"`
+    HeaderRules []HeaderRule      `json:"HeaderRules"`
+    Tenants     []TenantConfig    `json:"Tenants"` // extra game servers hosted next to the default one
+    // BandwidthKBps caps total patch download speed, 0 = unlimited; Schedule
+    // overrides it and MaxClients during time windows
+    BandwidthKBps int              `json:"BandwidthKBps" env:"BANDWIDTH_KBPS"`
+    Schedule      []ScheduleWindow `json:"Schedule"`
+    // RescanSchedule rescans channels on cron schedules, e.g. nightly after
+    // an rsync; none are started during RescanQuietHours
+    RescanSchedule   []ScheduledRescan `json:"RescanSchedule"`
+    RescanQuietHours []ClockWindow     `json:"RescanQuietHours"`
+    // AllowedUserAgents are regexps a client User-Agent must match to use
+    // the patch server. LauncherVersionPattern extracts the launcher version
+    // (first capture group); older than MinLauncherVersion gets a 426.
+    AllowedUserAgents      []string `json:"AllowedUserAgents" env:"ALLOWED_USER_AGENTS"`
+    LauncherVersionPattern string   `json:"LauncherVersionPattern" env:"LAUNCHER_VERSION_PATTERN"`
+    MinLauncherVersion     string   `json:"MinLauncherVersion" env:"MIN_LAUNCHER_VERSION"`
+    LauncherUpdateURL      string   `json:"LauncherUpdateURL" env:"LAUNCHER_UPDATE_URL"`
+    AuditLogFile           string   `json:"AuditLogFile" env:"AUDIT_LOG_FILE"` // append-only JSON lines, empty keeps history in memory
+    // TorrentPieceKB enables /torrent and the embedded /announce tracker,
+    // 0 disables them. TorrentPublicURL overrides the scheme and host put in
+    // the torrents when the server sits behind a proxy.
+    TorrentPieceKB   int    `json:"TorrentPieceKB" env:"TORRENT_PIECE_KB"`
+    TorrentPublicURL string `json:"TorrentPublicURL" env:"TORRENT_PUBLIC_URL"`
+    // ErrorPagesFolder holds 404.html, 429.html, 503.html and
+    // maintenance.html shown to browsers; MaintenanceMode answers every
+    // patch request with 503 and MaintenanceMessage
+    ErrorPagesFolder   string `json:"ErrorPagesFolder" env:"ERROR_PAGES_FOLDER"`
+    MaintenanceMode    bool   `json:"MaintenanceMode" env:"MAINTENANCE_MODE"`
+    MaintenanceMessage string `json:"MaintenanceMessage" env:"MAINTENANCE_MESSAGE"`
+    // PrecompressFolder stores gzip copies of game files of at least
+    // PrecompressMinKB, advertised per file in /check/v2; empty disables it
+    PrecompressFolder string `json:"PrecompressFolder" env:"PRECOMPRESS_FOLDER"`
+    PrecompressMinKB  int    `json:"PrecompressMinKB" env:"PRECOMPRESS_MIN_KB"`
+    // StoreFile is an embedded database keeping file metadata (so restarts
+    // only hash changed files), publish history and download counts
+    StoreFile string `json:"StoreFile" env:"STORE_FILE"`
+    // StagingFolder enables the upload API: files pushed through
+    // /admin/upload wait there until /admin/publish moves them live
+    StagingFolder string           `json:"StagingFolder" env:"STAGING_FOLDER"`
+    CDNPurge      []CDNPurgeConfig `json:"CDNPurge"`                         // CDNs purged of stale URLs on publish
+    PriorityFile  string           `json:"PriorityFile" env:"PRIORITY_FILE"` // download order rules, see loadPriorities
+    FilePolicy    FilePolicyConfig `json:"FilePolicy"`                       // extensions and sizes allowed in manifests
+    // SymlinkPolicy is what scans do with symbolic links and Windows
+    // junctions: follow (default), skip or error
+    SymlinkPolicy string `json:"SymlinkPolicy" env:"SYMLINK_POLICY"`
+    // FileGroups splits off optional packs served by /check?groups= and
+    // /bundle/{group}
+    FileGroups []FileGroupConfig `json:"FileGroups"`
+    // SnapshotFolder enables snapshot serving: every publish links (or
+    // copies, see SnapshotMode) the manifest's files there and they are
+    // served from it, so files copied into GameFolder afterwards never
+    // reach clients half-written
+    SnapshotFolder string `json:"SnapshotFolder" env:"SNAPSHOT_FOLDER"`
+    SnapshotMode   string `json:"SnapshotMode" env:"SNAPSHOT_MODE"` // copy (default) or hardlink
+    // PatchAccess and ImageAccess are allow/deny CIDR lists of the two
+    // listeners, editable at runtime through /admin/access
+    PatchAccess AccessRules `json:"PatchAccess"`
+    ImageAccess AccessRules `json:"ImageAccess"`
+    // URLSigningKey makes downloads of files of at least SignedURLMinKB
+    // require a URL signed by /authorize, valid for SignedURLTTLSeconds
+    URLSigningKey       string `json:"URLSigningKey" env:"URL_SIGNING_KEY"`
+    SignedURLMinKB      int    `json:"SignedURLMinKB" env:"SIGNED_URL_MIN_KB"`
+    SignedURLTTLSeconds int    `json:"SignedURLTTLSeconds" env:"SIGNED_URL_TTL_SECONDS"`
+    // CaseInsensitivePaths serves files whose request path differs from
+    // the manifest only in case or in using backslashes, as Windows would
+    CaseInsensitivePaths bool `json:"CaseInsensitivePaths" env:"CASE_INSENSITIVE_PATHS"`
+    // ImageQuotaMB caps uploads to ImageFolder through /admin/images (0 =
+    // unlimited; tenants have their own). Every hour images older than
+    // ImageMaxAgeDays are pruned, then the oldest until each folder fits
+    // ImageMaxTotalMB; 0 disables either policy.
+    ImageQuotaMB    int `json:"ImageQuotaMB" env:"IMAGE_QUOTA_MB"`
+    ImageMaxAgeDays int `json:"ImageMaxAgeDays" env:"IMAGE_MAX_AGE_DAYS"`
+    ImageMaxTotalMB int `json:"ImageMaxTotalMB" env:"IMAGE_MAX_TOTAL_MB"`
+    // ImageVariants serves images resized (?w=, ?h=, at most
+    // ImageVariantMaxPx, default 2048) or converted (?fmt=png|jpeg|webp),
+    // caching the results up to ImageVariantCacheMB (default 256) per image
+    // folder
+    ImageVariants       bool `json:"ImageVariants" env:"IMAGE_VARIANTS"`
+    ImageVariantMaxPx   int  `json:"ImageVariantMaxPx" env:"IMAGE_VARIANT_MAX_PX"`
+    ImageVariantCacheMB int  `json:"ImageVariantCacheMB" env:"IMAGE_VARIANT_CACHE_MB"`
+    // AccessLog logs every request with its X-Request-ID; TraceEndpoint
+    // exports a span per request to an OTLP/HTTP collector
+    AccessLog        bool   `json:"AccessLog" env:"ACCESS_LOG"`
+    TraceEndpoint    string `json:"TraceEndpoint" env:"TRACE_ENDPOINT"`
+    TraceServiceName string `json:"TraceServiceName" env:"TRACE_SERVICE_NAME"`
+    // Histograms adds request latency and size histograms to /metrics, see
+    // HistogramConfig
+    Histograms HistogramConfig `json:"Histograms"`
+}
+
+// loadConfig reads the JSON file (optional when running from environment
+// only), migrates older layouts, applies env overrides and reports every
+// invalid field at once. With migrate set it rewrites the file in the
+// current layout and exits instead.
+func (s *Server) loadConfig(path string, migrate bool) {
+    var errs []error
+    data, err := os.ReadFile(path)
+    switch {
+    case errors.Is(err, os.ErrNotExist):
+        if migrate {
+            log.Fatalf("Config file %s not found", path)
+        }
+        log.Printf("Config file %s not found, using environment only", path)
+    case err != nil:
+        errs = append(errs, err)
+    default:
+        if err := s.decodeConfig(path, data, migrate); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", path, err))
+        }
+    }
+    errs = append(errs, applyEnv(&s.config)...)
+    errs = append(errs, s.validateConfig(&s.config)...)
+    if len(errs) > 0 {
+        for _, err := range errs {
+            log.Printf("config: %v", err)
+        }
+        log.Fatalf("Invalid configuration (%d errors)", len(errs))
+    }
+}
+
+// decodeConfig migrates the JSON config data to CurrentConfigVersion and
+// decodes it into config
+func (s *Server) decodeConfig(path string, data []byte, migrate bool) error {
+    var raw map[string]any
+    if err := json.Unmarshal(data, &raw); err != nil {
+        return err
+    }
+    from, err := migrateConfig(raw)
+    if err != nil {
+        return err
+    }
+    if migrate {
+        if from == CurrentConfigVersion {
+            log.Printf("%s is already at ConfigVersion %d", path, from)
+        } else if err := rewriteConfig(path, data, raw); err != nil {
+            log.Fatal(err)
+        } else {
+            log.Printf("Migrated %s from ConfigVersion %d to %d (original saved as %s.bak)", path, from, CurrentConfigVersion, path)
+        }
+        os.Exit(0)
+    }
+    if from < CurrentConfigVersion {
+        log.Printf("%s uses ConfigVersion %d, migrated in memory to %d; run with -migrate-config to update the file", path, from, CurrentConfigVersion)
+    }
+    warnUnknownFields(raw)
+    migrated, err := json.Marshal(raw)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(migrated, &s.config)
+}
+
+// applyEnv overrides fields of cfg from the environment variables named by
+// their env struct tags
+func applyEnv(cfg *Config) []error {
+    var errs []error
+    v := reflect.ValueOf(cfg).Elem()
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        name := t.Field(i).Tag.Get("env")
+        if name == "" {
+            continue
+        }
+        raw, ok := os.LookupEnv(name)
+        if !ok {
+            continue
+        }
+        if err := setField(v.Field(i), raw); err != nil {
+            errs = append(errs, fmt.Errorf("%s=%q: %w", name, raw, err))
+        }
+    }
+    return errs
+}
+
+func setField(f reflect.Value, raw string) error {
+    switch f.Kind() {
+    case reflect.String:
+        f.SetString(raw)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(raw)
+        if err != nil {
+            return err
+        }
+        f.SetBool(b)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+            return err
+        }
+        f.SetInt(n)
+    case reflect.Slice:
+        if f.Type().Elem().Kind() != reflect.String {
+            return fmt.Errorf("unsupported type %s", f.Type())
+        }
+        var items []string
+        for _, s := range strings.Split(raw, ",") {
+            if s = strings.TrimSpace(s); s != "" {
+                items = append(items, s)
+            }
+        }
+        f.Set(reflect.ValueOf(items))
+    default:
+        return fmt.Errorf("unsupported type %s", f.Type())
+    }
+    return nil
+}
+
+// validateConfig checks every field and resolves folders to absolute paths
+func (s *Server) validateConfig(cfg *Config) []error {
+    var errs []error
+    checkPort := func(name string, port int) {
+        if port < 1 || port > 65535 {
+            errs = append(errs, fmt.Errorf("%s %d out of range 1-65535", name, port))
+        }
+    }
+    checkDir := func(name string, dir *string) {
+        if *dir == "" {
+            errs = append(errs, fmt.Errorf("%s is required", name))
+            return
+        }
+        abs, err := filepath.Abs(*dir)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", name, err))
+            return
+        }
+        *dir = abs
+        info, err := os.Stat(abs)
+        if err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", name, err))
+        } else if !info.IsDir() {
+            errs = append(errs, fmt.Errorf("%s %s is not a directory", name, abs))
+        }
+    }
+    if len(cfg.PatchListen) == 0 {
+        checkPort("PatchPort", cfg.PatchPort)
+    }
+    // ImagePort 0 without ImageListen disables the image server
+    imageEnabled := cfg.ImagePort != 0 || len(cfg.ImageListen) > 0
+    if len(cfg.ImageListen) == 0 && imageEnabled {
+        checkPort("ImagePort", cfg.ImagePort)
+    }
+    if len(cfg.PatchListen) == 0 && len(cfg.ImageListen) == 0 && cfg.PatchPort == cfg.ImagePort {
+        errs = append(errs, fmt.Errorf("PatchPort and ImagePort are both %d", cfg.PatchPort))
+    }
+    checkAddrs := func(name string, addrs []string) {
+        for _, addr := range addrs {
+            if _, _, err := net.SplitHostPort(addr); err != nil {
+                errs = append(errs, fmt.Errorf("%s: %w", name, err))
+            }
+        }
+    }
+    checkAddrs("PatchListen", cfg.PatchListen)
+    checkAddrs("ImageListen", cfg.ImageListen)
+    checkAddrs("PatchHTTP3Listen", cfg.PatchHTTP3Listen)
+    checkAddrs("ImageHTTP3Listen", cfg.ImageHTTP3Listen)
+    if len(cfg.PatchHTTP3Listen) > 0 || len(cfg.ImageHTTP3Listen) > 0 {
+        if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+            errs = append(errs, fmt.Errorf("HTTP/3 listeners need TLSCertFile and TLSKeyFile"))
+        } else if _, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+            errs = append(errs, fmt.Errorf("TLSCertFile: %w", err))
+        }
+    }
+    checkDir("GameFolder", &cfg.GameFolder)
+    if imageEnabled {
+        checkDir("ImageFolder", &cfg.ImageFolder)
+    }
+    checkLocales := func(prefix string, list []LocaleConfig) {
+        seen := map[string]bool{}
+        for i := range list {
+            l := &list[i]
+            name := strings.ToLower(l.Name)
+            if !groupNameRegexp.MatchString(name) {
+                errs = append(errs, fmt.Errorf("%sLocales[%d]: invalid Name %q", prefix, i, l.Name))
+            } else if seen[name] {
+                errs = append(errs, fmt.Errorf("%sLocales[%d]: duplicate Name %q", prefix, i, l.Name))
+            }
+            seen[name] = true
+            checkDir(fmt.Sprintf("%sLocales[%d].Folder", prefix, i), &l.Folder)
+        }
+    }
+    checkLocales("", cfg.Locales)
+    checkChannels := func(prefix string, list []ChannelConfig) {
+        seen := map[string]bool{DefaultChannelName: true}
+        for i := range list {
+            c := &list[i]
+            checkLocales(fmt.Sprintf("%sChannels[%d].", prefix, i), c.Locales)
+            if c.Name == "" || strings.ContainsAny(c.Name, "/.@") {
+                errs = append(errs, fmt.Errorf("%sChannels[%d]: invalid Name %q", prefix, i, c.Name))
+            } else if seen[c.Name] {
+                errs = append(errs, fmt.Errorf("%sChannels[%d]: duplicate Name %q", prefix, i, c.Name))
+            }
+            seen[c.Name] = true
+            checkDir(fmt.Sprintf("%sChannels[%d].GameFolder", prefix, i), &c.GameFolder)
+        }
+    }
+    checkChannels("", cfg.Channels)
+    seenTenants := map[string]bool{DefaultTenantName: true}
+    for i := range cfg.Tenants {
+        t := &cfg.Tenants[i]
+        prefix := fmt.Sprintf("Tenants[%d].", i)
+        if t.Name == "" || strings.ContainsAny(t.Name, "/.") {
+            errs = append(errs, fmt.Errorf("%sName: invalid Name %q", prefix, t.Name))
+        } else if seenTenants[t.Name] {
+            errs = append(errs, fmt.Errorf("%sName: duplicate Name %q", prefix, t.Name))
+        }
+        seenTenants[t.Name] = true
+        checkDir(prefix+"GameFolder", &t.GameFolder)
+        checkLocales(prefix, t.Locales)
+        if imageEnabled {
+            checkDir(prefix+"ImageFolder", &t.ImageFolder)
+        }
+        if t.MaxClients <= 0 {
+            errs = append(errs, fmt.Errorf("%sMaxClients must be > 0, got %d", prefix, t.MaxClients))
+        }
+        if t.ImageQuotaMB < 0 {
+            errs = append(errs, fmt.Errorf("%sImageQuotaMB must be >= 0, got %d", prefix, t.ImageQuotaMB))
+        }
+        checkChannels(prefix, t.Channels)
+    }
+    if cfg.NewsFolder != "" {
+        checkDir("NewsFolder", &cfg.NewsFolder)
+    }
+    if cfg.PrecompressMinKB < 0 {
+        errs = append(errs, fmt.Errorf("PrecompressMinKB must be >= 0, got %d", cfg.PrecompressMinKB))
+    }
+    if cfg.SignedURLMinKB < 0 || cfg.SignedURLTTLSeconds < 0 {
+        errs = append(errs, fmt.Errorf("SignedURLMinKB and SignedURLTTLSeconds must be >= 0"))
+    }
+    if cfg.SignedURLTTLSeconds == 0 {
+        cfg.SignedURLTTLSeconds = 600
+    }
+    errs = append(errs, validateHistograms(&cfg.Histograms)...)
+    errs = append(errs, validateHeaders(cfg)...)
+    errs = append(errs, validateAuth(cfg)...)
+    switch cfg.SymlinkPolicy {
+    case "":
+        cfg.SymlinkPolicy = SymlinkFollow
+    case SymlinkFollow, SymlinkSkip, SymlinkError:
+    default:
+        errs = append(errs, fmt.Errorf("SymlinkPolicy must be %s, %s or %s, got %q", SymlinkFollow, SymlinkSkip, SymlinkError, cfg.SymlinkPolicy))
+    }
+    switch cfg.FilePolicy.Mode {
+    case "":
+        cfg.FilePolicy.Mode = PolicyWarn
+    case PolicyWarn, PolicyFail:
+    default:
+        errs = append(errs, fmt.Errorf("FilePolicy.Mode must be %s or %s, got %q", PolicyWarn, PolicyFail, cfg.FilePolicy.Mode))
+    }
+    for ext, mb := range cfg.FilePolicy.MaxSizeMB {
+        if mb < 0 {
+            errs = append(errs, fmt.Errorf("FilePolicy.MaxSizeMB[%q] must be >= 0, got %d", ext, mb))
+        }
+    }
+    cfg.FilePolicy.normalize()
+    switch cfg.SnapshotMode {
+    case "":
+        cfg.SnapshotMode = SnapshotCopy
+    case SnapshotCopy, SnapshotHardlink:
+    default:
+        errs = append(errs, fmt.Errorf("SnapshotMode must be %s or %s, got %q", SnapshotCopy, SnapshotHardlink, cfg.SnapshotMode))
+    }
+    for name, dir := range map[string]*string{"PrecompressFolder": &cfg.PrecompressFolder, "StagingFolder": &cfg.StagingFolder, "SnapshotFolder": &cfg.SnapshotFolder} {
+        if *dir == "" {
+            continue
+        }
+        if abs, err := filepath.Abs(*dir); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", name, err))
+        } else {
+            *dir = abs
+        }
+    }
+    if cfg.ErrorPagesFolder != "" {
+        checkDir("ErrorPagesFolder", &cfg.ErrorPagesFolder)
+    }
+    if cfg.MaxClients <= 0 {
+        errs = append(errs, fmt.Errorf("MaxClients must be > 0, got %d", cfg.MaxClients))
+    }
+    if cfg.CacheSizeMB < 0 {
+        errs = append(errs, fmt.Errorf("CacheSizeMB must be >= 0, got %d", cfg.CacheSizeMB))
+    }
+    if cfg.CacheSizeMB > 0 && cfg.CacheFileMaxKB <= 0 {
+        errs = append(errs, fmt.Errorf("CacheFileMaxKB must be > 0 when the cache is enabled"))
+    }
+    if cfg.ImageQuotaMB < 0 || cfg.ImageMaxAgeDays < 0 || cfg.ImageMaxTotalMB < 0 {
+        errs = append(errs, fmt.Errorf("ImageQuotaMB, ImageMaxAgeDays and ImageMaxTotalMB must be >= 0"))
+    }
+    if cfg.ImageVariantMaxPx < 0 || cfg.ImageVariantMaxPx > vp8lMaxSize || cfg.ImageVariantCacheMB < 0 {
+        errs = append(errs, fmt.Errorf("ImageVariantMaxPx must be between 0 and %d and ImageVariantCacheMB >= 0", vp8lMaxSize))
+    }
+    if cfg.ImageVariantMaxPx == 0 {
+        cfg.ImageVariantMaxPx = 2048
+    }
+    if cfg.ImageVariantCacheMB == 0 {
+        cfg.ImageVariantCacheMB = 256
+    }
+    if cfg.HeaderTimeoutSeconds < 0 || cfg.IdleTimeoutSeconds < 0 || cfg.MinSpeedKBps < 0 || cfg.MinSpeedSeconds < 0 {
+        errs = append(errs, fmt.Errorf("HeaderTimeoutSeconds, IdleTimeoutSeconds, MinSpeedKBps and MinSpeedSeconds must be >= 0"))
+    }
+    if cfg.HeaderTimeoutSeconds == 0 {
+        cfg.HeaderTimeoutSeconds = 10
+    }
+    if cfg.IdleTimeoutSeconds == 0 {
+        cfg.IdleTimeoutSeconds = 120
+    }
+    if cfg.MinSpeedSeconds == 0 {
+        cfg.MinSpeedSeconds = 30
+    }
+    if cfg.SessionWindowSeconds < 0 {
+        errs = append(errs, fmt.Errorf("SessionWindowSeconds must be >= 0, got %d", cfg.SessionWindowSeconds))
+    }
+    if cfg.LightMaxClients < 0 {
+        errs = append(errs, fmt.Errorf("LightMaxClients must be >= 0, got %d", cfg.LightMaxClients))
+    }
+    if cfg.LightMaxClients == 0 {
+        cfg.LightMaxClients = 64
+    }
+    if cfg.QueueSize < 0 || cfg.QueueWaitSeconds < 0 {
+        errs = append(errs, fmt.Errorf("QueueSize and QueueWaitSeconds must be >= 0"))
+    }
+    for i, hook := range cfg.Hooks {
+        switch {
+        case hook.Event != HookPrePublish && hook.Event != HookPostPublish && hook.Event != HookPostRescan:
+            errs = append(errs, fmt.Errorf("Hooks[%d]: unknown Event %q", i, hook.Event))
+        case hook.Command == "":
+            errs = append(errs, fmt.Errorf("Hooks[%d]: Command is required", i))
+        case hook.TimeoutSeconds < 0:
+            errs = append(errs, fmt.Errorf("Hooks[%d]: TimeoutSeconds must be >= 0", i))
+        }
+    }
+    if cfg.TelemetryPerMinute < 0 || cfg.TelemetryAlertClients < 0 {
+        errs = append(errs, fmt.Errorf("TelemetryPerMinute and TelemetryAlertClients must be >= 0"))
+    }
+    if cfg.TelemetryPerMinute == 0 {
+        cfg.TelemetryPerMinute = 20
+    }
+    for i, hook := range cfg.Webhooks {
+        if hook.URL == "" {
+            errs = append(errs, fmt.Errorf("Webhooks[%d]: URL is required", i))
+        }
+        switch hook.Kind {
+        case "", "json", "discord", "slack":
+        default:
+            errs = append(errs, fmt.Errorf("Webhooks[%d]: unknown Kind %q", i, hook.Kind))
+        }
+    }
+    if o := &cfg.Origin; o.URL != "" {
+        if !strings.HasPrefix(o.URL, "http://") && !strings.HasPrefix(o.URL, "https://") {
+            errs = append(errs, fmt.Errorf("Origin: URL must be the http(s) URL of the origin patch server"))
+        }
+        if o.RefreshSeconds < 0 {
+            errs = append(errs, fmt.Errorf("Origin: RefreshSeconds must be >= 0"))
+        } else if o.RefreshSeconds == 0 {
+            o.RefreshSeconds = 60
+        }
+        // These read or publish files that an edge only has once requested
+        hasLocales := len(cfg.Locales) > 0
+        for _, c := range cfg.Channels {
+            hasLocales = hasLocales || len(c.Locales) > 0
+        }
+        for name, set := range map[string]bool{
+            "Tenants":           len(cfg.Tenants) > 0,
+            "Locales":           hasLocales,
+            "KeepVersions":      cfg.KeepVersions > 0,
+            "SnapshotFolder":    cfg.SnapshotFolder != "",
+            "PrecompressFolder": cfg.PrecompressFolder != "",
+            "StagingFolder":     cfg.StagingFolder != "",
+        } {
+            if set {
+                errs = append(errs, fmt.Errorf("Origin cannot be combined with %s", name))
+            }
+        }
+    }
+    switch f := &cfg.Failover; f.Role {
+    case "":
+    case RolePrimary, RoleStandby:
+        if !strings.HasPrefix(f.Peer, "http://") && !strings.HasPrefix(f.Peer, "https://") {
+            errs = append(errs, fmt.Errorf("Failover: Peer must be the http(s) URL of the other instance"))
+        }
+        if f.Redirect != "" && !strings.HasPrefix(f.Redirect, "http://") && !strings.HasPrefix(f.Redirect, "https://") {
+            errs = append(errs, fmt.Errorf("Failover: Redirect must be an http(s) URL"))
+        }
+        if f.CheckIntervalSeconds < 0 || f.FailAfter < 0 {
+            errs = append(errs, fmt.Errorf("Failover: CheckIntervalSeconds and FailAfter must be >= 0"))
+        }
+        if f.CheckIntervalSeconds == 0 {
+            f.CheckIntervalSeconds = 5
+        }
+        if f.FailAfter == 0 {
+            f.FailAfter = 3
+        }
+    default:
+        errs = append(errs, fmt.Errorf("Failover: Role must be %q or %q, got %q", RolePrimary, RoleStandby, f.Role))
+    }
+    if cfg.SelfCheckIntervalSeconds < 0 || cfg.SelfCheckSampleSize < 0 || cfg.MinFreeDiskMB < 0 {
+        errs = append(errs, fmt.Errorf("SelfCheckIntervalSeconds, SelfCheckSampleSize and MinFreeDiskMB must be >= 0"))
+    }
+    if cfg.ChunkSizeMB < 0 {
+        errs = append(errs, fmt.Errorf("ChunkSizeMB must be >= 0, got %d", cfg.ChunkSizeMB))
+    }
+    for i, cdn := range cfg.CDNPurge {
+        if cdn.Kind == "" {
+            cfg.CDNPurge[i].Kind, cdn.Kind = "json", "json"
+        }
+        switch {
+        case cdn.BaseURL == "":
+            errs = append(errs, fmt.Errorf("CDNPurge[%d]: BaseURL is required", i))
+        case cdn.Kind == "cloudflare" && (cdn.ZoneID == "" || cdn.Token == ""):
+            errs = append(errs, fmt.Errorf("CDNPurge[%d]: cloudflare needs ZoneID and Token", i))
+        case cdn.Kind == "bunny" && cdn.Token == "":
+            errs = append(errs, fmt.Errorf("CDNPurge[%d]: bunny needs Token", i))
+        case cdn.Kind == "json" && cdn.URL == "":
+            errs = append(errs, fmt.Errorf("CDNPurge[%d]: json needs URL", i))
+        case cdn.Kind != "cloudflare" && cdn.Kind != "bunny" && cdn.Kind != "json":
+            errs = append(errs, fmt.Errorf("CDNPurge[%d]: unknown Kind %q", i, cdn.Kind))
+        }
+    }
+    groupNames := map[string]bool{BaseGroup: true, DiffBundle: true}
+    for i, g := range cfg.FileGroups {
+        switch {
+        case !groupNameRegexp.MatchString(g.Name):
+            errs = append(errs, fmt.Errorf("FileGroups[%d]: Name %q must be lowercase letters, digits, - and _", i, g.Name))
+        case groupNames[g.Name]:
+            errs = append(errs, fmt.Errorf("FileGroups[%d]: Name %q is reserved or used twice", i, g.Name))
+        case len(g.Patterns) == 0:
+            errs = append(errs, fmt.Errorf("FileGroups[%d]: Patterns is empty", i))
+        }
+        groupNames[g.Name] = true
+        for _, pattern := range g.Patterns {
+            if _, err := path.Match(pattern, ""); err != nil {
+                errs = append(errs, fmt.Errorf("FileGroups[%d]: pattern %q: %w", i, pattern, err))
+            }
+        }
+    }
+    if cfg.TorrentPieceKB != 0 && (cfg.TorrentPieceKB < 16 || cfg.TorrentPieceKB&(cfg.TorrentPieceKB-1) != 0) {
+        errs = append(errs, fmt.Errorf("TorrentPieceKB must be 0 or a power of two >= 16, got %d", cfg.TorrentPieceKB))
+    }
+    for name, rules := range map[string]AccessRules{"PatchAccess": cfg.PatchAccess, "ImageAccess": cfg.ImageAccess} {
+        if _, err := newAccessList(rules); err != nil {
+            errs = append(errs, fmt.Errorf("%s: %w", name, err))
+        }
+    }
+    if _, err := parseCIDRs(cfg.TrustedProxies); err != nil {
+        errs = append(errs, fmt.Errorf("TrustedProxies: %w", err))
+    }
+    if cfg.BasePath != "" {
+        cfg.BasePath = "/" + strings.Trim(cfg.BasePath, "/")
+        if cfg.BasePath == "/" {
+            cfg.BasePath = ""
+        }
+    }
+    if cfg.AdminListen != "" {
+        if cfg.AdminSocketMode == "" {
+            cfg.AdminSocketMode = "0660"
+        }
+        if err := validateAdminListen(cfg.AdminListen, cfg.AdminSocketMode); err != nil {
+            errs = append(errs, fmt.Errorf("AdminListen: %w", err))
+        }
+    }
+    if cfg.BandwidthKBps < 0 {
+        errs = append(errs, fmt.Errorf("BandwidthKBps must be >= 0, got %d", cfg.BandwidthKBps))
+    }
+    for i, w := range cfg.Schedule {
+        if _, err := parseClock(w.Start); err != nil {
+            errs = append(errs, fmt.Errorf("Schedule[%d].Start: %w", i, err))
+        }
+        if _, err := parseClock(w.End); err != nil {
+            errs = append(errs, fmt.Errorf("Schedule[%d].End: %w", i, err))
+        }
+        if w.MaxClients < 0 || w.BandwidthKBps < -1 {
+            errs = append(errs, fmt.Errorf("Schedule[%d]: MaxClients must be >= 0 and BandwidthKBps >= -1", i))
+        }
+    }
+    for i, sched := range cfg.RescanSchedule {
+        if _, err := parseCron(sched.Cron); err != nil {
+            errs = append(errs, fmt.Errorf("RescanSchedule[%d]: %w", i, err))
+        }
+    }
+    for i, w := range cfg.RescanQuietHours {
+        if _, err := parseClock(w.Start); err != nil {
+            errs = append(errs, fmt.Errorf("RescanQuietHours[%d].Start: %w", i, err))
+        }
+        if _, err := parseClock(w.End); err != nil {
+            errs = append(errs, fmt.Errorf("RescanQuietHours[%d].End: %w", i, err))
+        }
+    }
+    if err := s.compileUserAgentRules(cfg); err != nil {
+        errs = append(errs, fmt.Errorf("user agent rules: %w", err))
+    }
+    if cfg.MinLauncherVersion != "" && cfg.LauncherVersionPattern == "" {
+        errs = append(errs, fmt.Errorf("MinLauncherVersion requires LauncherVersionPattern"))
+    }
+    if cfg.KeepVersions < 0 {
+        errs = append(errs, fmt.Errorf("KeepVersions must be >= 0, got %d", cfg.KeepVersions))
+    }
+    if cfg.RolloutMinutes < 0 || cfg.RolloutStartPercent < 0 || cfg.RolloutStartPercent > 100 {
+        errs = append(errs, fmt.Errorf("RolloutMinutes must be >= 0 and RolloutStartPercent between 0 and 100"))
+    }
+    if cfg.RolloutMinutes > 0 && cfg.KeepVersions < 2 {
+        errs = append(errs, fmt.Errorf("RolloutMinutes needs KeepVersions >= 2 to serve the previous version"))
+    }
+    if cfg.RolloutStartPercent == 0 {
+        cfg.RolloutStartPercent = 10
+    }
+    if cfg.KeepVersions > 0 {
+        if cfg.VersionsFolder == "" {
+            errs = append(errs, fmt.Errorf("VersionsFolder is required when KeepVersions > 0"))
+        } else if abs, err := filepath.Abs(cfg.VersionsFolder); err != nil {
+            errs = append(errs, fmt.Errorf("VersionsFolder: %w", err))
+        } else {
+            cfg.VersionsFolder = abs
+        }
+    }
+    if cfg.HashWorkers < 0 {
+        errs = append(errs, fmt.Errorf("HashWorkers must be >= 0, got %d", cfg.HashWorkers))
+    }
+    switch cfg.ScanErrors {
+    case "":
+        cfg.ScanErrors = PolicyFail
+    case PolicyWarn, PolicyFail:
+    default:
+        errs = append(errs, fmt.Errorf("ScanErrors must be %s or %s, got %q", PolicyWarn, PolicyFail, cfg.ScanErrors))
+    }
+    if cfg.ScanRetries < 0 || cfg.ScanRetryMillis < 0 {
+        errs = append(errs, fmt.Errorf("ScanRetries and ScanRetryMillis must be >= 0"))
+    }
+    if cfg.ScanRetryMillis == 0 {
+        cfg.ScanRetryMillis = 500
+    }
+    if cfg.SigningKeyFile != "" {
+        if _, err := loadSigningKey(cfg.SigningKeyFile); err != nil {
+            errs = append(errs, fmt.Errorf("SigningKeyFile: %w", err))
+        }
+    }
+    if cfg.SigningCertFile != "" && cfg.SigningKeyFile == "" {
+        errs = append(errs, fmt.Errorf("SigningCertFile needs SigningKeyFile"))
+    }
+    for i, k := range cfg.SigningKeys {
+        if _, err := loadSigningKey(k.KeyFile); err != nil {
+            errs = append(errs, fmt.Errorf("SigningKeys[%d]: %w", i, err))
+        }
+    }
+    for i, root := range cfg.RootKeys {
+        if pub, err := base64.StdEncoding.DecodeString(root); err != nil || len(pub) != ed25519.PublicKeySize {
+            errs = append(errs, fmt.Errorf("RootKeys[%d] is not a base64 Ed25519 public key", i))
+        }
+    }
+    return errs
+}
@@ -0,0 +1,80 @@
+package patchserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "reflect"
+    "strings"
+)
+
+// CurrentConfigVersion is the config layout this build writes. Files
+// without ConfigVersion are version 1, the original flat layout, which is
+// still current.
+const CurrentConfigVersion = 1
+
+// configMigrations[v-1] rewrites a version v config into version v+1. Add
+// an entry here, and bump CurrentConfigVersion, whenever a field is
+// renamed, moved or changes meaning, so existing patch_config.json files
+// keep loading.
+var configMigrations = []func(raw map[string]any) error{}
+
+// migrateConfig upgrades raw in place to CurrentConfigVersion, reporting
+// the version it started from
+func migrateConfig(raw map[string]any) (int, error) {
+    from := 1
+    if v, ok := raw["ConfigVersion"]; ok {
+        n, ok := v.(float64)
+        if !ok || n < 1 || n != float64(int(n)) {
+            return 0, fmt.Errorf("ConfigVersion must be a positive integer, got %v", v)
+        }
+        from = int(n)
+    }
+    if from > CurrentConfigVersion {
+        return from, fmt.Errorf("ConfigVersion %d is newer than this server supports (%d)", from, CurrentConfigVersion)
+    }
+    for v := from; v < CurrentConfigVersion; v++ {
+        if err := configMigrations[v-1](raw); err != nil {
+            return from, fmt.Errorf("migrating config from version %d: %w", v, err)
+        }
+        raw["ConfigVersion"] = v + 1
+    }
+    return from, nil
+}
+
+// warnUnknownFields logs top-level keys that match no Config field, which
+// are usually typos
+func warnUnknownFields(raw map[string]any) {
+    known := map[string]bool{}
+    t := reflect.TypeOf(Config{})
+    for i := 0; i < t.NumField(); i++ {
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        known[strings.ToLower(name)] = true
+    }
+    for key := range raw {
+        if !known[strings.ToLower(key)] {
+            log.Printf("config: unknown field %q ignored", key)
+        }
+    }
+}
+
+// rewriteConfig saves raw to path, keeping the original as path.bak
+func rewriteConfig(path string, original []byte, raw map[string]any) error {
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetIndent("", "    ")
+    enc.SetEscapeHTML(false)
+    if err := enc.Encode(raw); err != nil {
+        return err
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(path+".bak", original, info.Mode().Perm()); err != nil {
+        return err
+    }
+    return os.WriteFile(path, buf.Bytes(), info.Mode().Perm())
+}
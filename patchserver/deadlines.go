@@ -0,0 +1,87 @@
+package patchserver
+
+import (
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// deadlineState counts the downloads dropped by MinSpeedKBps
+type deadlineState struct {
+    slowDropped atomic.Int64
+}
+
+// newHTTPServer returns the server used by every listener: headers must
+// arrive within HeaderTimeoutSeconds and idle keep-alive connections are
+// closed after IdleTimeoutSeconds, so half-open or slow-loris connections
+// cannot pile up. Bodies and responses have no fixed deadline as large
+// downloads legitimately take long; see minSpeed.
+func (s *Server) newHTTPServer(h http.Handler) *http.Server {
+    return &http.Server{
+        Handler:           h,
+        ReadHeaderTimeout: time.Duration(s.config.HeaderTimeoutSeconds) * time.Second,
+        IdleTimeout:       time.Duration(s.config.IdleTimeoutSeconds) * time.Second,
+    }
+}
+
+// speedWriter counts the bytes a response has written
+type speedWriter struct {
+    http.ResponseWriter
+    written atomic.Int64
+}
+
+func (s *speedWriter) Write(p []byte) (int, error) {
+    n, err := s.ResponseWriter.Write(p)
+    s.written.Add(int64(n))
+    return n, err
+}
+
+func (s *speedWriter) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+// minSpeed drops responses of h that send less than MinSpeedKBps over any
+// MinSpeedSeconds window, freeing the download slot held by a client that
+// stopped reading. The connection's write deadline is moved to now so a
+// write blocked on the client fails at once.
+func (s *Server) minSpeed(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if s.config.MinSpeedKBps <= 0 {
+            h.ServeHTTP(w, r)
+            return
+        }
+        sw := &speedWriter{ResponseWriter: w}
+        done := make(chan struct{})
+        defer close(done)
+        go func() {
+            window := time.Duration(s.config.MinSpeedSeconds) * time.Second
+            least := int64(s.config.MinSpeedKBps) << 10 * int64(s.config.MinSpeedSeconds)
+            ticker := time.NewTicker(window)
+            defer ticker.Stop()
+            var last int64
+            for {
+                select {
+                case <-done:
+                    return
+                case <-ticker.C:
+                }
+                n := sw.written.Load()
+                if n-last < least {
+                    s.slowDropped.Add(1)
+                    logRequest(r, "Dropping %s %s: %d bytes in %s, below MinSpeedKBps", remoteIP(r), r.URL.Path, n-last, window)
+                    http.NewResponseController(w).SetWriteDeadline(time.Now())
+                    return
+                }
+                last = n
+            }
+        }()
+        h.ServeHTTP(sw, r)
+    })
+}
+
+// registerDeadlines adds the slow client counter
+func (s *Server) registerDeadlines() {
+    s.registerMetric("patch_slow_clients_dropped_total", "counter", "Downloads dropped for staying below MinSpeedKBps", func() float64 {
+        return float64(s.slowDropped.Load())
+    })
+}
@@ -0,0 +1,106 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "expvar"
+    "net/http"
+    "net/http/pprof"
+    "runtime"
+    "sort"
+    "time"
+)
+
+var startTime = time.Now()
+
+// redactedConfig returns a copy of config with secrets blanked out
+func (s *Server) redactedConfig() Config {
+    c := s.config
+    redact := func(v string) string {
+        if v == "" {
+            return ""
+        }
+        return "REDACTED"
+    }
+    redactChannels := func(list []ChannelConfig) []ChannelConfig {
+        out := make([]ChannelConfig, len(list))
+        for i, ch := range list {
+            out[i] = ch
+            out[i].Tokens = nil
+            for range ch.Tokens {
+                out[i].Tokens = append(out[i].Tokens, "REDACTED")
+            }
+        }
+        return out
+    }
+    c.AdminToken = redact(c.AdminToken)
+    c.URLSigningKey = redact(c.URLSigningKey)
+    c.Channels = redactChannels(c.Channels)
+    c.Tenants = append([]TenantConfig(nil), c.Tenants...)
+    for i := range c.Tenants {
+        c.Tenants[i].Channels = redactChannels(c.Tenants[i].Channels)
+    }
+    c.Webhooks = append([]WebhookConfig(nil), c.Webhooks...)
+    for i := range c.Webhooks {
+        c.Webhooks[i].URL = redact(c.Webhooks[i].URL)
+    }
+    c.AuthBackends = append([]AuthBackendConfig(nil), c.AuthBackends...)
+    for i := range c.AuthBackends {
+        c.AuthBackends[i].ClientSecret = redact(c.AuthBackends[i].ClientSecret)
+    }
+    c.Origin.Token = redact(c.Origin.Token)
+    c.CDNPurge = append([]CDNPurgeConfig(nil), c.CDNPurge...)
+    for i := range c.CDNPurge {
+        c.CDNPurge[i].Token = redact(c.CDNPurge[i].Token)
+    }
+    return c
+}
+
+// debugStateHandler dumps the running configuration, manifest sizes and
+// runtime statistics
+func (s *Server) debugStateHandler(w http.ResponseWriter, r *http.Request) {
+    type manifestState struct {
+        Channel   string `json:"channel"`
+        ETag      string `json:"etag"`
+        Files     int    `json:"files"`
+        BodyBytes int64  `json:"body_bytes"`
+        Stored    bool   `json:"stored"` // bodies in StoreFile, see storeBodies
+        Rollback  bool   `json:"rollback"`
+    }
+    manifests := []manifestState{}
+    for _, ch := range s.channels {
+        data := ch.data.Load()
+        manifests = append(manifests, manifestState{ch.name, data.ChecksumHeader, len(data.Entries), data.checksums.plain.Size(), data.stored != nil, data.ObjectDir == s.objectsDir()})
+    }
+    sort.Slice(manifests, func(i, j int) bool { return manifests[i].Channel < manifests[j].Channel })
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    w.Header().Set("Content-Type", "application/json")
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    enc.Encode(map[string]any{
+        "uptime_seconds": int64(time.Since(startTime).Seconds()),
+        "goroutines":     runtime.NumGoroutine(),
+        "go_version":     runtime.Version(),
+        "memory": map[string]uint64{
+            "heap_alloc": mem.HeapAlloc,
+            "heap_sys":   mem.HeapSys,
+            "sys":        mem.Sys,
+            "num_gc":     uint64(mem.NumGC),
+        },
+        "manifests": manifests,
+        "config":    s.redactedConfig(),
+    })
+}
+
+// registerDebug adds pprof, expvar and /admin/debug/state
+func (s *Server) registerDebug() {
+    debugMux := http.NewServeMux()
+    debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+    debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+    debugMux.Handle("/debug/vars", expvar.Handler())
+    debugMux.HandleFunc("/debug/state", s.debugStateHandler)
+    s.adminMux.Handle("/admin/debug/", http.StripPrefix("/admin", debugMux))
+}
@@ -0,0 +1,61 @@
+package patchserver
+
+import (
+    "bufio"
+    "compress/gzip"
+    "io"
+    "net/http"
+    "strings"
+)
+
+// maxDiffBody caps the client manifest accepted by /check/diff
+const maxDiffBody = 32 << 20
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding
+func acceptsGzip(r *http.Request) bool {
+    return acceptsEncoding(r, "gzip")
+}
+
+// checkDiffHandler takes the client's manifest in the /check line format
+// ("sha256\tpath") and replies with only the server lines that are missing
+// or different on the client
+func (s *Server) checkDiffHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    known := make(map[string]string)
+    scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxDiffBody))
+    for scanner.Scan() {
+        checksum, path, ok := strings.Cut(scanner.Text(), "\t")
+        if !ok {
+            continue
+        }
+        known[path] = strings.ToLower(checksum)
+    }
+    if err := scanner.Err(); err != nil {
+        http.Error(w, "invalid manifest: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    _, data := s.manifestFor(r)
+    w.Header().Set("ETag", data.ChecksumHeader)
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Add("Vary", "Accept-Encoding")
+    var out io.Writer = w
+    if acceptsGzip(r) {
+        w.Header().Set("Content-Encoding", "gzip")
+        gz := gzip.NewWriter(w)
+        defer gz.Close()
+        out = gz
+    }
+    bw := bufio.NewWriter(out)
+    defer bw.Flush()
+    for _, e := range data.Entries {
+        if known[e.Path] == e.SHA256 {
+            continue
+        }
+        bw.WriteString(e.SHA256 + "\t" + e.Path + "\n")
+    }
+}
@@ -0,0 +1,218 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "html/template"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// errorPageStatuses are the statuses rendered by errorPages
+var errorPageStatuses = map[int]string{
+    http.StatusNotFound:           "not_found",
+    http.StatusTooManyRequests:    "rate_limited",
+    http.StatusServiceUnavailable: "unavailable",
+}
+
+// maintenanceRetryAfter is the Retry-After sent while in maintenance
+const maintenanceRetryAfter = 300
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Status}} {{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .RetryAfter}}<p>Please try again in {{.RetryAfter}} seconds.</p>{{end}}
+</body></html>
+`))
+
+// errorPageState holds the ErrorPagesFolder templates and maintenance mode
+type errorPageState struct {
+    // errorTemplates maps "404", "429", "503" and "maintenance" to the
+    // page loaded from ErrorPagesFolder
+    errorTemplates     atomic.Pointer[map[string]*template.Template]
+    maintenance        atomic.Bool
+    maintenanceMessage atomic.Pointer[string]
+}
+
+// loadErrorPages parses <name>.html from ErrorPagesFolder for each page,
+// falling back to the built-in page for missing files
+func (s *Server) loadErrorPages() error {
+    pages := map[string]*template.Template{}
+    if s.config.ErrorPagesFolder != "" {
+        for _, name := range []string{"404", "429", "503", "maintenance"} {
+            file := filepath.Join(s.config.ErrorPagesFolder, name+".html")
+            if _, err := os.Stat(file); os.IsNotExist(err) {
+                continue
+            }
+            t, err := template.ParseFiles(file)
+            if err != nil {
+                return err
+            }
+            pages[name] = t
+        }
+    }
+    s.errorTemplates.Store(&pages)
+    return nil
+}
+
+// prefersHTML reports whether the Accept header ranks text/html above JSON,
+// which is what browsers send and launchers do not
+func prefersHTML(r *http.Request) bool {
+    var htmlQ, jsonQ float64
+    for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+        media, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        q := 1.0
+        for _, p := range strings.Split(params, ";") {
+            if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+                q, _ = strconv.ParseFloat(v, 64)
+            }
+        }
+        switch strings.ToLower(strings.TrimSpace(media)) {
+        case "text/html", "application/xhtml+xml":
+            htmlQ = max(htmlQ, q)
+        case "application/json", "application/*":
+            jsonQ = max(jsonQ, q)
+        }
+    }
+    return htmlQ > jsonQ
+}
+
+// writeErrorPage renders status as the branded HTML page or as JSON
+// {"error": code, "message": message}. page selects the template, by
+// default the status code.
+func (s *Server) writeErrorPage(w http.ResponseWriter, r *http.Request, status int, page, code, message string) {
+    if page == "" {
+        page = strconv.Itoa(status)
+    }
+    h := w.Header()
+    h.Del("Content-Length")
+    if !prefersHTML(r) {
+        h.Set("Content-Type", "application/json")
+        w.WriteHeader(status)
+        json.NewEncoder(w).Encode(map[string]any{"error": code, "message": message})
+        return
+    }
+    t := defaultErrorTemplate
+    if pages := s.errorTemplates.Load(); pages != nil && (*pages)[page] != nil {
+        t = (*pages)[page]
+    }
+    h.Set("Content-Type", "text/html; charset=utf-8")
+    w.WriteHeader(status)
+    t.Execute(w, map[string]any{
+        "Status":     status,
+        "Title":      http.StatusText(status),
+        "Code":       code,
+        "Message":    message,
+        "RetryAfter": h.Get("Retry-After"),
+    })
+}
+
+// errorPageWriter holds back plain-text error responses (those written by
+// http.Error) so errorPages can replace them
+type errorPageWriter struct {
+    http.ResponseWriter
+    r       *http.Request
+    status  int
+    message []byte
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+    if w.status != 0 {
+        return
+    }
+    w.status = status
+    _, templated := errorPageStatuses[status]
+    ct := w.Header().Get("Content-Type")
+    if templated && (strings.HasPrefix(ct, "text/plain") || prefersHTML(w.r) && !strings.HasPrefix(ct, "text/html")) {
+        return
+    }
+    w.status = -1
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+    if w.status == 0 {
+        w.WriteHeader(http.StatusOK)
+    }
+    if w.status > 0 {
+        if len(w.message) < 512 {
+            w.message = append(w.message, b...)
+        }
+        return len(b), nil
+    }
+    return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// errorPages renders 404, 429 and 503 responses of h with writeErrorPage
+func (s *Server) errorPages(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ew := &errorPageWriter{ResponseWriter: w, r: r}
+        h.ServeHTTP(ew, r)
+        if ew.status <= 0 {
+            return
+        }
+        message := strings.TrimSpace(string(ew.message))
+        if strings.HasPrefix(ew.Header().Get("Content-Type"), "application/json") {
+            var body struct {
+                Error string `json:"error"`
+            }
+            json.Unmarshal(ew.message, &body)
+            message = body.Error
+        }
+        s.writeErrorPage(w, r, ew.status, "", errorPageStatuses[ew.status], message)
+    })
+}
+
+// maintenanceGate answers every request with the maintenance page while
+// maintenance mode is on
+func (s *Server) maintenanceGate(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !s.maintenance.Load() {
+            h.ServeHTTP(w, r)
+            return
+        }
+        message := "The patch server is under maintenance."
+        if m := s.maintenanceMessage.Load(); m != nil && *m != "" {
+            message = *m
+        }
+        w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+        s.writeErrorPage(w, r, http.StatusServiceUnavailable, "maintenance", "maintenance", message)
+    })
+}
+
+// adminMaintenanceHandler switches maintenance mode, optionally replacing
+// the message
+func (s *Server) adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+    if err != nil {
+        s.audit(adminActor(r), "maintenance", "", r.FormValue("enabled"), err)
+        http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+        return
+    }
+    if r.Form.Has("message") {
+        message := r.FormValue("message")
+        s.maintenanceMessage.Store(&message)
+    }
+    s.maintenance.Store(enabled)
+    s.audit(adminActor(r), "maintenance", "", fmt.Sprint(enabled), nil)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"enabled": enabled})
+}
+
+// registerErrorPages adds /admin/maintenance
+func (s *Server) registerErrorPages() {
+    s.adminMux.HandleFunc("/admin/maintenance", s.adminMaintenanceHandler)
+}
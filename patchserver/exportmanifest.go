@@ -0,0 +1,175 @@
+package patchserver
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path"
+    "sort"
+    "strings"
+)
+
+// junkSuffixes and junkNames mark files that are usually left behind by
+// editors, downloads or the OS rather than meant to be published
+var (
+    junkSuffixes = []string{".tmp", ".temp", ".part", ".crdownload", ".bak", ".swp", "~"}
+    junkNames    = []string{"thumbs.db", "desktop.ini"}
+)
+
+// suspiciousReason explains why e probably should not be published, ""
+// when it looks fine
+func suspiciousReason(e ManifestEntry) string {
+    name := strings.ToLower(path.Base(e.Path))
+    for _, n := range junkNames {
+        if name == n {
+            return "OS metadata file"
+        }
+    }
+    for _, s := range junkSuffixes {
+        if strings.HasSuffix(name, s) {
+            return "temporary or backup file"
+        }
+    }
+    if e.Size == 0 {
+        return "empty file"
+    }
+    return ""
+}
+
+// exportManifestCommand scans a game folder the way the server would,
+// prints statistics about it and optionally writes the manifest, without
+// starting any listener. It validates a release before it is published.
+func exportManifestCommand(args []string) {
+    defaultConfig := "./patch_config.json"
+    if env, ok := os.LookupEnv("PATCH_CONFIG"); ok {
+        defaultConfig = env
+    }
+    fset := flag.NewFlagSet("export-manifest", flag.ExitOnError)
+    cfg := fset.String("config", defaultConfig, "path to config file (env PATCH_CONFIG)")
+    channelName := fset.String("channel", DefaultChannelName, "channel whose GameFolder is scanned")
+    dir := fset.String("dir", "", "folder to scan instead of the channel's GameFolder")
+    out := fset.String("o", "", "write the manifest to this file, nothing is written without it")
+    format := fset.String("format", "check", "manifest format: check (the /check body) or v2 (the /check/v2 JSON)")
+    strict := fset.Bool("strict", false, "exit with status 1 when suspicious files or path conflicts are found")
+    fset.Parse(args)
+    if *format != "check" && *format != "v2" {
+        log.Fatal("-format must be check or v2")
+    }
+
+    s := New(*cfg)
+    s.loadConfig(*cfg, false)
+    // a dry run must not touch the precompressed copies of the live server
+    s.config.PrecompressFolder = ""
+    if err := s.loadPriorities(); err != nil {
+        log.Fatal(err)
+    }
+    root := *dir
+    if root == "" {
+        root = s.channelFolder(*channelName)
+    }
+    if root == "" {
+        log.Fatalf("Unknown channel %q", *channelName)
+    }
+    if *out != "" {
+        if err := s.loadSigners(); err != nil {
+            log.Fatal(err)
+        }
+    }
+    data, err := s.buildManifest(root, osFolderOf(root), nil, nil)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    var total, largest int64
+    var largestPath string
+    bySum := map[string][]ManifestEntry{}
+    folded := map[string]bool{}
+    var suspicious []string
+    conflicts := 0
+    for _, e := range data.Entries {
+        total += e.Size
+        if e.Size > largest {
+            largest, largestPath = e.Size, e.Path
+        }
+        bySum[e.SHA256] = append(bySum[e.SHA256], e)
+        if reason := suspiciousReason(e); reason != "" {
+            suspicious = append(suspicious, fmt.Sprintf("%s (%s)", e.Path, reason))
+        }
+        if strings.Contains(e.Path, "\\") || folded[foldPath(e.Path)] {
+            conflicts++
+        }
+        folded[foldPath(e.Path)] = true
+    }
+    var dupSums []string
+    var dupBytes int64
+    for sum, list := range bySum {
+        if len(list) > 1 {
+            dupSums = append(dupSums, sum)
+            dupBytes += int64(len(list)-1) * list[0].Size
+        }
+    }
+    sort.Strings(dupSums)
+
+    fmt.Printf("Folder:      %s\n", root)
+    fmt.Printf("Files:       %d\n", len(data.Entries))
+    fmt.Printf("Total size:  %.1f MB\n", float64(total)/(1<<20))
+    if largestPath != "" {
+        fmt.Printf("Largest:     %s (%.1f MB)\n", largestPath, float64(largest)/(1<<20))
+    }
+    fmt.Printf("ETag:        %s\n", data.ChecksumHeader)
+    if len(s.config.FileGroups) > 0 {
+        for _, g := range s.groupSummaries(data.Entries) {
+            fmt.Printf("Group %-6s %d files, %.1f MB\n", g.Name+":", g.Files, float64(g.Size)/(1<<20))
+        }
+    }
+    fmt.Printf("Duplicates:  %d hashes shared by several files, %.1f MB redundant\n", len(dupSums), float64(dupBytes)/(1<<20))
+    for _, sum := range dupSums {
+        fmt.Printf("  %s\n", sum)
+        for _, e := range bySum[sum] {
+            fmt.Printf("    %s\n", e.Path)
+        }
+    }
+    fmt.Printf("Suspicious:  %d\n", len(suspicious))
+    for _, line := range suspicious {
+        fmt.Printf("  %s\n", line)
+    }
+    fmt.Printf("Conflicts:   %d paths Windows clients cannot store as served\n", conflicts)
+
+    if *out != "" {
+        blob := data.checksums.plain
+        if *format == "v2" {
+            blob = data.v2.plain
+        }
+        body, err := readBlob(blob)
+        if err != nil {
+            log.Fatal(err)
+        }
+        if err := os.WriteFile(*out, body, 0644); err != nil {
+            log.Fatal(err)
+        }
+        if sig, _ := s.signatures(data); *format == "check" && sig != nil {
+            if err := os.WriteFile(*out+".sig", sig, 0644); err != nil {
+                log.Fatal(err)
+            }
+        }
+        fmt.Printf("Wrote %s\n", *out)
+    }
+    if *strict && len(suspicious)+conflicts > 0 {
+        os.Exit(1)
+    }
+}
+
+// channelFolder returns the GameFolder of a channel of the default tenant,
+// "" when there is no such channel
+func (s *Server) channelFolder(name string) string {
+    if name == DefaultChannelName {
+        return s.config.GameFolder
+    }
+    for _, c := range s.config.Channels {
+        if c.Name == name {
+            return c.GameFolder
+        }
+    }
+    return ""
+}
@@ -0,0 +1,295 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Failover roles
+const (
+    RolePrimary = "primary"
+    RoleStandby = "standby"
+)
+
+// FailoverConfig pairs this instance with Peer, a second instance serving
+// the same GameFolder from shared or replicated storage. Each checks the
+// other's /healthz every CheckIntervalSeconds (default 5). The active one
+// publishes; the passive one serves downloads, follows the active one's
+// manifests and answers admin changes with a redirect to Redirect (503
+// without one). A standby takes over once the primary missed FailAfter
+// (default 3) checks in a row, and yields when the primary is active again.
+type FailoverConfig struct {
+    Role                 string `json:"Role"`
+    Peer                 string `json:"Peer"`
+    Redirect             string `json:"Redirect"`
+    CheckIntervalSeconds int    `json:"CheckIntervalSeconds"`
+    FailAfter            int    `json:"FailAfter"`
+}
+
+// failoverStatus is the failover section of /healthz
+type failoverStatus struct {
+    Role     string            `json:"role"`
+    Active   bool              `json:"active"`
+    Peer     string            `json:"peer"`
+    PeerUp   bool              `json:"peer_up"`
+    Channels map[string]string `json:"channels"`
+}
+
+// failoverState holds the role of this instance and what it knows of the
+// peer
+type failoverState struct {
+    failoverClient http.Client // Timeout is CheckIntervalSeconds
+    failoverActive atomic.Bool
+    peerUp         atomic.Bool
+    peerMisses     atomic.Int64
+    // following holds the channels whose rescan did not reach the peer's
+    // manifest, only used by failoverLoop
+    following map[string]*peerFollow
+}
+
+// followRetryMax caps the wait between rescans of a channel that does not
+// scan to the active peer's manifest
+const followRetryMax = 10 * time.Minute
+
+// peerFollow is a peer manifest a channel failed to reach, retried with
+// exponential backoff
+type peerFollow struct {
+    etag string
+    wait time.Duration
+    next time.Time
+}
+
+// failoverEnabled reports whether this instance is half of a pair
+func (s *Server) failoverEnabled() bool {
+    return s.config.Failover.Role != ""
+}
+
+// passive reports whether another instance is publishing, so this one must
+// not run hooks, webhooks, CDN purges or admin changes
+func (s *Server) passive() bool {
+    return s.failoverEnabled() && !s.failoverActive.Load()
+}
+
+func (s *Server) currentFailoverStatus() failoverStatus {
+    status := failoverStatus{
+        Role:     s.config.Failover.Role,
+        Active:   s.failoverActive.Load(),
+        Peer:     s.config.Failover.Peer,
+        PeerUp:   s.peerUp.Load(),
+        Channels: map[string]string{},
+    }
+    for _, ch := range s.allChannels() {
+        if data := ch.data.Load(); data != nil {
+            status.Channels[ch.name] = data.ChecksumHeader
+        }
+    }
+    return status
+}
+
+// peerStatus fetches the failover state of the peer from its /healthz
+func (s *Server) peerStatus() (*failoverStatus, error) {
+    resp, err := s.failoverClient.Get(strings.TrimSuffix(s.config.Failover.Peer, "/") + "/healthz")
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    var health struct {
+        Failover *failoverStatus `json:"failover"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+        return nil, fmt.Errorf("peer health: %w", err)
+    }
+    if health.Failover == nil {
+        return nil, fmt.Errorf("peer has no Failover configured")
+    }
+    return health.Failover, nil
+}
+
+// setActive switches publishing on or off, notifying webhooks
+func (s *Server) setActive(active bool, actor, reason string) {
+    if s.failoverActive.Swap(active) == active {
+        return
+    }
+    action, state := "failover_demote", "passive"
+    if active {
+        action, state = "failover_promote", "active"
+    }
+    log.Printf("Failover: now %s (%s)", state, reason)
+    s.audit(actor, action, s.config.Failover.Role, reason, nil)
+    s.notify(EventFailover, fmt.Sprintf("%s instance is now %s: %s", s.config.Failover.Role, state, reason), map[string]any{
+        "role":   s.config.Failover.Role,
+        "active": active,
+        "reason": reason,
+    })
+}
+
+// startFailover decides the initial state: the primary starts active
+// unless the standby already took over, the standby starts passive
+func (s *Server) startFailover() {
+    interval := time.Duration(s.config.Failover.CheckIntervalSeconds) * time.Second
+    s.failoverClient.Timeout = interval
+    if s.config.Failover.Role == RolePrimary {
+        if peer, err := s.peerStatus(); err == nil && peer.Active {
+            s.peerUp.Store(true)
+            log.Printf("Failover: standby %s is active, starting passive; POST /admin/failover/promote to take over", s.config.Failover.Peer)
+        } else {
+            s.failoverActive.Store(true)
+        }
+    }
+    go s.failoverLoop(interval)
+}
+
+// failoverLoop checks the peer, taking over when it is gone and following
+// its manifests while it publishes
+func (s *Server) failoverLoop(interval time.Duration) {
+    for range time.Tick(interval) {
+        peer, err := s.peerStatus()
+        if err != nil {
+            s.peerUp.Store(false)
+            misses := s.peerMisses.Add(1)
+            if misses == 1 {
+                log.Printf("Failover: peer %s: %v", s.config.Failover.Peer, err)
+            }
+            if s.config.Failover.Role == RoleStandby && misses >= int64(s.config.Failover.FailAfter) {
+                s.setActive(true, "failover", fmt.Sprintf("primary missed %d health checks", misses))
+            }
+            continue
+        }
+        if s.peerMisses.Swap(0) > 0 {
+            log.Printf("Failover: peer %s is back", s.config.Failover.Peer)
+        }
+        s.peerUp.Store(true)
+        if peer.Active && s.failoverActive.Load() && s.config.Failover.Role == RoleStandby {
+            s.setActive(false, "failover", "primary is active again")
+        }
+        if peer.Active && !s.failoverActive.Load() {
+            s.followPeer(peer, interval)
+        }
+    }
+}
+
+// followPeer brings the channels whose manifest differs from the active
+// peer's to it: from the version archive when the peer's manifest is
+// archived, else by rescanning the shared folder. A rescan that does not
+// reach the peer's manifest, e.g. while the folder is still being copied
+// or with a different FilePolicy, is retried after interval, doubling up
+// to followRetryMax until the peer publishes something else.
+func (s *Server) followPeer(peer *failoverStatus, interval time.Duration) {
+    now := time.Now()
+    for _, ch := range s.allChannels() {
+        etag, ok := peer.Channels[ch.name]
+        data := ch.data.Load()
+        if !ok || data == nil || data.ChecksumHeader == etag {
+            delete(s.following, ch.name)
+            continue
+        }
+        f := s.following[ch.name]
+        if f != nil && f.etag == etag && now.Before(f.next) {
+            continue
+        }
+        followed, err := s.followVersion(ch, etag)
+        if err != nil {
+            log.Printf("Failover: following %s to archived version %s: %v", ch.name, etag, err)
+        }
+        if followed {
+            delete(s.following, ch.name)
+            continue
+        }
+        if err := s.loadChannel(ch); err != nil {
+            log.Printf("Failover: following %s to %s: %v", ch.name, etag, err)
+        }
+        if current := ch.data.Load().ChecksumHeader; current != etag {
+            if f == nil || f.etag != etag {
+                f = &peerFollow{etag: etag, wait: interval}
+            } else {
+                f.wait = min(f.wait*2, followRetryMax)
+            }
+            f.next = now.Add(f.wait)
+            s.following[ch.name] = f
+            log.Printf("Failover: %s scans as %s, not the peer's %s, rescanning in %s", ch.name, current, etag, f.wait)
+            continue
+        }
+        delete(s.following, ch.name)
+    }
+}
+
+// followVersion serves the archived version etag of ch, which the active
+// peer publishes, false when it is not archived
+func (s *Server) followVersion(ch *channel, etag string) (bool, error) {
+    if s.config.KeepVersions == 0 {
+        return false, nil
+    }
+    s.rescanMu.Lock()
+    defer s.rescanMu.Unlock()
+    v, err := s.findVersion(ch, versionID(etag))
+    if errors.Is(err, errUnknownVersion) || err == nil && v.ETag != etag {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if _, err := s.servePinned(ch, v); err != nil {
+        return false, err
+    }
+    log.Printf("Failover: serving %s from archived version %s like the peer", ch.name, etag)
+    return true, nil
+}
+
+// failoverGate answers admin changes on a passive instance with a redirect
+// to Failover.Redirect, or 503. Reads and /admin/failover/ stay available.
+func (s *Server) failoverGate(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !s.passive() || r.Method == http.MethodGet || r.Method == http.MethodHead || strings.HasPrefix(r.URL.Path, "/admin/failover/") {
+            h.ServeHTTP(w, r)
+            return
+        }
+        if s.config.Failover.Redirect != "" {
+            http.Redirect(w, r, strings.TrimSuffix(s.config.Failover.Redirect, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+            return
+        }
+        w.Header().Set("Retry-After", "30")
+        http.Error(w, "passive failover instance, publish on the active one", http.StatusServiceUnavailable)
+    })
+}
+
+func (s *Server) adminFailoverHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(s.currentFailoverStatus())
+}
+
+// adminFailoverPromoteHandler makes this instance the publishing one. A
+// standby that is active yields once it sees the promoted primary.
+func (s *Server) adminFailoverPromoteHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    s.setActive(true, adminActor(r), "promoted by operator")
+    s.adminFailoverHandler(w, r)
+}
+
+func (s *Server) adminFailoverDemoteHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    s.setActive(false, adminActor(r), "demoted by operator")
+    s.adminFailoverHandler(w, r)
+}
+
+// registerFailover adds the failover admin endpoints and role gauge
+func (s *Server) registerFailover() {
+    s.adminMux.HandleFunc("/admin/failover", s.adminFailoverHandler)
+    s.adminMux.HandleFunc("/admin/failover/promote", s.adminFailoverPromoteHandler)
+    s.adminMux.HandleFunc("/admin/failover/demote", s.adminFailoverDemoteHandler)
+    s.registerMetric("patch_failover_active", "gauge", "Whether this instance publishes (1 without Failover)", func() float64 {
+        if s.passive() {
+            return 0
+        }
+        return 1
+    })
+}
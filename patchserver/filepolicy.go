@@ -0,0 +1,124 @@
+package patchserver
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "path"
+    "strings"
+    "sync/atomic"
+)
+
+// File policy modes
+const (
+    PolicyWarn = "warn"
+    PolicyFail = "fail"
+)
+
+// FilePolicyConfig keeps files that were never meant for players out of
+// the manifests. Extensions are lowercase with the dot (".zip"), "" matching
+// files without one. Allow, when set, lists the only extensions published;
+// Deny is checked after it. MaxSizeMB caps the size per extension, "*" for
+// any other. In warn mode (default) a rejected file is left out of the
+// manifest with a warning; in fail mode the scan fails and the previous
+// manifest stays published.
+type FilePolicyConfig struct {
+    Mode      string           `json:"Mode"`
+    Allow     []string         `json:"Allow"`
+    Deny      []string         `json:"Deny"`
+    MaxSizeMB map[string]int64 `json:"MaxSizeMB"`
+}
+
+// filePolicyState counts the files FilePolicy left out of manifests
+type filePolicyState struct {
+    filesRejected atomic.Int64
+}
+
+// normalize lowercases the extensions and adds missing dots
+func (p *FilePolicyConfig) normalize() {
+    ext := func(e string) string {
+        e = strings.ToLower(strings.TrimSpace(e))
+        if e != "" && e != "*" && !strings.HasPrefix(e, ".") {
+            e = "." + e
+        }
+        return e
+    }
+    for i, e := range p.Allow {
+        p.Allow[i] = ext(e)
+    }
+    for i, e := range p.Deny {
+        p.Deny[i] = ext(e)
+    }
+    if len(p.MaxSizeMB) > 0 {
+        sizes := make(map[string]int64, len(p.MaxSizeMB))
+        for e, mb := range p.MaxSizeMB {
+            sizes[ext(e)] = mb
+        }
+        p.MaxSizeMB = sizes
+    }
+}
+
+// extAllowed reports whether files named name may be published at all
+func (p *FilePolicyConfig) extAllowed(name string) (bool, string) {
+    ext := strings.ToLower(path.Ext(name))
+    if len(p.Allow) > 0 && !containsString(p.Allow, ext) {
+        return false, fmt.Sprintf("extension %q is not in FilePolicy.Allow", ext)
+    }
+    if containsString(p.Deny, ext) {
+        return false, fmt.Sprintf("extension %q is in FilePolicy.Deny", ext)
+    }
+    return true, ""
+}
+
+// check returns why the file at name of size bytes must not be published,
+// or "" when it may
+func (p *FilePolicyConfig) check(name string, size int64) string {
+    if ok, reason := p.extAllowed(name); !ok {
+        return reason
+    }
+    ext := strings.ToLower(path.Ext(name))
+    mb, ok := p.MaxSizeMB[ext]
+    if !ok {
+        mb, ok = p.MaxSizeMB["*"]
+    }
+    if ok && mb > 0 && size > mb<<20 {
+        return fmt.Sprintf("%.1f MB is over the %d MB FilePolicy.MaxSizeMB limit", float64(size)/(1<<20), mb)
+    }
+    return ""
+}
+
+// applyFilePolicy reports the files of root rejected by FilePolicy, given
+// as "path: reason", and fails the scan in fail mode
+func (s *Server) applyFilePolicy(root string, rejected []string) error {
+    if len(rejected) == 0 {
+        return nil
+    }
+    for _, r := range rejected {
+        log.Printf("Warning: FilePolicy rejects %s%s", root, r)
+    }
+    if s.config.FilePolicy.Mode == PolicyFail {
+        return fmt.Errorf("FilePolicy rejects %d file(s) in %s, first %s", len(rejected), root, rejected[0])
+    }
+    s.filesRejected.Add(int64(len(rejected)))
+    log.Printf("Left %d file(s) rejected by FilePolicy out of the manifest of %s", len(rejected), root)
+    return nil
+}
+
+// filePolicyFiles refuses downloads of extensions the policy never
+// publishes, in case such a file is still lying in the folder
+func (s *Server) filePolicyFiles(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if ok, _ := s.config.FilePolicy.extAllowed(r.URL.Path); !ok && !strings.HasSuffix(r.URL.Path, "/") {
+            http.NotFound(w, r)
+            return
+        }
+        h(w, r)
+    }
+}
+
+// registerFilePolicy adds the rejected file counter
+func (s *Server) registerFilePolicy() {
+    s.registerMetric("patch_file_policy_rejected_total", "counter", "Files left out of manifests by FilePolicy", func() float64 {
+        return float64(s.filesRejected.Load())
+    })
+}
@@ -0,0 +1,156 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+)
+
+// osFolder is a folder of the OS file system, like os.DirFS, that can also
+// tell links apart (see lstatFS). The folder must be absolute: only
+// absolute paths get the \\?\ prefix that lets Windows open paths over 260
+// characters.
+type osFolder string
+
+// osFolderOf returns root as an absolute osFolder
+func osFolderOf(root string) osFolder {
+    if abs, err := filepath.Abs(root); err == nil {
+        root = abs
+    }
+    return osFolder(root)
+}
+
+// needsOSFiles reports the configured features that write to the game
+// folders, which a FileSource other than the OS file system cannot serve
+func (s *Server) needsOSFiles() error {
+    switch {
+    case s.originEnabled():
+        return errors.New("Origin needs the OS file system as FileSource")
+    case s.config.StagingFolder != "":
+        return errors.New("StagingFolder needs the OS file system as FileSource")
+    case s.config.SnapshotFolder != "" && s.config.SnapshotMode == SnapshotHardlink:
+        return errors.New("hard linked snapshots need the OS file system as FileSource, set SnapshotMode to copy")
+    }
+    return nil
+}
+
+// lstatFS is implemented by file systems with symbolic links
+type lstatFS interface {
+    Lstat(name string) (fs.FileInfo, error)
+}
+
+func (dir osFolder) join(op, name string) (string, error) {
+    if !fs.ValidPath(name) || runtime.GOOS == "windows" && strings.ContainsAny(name, `\:`) {
+        return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+    }
+    return filepath.Join(string(dir), filepath.FromSlash(name)), nil
+}
+
+func (dir osFolder) Open(name string) (fs.File, error) {
+    full, err := dir.join("open", name)
+    if err != nil {
+        return nil, err
+    }
+    return os.Open(full)
+}
+
+func (dir osFolder) Stat(name string) (fs.FileInfo, error) {
+    full, err := dir.join("stat", name)
+    if err != nil {
+        return nil, err
+    }
+    return os.Stat(full)
+}
+
+func (dir osFolder) Lstat(name string) (fs.FileInfo, error) {
+    full, err := dir.join("lstat", name)
+    if err != nil {
+        return nil, err
+    }
+    return os.Lstat(full)
+}
+
+func (dir osFolder) ReadDir(name string) ([]fs.DirEntry, error) {
+    full, err := dir.join("readdir", name)
+    if err != nil {
+        return nil, err
+    }
+    return os.ReadDir(full)
+}
+
+// fsName returns the fs.FS name of a "/"-rooted manifest or request path
+func fsName(p string) string {
+    if p = strings.Trim(p, "/"); p == "" {
+        return "."
+    }
+    return p
+}
+
+// open opens the file of e for data: its object after a rollback or
+// snapshot, otherwise the file in the channel's folder, or in the base
+// folder for files a locale overlay inherits
+func (ch *channel) open(data *DirData, e ManifestEntry) (fs.File, error) {
+    if data.ObjectDir != "" {
+        return os.Open(filepath.Join(data.ObjectDir, e.SHA256))
+    }
+    if e.inherited {
+        return ch.base.fsys.Open(fsName(e.Path))
+    }
+    return ch.fsys.Open(fsName(e.Path))
+}
+
+// stat describes the file of e for data, see open
+func (ch *channel) stat(data *DirData, e ManifestEntry) (fs.FileInfo, error) {
+    if data.ObjectDir != "" {
+        return os.Stat(filepath.Join(data.ObjectDir, e.SHA256))
+    }
+    if e.inherited {
+        return fs.Stat(ch.base.fsys, fsName(e.Path))
+    }
+    return fs.Stat(ch.fsys, fsName(e.Path))
+}
+
+// hash returns the hex encoded sha256 of the file of e for data
+func (ch *channel) hash(data *DirData, e ManifestEntry) (string, error) {
+    f, err := ch.open(data, e)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    return hashReader(f)
+}
+
+// sectionReader returns the bytes [off, off+n) of f, which must support
+// random access
+func sectionReader(f fs.File, off, n int64) (*io.SectionReader, error) {
+    ra, ok := f.(io.ReaderAt)
+    if !ok {
+        return nil, fmt.Errorf("%T does not implement io.ReaderAt", f)
+    }
+    return io.NewSectionReader(ra, off, n), nil
+}
+
+// hashFS returns the hex encoded sha256 of the "/"-rooted path in fsys
+func hashFS(fsys fs.FS, p string) (string, error) {
+    f, err := fsys.Open(fsName(p))
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    return hashReader(f)
+}
+
+func hashReader(r io.Reader) (string, error) {
+    h := sha256.New()
+    if _, err := io.Copy(h, r); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
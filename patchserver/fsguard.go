@@ -0,0 +1,67 @@
+package patchserver
+
+import (
+    "io/fs"
+    "net/http"
+    "path"
+    "strings"
+)
+
+// safePath rejects request paths that are not plain, visible file paths:
+// parent references, backslashes, NUL bytes, drive letters and
+// dot-prefixed segments (dotfiles and hidden folders)
+func safePath(p string) bool {
+    if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "\\\x00") {
+        return false
+    }
+    for _, seg := range strings.Split(p[1:], "/") {
+        if strings.HasPrefix(seg, ".") || isDrive(seg) {
+            return false
+        }
+    }
+    return true
+}
+
+// isDrive reports whether seg starts like a Windows drive ("C:")
+func isDrive(seg string) bool {
+    return len(seg) >= 2 && seg[1] == ':' && ('a' <= seg[0]|0x20 && seg[0]|0x20 <= 'z')
+}
+
+// viaLink reports whether the request path name in fsys goes through a
+// symbolic link or junction, which scans leave out unless SymlinkPolicy is
+// follow. File systems without links never do.
+func viaLink(fsys fs.FS, name string) bool {
+    links, ok := fsys.(lstatFS)
+    if !ok {
+        return false
+    }
+    p := ""
+    for _, seg := range strings.Split(strings.Trim(name, "/"), "/") {
+        if seg == "" {
+            continue
+        }
+        p = path.Join(p, seg)
+        info, err := links.Lstat(p)
+        if err != nil {
+            return false
+        }
+        if info.Mode()&(fs.ModeSymlink|fs.ModeIrregular) != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// guardFiles returns 404 for unsafe paths, for links the SymlinkPolicy
+// keeps out of manifests and, unless listing is enabled, for directories
+// that would be rendered as an index by http.FileServer
+func (s *Server) guardFiles(fsys fs.FS, listing bool, h http.Handler) http.Handler {
+    links := s.config.SymlinkPolicy == SymlinkSkip || s.config.SymlinkPolicy == SymlinkError
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !safePath(r.URL.Path) || (!listing && isListing(fsys, r.URL.Path)) || (links && viaLink(fsys, r.URL.Path)) {
+            http.NotFound(w, r)
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,146 @@
+package patchserver
+
+import (
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSafePath(t *testing.T) {
+    tests := []struct {
+        path string
+        want bool
+    }{
+        {"/", true},
+        {"/a.txt", true},
+        {"/dat/mhfdat.bin", true},
+        {"/a..b/c", true},
+        {"/..", false},
+        {"/../secret.txt", false},
+        {"/dat/../../secret.txt", false},
+        {"/...", false},
+        {"/dat\\..\\secret.txt", false},
+        {"/..\\secret.txt", false},
+        {"relative/a.txt", false},
+        {"", false},
+        {"/C:/Windows/win.ini", false},
+        {"/c:", false},
+        {"/dat/D:secret.txt", false},
+        {"/.env", false},
+        {"/.git/config", false},
+        {"/dat/.hidden/a.txt", false},
+        {"/a.txt\x00.png", false},
+    }
+    for _, tt := range tests {
+        if got := safePath(tt.path); got != tt.want {
+            t.Errorf("safePath(%q) = %v, want %v", tt.path, got, tt.want)
+        }
+    }
+}
+
+// guardRoot lays out root/game with a file, a dotfile and links escaping
+// to root/secret.txt, returning the game folder
+func guardRoot(t *testing.T) string {
+    t.Helper()
+    root := t.TempDir()
+    game := filepath.Join(root, "game")
+    for name, body := range map[string]string{
+        "secret.txt":         "secret",
+        "game/a.txt":         "game",
+        "game/.hidden":       "secret",
+        "game/.git/config":   "secret",
+        "game/dat/index.txt": "dat",
+    } {
+        file := filepath.Join(root, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(file, []byte(body), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.Symlink(filepath.Join(root, "secret.txt"), filepath.Join(game, "link.txt")); err != nil {
+        t.Skipf("cannot create symbolic links: %v", err)
+    }
+    if err := os.Symlink(root, filepath.Join(game, "up")); err != nil {
+        t.Fatal(err)
+    }
+    return game
+}
+
+func TestGuardFilesTraversal(t *testing.T) {
+    game := guardRoot(t)
+    h := New("").guardFiles(osFolder(game), false, http.FileServer(http.Dir(game)))
+    tests := []struct {
+        name, target string
+        path         string // set to bypass URL parsing
+        want         int
+    }{
+        {name: "plain", target: "/a.txt", want: http.StatusOK},
+        {name: "parent", target: "/x", path: "/../secret.txt", want: http.StatusNotFound},
+        {name: "nested parent", target: "/x", path: "/dat/../../secret.txt", want: http.StatusNotFound},
+        {name: "encoded parent", target: "/%2e%2e/secret.txt", want: http.StatusNotFound},
+        {name: "encoded slash", target: "/%2e%2e%2fsecret.txt", want: http.StatusNotFound},
+        {name: "mixed case encoding", target: "/%2E%2e/secret.txt", want: http.StatusNotFound},
+        {name: "backslash", target: "/..%5csecret.txt", want: http.StatusNotFound},
+        {name: "raw backslash", target: "/x", path: "/..\\secret.txt", want: http.StatusNotFound},
+        {name: "absolute", target: "/x", path: "//" + strings.TrimPrefix(filepath.ToSlash(filepath.Join(filepath.Dir(game), "secret.txt")), "/"), want: http.StatusNotFound},
+        {name: "relative", target: "/x", path: "secret.txt", want: http.StatusNotFound},
+        {name: "drive letter", target: "/C:/Windows/win.ini", want: http.StatusNotFound},
+        {name: "encoded drive letter", target: "/C%3a/Windows/win.ini", want: http.StatusNotFound},
+        {name: "dotfile", target: "/.hidden", want: http.StatusNotFound},
+        {name: "hidden folder", target: "/.git/config", want: http.StatusNotFound},
+        {name: "encoded dotfile", target: "/%2ehidden", want: http.StatusNotFound},
+        {name: "nul", target: "/a.txt%00", want: http.StatusNotFound},
+        {name: "listing", target: "/dat/", want: http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+            if tt.path != "" {
+                r.URL.Path = tt.path
+            }
+            w := httptest.NewRecorder()
+            h.ServeHTTP(w, r)
+            body, _ := io.ReadAll(w.Body)
+            if w.Code != tt.want {
+                t.Errorf("%s: status %d, want %d", r.URL.Path, w.Code, tt.want)
+            }
+            if strings.Contains(string(body), "secret") {
+                t.Errorf("%s: served %q from outside the game folder", r.URL.Path, body)
+            }
+        })
+    }
+}
+
+func TestGuardFilesSymlinks(t *testing.T) {
+    game := guardRoot(t)
+    tests := []struct {
+        policy, path string
+        want         int
+    }{
+        // follow serves what the scan put in the manifest, links included
+        {SymlinkFollow, "/link.txt", http.StatusOK},
+        {SymlinkFollow, "/up/secret.txt", http.StatusOK},
+        {SymlinkSkip, "/link.txt", http.StatusNotFound},
+        {SymlinkSkip, "/up/secret.txt", http.StatusNotFound},
+        {SymlinkSkip, "/up/game/a.txt", http.StatusNotFound},
+        {SymlinkSkip, "/a.txt", http.StatusOK},
+        {SymlinkError, "/link.txt", http.StatusNotFound},
+        {SymlinkError, "/up/secret.txt", http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        s := New("")
+        s.config.SymlinkPolicy = tt.policy
+        h := s.guardFiles(osFolder(game), false, http.FileServer(http.Dir(game)))
+        w := httptest.NewRecorder()
+        h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+        if w.Code != tt.want {
+            t.Errorf("SymlinkPolicy %s, %s: status %d, want %d", tt.policy, tt.path, w.Code, tt.want)
+        }
+    }
+}
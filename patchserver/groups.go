@@ -0,0 +1,211 @@
+package patchserver
+
+import (
+    "archive/zip"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// BaseGroup names the files that belong to no FileGroups entry
+const BaseGroup = "base"
+
+// DiffBundle is reserved for /bundle/diff/{fromEtag}, see diffBundleHandler
+const DiffBundle = "diff"
+
+// FileGroupConfig is a named set of files, e.g. an HD texture pack, that
+// launchers can offer separately. Patterns use the PriorityFile syntax;
+// a file belongs to the first group with a matching pattern.
+type FileGroupConfig struct {
+    Name        string   `json:"Name"`
+    Title       string   `json:"Title"`
+    Description string   `json:"Description"`
+    Patterns    []string `json:"Patterns"`
+    Optional    bool     `json:"Optional"`
+}
+
+// groupSummary is a group as listed in /check/v2
+type groupSummary struct {
+    Name        string `json:"name"`
+    Title       string `json:"title,omitempty"`
+    Description string `json:"description,omitempty"`
+    Optional    bool   `json:"optional"`
+    Files       int    `json:"files"`
+    Size        int64  `json:"size"`
+}
+
+var groupNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// groupOf returns the group of the manifest path p, "" for base files
+func (s *Server) groupOf(p string) string {
+    for _, g := range s.config.FileGroups {
+        for _, pattern := range g.Patterns {
+            if matchPattern(pattern, p) {
+                return g.Name
+            }
+        }
+    }
+    return ""
+}
+
+// groupSummaries counts the files and bytes of the base files and of every
+// configured group in entries
+func (s *Server) groupSummaries(entries []ManifestEntry) []groupSummary {
+    if len(s.config.FileGroups) == 0 {
+        return nil
+    }
+    summaries := []groupSummary{{Name: BaseGroup}}
+    index := map[string]int{"": 0}
+    for _, g := range s.config.FileGroups {
+        index[g.Name] = len(summaries)
+        summaries = append(summaries, groupSummary{Name: g.Name, Title: g.Title, Description: g.Description, Optional: g.Optional})
+    }
+    for _, e := range entries {
+        sum := &summaries[index[e.Group]]
+        sum.Files++
+        sum.Size += e.Size
+    }
+    return summaries
+}
+
+// parseGroups reads a comma separated list of group names, reporting
+// whether they are all known
+func (s *Server) parseGroups(list string) (map[string]bool, error) {
+    groups := map[string]bool{}
+    for _, name := range strings.Split(list, ",") {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            continue
+        }
+        if name != BaseGroup && !s.knownGroup(name) {
+            return nil, fmt.Errorf("unknown group %q", name)
+        }
+        groups[name] = true
+    }
+    if len(groups) == 0 {
+        return nil, fmt.Errorf("no group given")
+    }
+    return groups, nil
+}
+
+func (s *Server) knownGroup(name string) bool {
+    for _, g := range s.config.FileGroups {
+        if g.Name == name {
+            return true
+        }
+    }
+    return false
+}
+
+// groupEntries returns the entries of data in groups and the ETag of their
+// /check lines
+func groupEntries(data *DirData, groups map[string]bool) ([]ManifestEntry, []byte, string) {
+    var entries []ManifestEntry
+    var body []byte
+    for _, e := range data.Entries {
+        group := e.Group
+        if group == "" {
+            group = BaseGroup
+        }
+        if groups[group] {
+            entries = append(entries, e)
+            body = append(body, e.SHA256+"\t"+e.Path+"\n"...)
+        }
+    }
+    sum := sha256.Sum256(body)
+    return entries, body, fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:]))
+}
+
+// groupCheck serves /check?groups=a,b: the lines of the files in the listed
+// groups only, with their own ETag
+func (s *Server) groupCheck(w http.ResponseWriter, r *http.Request, ch *channel, data *DirData) {
+    groups, err := s.parseGroups(r.URL.Query().Get("groups"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    _, body, etag := groupEntries(data, groups)
+    if !ch.force.Load() && r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("ETag", etag)
+    w.Header().Set("X-Version-Base", versionBase(data))
+    w.WriteHeader(http.StatusOK)
+    w.Write(body)
+}
+
+// bundleHandler serves /bundle/{group}: every file of the group in one
+// uncompressed zip, for launchers installing an optional pack at once
+func (s *Server) bundleHandler(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/bundle/")
+    groups, err := s.parseGroups(name)
+    if err != nil || strings.Contains(name, ",") {
+        http.NotFound(w, r)
+        return
+    }
+    ch, data := s.manifestFor(r)
+    entries, _, etag := groupEntries(data, groups)
+    var size int64
+    for _, e := range entries {
+        size += e.Size
+    }
+    if !s.allowDownload(w, r, "/bundle/"+name, size) {
+        return
+    }
+    if r.Header.Get("If-None-Match") == etag {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    writeBundle(w, r, ch, data, name, etag, entries, nil)
+}
+
+// writeBundle streams entries of data as an uncompressed zip named
+// name.zip. Paths listed in deleted are stored, one per line, in a
+// ".deleted" member, which cannot clash with a game file as hidden files
+// are never in a manifest.
+func writeBundle(w http.ResponseWriter, r *http.Request, ch *channel, data *DirData, name, etag string, entries []ManifestEntry, deleted []string) {
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Content-Type", "application/zip")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".zip"))
+    if r.Method == http.MethodHead {
+        return
+    }
+    // on errors the zip is left without its central directory so clients
+    // see it is truncated
+    zw := zip.NewWriter(w)
+    for _, e := range entries {
+        f, err := ch.open(data, e)
+        if err != nil {
+            logRequest(r, "Bundle %s of %s: %v", name, ch.name, err)
+            return
+        }
+        fw, err := zw.CreateHeader(&zip.FileHeader{
+            Name:     strings.TrimPrefix(e.Path, "/"),
+            Method:   zip.Store,
+            Modified: time.Unix(e.ModTime, 0),
+        })
+        if err == nil {
+            _, err = io.Copy(fw, f)
+        }
+        f.Close()
+        if err != nil {
+            return
+        }
+    }
+    if len(deleted) > 0 {
+        fw, err := zw.CreateHeader(&zip.FileHeader{Name: ".deleted", Method: zip.Store, Modified: time.Now()})
+        if err != nil {
+            return
+        }
+        if _, err := io.WriteString(fw, strings.Join(deleted, "\n")+"\n"); err != nil {
+            return
+        }
+    }
+    zw.Close()
+}
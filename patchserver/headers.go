@@ -0,0 +1,110 @@
+package patchserver
+
+import (
+    "fmt"
+    "net/http"
+    "path"
+)
+
+// HeaderRule sets response headers of one server, patch or image (both
+// when empty), on the requests whose path matches Path, a PriorityFile
+// pattern (every path when empty). An empty value removes the header.
+type HeaderRule struct {
+    Server string            `json:"Server"`
+    Path   string            `json:"Path"`
+    Set    map[string]string `json:"Set"`
+}
+
+// validateHeaders checks Headers and HeaderRules, canonicalizing the
+// header names
+func validateHeaders(cfg *Config) []error {
+    var errs []error
+    canonical := func(where string, set map[string]string) map[string]string {
+        out := make(map[string]string, len(set))
+        for k, v := range set {
+            if k == "" {
+                errs = append(errs, fmt.Errorf("%s: empty header name", where))
+            }
+            out[http.CanonicalHeaderKey(k)] = v
+        }
+        return out
+    }
+    cfg.Headers = canonical("Headers", cfg.Headers)
+    for i := range cfg.HeaderRules {
+        rule := &cfg.HeaderRules[i]
+        where := fmt.Sprintf("HeaderRules[%d]", i)
+        if rule.Server != "" && rule.Server != "patch" && rule.Server != "image" {
+            errs = append(errs, fmt.Errorf("%s.Server must be patch, image or empty, got %q", where, rule.Server))
+        }
+        if _, err := path.Match(rule.Path, ""); err != nil {
+            errs = append(errs, fmt.Errorf("%s.Path: %w", where, err))
+        }
+        rule.Set = canonical(where+".Set", rule.Set)
+    }
+    return errs
+}
+
+// headerWriter applies the configured headers just before the response
+// headers are sent, so they override those set by the handlers
+type headerWriter struct {
+    http.ResponseWriter
+    set     []map[string]string
+    applied bool
+}
+
+func (w *headerWriter) apply() {
+    if w.applied {
+        return
+    }
+    w.applied = true
+    h := w.ResponseWriter.Header()
+    for _, set := range w.set {
+        for k, v := range set {
+            if v == "" {
+                h.Del(k)
+            } else {
+                h.Set(k, v)
+            }
+        }
+    }
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+    w.apply()
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+    w.apply()
+    return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
+
+// responseHeaders applies Headers and the HeaderRules of server to the
+// responses of h, later rules overriding earlier ones
+func (s *Server) responseHeaders(server string, h http.Handler) http.Handler {
+    var rules []HeaderRule
+    for _, rule := range s.config.HeaderRules {
+        if rule.Server == "" || rule.Server == server {
+            rules = append(rules, rule)
+        }
+    }
+    if len(s.config.Headers) == 0 && len(rules) == 0 {
+        return h
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        set := []map[string]string{s.config.Headers}
+        for _, rule := range rules {
+            if rule.Path == "" || matchPattern(rule.Path, r.URL.Path) {
+                set = append(set, rule.Set)
+            }
+        }
+        hw := &headerWriter{ResponseWriter: w, set: set}
+        h.ServeHTTP(hw, r)
+        // Nothing written yet: net/http sends the headers after this
+        hw.apply()
+    })
+}
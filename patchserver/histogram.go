@@ -0,0 +1,229 @@
+package patchserver
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Histogram labels
+const (
+    LabelEndpoint = "endpoint"
+    LabelTenant   = "tenant"
+    LabelStatus   = "status"
+)
+
+// HistogramConfig adds request latency and response size histograms to
+// /metrics. Labels picks which of endpoint, tenant and status (class, e.g.
+// 2xx) split them, all three by default; every series also has the server
+// (patch or image), and endpoints are a fixed set, so the series count
+// stays bounded by the tenants. DurationBuckets (seconds) and SizeBuckets
+// (bytes) override the defaults. Exemplars attach the trace or request ID
+// of a recent request to each bucket, sent to scrapers asking for
+// OpenMetrics.
+type HistogramConfig struct {
+    Enabled         bool      `json:"Enabled"`
+    Labels          []string  `json:"Labels"`
+    DurationBuckets []float64 `json:"DurationBuckets"`
+    SizeBuckets     []float64 `json:"SizeBuckets"`
+    Exemplars       bool      `json:"Exemplars"`
+}
+
+var (
+    // Patch downloads can take minutes, so the latency buckets go further
+    // than usual
+    defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+    // 1 KB to 4 GB in steps of 4
+    defaultSizeBuckets = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30, 1 << 32}
+)
+
+// validateHistograms checks and defaults the Histograms block
+func validateHistograms(h *HistogramConfig) []error {
+    var errs []error
+    if h.Labels == nil {
+        h.Labels = []string{LabelEndpoint, LabelTenant, LabelStatus}
+    }
+    for _, l := range h.Labels {
+        if l != LabelEndpoint && l != LabelTenant && l != LabelStatus {
+            errs = append(errs, fmt.Errorf("Histograms.Labels: unknown label %q, use %s, %s or %s", l, LabelEndpoint, LabelTenant, LabelStatus))
+        }
+    }
+    buckets := func(name string, b *[]float64, def []float64) {
+        if len(*b) == 0 {
+            *b = def
+            return
+        }
+        for i, v := range *b {
+            if v <= 0 || i > 0 && v <= (*b)[i-1] {
+                errs = append(errs, fmt.Errorf("Histograms.%s must be positive and increasing", name))
+                return
+            }
+        }
+    }
+    buckets("DurationBuckets", &h.DurationBuckets, defaultDurationBuckets)
+    buckets("SizeBuckets", &h.SizeBuckets, defaultSizeBuckets)
+    return errs
+}
+
+// exemplar is a sample kept for a bucket, labels already rendered
+type exemplar struct {
+    labels string
+    value  float64
+    time   time.Time
+}
+
+type histogramSeries struct {
+    labels    string
+    counts    []uint64 // per bucket, the last one +Inf
+    exemplars []exemplar
+    sum       float64
+    count     uint64
+}
+
+// histogram is a Prometheus histogram family with a series per label set
+type histogram struct {
+    name    string
+    help    string
+    buckets []float64
+    mu      sync.Mutex
+    series  map[string]*histogramSeries
+}
+
+func (s *Server) newHistogram(name, help string, buckets []float64) *histogram {
+    h := &histogram{name: name, help: help, buckets: buckets, series: map[string]*histogramSeries{}}
+    s.metricsMu.Lock()
+    defer s.metricsMu.Unlock()
+    s.metrics[name] = metric{name: name, help: help, kind: "histogram", write: h.write}
+    return h
+}
+
+// observe adds v to the series of labels, keeping ex as the exemplar of
+// its bucket when set
+func (h *histogram) observe(labels string, v float64, ex string) {
+    i := sort.SearchFloat64s(h.buckets, v)
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    s, ok := h.series[labels]
+    if !ok {
+        s = &histogramSeries{
+            labels:    labels,
+            counts:    make([]uint64, len(h.buckets)+1),
+            exemplars: make([]exemplar, len(h.buckets)+1),
+        }
+        h.series[labels] = s
+    }
+    s.counts[i]++
+    s.sum += v
+    s.count++
+    if ex != "" {
+        s.exemplars[i] = exemplar{labels: ex, value: v, time: time.Now()}
+    }
+}
+
+// write renders every series, with exemplars in OpenMetrics
+func (h *histogram) write(w io.Writer, openMetrics bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    keys := make([]string, 0, len(h.series))
+    for k := range h.series {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        s := h.series[k]
+        var total uint64
+        for i, n := range s.counts {
+            total += n
+            le := "+Inf"
+            if i < len(h.buckets) {
+                le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+            }
+            fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d", h.name, s.labels, le, total)
+            if ex := s.exemplars[i]; openMetrics && ex.labels != "" {
+                fmt.Fprintf(w, " # {%s} %g %.3f", ex.labels, ex.value, float64(ex.time.UnixNano())/1e9)
+            }
+            fmt.Fprintln(w)
+        }
+        fmt.Fprintf(w, "%s_sum{%s} %g\n%s_count{%s} %d\n", h.name, s.labels, s.sum, h.name, s.labels, s.count)
+    }
+}
+
+// histogramState holds the request histograms, see Histograms
+type histogramState struct {
+    requestDuration *histogram
+    responseSize    *histogram
+}
+
+// initHistograms registers the histograms when enabled
+func (s *Server) initHistograms() {
+    if !s.config.Histograms.Enabled {
+        return
+    }
+    s.requestDuration = s.newHistogram("patch_http_request_duration_seconds", "Time to serve requests, including the transfer", s.config.Histograms.DurationBuckets)
+    s.responseSize = s.newHistogram("patch_http_response_size_bytes", "Response body bytes sent", s.config.Histograms.SizeBuckets)
+}
+
+// prefixEndpoints are the endpoints named by their path prefix
+var prefixEndpoints = []string{"/admin/", "/chunks/", "/bundle/", "/v/", "/torrent/seed/"}
+
+// endpointOf names the endpoint of a request path of tenant t, so every
+// game file counts as "file" and the label values stay few
+func endpointOf(server string, t *tenant, p string) string {
+    if server == "image" {
+        return "image"
+    }
+    if first, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/"); ok {
+        if _, isChannel := t.channels[first]; isChannel {
+            p = "/" + rest
+        }
+    }
+    switch {
+    case lightPaths[p], p == "/metrics", p == "/healthz":
+        return p
+    }
+    for _, prefix := range prefixEndpoints {
+        if strings.HasPrefix(p, prefix) {
+            return prefix
+        }
+    }
+    return "file"
+}
+
+// exemplarLabels renders the exemplar of a request: its trace ID when it
+// has one, else the request ID unless it cannot be a label value as is
+func (s *Server) exemplarLabels(traceID, id string) string {
+    switch {
+    case !s.config.Histograms.Exemplars:
+        return ""
+    case traceID != "":
+        return `trace_id="` + traceID + `"`
+    case len(id) <= 64 && !strings.ContainsAny(id, `"\`):
+        return `request_id="` + id + `"`
+    }
+    return ""
+}
+
+// observeRequest records a finished request of server in the histograms.
+// exemplar is the rendered label set of its trace or request ID.
+func (s *Server) observeRequest(server string, r *http.Request, status int, bytes int64, elapsed time.Duration, exemplar string) {
+    t, tr := s.tenantFor(r)
+    labels := []string{`server="` + server + `"`}
+    for _, l := range s.config.Histograms.Labels {
+        switch l {
+        case LabelEndpoint:
+            labels = append(labels, `endpoint="`+endpointOf(server, t, tr.URL.Path)+`"`)
+        case LabelTenant:
+            labels = append(labels, `tenant="`+t.name+`"`)
+        case LabelStatus:
+            labels = append(labels, `status="`+strconv.Itoa(status/100)+`xx"`)
+        }
+    }
+    key := strings.Join(labels, ",")
+    s.requestDuration.observe(key, elapsed.Seconds(), exemplar)
+    s.responseSize.observe(key, float64(bytes), exemplar)
+}
@@ -0,0 +1,103 @@
+package patchserver
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "os/exec"
+    "strconv"
+    "time"
+)
+
+// Hook events
+const (
+    HookPrePublish  = "pre_publish"
+    HookPostPublish = "post_publish"
+    HookPostRescan  = "post_rescan"
+)
+
+// maxHookOutput caps the script output kept for the log
+const maxHookOutput = 4096
+
+// HookConfig runs an operator script on a manifest event. pre_publish
+// hooks run before a changed manifest goes live and a non-zero exit keeps
+// the previous one; post_publish and post_rescan hooks run in the
+// background afterwards. TimeoutSeconds defaults to 60.
+type HookConfig struct {
+    Event          string   `json:"Event"`
+    Command        string   `json:"Command"`
+    Args           []string `json:"Args"`
+    TimeoutSeconds int      `json:"TimeoutSeconds"`
+}
+
+// hookEnv describes a manifest of ch to hook scripts
+func hookEnv(event string, ch *channel, data, old *DirData) []string {
+    var total int64
+    for _, e := range data.Entries {
+        total += e.Size
+    }
+    previous := ""
+    if old != nil {
+        previous = versionID(old.ChecksumHeader)
+    }
+    changed := "0"
+    if previous != versionID(data.ChecksumHeader) {
+        changed = "1"
+    }
+    return append(os.Environ(),
+        "PATCH_EVENT="+event,
+        "PATCH_CHANNEL="+ch.name,
+        "PATCH_ROOT="+ch.root,
+        "PATCH_ETAG="+versionID(data.ChecksumHeader),
+        "PATCH_PREVIOUS_ETAG="+previous,
+        "PATCH_CHANGED="+changed,
+        "PATCH_FILES="+strconv.Itoa(len(data.Entries)),
+        "PATCH_BYTES="+strconv.FormatInt(total, 10),
+    )
+}
+
+// runHooks runs the hooks of event one after another, stopping at the
+// first failure, which it returns
+func (s *Server) runHooks(event string, ch *channel, data, old *DirData) error {
+    for _, hook := range s.config.Hooks {
+        if hook.Event != event {
+            continue
+        }
+        timeout := time.Duration(hook.TimeoutSeconds) * time.Second
+        if timeout == 0 {
+            timeout = time.Minute
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), timeout)
+        cmd := exec.CommandContext(ctx, hook.Command, hook.Args...)
+        cmd.Env = hookEnv(event, ch, data, old)
+        var out bytes.Buffer
+        cmd.Stdout = &out
+        cmd.Stderr = &out
+        err := cmd.Run()
+        cancel()
+        output := bytes.TrimSpace(out.Bytes())
+        if len(output) > maxHookOutput {
+            output = output[:maxHookOutput]
+        }
+        if err != nil {
+            log.Printf("Hook %s %s for %s failed: %v: %s", event, hook.Command, ch.name, err, output)
+            return fmt.Errorf("%s hook %s: %w", event, hook.Command, err)
+        }
+        if len(output) > 0 {
+            log.Printf("Hook %s %s for %s: %s", event, hook.Command, ch.name, output)
+        }
+    }
+    return nil
+}
+
+// hasHooks reports whether any hook listens to event
+func (s *Server) hasHooks(event string) bool {
+    for _, hook := range s.config.Hooks {
+        if hook.Event == event {
+            return true
+        }
+    }
+    return false
+}
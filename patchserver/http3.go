@@ -0,0 +1,120 @@
+package patchserver
+
+import (
+    "crypto/tls"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/quic-go/quic-go"
+    "github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long clients may remember the HTTP/3 endpoints
+const altSvcMaxAge = 24 * time.Hour
+
+// certReloadInterval is how often TLSCertFile is checked for a renewal
+const certReloadInterval = time.Minute
+
+// certLoader serves TLSCertFile and TLSKeyFile, reloading them when the
+// certificate file changes so a renewal needs no restart
+type certLoader struct {
+    mu      sync.Mutex
+    cert    *tls.Certificate
+    modTime time.Time
+    checked time.Time
+}
+
+// http3State holds the TLS certificate shared by HTTPS and HTTP/3
+type http3State struct {
+    certs certLoader
+}
+
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    c := &s.certs
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.cert != nil && time.Since(c.checked) < certReloadInterval {
+        return c.cert, nil
+    }
+    c.checked = time.Now()
+    info, err := os.Stat(s.config.TLSCertFile)
+    if err == nil && c.cert != nil && info.ModTime().Equal(c.modTime) {
+        return c.cert, nil
+    }
+    cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+    if err != nil {
+        if c.cert != nil {
+            log.Printf("Reloading TLS certificate: %v, keeping the previous one", err)
+            return c.cert, nil
+        }
+        return nil, err
+    }
+    if info != nil {
+        c.modTime = info.ModTime()
+    }
+    c.cert = &cert
+    return c.cert, nil
+}
+
+// altSvc advertises the HTTP/3 listeners addrs on the responses of h so
+// clients can switch to QUIC for their next requests
+func altSvc(addrs []string, h http.Handler) http.Handler {
+    if len(addrs) == 0 {
+        return h
+    }
+    var services []string
+    seen := map[string]bool{}
+    for _, addr := range addrs {
+        _, port, _ := net.SplitHostPort(addr)
+        if !seen[port] {
+            seen[port] = true
+            services = append(services, fmt.Sprintf(`h3=":%s"; ma=%d`, port, int(altSvcMaxAge.Seconds())))
+        }
+    }
+    value := strings.Join(services, ", ")
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Alt-Svc", value)
+        h.ServeHTTP(w, r)
+    })
+}
+
+// superviseHTTP3 serves h over HTTP/3 on the UDP addresses addrs
+func (s *Server) superviseHTTP3(name string, addrs []string, h http.Handler) {
+    for _, addr := range addrs {
+        sl := &supervisedListener{name: name + "-h3", addr: addr}
+        s.trackListener(sl)
+        go s.runHTTP3(sl, h)
+    }
+}
+
+func (s *Server) runHTTP3(sl *supervisedListener, h http.Handler) {
+    backoff := time.Second
+    for {
+        conn, err := net.ListenPacket("udp", sl.addr)
+        if err != nil {
+            log.Printf("%s server on %s: %v, retrying in %s", sl.name, sl.addr, err, backoff)
+            time.Sleep(backoff)
+            backoff = min(backoff*2, listenRetryMax)
+            continue
+        }
+        backoff = time.Second
+        srv := &http3.Server{
+            Handler:    h,
+            TLSConfig:  &tls.Config{GetCertificate: s.getCertificate},
+            QUICConfig: &quic.Config{MaxIdleTimeout: time.Duration(s.config.IdleTimeoutSeconds) * time.Second},
+        }
+        sl.up.Store(true)
+        log.Printf("Starting %s server on udp %s", sl.name, conn.LocalAddr())
+        err = srv.Serve(conn)
+        sl.up.Store(false)
+        conn.Close()
+        log.Printf("%s server on %s stopped: %v, rebinding in %s", sl.name, sl.addr, err, backoff)
+        time.Sleep(backoff)
+    }
+}
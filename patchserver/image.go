@@ -0,0 +1,92 @@
+package patchserver
+
+import (
+    "io/fs"
+    "net/http"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// isListing reports whether name resolves to a directory under root that
+// http.FileServer would render as an index (no index.html inside)
+func isListing(fsys fs.FS, name string) bool {
+    dir := fsName(path.Clean("/" + name))
+    info, err := fs.Stat(fsys, dir)
+    if err != nil || !info.IsDir() {
+        return false
+    }
+    _, err = fs.Stat(fsys, path.Join(dir, "index.html"))
+    return err != nil
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for origin
+func (s *Server) corsOrigin(origin string) string {
+    for _, allowed := range s.config.ImageCORSOrigins {
+        if allowed == "*" {
+            return "*"
+        }
+        if strings.EqualFold(allowed, origin) {
+            return origin
+        }
+    }
+    return ""
+}
+
+// imageServerEnabled reports whether the image server runs; ImagePort 0
+// without ImageListen turns it off
+func (s *Server) imageServerEnabled() bool {
+    return s.config.ImagePort != 0 || len(s.config.ImageListen) > 0
+}
+
+// imageHandler serves ImageFolder applying the Content-Type overrides,
+// cache policy, CORS and directory listing settings, and the resized or
+// converted variants asked for with ImageVariants
+func (s *Server) imageHandler(root string) http.Handler {
+    files := s.guardFiles(osFolderOf(root), s.config.ImageDirListing, http.FileServer(http.Dir(root)))
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if origin := r.Header.Get("Origin"); origin != "" {
+            if allow := s.corsOrigin(origin); allow != "" {
+                w.Header().Set("Access-Control-Allow-Origin", allow)
+                w.Header().Add("Vary", "Origin")
+                if r.Method == http.MethodOptions {
+                    w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+                    w.WriteHeader(http.StatusNoContent)
+                    return
+                }
+            }
+        }
+        variant, isVariant, err := s.parseVariant(r)
+        isVariant = isVariant && s.config.ImageVariants
+        if isVariant && err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if isVariant && !safePath(r.URL.Path) {
+            http.NotFound(w, r)
+            return
+        }
+        ext := strings.ToLower(path.Ext(r.URL.Path))
+        if ct, ok := s.config.ImageContentTypes[ext]; ok && !isVariant {
+            w.Header().Set("Content-Type", ct)
+        }
+        maxAge, ok := s.config.ImageCacheMaxAge[ext]
+        if !ok {
+            maxAge, ok = s.config.ImageCacheMaxAge["*"]
+        }
+        if ok {
+            if maxAge > 0 {
+                w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+                w.Header().Set("Expires", time.Now().Add(time.Duration(maxAge)*time.Second).UTC().Format(http.TimeFormat))
+            } else {
+                w.Header().Set("Cache-Control", "no-cache")
+            }
+        }
+        if isVariant {
+            s.serveVariant(w, r, root, r.URL.Path, variant)
+            return
+        }
+        files.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,313 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// imagePruneInterval is how often ImageMaxAgeDays and ImageMaxTotalMB are
+// enforced
+const imagePruneInterval = time.Hour
+
+// imageStoreState serialises uploads, deletions and pruning of image
+// folders so quota checks see a stable total
+type imageStoreState struct {
+    imagesMu sync.Mutex
+}
+
+type imageFile struct {
+    Path    string `json:"path"`
+    Size    int64  `json:"size"`
+    ModTime int64  `json:"mtime"`
+}
+
+// ImageUsage is the storage report of one tenant's ImageFolder
+type ImageUsage struct {
+    Tenant     string     `json:"tenant"`
+    Files      int        `json:"files"`
+    Bytes      int64      `json:"bytes"`
+    QuotaBytes int64      `json:"quota_bytes,omitempty"`
+    Oldest     *imageFile `json:"oldest,omitempty"`
+    Newest     *imageFile `json:"newest,omitempty"`
+}
+
+// imageFiles lists the visible files of root, oldest first
+func imageFiles(root string) ([]imageFile, error) {
+    var files []imageFile
+    err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if p != root && strings.HasPrefix(d.Name(), ".") {
+            if d.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if d.IsDir() {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        files = append(files, imageFile{relPath(root, p), info.Size(), info.ModTime().Unix()})
+        return nil
+    })
+    sort.SliceStable(files, func(i, j int) bool { return files[i].ModTime < files[j].ModTime })
+    return files, err
+}
+
+func imageUsage(t *tenant) (ImageUsage, error) {
+    files, err := imageFiles(t.imageFolder)
+    if err != nil {
+        return ImageUsage{}, err
+    }
+    u := ImageUsage{Tenant: t.name, Files: len(files), QuotaBytes: t.imageQuota}
+    for _, f := range files {
+        u.Bytes += f.Size
+    }
+    if len(files) > 0 {
+        u.Oldest, u.Newest = &files[0], &files[len(files)-1]
+    }
+    return u, nil
+}
+
+// pruneImages removes the images of t older than ImageMaxAgeDays, then the
+// oldest ones until the folder fits ImageMaxTotalMB, returning what it
+// removed
+func (s *Server) pruneImages(t *tenant) ([]string, error) {
+    s.imagesMu.Lock()
+    defer s.imagesMu.Unlock()
+    files, err := imageFiles(t.imageFolder)
+    if err != nil {
+        return nil, err
+    }
+    var total int64
+    for _, f := range files {
+        total += f.Size
+    }
+    cutoff := time.Now().AddDate(0, 0, -s.config.ImageMaxAgeDays).Unix()
+    maxTotal := int64(s.config.ImageMaxTotalMB) << 20
+    var removed []string
+    for _, f := range files {
+        expired := s.config.ImageMaxAgeDays > 0 && f.ModTime < cutoff
+        over := maxTotal > 0 && total > maxTotal
+        if !expired && !over {
+            break
+        }
+        if err := os.Remove(filepath.Join(t.imageFolder, filepath.FromSlash(f.Path))); err != nil {
+            return removed, err
+        }
+        total -= f.Size
+        removed = append(removed, f.Path)
+    }
+    return removed, nil
+}
+
+// pruneImagesLoop applies the image retention policies to every tenant
+func (s *Server) pruneImagesLoop() {
+    for {
+        for _, t := range s.allTenants() {
+            removed, err := s.pruneImages(t)
+            if len(removed) > 0 || err != nil {
+                s.audit("prune", "image_prune", t.name, fmt.Sprintf("%d files", len(removed)), err)
+            }
+            if err != nil {
+                log.Printf("Pruning images of %s: %v", t.name, err)
+            }
+        }
+        time.Sleep(imagePruneInterval)
+    }
+}
+
+// adminTenant resolves the tenant query parameter, defaulting to the
+// default tenant
+func (s *Server) adminTenant(w http.ResponseWriter, r *http.Request) (*tenant, bool) {
+    name := r.URL.Query().Get("tenant")
+    if name == "" || name == DefaultTenantName {
+        return s.defaultTenant, true
+    }
+    t, ok := s.tenants[name]
+    if !ok {
+        http.Error(w, "unknown tenant", http.StatusNotFound)
+    }
+    return t, ok
+}
+
+// adminImageUsageHandler reports the image storage of one tenant, or of
+// all of them without a tenant parameter
+func (s *Server) adminImageUsageHandler(w http.ResponseWriter, r *http.Request) {
+    list := s.allTenants()
+    if r.URL.Query().Has("tenant") {
+        t, ok := s.adminTenant(w, r)
+        if !ok {
+            return
+        }
+        list = []*tenant{t}
+    }
+    usage := []ImageUsage{}
+    for _, t := range list {
+        u, err := imageUsage(t)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        usage = append(usage, u)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
+
+// adminImagePruneHandler applies the retention policies to a tenant now
+func (s *Server) adminImagePruneHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    t, ok := s.adminTenant(w, r)
+    if !ok {
+        return
+    }
+    removed, err := s.pruneImages(t)
+    s.audit(adminActor(r), "image_prune", t.name, fmt.Sprintf("%d files", len(removed)), err)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"tenant": t.name, "removed": append([]string{}, removed...)})
+}
+
+// errQuota is returned when an upload would exceed the tenant's quota
+var errQuota = errors.New("image quota exceeded")
+
+// adminImageFileHandler stores the body of a PUT at
+// /admin/images/files/{path} in the tenant's ImageFolder, within its
+// quota, and removes the file on DELETE
+func (s *Server) adminImageFileHandler(w http.ResponseWriter, r *http.Request) {
+    t, ok := s.adminTenant(w, r)
+    if !ok {
+        return
+    }
+    p := "/" + strings.TrimPrefix(r.URL.Path, "/admin/images/files/")
+    if p == "/" || !safePath(p) || path.Clean(p) != p {
+        http.Error(w, "invalid path", http.StatusBadRequest)
+        return
+    }
+    file := filepath.Join(t.imageFolder, filepath.FromSlash(p))
+    var err error
+    switch r.Method {
+    case http.MethodPut:
+        err = s.storeImage(t, file, r.Body)
+        s.audit(adminActor(r), "image_upload", t.name, p, err)
+    case http.MethodDelete:
+        s.imagesMu.Lock()
+        err = os.Remove(file)
+        s.imagesMu.Unlock()
+        s.audit(adminActor(r), "image_delete", t.name, p, err)
+    default:
+        w.Header().Set("Allow", "PUT, DELETE")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    switch {
+    case errors.Is(err, errQuota):
+        http.Error(w, err.Error(), http.StatusInsufficientStorage)
+    case errors.Is(err, fs.ErrNotExist):
+        http.NotFound(w, r)
+    case err != nil:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    default:
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+// storeImage writes body to file through a temporary file, failing with
+// errQuota when the folder would outgrow the tenant's quota. The file it
+// replaces does not count against the quota. The upload is received
+// without imagesMu, which is only held to check the quota again and move
+// the file in place, so a slow upload does not hold up the others.
+func (s *Server) storeImage(t *tenant, file string, body io.Reader) error {
+    var room int64 = -1
+    if t.imageQuota > 0 {
+        var err error
+        if room, err = imageRoom(t, file); err != nil {
+            return err
+        }
+        body = io.LimitReader(body, room+1)
+    }
+    if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    n, err := io.Copy(tmp, body)
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    if room >= 0 && n > room {
+        return errQuota
+    }
+    s.imagesMu.Lock()
+    defer s.imagesMu.Unlock()
+    if t.imageQuota > 0 {
+        // Other uploads may have used the room meanwhile
+        if room, err = imageRoom(t, file); err != nil {
+            return err
+        }
+        if n > room {
+            return errQuota
+        }
+    }
+    return os.Rename(tmp.Name(), file)
+}
+
+// imageRoom returns the bytes t may still store in file, counting the
+// file it would replace as free
+func imageRoom(t *tenant, file string) (int64, error) {
+    u, err := imageUsage(t)
+    if err != nil {
+        return 0, err
+    }
+    room := t.imageQuota - u.Bytes
+    if info, err := os.Stat(file); err == nil {
+        room += info.Size()
+    }
+    return room, nil
+}
+
+// requireImages answers 404 while the image server is disabled
+func (s *Server) requireImages(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !s.imageServerEnabled() {
+            http.Error(w, "the image server is disabled", http.StatusNotFound)
+            return
+        }
+        h(w, r)
+    }
+}
+
+// registerImageStore adds the image admin endpoints
+func (s *Server) registerImageStore() {
+    s.adminMux.HandleFunc("/admin/images/usage", s.requireImages(s.adminImageUsageHandler))
+    s.adminMux.HandleFunc("/admin/images/prune", s.requireImages(s.adminImagePruneHandler))
+    s.adminMux.HandleFunc("/admin/images/files/", s.requireImages(s.adminImageFileHandler))
+}
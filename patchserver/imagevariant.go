@@ -0,0 +1,310 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "image"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
+    "io/fs"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "golang.org/x/image/draw"
+    _ "golang.org/x/image/webp"
+)
+
+// variantFolder holds the generated variants inside each image folder.
+// Being dot-prefixed it is neither served, listed nor counted as an image.
+const variantFolder = ".variants"
+
+// maxVariantSourcePixels refuses to decode larger sources
+const maxVariantSourcePixels = 64 << 20
+
+// variantPruneInterval is how often the variant caches are trimmed to
+// ImageVariantCacheMB
+const variantPruneInterval = 10 * time.Minute
+
+var variantTypes = map[string]string{
+    "png":  "image/png",
+    "jpeg": "image/jpeg",
+    "webp": "image/webp",
+}
+
+// variantState tracks the image variants being built
+type variantState struct {
+    // variantSlots bounds the concurrent decodes and encodes
+    variantSlots     chan struct{}
+    variantsMu       sync.Mutex
+    variantsPending  map[string]chan struct{}
+    variantsBuilt    atomic.Int64
+    variantsCacheHit atomic.Int64
+}
+
+// imageVariant is a resize and format conversion requested with ?w=, ?h=
+// and ?fmt=
+type imageVariant struct {
+    width, height int    // bounding box, 0 to follow the other side
+    format        string // png, jpeg or webp; empty keeps the source format
+}
+
+// parseVariant reads the variant query of r, returning ok false when r
+// asks for the original file
+func (s *Server) parseVariant(r *http.Request) (v imageVariant, ok bool, err error) {
+    q := r.URL.Query()
+    if !q.Has("w") && !q.Has("h") && !q.Has("fmt") {
+        return v, false, nil
+    }
+    side := func(name string) (int, error) {
+        text := q.Get(name)
+        if text == "" {
+            return 0, nil
+        }
+        n, err := strconv.Atoi(text)
+        if err != nil || n < 1 || n > s.config.ImageVariantMaxPx {
+            return 0, fmt.Errorf("%s must be between 1 and %d", name, s.config.ImageVariantMaxPx)
+        }
+        return n, nil
+    }
+    if v.width, err = side("w"); err != nil {
+        return v, true, err
+    }
+    if v.height, err = side("h"); err != nil {
+        return v, true, err
+    }
+    v.format = strings.ToLower(q.Get("fmt"))
+    if v.format == "jpg" {
+        v.format = "jpeg"
+    }
+    if _, known := variantTypes[v.format]; v.format != "" && !known {
+        return v, true, errors.New("fmt must be png, jpeg or webp")
+    }
+    return v, true, nil
+}
+
+// serveVariant serves the variant v of the image at name in root,
+// generating and caching it on first use
+func (s *Server) serveVariant(w http.ResponseWriter, r *http.Request, root, name string, v imageVariant) {
+    src := filepath.Join(root, filepath.FromSlash(path.Clean("/"+name)))
+    info, err := os.Stat(src)
+    if err != nil || info.IsDir() {
+        http.NotFound(w, r)
+        return
+    }
+    format := v.format
+    if format == "" {
+        format = strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+        if format == "jpg" {
+            format = "jpeg"
+        }
+        if _, known := variantTypes[format]; !known {
+            format = "png"
+        }
+    }
+    sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d\x00%d\x00%s", name, info.Size(), info.ModTime().UnixNano(), v.width, v.height, format)))
+    key := hex.EncodeToString(sum[:16])
+    cached := filepath.Join(root, variantFolder, key+"."+format)
+
+    if err := s.buildVariant(src, cached, key, v.width, v.height, format); err != nil {
+        if errors.Is(err, image.ErrFormat) {
+            http.Error(w, "not an image", http.StatusUnsupportedMediaType)
+            return
+        }
+        logRequest(r, "Image variant of %s: %v", name, err)
+        http.Error(w, "cannot convert image", http.StatusUnprocessableEntity)
+        return
+    }
+    f, err := os.Open(cached)
+    if err != nil {
+        http.Error(w, "variant unavailable", http.StatusInternalServerError)
+        return
+    }
+    defer f.Close()
+    now := time.Now()
+    os.Chtimes(cached, now, now) // keeps it recent for pruneVariants
+    w.Header().Set("Content-Type", variantTypes[format])
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// buildVariant writes the variant to dst unless it already exists. Requests
+// for the same variant wait for the first one instead of converting again.
+func (s *Server) buildVariant(src, dst, key string, width, height int, format string) error {
+    for {
+        if _, err := os.Stat(dst); err == nil {
+            s.variantsCacheHit.Add(1)
+            return nil
+        }
+        s.variantsMu.Lock()
+        wait, busy := s.variantsPending[key]
+        if !busy {
+            s.variantsPending[key] = make(chan struct{})
+        }
+        s.variantsMu.Unlock()
+        if !busy {
+            break
+        }
+        <-wait
+        if _, err := os.Stat(dst); err != nil {
+            return errors.New("conversion failed")
+        }
+    }
+    defer func() {
+        s.variantsMu.Lock()
+        close(s.variantsPending[key])
+        delete(s.variantsPending, key)
+        s.variantsMu.Unlock()
+    }()
+    s.variantSlots <- struct{}{}
+    defer func() { <-s.variantSlots }()
+
+    f, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    cfg, _, err := image.DecodeConfig(f)
+    if err != nil {
+        return err
+    }
+    if cfg.Width*cfg.Height > maxVariantSourcePixels {
+        return fmt.Errorf("source is %dx%d, too large to convert", cfg.Width, cfg.Height)
+    }
+    if _, err := f.Seek(0, 0); err != nil {
+        return err
+    }
+    img, _, err := image.Decode(f)
+    if err != nil {
+        return err
+    }
+    img = scaleToFit(img, width, height)
+
+    if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+    if err != nil {
+        return err
+    }
+    switch format {
+    case "png":
+        err = png.Encode(tmp, img)
+    case "jpeg":
+        err = jpeg.Encode(tmp, img, &jpeg.Options{Quality: 85})
+    case "webp":
+        err = encodeWebP(tmp, img)
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp.Name(), dst)
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    s.variantsBuilt.Add(1)
+    return nil
+}
+
+// scaleToFit shrinks img to fit width x height keeping its aspect ratio; a
+// zero side follows the other one. Images are never enlarged.
+func scaleToFit(img image.Image, width, height int) image.Image {
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    scale := 1.0
+    if width > 0 && width < w {
+        scale = float64(width) / float64(w)
+    }
+    if height > 0 && float64(height) < float64(h)*scale {
+        scale = float64(height) / float64(h)
+    }
+    if scale == 1 {
+        return img
+    }
+    dst := image.NewNRGBA(image.Rect(0, 0, max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))))
+    draw.CatmullRom.Scale(dst, dst.Rect, img, b, draw.Src, nil)
+    return dst
+}
+
+// pruneVariants removes the least recently served variants of root until
+// they fit ImageVariantCacheMB
+func (s *Server) pruneVariants(root string) (int, error) {
+    type variant struct {
+        path    string
+        size    int64
+        modTime time.Time
+    }
+    var list []variant
+    var total int64
+    dir := filepath.Join(root, variantFolder)
+    err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            if errors.Is(err, fs.ErrNotExist) {
+                return nil
+            }
+            return err
+        }
+        if d.IsDir() {
+            return nil
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        list = append(list, variant{p, info.Size(), info.ModTime()})
+        total += info.Size()
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].modTime.Before(list[j].modTime) })
+    limit := int64(s.config.ImageVariantCacheMB) << 20
+    removed := 0
+    for _, v := range list {
+        if total <= limit {
+            break
+        }
+        if err := os.Remove(v.path); err != nil {
+            return removed, err
+        }
+        total -= v.size
+        removed++
+    }
+    return removed, nil
+}
+
+func (s *Server) pruneVariantsLoop() {
+    for {
+        for _, t := range s.allTenants() {
+            if _, err := s.pruneVariants(t.imageFolder); err != nil {
+                log.Printf("Pruning image variants of %s: %v", t.name, err)
+            }
+        }
+        time.Sleep(variantPruneInterval)
+    }
+}
+
+// registerImageVariants adds the variant build and cache hit counters
+func (s *Server) registerImageVariants() {
+    s.registerMetric("patch_image_variants_built_total", "counter", "Image variants resized or converted", func() float64 {
+        return float64(s.variantsBuilt.Load())
+    })
+    s.registerMetric("patch_image_variants_cache_hits_total", "counter", "Image variant requests served from the variant cache", func() float64 {
+        return float64(s.variantsCacheHit.Load())
+    })
+}
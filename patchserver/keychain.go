@@ -0,0 +1,385 @@
+package patchserver
+
+import (
+    "crypto/ed25519"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// SigningKeyConfig is a manifest signing key (a genkey .key file) with the
+// certificate issued for it by `patchserver certify`
+type SigningKeyConfig struct {
+    KeyFile  string `json:"KeyFile"`
+    CertFile string `json:"CertFile"`
+}
+
+// KeyCertificate vouches, with a root key embedded in launchers, for an
+// online signing key during [NotBefore, Expires)
+type KeyCertificate struct {
+    KeyID     string `json:"key_id"`
+    PublicKey string `json:"public_key"`
+    NotBefore int64  `json:"not_before"`
+    Expires   int64  `json:"expires"`
+    RootID    string `json:"root_id"`
+    Signature string `json:"signature"`
+}
+
+// RevocationList names the signing keys a root key no longer trusts.
+// Launchers keep the highest Serial they verified and ignore older lists.
+type RevocationList struct {
+    Serial    int64    `json:"serial"`
+    Issued    int64    `json:"issued"`
+    Revoked   []string `json:"revoked"`
+    RootID    string   `json:"root_id"`
+    Signature string   `json:"signature"`
+}
+
+// keyID names a public key by the first 8 bytes of its SHA-256
+func keyID(pub ed25519.PublicKey) string {
+    sum := sha256.Sum256(pub)
+    return hex.EncodeToString(sum[:8])
+}
+
+// signedPayload is what a root key signs for a certificate
+func (c *KeyCertificate) signedPayload() []byte {
+    return []byte(fmt.Sprintf("mhf-patch-key-cert\n%s\n%s\n%d\n%d", c.KeyID, c.PublicKey, c.NotBefore, c.Expires))
+}
+
+// signedPayload is what a root key signs for a revocation list
+func (l *RevocationList) signedPayload() []byte {
+    return []byte(fmt.Sprintf("mhf-patch-revocations\n%d\n%d\n%s", l.Serial, l.Issued, strings.Join(l.Revoked, ",")))
+}
+
+// verifyRoot checks sig over payload against the root key rootID out of
+// roots, base64 public keys
+func verifyRoot(roots []string, rootID, sig string, payload []byte) error {
+    raw, err := base64.StdEncoding.DecodeString(sig)
+    if err != nil {
+        return fmt.Errorf("signature: %w", err)
+    }
+    for _, r := range roots {
+        pub, err := base64.StdEncoding.DecodeString(r)
+        if err != nil || len(pub) != ed25519.PublicKeySize || keyID(pub) != rootID {
+            continue
+        }
+        if ed25519.Verify(pub, payload, raw) {
+            return nil
+        }
+        return errors.New("bad signature")
+    }
+    return fmt.Errorf("root key %s is not in RootKeys", rootID)
+}
+
+func readJSONFile(path string, v any) error {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(data, v); err != nil {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+    return nil
+}
+
+func writeJSONFile(path string, v any, mode os.FileMode) error {
+    data, err := json.MarshalIndent(v, "", "    ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, append(data, '\n'), mode)
+}
+
+// signer is a loaded manifest signing key
+type signer struct {
+    id   string
+    key  ed25519.PrivateKey
+    cert *KeyCertificate // nil for a SigningKeyFile without SigningCertFile
+}
+
+// validAt reports whether the certificate of sg, if any, is valid at the
+// unix time now
+func (sg *signer) validAt(now int64) bool {
+    return sg.cert == nil || sg.cert.NotBefore <= now && now < sg.cert.Expires
+}
+
+// keychainState holds the manifest signing keys
+type keychainState struct {
+    // signers holds every key that is not revoked or already expired at
+    // startup; only those valid at the time sign, see usableSigners
+    signers []*signer
+    // revocations is the RevocationFile as served at /keys, nil without one
+    revocations *RevocationList
+}
+
+// loadSigners loads SigningKeyFile and SigningKeys with their certificates
+// and the revocation list, checking them against RootKeys when set. Keys
+// that are revoked or whose certificate expired are left out with a
+// warning rather than failing startup, so an expired key never takes the
+// patch server down. A key certified from a later date is kept and signs
+// from then on.
+func (s *Server) loadSigners() error {
+    s.signers = nil
+    s.revocations = nil
+    list := s.config.SigningKeys
+    if s.config.SigningKeyFile != "" {
+        list = append([]SigningKeyConfig{{s.config.SigningKeyFile, s.config.SigningCertFile}}, list...)
+    }
+    if s.config.RevocationFile != "" {
+        s.revocations = new(RevocationList)
+        if err := readJSONFile(s.config.RevocationFile, s.revocations); err != nil {
+            return err
+        }
+        if len(s.config.RootKeys) > 0 {
+            if err := verifyRoot(s.config.RootKeys, s.revocations.RootID, s.revocations.Signature, s.revocations.signedPayload()); err != nil {
+                return fmt.Errorf("%s: %w", s.config.RevocationFile, err)
+            }
+        }
+    }
+    now := time.Now().Unix()
+    for _, k := range list {
+        key, err := loadSigningKey(k.KeyFile)
+        if err != nil {
+            return err
+        }
+        sg := &signer{id: keyID(key.Public().(ed25519.PublicKey)), key: key}
+        if k.CertFile != "" {
+            sg.cert = new(KeyCertificate)
+            if err := readJSONFile(k.CertFile, sg.cert); err != nil {
+                return err
+            }
+            if sg.cert.KeyID != sg.id {
+                return fmt.Errorf("%s certifies key %s, not %s from %s", k.CertFile, sg.cert.KeyID, sg.id, k.KeyFile)
+            }
+            if len(s.config.RootKeys) > 0 {
+                if err := verifyRoot(s.config.RootKeys, sg.cert.RootID, sg.cert.Signature, sg.cert.signedPayload()); err != nil {
+                    return fmt.Errorf("%s: %w", k.CertFile, err)
+                }
+            }
+            if now >= sg.cert.Expires {
+                log.Printf("Warning: signing key %s expired on %s, not using it", sg.id, time.Unix(sg.cert.Expires, 0).Format(time.DateOnly))
+                continue
+            }
+            if now < sg.cert.NotBefore {
+                log.Printf("Signing key %s is certified from %s, signing with it from then", sg.id, time.Unix(sg.cert.NotBefore, 0).Format(time.DateTime))
+            }
+        }
+        if s.revocations != nil && containsString(s.revocations.Revoked, sg.id) {
+            log.Printf("Warning: signing key %s is revoked, not using it", sg.id)
+            continue
+        }
+        s.signers = append(s.signers, sg)
+    }
+    if len(list) > 0 && len(s.signers) == 0 {
+        log.Printf("Warning: no usable signing key, manifests are served unsigned")
+    }
+    return nil
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// manifestSignature is one entry of /check.sigs
+type manifestSignature struct {
+    KeyID     string `json:"key_id"`
+    Signature string `json:"signature"`
+}
+
+// usableSigners returns the signing keys whose certificate is valid now
+func (s *Server) usableSigners() []*signer {
+    now := time.Now().Unix()
+    var out []*signer
+    for _, sg := range s.signers {
+        if sg.validAt(now) {
+            out = append(out, sg)
+        }
+    }
+    return out
+}
+
+// signatureCache holds the signatures of a manifest by the signing keys
+// that made them
+type signatureCache struct {
+    mu   sync.Mutex
+    done bool
+    keys string // IDs of the keys, comma separated
+    sig  []byte
+    sigs []byte
+}
+
+// signatures returns the /check.sig and /check.sigs bodies of data, signed
+// by the keys valid now. They are signed again once a certificate expires
+// or starts, so a key rotation needs no restart. Without signing keys, an
+// edge serves the origin's signatures.
+func (s *Server) signatures(data *DirData) (sig, sigs []byte) {
+    if len(s.signers) == 0 || data.signed == nil {
+        return data.Signature, data.Signatures
+    }
+    signers := s.usableSigners()
+    ids := make([]string, len(signers))
+    for i, sg := range signers {
+        ids[i] = sg.id
+    }
+    keys := strings.Join(ids, ",")
+    c := data.signed
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.done || c.keys != keys {
+        body, err := readBlob(data.checksums.plain)
+        if err != nil {
+            log.Printf("Reading manifest %s to sign it: %v", data.ChecksumHeader, err)
+            return c.sig, c.sigs
+        }
+        if c.done {
+            log.Printf("Signing manifest %s again with key(s) %q", data.ChecksumHeader, keys)
+        }
+        c.done, c.keys = true, keys
+        c.sig = signManifest(signers, body)
+        c.sigs = signManifestAll(signers, body)
+    }
+    return c.sig, c.sigs
+}
+
+// signManifestAll returns the /check.sigs document for body, signed by
+// every one of signers, or nil if there is none
+func signManifestAll(signers []*signer, body []byte) []byte {
+    if len(signers) == 0 {
+        return nil
+    }
+    sigs := make([]manifestSignature, len(signers))
+    for i, sg := range signers {
+        sigs[i] = manifestSignature{sg.id, base64.StdEncoding.EncodeToString(ed25519.Sign(sg.key, body))}
+    }
+    out, _ := json.Marshal(map[string]any{"signatures": sigs})
+    return out
+}
+
+// checkSigsHandler serves the signatures of the /check body by every
+// signing key, so launchers can verify it during a key rotation
+func (s *Server) checkSigsHandler(w http.ResponseWriter, r *http.Request) {
+    _, data := s.manifestFor(r)
+    _, sigs := s.signatures(data)
+    if sigs == nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("ETag", data.ChecksumHeader)
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(sigs)
+}
+
+// keysHandler serves the certificates of the signing keys in use and the
+// revocation list for launchers to check against their root keys
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+    certs := []*KeyCertificate{}
+    for _, sg := range s.usableSigners() {
+        if sg.cert != nil {
+            certs = append(certs, sg.cert)
+        }
+    }
+    if len(certs) == 0 && s.revocations == nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"certificates": certs, "revocations": s.revocations})
+}
+
+// certifyCommand issues a certificate for a signing public key with a root
+// key kept offline
+func certifyCommand(args []string) {
+    fset := flag.NewFlagSet("certify", flag.ExitOnError)
+    root := fset.String("root", "root.key", "root private key written by genkey")
+    pubFile := fset.String("key", "manifest.pub", "public key of the signing key to certify")
+    days := fset.Int("days", 365, "days the certificate is valid")
+    out := fset.String("out", "", "certificate file, default <key>.cert")
+    fset.Parse(args)
+
+    rootKey, err := loadSigningKey(*root)
+    if err != nil {
+        log.Fatal(err)
+    }
+    data, err := os.ReadFile(*pubFile)
+    if err != nil {
+        log.Fatal(err)
+    }
+    pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(pub) != ed25519.PublicKeySize {
+        log.Fatalf("%s is not a base64 Ed25519 public key", *pubFile)
+    }
+    now := time.Now()
+    cert := &KeyCertificate{
+        KeyID:     keyID(pub),
+        PublicKey: base64.StdEncoding.EncodeToString(pub),
+        NotBefore: now.Unix(),
+        Expires:   now.AddDate(0, 0, *days).Unix(),
+        RootID:    keyID(rootKey.Public().(ed25519.PublicKey)),
+    }
+    cert.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(rootKey, cert.signedPayload()))
+    if *out == "" {
+        *out = strings.TrimSuffix(*pubFile, ".pub") + ".cert"
+    }
+    if err := writeJSONFile(*out, cert, 0644); err != nil {
+        log.Fatal(err)
+    }
+    fmt.Printf("Wrote %s: key %s valid until %s\n", *out, cert.KeyID, time.Unix(cert.Expires, 0).Format(time.DateOnly))
+}
+
+// revokeCommand adds signing keys to a revocation list, re-signing it with
+// the root key under the next serial
+func revokeCommand(args []string) {
+    fset := flag.NewFlagSet("revoke", flag.ExitOnError)
+    root := fset.String("root", "root.key", "root private key written by genkey")
+    file := fset.String("list", "revocations.json", "revocation list to update, created if missing")
+    fset.Parse(args)
+    if fset.NArg() == 0 {
+        log.Fatal("usage: patchserver revoke [-root root.key] [-list revocations.json] <key id or .pub file>...")
+    }
+
+    rootKey, err := loadSigningKey(*root)
+    if err != nil {
+        log.Fatal(err)
+    }
+    list := &RevocationList{Revoked: []string{}}
+    if err := readJSONFile(*file, list); err != nil && !errors.Is(err, os.ErrNotExist) {
+        log.Fatal(err)
+    }
+    for _, arg := range fset.Args() {
+        id := arg
+        if data, err := os.ReadFile(arg); err == nil {
+            pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+            if err != nil || len(pub) != ed25519.PublicKeySize {
+                log.Fatalf("%s is not a base64 Ed25519 public key", arg)
+            }
+            id = keyID(pub)
+        }
+        if !containsString(list.Revoked, id) {
+            list.Revoked = append(list.Revoked, id)
+        }
+    }
+    list.Serial++
+    list.Issued = time.Now().Unix()
+    list.RootID = keyID(rootKey.Public().(ed25519.PublicKey))
+    list.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(rootKey, list.signedPayload()))
+    if err := writeJSONFile(*file, list, 0644); err != nil {
+        log.Fatal(err)
+    }
+    fmt.Printf("Wrote %s serial %d: %d revoked keys\n", *file, list.Serial, len(list.Revoked))
+}
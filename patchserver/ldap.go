@@ -0,0 +1,345 @@
+package patchserver
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// A minimal LDAPv3 client (RFC 4511): a simple bind, optionally after
+// StartTLS, and a base-scope search to check an attribute of the bound
+// entry. That is all authentication needs, without a dependency.
+
+const (
+    berInteger     = 0x02
+    berOctetString = 0x04
+    berBoolean     = 0x01
+    berEnumerated  = 0x0a
+    berSequence    = 0x30
+
+    ldapBindRequest     = 0x60
+    ldapBindResponse    = 0x61
+    ldapUnbindRequest   = 0x42
+    ldapSearchRequest   = 0x63
+    ldapSearchEntry     = 0x64
+    ldapSearchDone      = 0x65
+    ldapSearchReference = 0x73
+    ldapExtendedRequest = 0x77
+    ldapExtendedResp    = 0x78
+    ldapSimpleAuth      = 0x80
+    ldapExtendedName    = 0x80
+    ldapEqualityMatch   = 0xa3
+
+    ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+    // maxLDAPMessage bounds what a server can make us read
+    maxLDAPMessage = 1 << 20
+)
+
+// ldapInvalidCredentials is the result code of a refused bind
+const ldapInvalidCredentials = 49
+
+// berTLV encodes a tag, length and content
+func berTLV(tag byte, content ...[]byte) []byte {
+    n := 0
+    for _, c := range content {
+        n += len(c)
+    }
+    out := []byte{tag}
+    switch {
+    case n < 0x80:
+        out = append(out, byte(n))
+    case n < 0x100:
+        out = append(out, 0x81, byte(n))
+    case n < 0x10000:
+        out = append(out, 0x82, byte(n>>8), byte(n))
+    default:
+        out = append(out, 0x83, byte(n>>16), byte(n>>8), byte(n))
+    }
+    for _, c := range content {
+        out = append(out, c...)
+    }
+    return out
+}
+
+// berInt encodes a non-negative integer
+func berInt(tag byte, v int) []byte {
+    b := []byte{byte(v)}
+    for v >>= 8; v > 0; v >>= 8 {
+        b = append([]byte{byte(v)}, b...)
+    }
+    if b[0]&0x80 != 0 {
+        b = append([]byte{0}, b...)
+    }
+    return berTLV(tag, b)
+}
+
+// berValue decodes a non-negative integer
+func berValue(content []byte) int {
+    v := 0
+    for _, b := range content {
+        v = v<<8 | int(b)
+    }
+    return v
+}
+
+func berString(tag byte, s string) []byte {
+    return berTLV(tag, []byte(s))
+}
+
+// berRead reads one TLV from r
+func berRead(r *bufio.Reader) (byte, []byte, error) {
+    tag, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+    b, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+    n := int(b)
+    if b&0x80 != 0 {
+        size := int(b & 0x7f)
+        if size == 0 || size > 3 {
+            return 0, nil, fmt.Errorf("ldap: unsupported length of %d bytes", size)
+        }
+        n = 0
+        for i := 0; i < size; i++ {
+            if b, err = r.ReadByte(); err != nil {
+                return 0, nil, err
+            }
+            n = n<<8 | int(b)
+        }
+    }
+    if n > maxLDAPMessage {
+        return 0, nil, fmt.Errorf("ldap: %d byte message", n)
+    }
+    content := make([]byte, n)
+    _, err = io.ReadFull(r, content)
+    return tag, content, err
+}
+
+// berSplit splits the content of a constructed value into its elements
+func berSplit(content []byte) ([]berElement, error) {
+    var out []berElement
+    r := bufio.NewReader(bytes.NewReader(content))
+    for {
+        tag, c, err := berRead(r)
+        if err == io.EOF {
+            return out, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, berElement{tag, c})
+    }
+}
+
+type berElement struct {
+    tag     byte
+    content []byte
+}
+
+// ldapConn is a connection with its next message ID
+type ldapConn struct {
+    conn net.Conn
+    r    *bufio.Reader
+    id   int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL, upgrading ldap:// with
+// StartTLS when startTLS is set
+func dialLDAP(rawURL string, startTLS bool, timeout time.Duration) (*ldapConn, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    host := u.Host
+    dialer := &net.Dialer{Timeout: timeout}
+    var conn net.Conn
+    switch u.Scheme {
+    case "ldap":
+        if u.Port() == "" {
+            host = net.JoinHostPort(u.Hostname(), "389")
+        }
+        conn, err = dialer.Dial("tcp", host)
+    case "ldaps":
+        if u.Port() == "" {
+            host = net.JoinHostPort(u.Hostname(), "636")
+        }
+        conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+    default:
+        return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+    }
+    if err != nil {
+        return nil, err
+    }
+    conn.SetDeadline(time.Now().Add(timeout))
+    c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+    if startTLS && u.Scheme == "ldap" {
+        op, err := c.request(berTLV(ldapExtendedRequest, berString(ldapExtendedName, ldapStartTLSOID)), ldapExtendedResp)
+        if err == nil {
+            err = ldapResultError("StartTLS", op)
+        }
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+        if err := tc.Handshake(); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        c.conn, c.r = tc, bufio.NewReader(tc)
+    }
+    return c, nil
+}
+
+// send writes protocolOp as the next message, returning its ID
+func (c *ldapConn) send(op []byte) (int, error) {
+    c.id++
+    _, err := c.conn.Write(berTLV(berSequence, berInt(berInteger, c.id), op))
+    return c.id, err
+}
+
+// receive reads the next message for id, returning its protocolOp
+func (c *ldapConn) receive(id int) (berElement, error) {
+    for {
+        tag, content, err := berRead(c.r)
+        if err != nil {
+            return berElement{}, err
+        }
+        parts, err := berSplit(content)
+        if err != nil || tag != berSequence || len(parts) < 2 || parts[0].tag != berInteger {
+            return berElement{}, errors.New("ldap: malformed message")
+        }
+        // Unsolicited notifications have ID 0
+        if berValue(parts[0].content) == id {
+            return parts[1], nil
+        }
+    }
+}
+
+// request sends op and waits for its response of tag want
+func (c *ldapConn) request(op []byte, want byte) (berElement, error) {
+    id, err := c.send(op)
+    if err != nil {
+        return berElement{}, err
+    }
+    resp, err := c.receive(id)
+    if err == nil && resp.tag != want {
+        err = fmt.Errorf("ldap: unexpected response 0x%02x", resp.tag)
+    }
+    return resp, err
+}
+
+// ldapResultCode returns the resultCode of an LDAPResult
+func ldapResultCode(op berElement) (int, string, error) {
+    parts, err := berSplit(op.content)
+    if err != nil || len(parts) < 3 || parts[0].tag != berEnumerated || len(parts[0].content) == 0 {
+        return 0, "", errors.New("ldap: malformed result")
+    }
+    return berValue(parts[0].content), string(parts[2].content), nil
+}
+
+func ldapResultError(what string, op berElement) error {
+    code, msg, err := ldapResultCode(op)
+    if err != nil {
+        return err
+    }
+    if code != 0 {
+        return fmt.Errorf("ldap: %s failed with result %d %s", what, code, msg)
+    }
+    return nil
+}
+
+// bind does a simple bind, returning false without error when the
+// credentials are refused
+func (c *ldapConn) bind(dn, password string) (bool, error) {
+    op, err := c.request(berTLV(ldapBindRequest,
+        berInt(berInteger, 3),
+        berString(berOctetString, dn),
+        berString(ldapSimpleAuth, password)), ldapBindResponse)
+    if err != nil {
+        return false, err
+    }
+    code, msg, err := ldapResultCode(op)
+    switch {
+    case err != nil:
+        return false, err
+    case code == ldapInvalidCredentials:
+        return false, nil
+    case code != 0:
+        return false, fmt.Errorf("ldap: bind failed with result %d %s", code, msg)
+    }
+    return true, nil
+}
+
+// hasAttribute reports whether the entry dn has attr equal to value, as
+// far as the bound user may read it
+func (c *ldapConn) hasAttribute(dn, attr, value string) (bool, error) {
+    id, err := c.send(berTLV(ldapSearchRequest,
+        berString(berOctetString, dn),
+        berInt(berEnumerated, 0), // baseObject
+        berInt(berEnumerated, 0), // neverDerefAliases
+        berInt(berInteger, 1),
+        berInt(berInteger, 10),
+        berTLV(berBoolean, []byte{0xff}), // typesOnly
+        berTLV(ldapEqualityMatch, berString(berOctetString, attr), berString(berOctetString, value)),
+        berTLV(berSequence, berString(berOctetString, "1.1")))) // no attributes
+    if err != nil {
+        return false, err
+    }
+    found := false
+    for {
+        op, err := c.receive(id)
+        if err != nil {
+            return false, err
+        }
+        switch op.tag {
+        case ldapSearchEntry:
+            found = true
+        case ldapSearchReference:
+        case ldapSearchDone:
+            code, msg, err := ldapResultCode(op)
+            // noSuchObject: the entry is not visible at all
+            if err == nil && code != 0 && code != 32 {
+                err = fmt.Errorf("ldap: search failed with result %d %s", code, msg)
+            }
+            return found, err
+        default:
+            return false, fmt.Errorf("ldap: unexpected response 0x%02x", op.tag)
+        }
+    }
+}
+
+func (c *ldapConn) close() {
+    c.send(berTLV(ldapUnbindRequest))
+    c.conn.Close()
+}
+
+// escapeDN escapes a user name for use as an attribute value in a DN
+// (RFC 4514)
+func escapeDN(s string) string {
+    var b strings.Builder
+    for i, r := range s {
+        switch {
+        case strings.ContainsRune(`,+"\<>;=`, r),
+            i == 0 && (r == ' ' || r == '#'),
+            i == len(s)-1 && r == ' ':
+            b.WriteByte('\\')
+            b.WriteRune(r)
+        case r < 0x20 || r == 0x7f:
+            fmt.Fprintf(&b, "\\%02x", r)
+        default:
+            b.WriteRune(r)
+        }
+    }
+    return b.String()
+}
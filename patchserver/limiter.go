@@ -0,0 +1,218 @@
+package patchserver
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// queueRetryAfter is the Retry-After hint sent with 503 busy responses
+const queueRetryAfter = 5 * time.Second
+
+// slots is a counting semaphore whose limit can change while in use.
+// Priority waiters, clients inside a patch session, are served before
+// everyone else.
+type slots struct {
+    mu       sync.Mutex
+    limit    int
+    used     int
+    priority int           // priority requests waiting
+    wake     chan struct{} // closed and replaced whenever a slot may be free
+}
+
+func newSlots(limit int) *slots {
+    return &slots{limit: limit, wake: make(chan struct{})}
+}
+
+// free reports whether a request may take a slot, s.mu must be held
+func (s *slots) free(prio bool) bool {
+    return s.used < s.limit && (prio || s.priority == 0)
+}
+
+// tryAcquire takes a slot if one is free right now
+func (s *slots) tryAcquire(prio bool) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.free(prio) {
+        s.used++
+        return true
+    }
+    return false
+}
+
+// acquire waits for a slot until timeout fires or ctx is done
+func (s *slots) acquire(ctx context.Context, timeout <-chan time.Time, prio bool) bool {
+    if prio {
+        s.mu.Lock()
+        s.priority++
+        s.mu.Unlock()
+        defer func() {
+            s.mu.Lock()
+            s.priority--
+            s.broadcast()
+            s.mu.Unlock()
+        }()
+    }
+    for {
+        s.mu.Lock()
+        if s.free(prio) {
+            s.used++
+            s.mu.Unlock()
+            return true
+        }
+        wake := s.wake
+        s.mu.Unlock()
+        select {
+        case <-wake:
+        case <-timeout:
+            return false
+        case <-ctx.Done():
+            return false
+        }
+    }
+}
+
+func (s *slots) release() {
+    s.mu.Lock()
+    s.used--
+    s.broadcast()
+    s.mu.Unlock()
+}
+
+// setLimit resizes the pool; requests above a lowered limit finish normally
+func (s *slots) setLimit(limit int) {
+    s.mu.Lock()
+    s.limit = limit
+    s.broadcast()
+    s.mu.Unlock()
+}
+
+func (s *slots) getLimit() int {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.limit
+}
+
+// broadcast wakes every waiter, s.mu must be held
+func (s *slots) broadcast() {
+    close(s.wake)
+    s.wake = make(chan struct{})
+}
+
+// concurrencyLimiter wraps a handler to limit concurrent requests to the
+// size of pool. Requests beyond it wait in a queue of queueSize
+// (0 = unbounded) for at most maxWait (0 = forever) and are rejected with
+// 503 when either runs out; requests of a patch session skip ahead of the
+// queue. Its metrics carry the given Prometheus labels.
+func (s *Server) concurrencyLimiter(labels string, pool *slots, queueSize int, maxWait time.Duration, h http.Handler) http.Handler {
+    var active, waiting, rejected atomic.Int64
+    s.registerMetric("patch_active_requests{"+labels+"}", "gauge", "Requests currently being served.", func() float64 {
+        return float64(active.Load())
+    })
+    s.registerMetric("patch_max_clients{"+labels+"}", "gauge", "Current concurrent request limit.", func() float64 {
+        return float64(pool.getLimit())
+    })
+    s.registerMetric("patch_queue_depth{"+labels+"}", "gauge", "Requests waiting for a free slot.", func() float64 {
+        return float64(waiting.Load())
+    })
+    s.registerMetric("patch_queue_rejected_total{"+labels+"}", "counter", "Requests rejected because the queue was full or timed out.", func() float64 {
+        return float64(rejected.Load())
+    })
+
+    serve := func(w http.ResponseWriter, r *http.Request) {
+        active.Add(1)
+        defer func() {
+            active.Add(-1)
+            pool.release()
+        }()
+        h.ServeHTTP(w, r)
+    }
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        prio := inSession(r)
+        if pool.tryAcquire(prio) {
+            serve(w, r)
+            return
+        }
+
+        // clients inside a session are never turned away by a full queue
+        position := waiting.Add(1)
+        if queueSize > 0 && position > int64(queueSize) && !prio {
+            waiting.Add(-1)
+            rejected.Add(1)
+            writeBusy(w, "queue full", position-1)
+            return
+        }
+        var timeout <-chan time.Time
+        if maxWait > 0 {
+            timer := time.NewTimer(maxWait)
+            defer timer.Stop()
+            timeout = timer.C
+        }
+        ok := pool.acquire(r.Context(), timeout, prio)
+        waiting.Add(-1)
+        switch {
+        case ok:
+            serve(w, r)
+        case r.Context().Err() == nil:
+            rejected.Add(1)
+            writeBusy(w, "queue wait timed out", position)
+        }
+    })
+}
+
+// writeBusy replies 503 with a Retry-After hint and the queue position
+func writeBusy(w http.ResponseWriter, reason string, position int64) {
+    w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter.Seconds())))
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusServiceUnavailable)
+    json.NewEncoder(w).Encode(map[string]any{
+        "error":    reason,
+        "position": position,
+    })
+}
+
+// lightPaths are the channel-relative endpoints served from the light pool
+var lightPaths = map[string]bool{
+    "/check":           true,
+    "/check.sig":       true,
+    "/check.sigs":      true,
+    "/keys":            true,
+    "/check/v2":        true,
+    "/check/diff":      true,
+    "/news":            true,
+    "/progress":        true,
+    "/telemetry/error": true,
+    "/authorize":       true,
+    "/announce":        true,
+}
+
+// isLightRequest reports whether r is a small metadata request of tenant
+// t rather than a file transfer, looking past any channel prefix
+func isLightRequest(t *tenant, r *http.Request) bool {
+    p := r.URL.Path
+    if first, rest, ok := strings.Cut(strings.TrimPrefix(p, "/"), "/"); ok {
+        if _, isChannel := t.channels[first]; isChannel {
+            p = "/" + rest
+        }
+    } else if _, isChannel := t.channels[first]; isChannel {
+        p = "/"
+    }
+    return lightPaths[p] || strings.HasPrefix(p, "/chunks/") && strings.HasSuffix(p, "/manifest")
+}
+
+// splitPools sends the light requests of t to light and the rest to bulk,
+// so a saturated download pool never delays /check
+func splitPools(t *tenant, light, bulk http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if isLightRequest(t, r) {
+            light.ServeHTTP(w, r)
+            return
+        }
+        bulk.ServeHTTP(w, r)
+    })
+}
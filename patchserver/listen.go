@@ -0,0 +1,152 @@
+package patchserver
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// systemdListeners returns the sockets passed through systemd socket
+// activation, grouped by FileDescriptorName ("patch" or "image"). Sockets
+// without a name are treated as patch sockets.
+func systemdListeners() (map[string][]net.Listener, error) {
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return nil, nil
+    }
+    count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil {
+        return nil, fmt.Errorf("LISTEN_FDS: %w", err)
+    }
+    names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+
+    listeners := make(map[string][]net.Listener)
+    for i := 0; i < count; i++ {
+        name := "patch"
+        if i < len(names) && names[i] == "image" {
+            name = "image"
+        }
+        f := os.NewFile(uintptr(listenFdsStart+i), name)
+        l, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            return nil, fmt.Errorf("socket activation fd %d: %w", listenFdsStart+i, err)
+        }
+        listeners[name] = append(listeners[name], l)
+    }
+    return listeners, nil
+}
+
+// listenRetryMax caps the wait between rebind attempts of a listener
+const listenRetryMax = time.Minute
+
+// supervisedListener serves one address, reopening it whenever it cannot
+// be bound or stops accepting, so a busy or failed port only takes down
+// its own server
+type supervisedListener struct {
+    name   string // patch, image, admin, or patch-h3 and image-h3
+    addr   string
+    detail string // appended to the start log line
+    listen func(addr string) (net.Listener, error)
+    up     atomic.Bool
+}
+
+// listenState holds the listeners being served
+type listenState struct {
+    supervisedMu sync.Mutex
+    supervised   []*supervisedListener
+}
+
+func listenTCP(addr string) (net.Listener, error) {
+    return net.Listen("tcp", addr)
+}
+
+// superviseListeners serves h on the sockets name inherited from systemd,
+// else on addrs, else on all interfaces on port
+func (s *Server) superviseListeners(name string, addrs []string, port int, inherited []net.Listener, detail string, h http.Handler) {
+    if len(inherited) == 0 && len(addrs) == 0 {
+        addrs = []string{fmt.Sprintf(":%d", port)}
+    }
+    for _, l := range inherited {
+        s.superviseListener(&supervisedListener{name: name, addr: l.Addr().String(), detail: detail, listen: listenTCP}, l, h)
+    }
+    if len(inherited) > 0 {
+        return
+    }
+    for _, addr := range addrs {
+        s.superviseListener(&supervisedListener{name: name, addr: addr, detail: detail, listen: listenTCP}, nil, h)
+    }
+}
+
+// superviseListener starts sl with the already open l, if any
+func (s *Server) superviseListener(sl *supervisedListener, l net.Listener, h http.Handler) {
+    s.trackListener(sl)
+    go s.runListener(sl, l, h)
+}
+
+// trackListener reports sl in /healthz and /metrics
+func (s *Server) trackListener(sl *supervisedListener) {
+    s.supervisedMu.Lock()
+    s.supervised = append(s.supervised, sl)
+    s.supervisedMu.Unlock()
+    s.registerMetric(fmt.Sprintf("patch_listener_up{listener=%q,addr=%q}", sl.name, sl.addr), "gauge", "Whether the listener is bound and serving", func() float64 {
+        if sl.up.Load() {
+            return 1
+        }
+        return 0
+    })
+}
+
+func (s *Server) runListener(sl *supervisedListener, l net.Listener, h http.Handler) {
+    backoff := time.Second
+    for {
+        if l == nil {
+            var err error
+            if l, err = sl.listen(sl.addr); err != nil {
+                log.Printf("%s server on %s: %v, retrying in %s", sl.name, sl.addr, err, backoff)
+                time.Sleep(backoff)
+                backoff = min(backoff*2, listenRetryMax)
+                continue
+            }
+        }
+        backoff = time.Second
+        sl.up.Store(true)
+        log.Printf("Starting %s server on %s%s", sl.name, l.Addr(), sl.detail)
+        err := s.newHTTPServer(h).Serve(l)
+        sl.up.Store(false)
+        l.Close()
+        l = nil
+        log.Printf("%s server on %s stopped: %v, rebinding in %s", sl.name, sl.addr, err, backoff)
+        time.Sleep(backoff)
+    }
+}
+
+// listenerState is a listener as reported by /healthz
+type listenerState struct {
+    Name string `json:"name"`
+    Addr string `json:"addr"`
+    Up   bool   `json:"up"`
+}
+
+func (s *Server) listenerStates() []listenerState {
+    s.supervisedMu.Lock()
+    defer s.supervisedMu.Unlock()
+    states := make([]listenerState, len(s.supervised))
+    for i, sl := range s.supervised {
+        states[i] = listenerState{sl.name, sl.addr, sl.up.Load()}
+    }
+    return states
+}
@@ -0,0 +1,270 @@
+package patchserver
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// loadStats is shared by all simulated clients
+type loadStats struct {
+    requests  atomic.Int64
+    bytes     atomic.Int64
+    errors    atomic.Int64
+    busy      atomic.Int64
+    mismatch  atomic.Int64
+    sessions  atomic.Int64
+    mu        sync.Mutex
+    latencies []time.Duration // time to first byte of each request
+    statuses  map[int]int
+}
+
+func (s *loadStats) record(status int, ttfb time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.latencies = append(s.latencies, ttfb)
+    s.statuses[status]++
+}
+
+// slowReader limits reads to rate bytes per second, 0 = unlimited
+type slowReader struct {
+    r     io.Reader
+    rate  int64
+    start time.Time
+    read  int64
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+    if s.rate > 0 {
+        if len(p) > int(s.rate/10)+1 {
+            p = p[:s.rate/10+1]
+        }
+        if ahead := time.Duration(s.read)*time.Second/time.Duration(s.rate) - time.Since(s.start); ahead > 0 {
+            time.Sleep(ahead)
+        }
+    }
+    n, err := s.r.Read(p)
+    s.read += int64(n)
+    return n, err
+}
+
+type loadClient struct {
+    base      string
+    headers   http.Header
+    rate      int64
+    missing   float64
+    verify    bool
+    http      *http.Client
+    stats     *loadStats
+    checkETag string
+    files     []loadFile // manifest of checkETag
+}
+
+type loadFile struct{ path, sha string }
+
+func (c *loadClient) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path, nil)
+    if err != nil {
+        return nil, err
+    }
+    for k, v := range c.headers {
+        req.Header[k] = v
+    }
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    start := time.Now()
+    resp, err := c.http.Do(req)
+    c.stats.requests.Add(1)
+    if err != nil {
+        if ctx.Err() == nil {
+            c.stats.errors.Add(1)
+        }
+        return nil, err
+    }
+    c.stats.record(resp.StatusCode, time.Since(start))
+    switch {
+    case resp.StatusCode == http.StatusServiceUnavailable:
+        c.stats.busy.Add(1)
+    case resp.StatusCode >= 400:
+        c.stats.errors.Add(1)
+    }
+    return resp, nil
+}
+
+// session is one launcher run: fetch /check, then download a random share
+// of the files as if they were outdated
+func (c *loadClient) session(ctx context.Context) {
+    header := http.Header{}
+    if c.checkETag != "" {
+        header.Set("If-None-Match", c.checkETag)
+    }
+    resp, err := c.get(ctx, "/check", header)
+    if err != nil {
+        return
+    }
+    if resp.StatusCode == http.StatusOK {
+        c.files = c.files[:0]
+        scanner := bufio.NewScanner(resp.Body)
+        for scanner.Scan() {
+            sha, path, ok := strings.Cut(scanner.Text(), "\t")
+            if ok {
+                c.files = append(c.files, loadFile{path, sha})
+            }
+        }
+        c.checkETag = resp.Header.Get("ETag")
+    }
+    resp.Body.Close()
+    c.stats.sessions.Add(1)
+    for _, f := range c.files {
+        if rand.Float64() >= c.missing {
+            continue
+        }
+        if ctx.Err() != nil {
+            return
+        }
+        resp, err := c.get(ctx, (&url.URL{Path: f.path}).EscapedPath(), nil)
+        if err != nil {
+            continue
+        }
+        h := sha256.New()
+        n, err := io.Copy(h, &slowReader{r: resp.Body, rate: c.rate, start: time.Now()})
+        resp.Body.Close()
+        c.stats.bytes.Add(n)
+        if err != nil {
+            if ctx.Err() == nil {
+                c.stats.errors.Add(1)
+            }
+            continue
+        }
+        if c.verify && resp.StatusCode == http.StatusOK && hex.EncodeToString(h.Sum(nil)) != f.sha {
+            c.stats.mismatch.Add(1)
+        }
+    }
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// defaultPatchURL is the patch server the client subcommands target by
+// default, the PatchPort of patch_config.json on this host
+const defaultPatchURL = "http://127.0.0.1:8094"
+
+// loadtestCommand runs simulated launchers against a patch server and
+// reports throughput and error rates
+func loadtestCommand(args []string) {
+    fset := flag.NewFlagSet("loadtest", flag.ExitOnError)
+    target := fset.String("url", defaultPatchURL, "patch server base URL, including any channel prefix")
+    clients := fset.Int("clients", 10, "simulated launchers")
+    duration := fset.Duration("duration", time.Minute, "test length")
+    rateKB := fset.Int64("rate", 0, "download speed of each client in KB/s, 0 = unlimited")
+    missing := fset.Float64("missing", 0.1, "share of files each session downloads (0-1)")
+    verify := fset.Bool("verify", false, "check downloaded files against the manifest")
+    token := fset.String("token", "", "channel token (X-Patch-Token)")
+    userAgent := fset.String("user-agent", "mhf-loadtest", "User-Agent sent by the clients")
+    think := fset.Duration("think", time.Second, "pause between the sessions of a client")
+    fset.Parse(args)
+    if *clients <= 0 || *missing < 0 || *missing > 1 {
+        log.Fatal("-clients must be > 0 and -missing between 0 and 1")
+    }
+
+    headers := http.Header{"User-Agent": {*userAgent}}
+    if *token != "" {
+        headers.Set("X-Patch-Token", *token)
+    }
+    stats := &loadStats{statuses: map[int]int{}}
+    transport := &http.Transport{MaxIdleConnsPerHost: *clients}
+    ctx, cancel := context.WithTimeout(context.Background(), *duration)
+    defer cancel()
+
+    log.Printf("Load test: %d clients against %s for %s", *clients, *target, *duration)
+    start := time.Now()
+    var wg sync.WaitGroup
+    for i := 0; i < *clients; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            c := &loadClient{
+                base:    strings.TrimSuffix(*target, "/"),
+                headers: headers,
+                rate:    *rateKB << 10,
+                missing: *missing,
+                verify:  *verify,
+                http:    &http.Client{Transport: transport},
+                stats:   stats,
+            }
+            for ctx.Err() == nil {
+                c.session(ctx)
+                select {
+                case <-ctx.Done():
+                case <-time.After(*think):
+                }
+            }
+        }()
+    }
+    done := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+    var lastBytes int64
+    for running := true; running; {
+        select {
+        case <-done:
+            running = false
+        case <-ticker.C:
+            b := stats.bytes.Load()
+            log.Printf("%s: %d requests, %.1f MB/s, %d errors, %d busy",
+                time.Since(start).Round(time.Second), stats.requests.Load(), float64(b-lastBytes)/5/(1<<20), stats.errors.Load(), stats.busy.Load())
+            lastBytes = b
+        }
+    }
+
+    elapsed := time.Since(start).Seconds()
+    stats.mu.Lock()
+    defer stats.mu.Unlock()
+    sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+    requests := stats.requests.Load()
+    errorRate := 0.0
+    if requests > 0 {
+        errorRate = float64(stats.errors.Load()+stats.busy.Load()) / float64(requests) * 100
+    }
+    fmt.Printf("\nSessions:    %d\n", stats.sessions.Load())
+    fmt.Printf("Requests:    %d (%.1f/s)\n", requests, float64(requests)/elapsed)
+    fmt.Printf("Downloaded:  %.1f MB (%.2f MB/s)\n", float64(stats.bytes.Load())/(1<<20), float64(stats.bytes.Load())/elapsed/(1<<20))
+    fmt.Printf("Errors:      %d, busy (503): %d, error rate %.2f%%\n", stats.errors.Load(), stats.busy.Load(), errorRate)
+    if *verify {
+        fmt.Printf("Mismatches:  %d\n", stats.mismatch.Load())
+    }
+    fmt.Printf("Time to first byte: p50 %s, p95 %s, p99 %s\n",
+        percentile(stats.latencies, 0.5).Round(time.Millisecond),
+        percentile(stats.latencies, 0.95).Round(time.Millisecond),
+        percentile(stats.latencies, 0.99).Round(time.Millisecond))
+    codes := make([]int, 0, len(stats.statuses))
+    for code := range stats.statuses {
+        codes = append(codes, code)
+    }
+    sort.Ints(codes)
+    for _, code := range codes {
+        fmt.Printf("  HTTP %d: %d\n", code, stats.statuses[code])
+    }
+}
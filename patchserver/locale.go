@@ -0,0 +1,119 @@
+package patchserver
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+    "sync/atomic"
+)
+
+// LocaleConfig overlays the files of Folder on a channel's GameFolder for
+// one regional client (e.g. jp, tw, en). Clients pick it with ?locale= or
+// X-Patch-Locale and get the base files merged with the overlay, the
+// overlay winning on equal paths.
+type LocaleConfig struct {
+    Name   string `json:"Name"`
+    Folder string `json:"Folder"`
+}
+
+// addLocales creates the overlay channels of base, registered in channels
+// as base@locale so they are rescanned, versioned and administered like
+// any other channel
+func (s *Server) addLocales(base *channel, list []LocaleConfig, folder folderFiles) {
+    if len(list) == 0 {
+        return
+    }
+    base.locales = make(map[string]*channel, len(list))
+    for _, l := range list {
+        name := strings.ToLower(l.Name)
+        ch := &channel{
+            srv:    s,
+            name:   base.name + "@" + name,
+            root:   l.Folder,
+            tokens: base.tokens,
+            auth:   base.auth,
+            data:   new(atomic.Pointer[DirData]),
+            base:   base,
+        }
+        ch.fsys, ch.files = folder(l.Folder)
+        ch.force.Store(base.force.Load())
+        base.locales[name] = ch
+        s.channels[ch.name] = ch
+    }
+}
+
+// localeFor returns the overlay of ch the client asked for, or ch itself
+// when it asked for none or for one without an overlay
+func (ch *channel) localeFor(w http.ResponseWriter, r *http.Request) *channel {
+    if len(ch.locales) == 0 {
+        return ch
+    }
+    w.Header().Add("Vary", "X-Patch-Locale")
+    name := r.URL.Query().Get("locale")
+    if name == "" {
+        name = r.Header.Get("X-Patch-Locale")
+    }
+    if l, ok := ch.locales[strings.ToLower(name)]; ok {
+        return l
+    }
+    return ch
+}
+
+// buildManifest scans the channel's folder, merged with its base folder
+// for a locale overlay, or fetches it from the origin of an edge
+func (ch *channel) buildManifest() (*DirData, error) {
+    s := ch.srv
+    if s.originEnabled() {
+        return s.originManifest(ch)
+    }
+    known := func(path string) (StoredFile, bool) { return s.Manifests.File(ch.name, path) }
+    if ch.base == nil {
+        return s.buildManifest(ch.root, ch.fsys, known, ch.data.Load())
+    }
+    base, err := s.scanFolder(ch.base.root, ch.base.fsys, known, ch.base.data.Load())
+    if err != nil {
+        return nil, err
+    }
+    overlay, err := s.scanFolder(ch.root, ch.fsys, known, ch.data.Load())
+    if err != nil {
+        return nil, err
+    }
+    replaced := make(map[string]bool, len(overlay))
+    for _, e := range overlay {
+        replaced[e.Path] = true
+    }
+    entries := make([]ManifestEntry, 0, len(base)+len(overlay))
+    for _, e := range base {
+        if !replaced[e.Path] {
+            e.inherited = true
+            entries = append(entries, e)
+        }
+    }
+    entries = append(entries, overlay...)
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+    return s.newDirData(entries)
+}
+
+// withLocales adds the overlays of the listed channels that are missing,
+// so rescanning a base channel also refreshes the clients of its regions
+func withLocales(list []*channel) []*channel {
+    listed := make(map[*channel]bool, len(list))
+    for _, ch := range list {
+        listed[ch] = true
+    }
+    out := append([]*channel{}, list...)
+    for _, ch := range list {
+        names := make([]string, 0, len(ch.locales))
+        for name := range ch.locales {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            if l := ch.locales[name]; !listed[l] {
+                out = append(out, l)
+                listed[l] = true
+            }
+        }
+    }
+    return out
+}
@@ -0,0 +1,134 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "strconv"
+    "syscall"
+)
+
+// maxManifestPage caps the limit of a paginated /check request
+const maxManifestPage = 10000
+
+func (s *Server) checkHandler(w http.ResponseWriter, r *http.Request) {
+    ch, data := s.manifestFor(r)
+    if r.URL.Query().Has("groups") {
+        s.groupCheck(w, r, ch, data)
+        return
+    }
+    etag := r.Header.Get("If-None-Match")
+    if !ch.force.Load() && etag == data.ChecksumHeader {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    w.Header().Set("ETag", data.ChecksumHeader)
+    w.Header().Set("X-Version-Base", versionBase(data))
+    query := r.URL.Query()
+    if !query.Has("offset") && !query.Has("limit") {
+        writeEncoded(w, r, "text/plain; charset=utf-8", data.checksums)
+        return
+    }
+
+    // Paginated: the page hash lets clients verify each piece on its own
+    offset, err := strconv.Atoi(query.Get("offset"))
+    if err != nil && query.Has("offset") || offset < 0 {
+        http.Error(w, "invalid offset", http.StatusBadRequest)
+        return
+    }
+    limit := maxManifestPage
+    if query.Has("limit") {
+        if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit <= 0 || limit > maxManifestPage {
+            http.Error(w, fmt.Sprintf("limit must be 1-%d", maxManifestPage), http.StatusBadRequest)
+            return
+        }
+    }
+    page, err := data.Page(offset, limit)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    sum := sha256.Sum256(page)
+    w.Header().Set("X-Manifest-Total", strconv.Itoa(len(data.Entries)))
+    w.Header().Set("X-Page-SHA256", hex.EncodeToString(sum[:]))
+    w.WriteHeader(http.StatusOK)
+    w.Write(page)
+}
+
+// rescanOnSignal reloads priorities, rebuilds the manifests and reloads news
+// and error pages whenever the process receives SIGHUP
+func (s *Server) rescanOnSignal() {
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGHUP)
+    for range sig {
+        log.Printf("SIGHUP received, rescanning all channels")
+        if err := s.loadPriorities(); err != nil {
+            log.Printf("Reloading priorities failed, keeping the previous rules: %v", err)
+        }
+        for name, result := range s.rescanChannels("signal", s.allChannels()) {
+            log.Printf("Rescan %s: %s", name, result)
+        }
+        if err := s.loadNews(); err != nil {
+            log.Printf("Reloading news failed: %v", err)
+        }
+        if err := s.loadErrorPages(); err != nil {
+            log.Printf("Reloading error pages failed: %v", err)
+        }
+    }
+}
+
+// Main runs the patchserver command line: a subcommand when the first
+// argument names one, otherwise a Server for the -config file
+func Main() {
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "genkey":
+            genkeyCommand(os.Args[2:])
+            return
+        case "certify":
+            certifyCommand(os.Args[2:])
+            return
+        case "revoke":
+            revokeCommand(os.Args[2:])
+            return
+        case "export-manifest", "-dry-run", "--dry-run":
+            exportManifestCommand(os.Args[2:])
+            return
+        case "loadtest", "-loadtest", "--loadtest":
+            loadtestCommand(os.Args[2:])
+            return
+        case "sync":
+            syncCommand(os.Args[2:])
+            return
+        case "hash-token":
+            hashTokenCommand(os.Args[2:])
+            return
+        case "verify-server":
+            verifyServerCommand(os.Args[2:])
+            return
+        case "install", "uninstall", "start", "stop":
+            serviceCommand(os.Args[1], os.Args[2:])
+            return
+        }
+    }
+
+    defaultConfig := "./patch_config.json"
+    if env, ok := os.LookupEnv("PATCH_CONFIG"); ok {
+        defaultConfig = env
+    }
+    cfg := flag.String("config", defaultConfig, "path to config file (env PATCH_CONFIG)")
+    migrate := flag.Bool("migrate-config", false, "rewrite the config file in the current layout and exit")
+    flag.Parse()
+
+    runAsService(*cfg)
+    s := New(*cfg)
+    if *migrate {
+        s.loadConfig(*cfg, true)
+    }
+    log.Fatal(s.Run())
+}
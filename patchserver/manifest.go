@@ -0,0 +1,586 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "runtime"
+    "strings"
+    "sync"
+)
+
+type DirData struct {
+    ChecksumHeader string
+    // Signature and Signatures are the origin's /check.sig and /check.sigs
+    // on an edge without signing keys, see signatures
+    Signature  []byte
+    Signatures []byte
+    Entries    []ManifestEntry
+    checksums  encodedBody // served by /check
+    v2         encodedBody // JSON manifest served by /check/v2
+    stored     *bodyStore  // where checksums and v2 are, with StoreFile
+    ObjectDir  string      // set when serving an archived version after a rollback, or a snapshot
+    index      map[string]int
+    foldIndex  map[string]int // case-insensitive index, see CaseInsensitivePaths
+    lineStarts []int          // offset of each entry's line in checksums
+    previous   string
+    changes    []ManifestChange // since previous, see setPrevious
+    fromBodies *changeBodies    // JSON manifests relative to older versions
+    verified   *sync.Map        // path -> mtime of files hashed again, see verifiedFile
+    hashing    *sync.Map        // paths verifiedFile is hashing again
+    signed     *signatureCache
+}
+
+// changeBodies caches the JSON manifests of one DirData rendered with the
+// changes from an archived version, by version ID
+type changeBodies struct {
+    mu     sync.Mutex
+    bodies map[string]encodedBody
+}
+
+// Lookup returns the manifest entry for a "/"-rooted path
+func (d *DirData) Lookup(path string) (ManifestEntry, bool) {
+    i, ok := d.index[path]
+    if !ok {
+        return ManifestEntry{}, false
+    }
+    return d.Entries[i], true
+}
+
+// ManifestEntry describes one file of GameFolder
+type ManifestEntry struct {
+    Path    string `json:"path"`
+    SHA256  string `json:"sha256"`
+    Size    int64  `json:"size"`
+    ModTime int64  `json:"mtime"` // unix seconds
+    // Encodings maps each Content-Encoding the file is available in to
+    // its size, see PrecompressFolder
+    Encodings map[string]int64 `json:"encodings,omitempty"`
+    // Priority orders downloads, lowest first, see PriorityFile
+    Priority int `json:"priority"`
+    // Group is the FileGroups entry the file belongs to, empty for base files
+    Group       string `json:"group,omitempty"`
+    modTimeNano int64  // exact mtime, for the store's checksum reuse
+    inherited   bool   // stored in the base folder of a locale overlay
+}
+
+type manifestV2 struct {
+    ETag        string           `json:"etag"`
+    VersionBase string           `json:"version_base"` // prefix of the immutable /v/ URLs
+    Previous    string           `json:"previous,omitempty"`
+    Files       []ManifestEntry  `json:"files"`
+    Changes     []ManifestChange `json:"changes,omitempty"`
+    Groups      []groupSummary   `json:"groups,omitempty"`
+}
+
+// Manifest change actions, relative to the previously published manifest
+const (
+    ActionAdd    = "add"
+    ActionUpdate = "update"
+    ActionDelete = "delete"
+    ActionRename = "rename"
+)
+
+// ManifestChange tells launchers how to go from the previous manifest to
+// this one. From is only set for renames; SHA256 and Size are empty for
+// deletes.
+type ManifestChange struct {
+    Action string `json:"action"`
+    Path   string `json:"path"`
+    From   string `json:"from,omitempty"`
+    SHA256 string `json:"sha256,omitempty"`
+    Size   int64  `json:"size,omitempty"`
+}
+
+// diffManifests lists the changes from prev to entries. A file that
+// disappeared while a new path appeared with the same checksum is a rename.
+func diffManifests(prev *DirData, entries []ManifestEntry) []ManifestChange {
+    var changes []ManifestChange
+    var added []ManifestEntry
+    current := make(map[string]bool, len(entries))
+    for _, e := range entries {
+        current[e.Path] = true
+        old, ok := prev.Lookup(e.Path)
+        switch {
+        case !ok:
+            added = append(added, e)
+        case old.SHA256 != e.SHA256:
+            changes = append(changes, ManifestChange{Action: ActionUpdate, Path: e.Path, SHA256: e.SHA256, Size: e.Size})
+        }
+    }
+    removed := map[string][]string{} // checksum -> deleted paths
+    var deleted []string
+    for _, e := range prev.Entries {
+        if !current[e.Path] {
+            removed[e.SHA256] = append(removed[e.SHA256], e.Path)
+            deleted = append(deleted, e.Path)
+        }
+    }
+    renamed := map[string]bool{}
+    for _, e := range added {
+        if from := removed[e.SHA256]; len(from) > 0 {
+            removed[e.SHA256] = from[1:]
+            renamed[from[0]] = true
+            changes = append(changes, ManifestChange{Action: ActionRename, Path: e.Path, From: from[0], SHA256: e.SHA256, Size: e.Size})
+            continue
+        }
+        changes = append(changes, ManifestChange{Action: ActionAdd, Path: e.Path, SHA256: e.SHA256, Size: e.Size})
+    }
+    for _, path := range deleted {
+        if !renamed[path] {
+            changes = append(changes, ManifestChange{Action: ActionDelete, Path: path})
+        }
+    }
+    return changes
+}
+
+// setPrevious re-renders the JSON manifest with the changes since prev, the
+// manifest it replaces. An unchanged rescan keeps prev's changes so they
+// stay relative to the last publish.
+func (s *Server) setPrevious(d, prev *DirData) error {
+    if prev == nil {
+        return nil
+    }
+    if prev.ChecksumHeader == d.ChecksumHeader {
+        d.previous, d.changes = prev.previous, prev.changes
+    } else {
+        d.previous, d.changes = prev.ChecksumHeader, diffManifests(prev, d.Entries)
+    }
+    return s.renderV2(d)
+}
+
+// renderV2 renders the JSON manifest served by /check/v2
+func (s *Server) renderV2(d *DirData) error {
+    body, err := s.marshalV2(d, d.previous, d.changes)
+    if err != nil {
+        return err
+    }
+    d.v2 = encodeBody(body)
+    return nil
+}
+
+func (s *Server) marshalV2(d *DirData, previous string, changes []ManifestChange) ([]byte, error) {
+    return json.Marshal(manifestV2{
+        ETag:        d.ChecksumHeader,
+        VersionBase: versionBase(d),
+        Previous:    previous,
+        Files:       d.Entries,
+        Changes:     changes,
+        Groups:      s.groupSummaries(d.Entries),
+    })
+}
+
+// v2From returns the JSON manifest with the changes from the archived
+// version id of ch, for launchers more than one publish behind. It fails
+// for the previous and current versions, whose manifest is v2, and
+// for versions that are not archived.
+func (s *Server) v2From(d *DirData, ch *channel, id string) (encodedBody, bool) {
+    if s.config.KeepVersions == 0 || id == versionID(d.ChecksumHeader) || id == versionID(d.previous) {
+        return encodedBody{}, false
+    }
+    d.fromBodies.mu.Lock()
+    defer d.fromBodies.mu.Unlock()
+    if enc, ok := d.fromBodies.bodies[id]; ok {
+        return enc, true
+    }
+    v, err := s.findVersion(ch, id)
+    if err != nil {
+        return encodedBody{}, false
+    }
+    body, err := s.marshalV2(d, v.ETag, diffManifests(indexEntries(v.Files), d.Entries))
+    if err != nil {
+        return encodedBody{}, false
+    }
+    enc := encodeBody(body)
+    if d.stored != nil {
+        if stored, err := d.stored.put("v2 "+id, enc); err == nil {
+            enc = stored
+        } else {
+            log.Printf("Keeping manifest %s from %s in memory: %v", d.ChecksumHeader, id, err)
+        }
+    }
+    // Bounded by KeepVersions
+    d.fromBodies.bodies[id] = enc
+    return enc, true
+}
+
+// indexEntries returns entries as a DirData that only supports Lookup
+func indexEntries(entries []ManifestEntry) *DirData {
+    d := &DirData{Entries: entries, index: make(map[string]int, len(entries))}
+    for i, e := range entries {
+        d.index[e.Path] = i
+    }
+    return d
+}
+
+// clientVersion returns the version ID a launcher reports having, from
+// ?from= or If-None-Match
+func clientVersion(r *http.Request) string {
+    if from := r.URL.Query().Get("from"); from != "" {
+        return versionID(from)
+    }
+    return versionID(strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/"))
+}
+
+// hashFile returns the hex encoded sha256 of the file at path
+func hashFile(path string) (string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    return hashReader(f)
+}
+
+// storedLookup returns the stored record of a "/"-rooted path, see
+// ManifestStore.File
+type storedLookup func(path string) (StoredFile, bool)
+
+// buildManifest renders the manifest of every file in fsys, the folder root
+func (s *Server) buildManifest(root string, fsys fs.FS, known storedLookup, prev *DirData) (*DirData, error) {
+    entries, err := s.scanFolder(root, fsys, known, prev)
+    if err != nil {
+        return nil, err
+    }
+    return s.newDirData(entries)
+}
+
+// scanFolder hashes every file in fsys, the folder root, with a pool of
+// workers, reusing the checksum from known when a file's size and mtime
+// are unchanged. Paths are collected first so the entries keep the walk's
+// lexical order regardless of which worker finishes first. With ScanErrors
+// warn an unreadable file or folder keeps its entries from prev, the
+// previous manifest of the folder, so clients are not told to delete it.
+func (s *Server) scanFolder(root string, fsys fs.FS, known storedLookup, prev *DirData) ([]ManifestEntry, error) {
+    var paths, rejected []string
+    var infos []fs.FileInfo
+    var scanErrs []ScanError
+    // unread holds the paths the walk could not read and where their
+    // previous entries go among paths
+    var unread []unreadPath
+    // hidden files and folders are never served, so walkFolder keeps them
+    // out too
+    err := s.walkFolder(root, fsys, func(name string, info fs.FileInfo) error {
+        if reason := s.config.FilePolicy.check(name, info.Size()); reason != "" {
+            rejected = append(rejected, "/"+name+": "+reason)
+            return nil
+        }
+        if info.Size() == 0 && s.config.SkipEmptyFiles {
+            log.Printf("Warning: skipping empty file %s (SkipEmptyFiles)", filepath.Join(root, filepath.FromSlash(name)))
+            return nil
+        }
+        paths = append(paths, "/"+name)
+        infos = append(infos, info)
+        return nil
+    }, func(name string, err error) error {
+        // Deleted while the scan ran
+        if errors.Is(err, fs.ErrNotExist) {
+            return nil
+        }
+        scanErrs = append(scanErrs, ScanError{Path: "/" + name, Error: err.Error(), Attempts: 1})
+        unread = append(unread, unreadPath{at: len(paths), path: "/" + name})
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if err := s.applyFilePolicy(root, rejected); err != nil {
+        return nil, err
+    }
+
+    workers := s.config.HashWorkers
+    if workers <= 0 {
+        workers = runtime.NumCPU()
+    }
+    checksums := make([]string, len(paths))
+    encodings := make([]map[string]int64, len(paths))
+    failed := make([]bool, len(paths))
+    jobs := make(chan int)
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    done := 0
+    for w := 0; w < workers; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range jobs {
+                var checksum string
+                var k StoredFile
+                var ok bool
+                if known != nil {
+                    k, ok = known(paths[i])
+                }
+                attempts, err := s.withScanRetries(func() (err error) {
+                    if ok && k.Size == infos[i].Size() && k.ModTimeNano == infos[i].ModTime().UnixNano() {
+                        checksum = k.SHA256
+                    } else if checksum, err = hashFS(fsys, paths[i]); err != nil {
+                        return err
+                    }
+                    encodings[i], err = s.precompress(fsys, paths[i], checksum, infos[i].Size())
+                    return err
+                })
+                mu.Lock()
+                if err != nil {
+                    failed[i] = true
+                    scanErrs = append(scanErrs, ScanError{Path: paths[i], Error: err.Error(), Attempts: attempts})
+                }
+                checksums[i] = checksum
+                done++
+                if s.config.ScanLogEvery > 0 && done%s.config.ScanLogEvery == 0 {
+                    log.Printf("Hashed %d/%d files", done, len(paths))
+                }
+                mu.Unlock()
+            }
+        }()
+    }
+    for i := range paths {
+        jobs <- i
+    }
+    close(jobs)
+    wg.Wait()
+    if err := s.applyScanErrors(root, scanErrs); err != nil {
+        return nil, err
+    }
+
+    entries := make([]ManifestEntry, 0, len(paths))
+    kept := 0
+    for i := 0; i <= len(paths); i++ {
+        for ; len(unread) > 0 && unread[0].at == i; unread = unread[1:] {
+            old := prev.under(unread[0].path)
+            kept += len(old)
+            entries = append(entries, old...)
+        }
+        if i == len(paths) {
+            break
+        }
+        if failed[i] {
+            old := prev.under(paths[i])
+            kept += len(old)
+            entries = append(entries, old...)
+            continue
+        }
+        entries = append(entries, ManifestEntry{
+            Path:        paths[i],
+            SHA256:      checksums[i],
+            Size:        infos[i].Size(),
+            ModTime:     infos[i].ModTime().Unix(),
+            Encodings:   encodings[i],
+            modTimeNano: infos[i].ModTime().UnixNano(),
+        })
+    }
+    if kept > 0 {
+        log.Printf("Kept the previous entries of %d unreadable file(s) in the manifest of %s (ScanErrors warn)", kept, root)
+    }
+    log.Printf("Manifest built for %s: %d files with %d workers", root, len(entries), workers)
+    if n := warnPathConflicts(root, entries); n > 0 {
+        log.Printf("%s has %d path(s) Windows clients cannot store as served", root, n)
+    }
+    return entries, nil
+}
+
+// unreadPath is a file or folder a walk could not read, at is the number
+// of paths walked before it
+type unreadPath struct {
+    at   int
+    path string
+}
+
+// under returns the entries of d at p or inside the folder p, in manifest
+// order. Entries a locale overlay inherits are left out: they belong to
+// the base folder's scan.
+func (d *DirData) under(p string) []ManifestEntry {
+    if d == nil {
+        return nil
+    }
+    var out []ManifestEntry
+    for _, e := range d.Entries {
+        if !e.inherited && (e.Path == p || strings.HasPrefix(e.Path, p+"/")) {
+            out = append(out, e)
+        }
+    }
+    return out
+}
+
+// relPath returns the "/"-rooted manifest path of file under root. Only
+// the OS separator is converted, so a backslash inside a Linux file name
+// stays part of the name.
+func relPath(root, file string) string {
+    return filepath.ToSlash(strings.TrimPrefix(file, root))
+}
+
+// newDirData renders the /check body, ETag, JSON manifest and signature
+// for entries, assigning their priorities and groups
+func (s *Server) newDirData(entries []ManifestEntry) (*DirData, error) {
+    data := &DirData{
+        Entries:    entries,
+        index:      make(map[string]int, len(entries)),
+        fromBodies: &changeBodies{bodies: map[string]encodedBody{}},
+        verified:   new(sync.Map),
+        hashing:    new(sync.Map),
+        signed:     new(signatureCache),
+    }
+    var body []byte
+    hasher := sha256.New()
+    rules := s.priorityRules.Load()
+    for i, e := range entries {
+        entries[i].Priority = rules.priorityOf(e.Path)
+        entries[i].Group = s.groupOf(e.Path)
+        line := []byte(fmt.Sprintf("%s\t%s\n", e.SHA256, e.Path))
+        data.lineStarts = append(data.lineStarts, len(body))
+        body = append(body, line...)
+        hasher.Write(line)
+        data.index[e.Path] = i
+    }
+    if s.config.CaseInsensitivePaths {
+        data.foldIndex = buildFoldIndex(entries)
+    }
+    data.ChecksumHeader = fmt.Sprintf("\"%s\"", hex.EncodeToString(hasher.Sum(nil)))
+    data.checksums = encodeBody(body)
+    if err := s.renderV2(data); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
+
+// Page returns the /check lines of entries [offset, offset+limit)
+func (d *DirData) Page(offset, limit int) ([]byte, error) {
+    if offset >= len(d.Entries) {
+        return nil, nil
+    }
+    end := d.checksums.plain.Size()
+    if offset+limit < len(d.Entries) {
+        end = int64(d.lineStarts[offset+limit])
+    }
+    start := int64(d.lineStarts[offset])
+    page := make([]byte, end-start)
+    _, err := d.checksums.plain.ReadAt(page, start)
+    return page, err
+}
+
+// loadFolderData rescans every channel, keeping the previous manifest of
+// any channel whose rescan fails
+func (s *Server) loadFolderData() error {
+    var errs []error
+    for _, ch := range s.channels {
+        if err := s.loadChannel(ch); err != nil {
+            errs = append(errs, fmt.Errorf("channel %s: %w", ch.name, err))
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// loadChannel rescans the channel root and atomically swaps in the new
+// manifest. A manifest whose ETag differs from the one it replaces counts
+// as a publish. A channel pinned by a rollback keeps serving the archived
+// version instead.
+func (s *Server) loadChannel(ch *channel) error {
+    s.rescanMu.Lock()
+    defer s.rescanMu.Unlock()
+    if id := s.pinnedVersion(ch); id != "" {
+        return s.loadPinned(ch, id)
+    }
+    data, err := ch.buildManifest()
+    if err != nil && s.passive() {
+        return err
+    }
+    if err != nil {
+        s.notify(EventRescanFailed, fmt.Sprintf("Rescan of %s (%s) failed: %v", ch.root, ch.name, err), map[string]any{
+            "channel": ch.name,
+        })
+        return err
+    }
+    if err := s.snapshotManifest(ch, data); err != nil {
+        return fmt.Errorf("snapshot: %w", err)
+    }
+    current := ch.data.Load()
+    // A passive failover instance only follows what the active one
+    // published and leaves hooks, notifications and pruning to it
+    publish := current != nil && current.ChecksumHeader != data.ChecksumHeader && !s.passive()
+    if publish {
+        if err := s.runHooks(HookPrePublish, ch, data, current); err != nil {
+            return err
+        }
+    }
+    // After a restart the changes are relative to the last archived version
+    prev := current
+    if prev == nil {
+        prev = s.lastArchived(ch, data.ChecksumHeader)
+    }
+    if err := s.setPrevious(data, prev); err != nil {
+        return err
+    }
+    if err := s.storeBodies(ch, data); err != nil {
+        log.Printf("Keeping %s manifest %s in memory, storing it failed: %v", ch.name, data.ChecksumHeader, err)
+    }
+    old := ch.data.Swap(data)
+    if s.cache != nil {
+        s.cache.purge()
+    }
+    if err := s.Manifests.Save(ch.name, data, old); err != nil {
+        log.Printf("Saving %s to store failed: %v", ch.name, err)
+    }
+    if s.config.KeepVersions > 0 && (old == nil || old.ChecksumHeader != data.ChecksumHeader) {
+        if err := s.archiveVersion(ch, data); err != nil {
+            log.Printf("Archiving %s version %s failed: %v", ch.name, data.ChecksumHeader, err)
+        }
+    }
+    if s.config.TorrentPieceKB > 0 && (old == nil || old.ChecksumHeader != data.ChecksumHeader) {
+        go s.buildTorrent(ch, data)
+    }
+    if old != nil && old.ChecksumHeader != data.ChecksumHeader {
+        s.startRollout(ch, old)
+    }
+    // After startRollout, so the files of the version clients are held
+    // back on are kept
+    s.pruneBodies(ch, old)
+    if !s.passive() {
+        s.prunePrecompressed()
+        s.pruneSnapshots()
+    }
+    if publish {
+        s.purgeCDNs(ch, old, data)
+        s.notify(EventPublish, fmt.Sprintf("Published %s manifest %s (%d files)", ch.name, data.ChecksumHeader, len(data.Entries)), map[string]any{
+            "channel":  ch.name,
+            "etag":     data.ChecksumHeader,
+            "previous": old.ChecksumHeader,
+            "files":    len(data.Entries),
+        })
+        if s.hasHooks(HookPostPublish) {
+            go s.runHooks(HookPostPublish, ch, data, old)
+        }
+    }
+    if s.hasHooks(HookPostRescan) && !s.passive() {
+        go s.runHooks(HookPostRescan, ch, data, old)
+    }
+    return nil
+}
+
+// checkV2Handler serves the JSON manifest with size and mtime per file,
+// sharing the ETag of the plain /check manifest
+func (s *Server) checkV2Handler(w http.ResponseWriter, r *http.Request) {
+    ch, data := s.manifestFor(r)
+    etag := r.Header.Get("If-None-Match")
+    if !ch.force.Load() && etag == data.ChecksumHeader {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    enc := data.v2
+    if from := clientVersion(r); from != "" {
+        if v2, ok := s.v2From(data, ch, from); ok {
+            enc = v2
+        }
+    }
+    if s.config.KeepVersions > 0 {
+        w.Header().Add("Vary", "If-None-Match")
+    }
+    w.Header().Set("ETag", data.ChecksumHeader)
+    w.Header().Set("X-Version-Base", versionBase(data))
+    writeEncoded(w, r, "application/json", enc)
+}
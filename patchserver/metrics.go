@@ -0,0 +1,75 @@
+package patchserver
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// metric is a single Prometheus sample read when /metrics is scraped. The
+// name may carry labels, e.g. patch_queue_depth{tenant="default"}. A
+// histogram writes its whole family instead.
+type metric struct {
+    name  string
+    help  string
+    kind  string // gauge, counter or histogram
+    value func() float64
+    write func(w io.Writer, openMetrics bool)
+}
+
+// metricState holds the metrics served at /metrics by name
+type metricState struct {
+    metricsMu sync.Mutex
+    metrics   map[string]metric
+}
+
+func (s *Server) registerMetric(name, kind, help string, value func() float64) {
+    s.metricsMu.Lock()
+    defer s.metricsMu.Unlock()
+    s.metrics[name] = metric{name: name, help: help, kind: kind, value: value}
+}
+
+// metricsHandler writes all registered metrics in Prometheus text format
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+    s.metricsMu.Lock()
+    names := make([]string, 0, len(s.metrics))
+    for name := range s.metrics {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    list := make([]metric, len(names))
+    for i, name := range names {
+        list[i] = s.metrics[name]
+    }
+    s.metricsMu.Unlock()
+
+    // OpenMetrics is only sent when asked for, as exemplars need it
+    openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+    if openMetrics {
+        w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+    } else {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    }
+    family := ""
+    for _, m := range list {
+        if f, _, _ := strings.Cut(m.name, "{"); f != family {
+            family = f
+            if openMetrics && m.kind == "counter" {
+                // OpenMetrics names counter families without _total
+                f = strings.TrimSuffix(f, "_total")
+            }
+            fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f, m.help, f, m.kind)
+        }
+        if m.write != nil {
+            m.write(w, openMetrics)
+            continue
+        }
+        fmt.Fprintf(w, "%s %g\n", m.name, m.value())
+    }
+    if openMetrics {
+        fmt.Fprintln(w, "# EOF")
+    }
+}
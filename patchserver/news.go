@@ -0,0 +1,137 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// NewsItem is one launcher announcement. Items without a locale are shown
+// to every client.
+type NewsItem struct {
+    Title  string `json:"title"`
+    Body   string `json:"body"`
+    Image  string `json:"image,omitempty"`
+    Link   string `json:"link,omitempty"`
+    Date   int64  `json:"date"` // unix seconds
+    Locale string `json:"locale,omitempty"`
+}
+
+// newsState holds the items served at /news
+type newsState struct {
+    news atomic.Pointer[[]NewsItem]
+}
+
+// loadNews reads every *.json file in NewsFolder, each holding a single
+// item or an array of items, newest first
+func (s *Server) loadNews() error {
+    items := []NewsItem{}
+    if s.config.NewsFolder != "" {
+        files, err := filepath.Glob(filepath.Join(s.config.NewsFolder, "*.json"))
+        if err != nil {
+            return err
+        }
+        for _, file := range files {
+            data, err := os.ReadFile(file)
+            if err != nil {
+                return err
+            }
+            var batch []NewsItem
+            if err := json.Unmarshal(data, &batch); err != nil {
+                var item NewsItem
+                if err := json.Unmarshal(data, &item); err != nil {
+                    return fmt.Errorf("%s: %w", file, err)
+                }
+                batch = []NewsItem{item}
+            }
+            items = append(items, batch...)
+        }
+    }
+    sort.SliceStable(items, func(i, j int) bool { return items[i].Date > items[j].Date })
+    s.news.Store(&items)
+    return nil
+}
+
+// requestLocales lists the locales a client asked for, ?locale= first and
+// then Accept-Language ordered by quality
+func requestLocales(r *http.Request) []string {
+    var locales []string
+    if l := r.URL.Query().Get("locale"); l != "" {
+        locales = append(locales, l)
+    }
+    type weighted struct {
+        tag string
+        q   float64
+    }
+    var accepted []weighted
+    for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+        tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        if tag == "" || tag == "*" {
+            continue
+        }
+        q := 1.0
+        if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+            if f, err := strconv.ParseFloat(v, 64); err == nil {
+                q = f
+            }
+        }
+        accepted = append(accepted, weighted{tag, q})
+    }
+    sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].q > accepted[j].q })
+    for _, a := range accepted {
+        locales = append(locales, a.tag)
+    }
+    return locales
+}
+
+// negotiateLocale picks the first requested locale available in items,
+// matching either the full tag or its base language
+func (s *Server) negotiateLocale(requested []string, items []NewsItem) string {
+    available := make(map[string]string)
+    for _, item := range items {
+        if item.Locale == "" {
+            continue
+        }
+        tag := strings.ToLower(item.Locale)
+        available[tag] = item.Locale
+        base, _, _ := strings.Cut(tag, "-")
+        if _, ok := available[base]; !ok {
+            available[base] = item.Locale
+        }
+    }
+    for _, want := range requested {
+        want = strings.ToLower(want)
+        if l, ok := available[want]; ok {
+            return l
+        }
+        base, _, _ := strings.Cut(want, "-")
+        if l, ok := available[base]; ok {
+            return l
+        }
+    }
+    return s.config.NewsDefaultLocale
+}
+
+func (s *Server) newsHandler(w http.ResponseWriter, r *http.Request) {
+    items := *s.news.Load()
+    locale := s.negotiateLocale(requestLocales(r), items)
+    selected := []NewsItem{}
+    for _, item := range items {
+        if item.Locale == "" || strings.EqualFold(item.Locale, locale) {
+            selected = append(selected, item)
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Language", locale)
+    w.Header().Add("Vary", "Accept-Language")
+    json.NewEncoder(w).Encode(map[string]any{
+        "locale": locale,
+        "news":   selected,
+    })
+}
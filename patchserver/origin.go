@@ -0,0 +1,389 @@
+package patchserver
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// originManifestFile keeps the last manifest fetched from the origin in a
+// channel's folder, so an edge restarting while the origin is down still
+// serves what it has
+const originManifestFile = ".origin-manifest.json"
+
+// OriginConfig turns this server into a caching edge of another patch
+// server at URL: manifests are fetched from the origin every
+// RefreshSeconds (default 60) instead of scanning GameFolder, and files
+// missing there are downloaded on first request, verified against the
+// manifest and kept in GameFolder. Channels other than stable are read from
+// URL/<channel>. Token, or else the first of a channel's Tokens, and
+// UserAgent are sent to the origin when set.
+type OriginConfig struct {
+    URL            string `json:"URL"`
+    Token          string `json:"Token"`
+    UserAgent      string `json:"UserAgent"`
+    RefreshSeconds int    `json:"RefreshSeconds"`
+}
+
+const (
+    // originHeaderTimeout is how long the origin may take to start
+    // answering a file request
+    originHeaderTimeout = 30 * time.Second
+    // originIdleTimeout aborts a file download that received nothing for
+    // that long
+    originIdleTimeout = 60 * time.Second
+)
+
+var (
+    originClient = &http.Client{Timeout: 30 * time.Second}
+    // originFileClient has no overall timeout, large files may take long;
+    // fetchOriginFile aborts stalled downloads instead
+    originFileClient = &http.Client{Transport: originTransport()}
+)
+
+// originTransport is the default transport, giving up on an origin that
+// does not answer within originHeaderTimeout
+func originTransport() http.RoundTripper {
+    t := http.DefaultTransport.(*http.Transport).Clone()
+    t.ResponseHeaderTimeout = originHeaderTimeout
+    return t
+}
+
+// originFetch is a file download from the origin shared by the requests
+// waiting for it, canceled when the last of them gives up
+type originFetch struct {
+    done    chan struct{}
+    err     error
+    waiters int
+    cancel  context.CancelFunc
+}
+
+// originState tracks the files an edge fetches from its origin
+type originState struct {
+    originMu      sync.Mutex
+    originPending map[string]*originFetch
+    // originVerified holds the files, by path and checksum, known to match
+    // the manifest
+    originVerified sync.Map
+    originFetches  atomic.Int64
+    originBytes    atomic.Int64
+    originErrors   atomic.Int64
+}
+
+// originEnabled reports whether this server is an edge of an origin
+func (s *Server) originEnabled() bool {
+    return s.config.Origin.URL != ""
+}
+
+// originURL returns the origin URL of p in ch
+func (s *Server) originURL(ch *channel, p string) string {
+    base := strings.TrimSuffix(s.config.Origin.URL, "/")
+    if ch.name != DefaultChannelName {
+        base += "/" + url.PathEscape(ch.name)
+    }
+    return base + (&url.URL{Path: p}).EscapedPath()
+}
+
+func (s *Server) originRequest(ch *channel, method, p string) (*http.Request, error) {
+    req, err := http.NewRequest(method, s.originURL(ch, p), nil)
+    if err != nil {
+        return nil, err
+    }
+    if s.config.Origin.Token != "" {
+        req.Header.Set("X-Patch-Token", s.config.Origin.Token)
+    } else if len(ch.tokens) > 0 {
+        req.Header.Set("X-Patch-Token", ch.tokens[0])
+    }
+    if s.config.Origin.UserAgent != "" {
+        req.Header.Set("User-Agent", s.config.Origin.UserAgent)
+    }
+    return req, nil
+}
+
+// originGet fetches p of ch from the origin, returning nil without error
+// when it answers 404
+func (s *Server) originGet(ch *channel, p string) ([]byte, error) {
+    req, err := s.originRequest(ch, http.MethodGet, p)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := originClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return io.ReadAll(resp.Body)
+    case http.StatusNotFound:
+        return nil, nil
+    }
+    return nil, fmt.Errorf("origin %s: %s", p, resp.Status)
+}
+
+// originManifest builds the manifest of ch from the origin's /check/v2,
+// falling back to the copy saved by the last successful fetch. The ETag is
+// computed again and must match the origin's.
+func (s *Server) originManifest(ch *channel) (*DirData, error) {
+    saved := filepath.Join(ch.root, originManifestFile)
+    body, err := s.originGet(ch, "/check/v2")
+    if err == nil && body == nil {
+        err = errors.New("origin has no /check/v2")
+    }
+    fresh := err == nil
+    if err != nil {
+        s.originErrors.Add(1)
+        var readErr error
+        if body, readErr = os.ReadFile(saved); readErr != nil {
+            return nil, err
+        }
+        log.Printf("Origin unreachable for %s, using the saved manifest: %v", ch.name, err)
+    }
+    var m manifestV2
+    if err := json.Unmarshal(body, &m); err != nil {
+        return nil, fmt.Errorf("origin manifest: %w", err)
+    }
+    for i, e := range m.Files {
+        if !safePath(e.Path) {
+            return nil, fmt.Errorf("origin manifest has unsafe path %q", e.Path)
+        }
+        // Precompressed copies stay on the origin
+        m.Files[i].Encodings = nil
+        m.Files[i].modTimeNano = e.ModTime * int64(time.Second)
+    }
+    data, err := s.newDirData(m.Files)
+    if err != nil {
+        return nil, err
+    }
+    if data.ChecksumHeader != m.ETag {
+        return nil, fmt.Errorf("origin manifest does not match its ETag %s", m.ETag)
+    }
+    if fresh {
+        // The origin's signatures cover the same /check body
+        if len(s.signers) == 0 {
+            if data.Signature, err = s.originGet(ch, "/check.sig"); err != nil {
+                return nil, err
+            }
+            if data.Signatures, err = s.originGet(ch, "/check.sigs"); err != nil {
+                return nil, err
+            }
+        }
+        if err := os.WriteFile(saved, body, 0644); err != nil {
+            log.Printf("Saving the origin manifest of %s: %v", ch.name, err)
+        }
+        log.Printf("Manifest of %s fetched from origin: %d files", ch.name, len(data.Entries))
+    }
+    return data, nil
+}
+
+// originFile makes sure the file of e is in the folder of ch and matches
+// the manifest, downloading it from the origin when it is missing or
+// differs. Concurrent requests for a file wait for one download, which is
+// canceled once all of their contexts are done.
+func (s *Server) originFile(ctx context.Context, ch *channel, e ManifestEntry) error {
+    key := ch.name + "\x00" + e.Path + "\x00" + e.SHA256
+    if _, ok := s.originVerified.Load(key); ok {
+        return nil
+    }
+    s.originMu.Lock()
+    f, busy := s.originPending[key]
+    if !busy {
+        fctx, cancel := context.WithCancel(context.Background())
+        f = &originFetch{done: make(chan struct{}), cancel: cancel}
+        s.originPending[key] = f
+        go s.runOriginFetch(fctx, key, f, ch, e)
+    }
+    f.waiters++
+    s.originMu.Unlock()
+
+    select {
+    case <-f.done:
+        return f.err
+    case <-ctx.Done():
+        s.originMu.Lock()
+        if f.waiters--; f.waiters == 0 {
+            // a request arriving now starts a new download
+            if s.originPending[key] == f {
+                delete(s.originPending, key)
+            }
+            f.cancel()
+        }
+        s.originMu.Unlock()
+        return ctx.Err()
+    }
+}
+
+// runOriginFetch checks the file of e and downloads it if needed for the
+// requests waiting on f
+func (s *Server) runOriginFetch(ctx context.Context, key string, f *originFetch, ch *channel, e ManifestEntry) {
+    defer f.cancel()
+    name := filepath.Join(ch.root, filepath.FromSlash(e.Path))
+    err := func() error {
+        if info, err := os.Stat(name); err == nil && info.Size() == e.Size {
+            if sum, err := hashFile(name); err == nil && sum == e.SHA256 {
+                return nil
+            }
+        }
+        return s.fetchOriginFile(ctx, ch, e, name)
+    }()
+    if err == nil {
+        s.originVerified.Store(key, true)
+    } else if ctx.Err() == nil {
+        s.originErrors.Add(1)
+    }
+    s.originMu.Lock()
+    if s.originPending[key] == f {
+        delete(s.originPending, key)
+    }
+    s.originMu.Unlock()
+    f.err = err
+    close(f.done)
+}
+
+// fetchOriginFile downloads e to name through a temporary file, installing
+// it only when its size and checksum match
+func (s *Server) fetchOriginFile(ctx context.Context, ch *channel, e ManifestEntry, name string) error {
+    req, err := s.originRequest(ch, http.MethodGet, e.Path)
+    if err != nil {
+        return err
+    }
+    ctx, cancel := context.WithCancelCause(ctx)
+    defer cancel(nil)
+    idle := time.AfterFunc(originIdleTimeout, func() { cancel(errOriginIdle) })
+    defer idle.Stop()
+    resp, err := originFileClient.Do(req.WithContext(ctx))
+    if err != nil {
+        return originCause(ctx, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("origin %s: %s", e.Path, resp.Status)
+    }
+    if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+        return err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(name), ".origin-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    h := sha256.New()
+    n, err := io.Copy(io.MultiWriter(tmp, h), &idleReader{resp.Body, idle})
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    s.originBytes.Add(n)
+    if err != nil {
+        return fmt.Errorf("origin %s: %w", e.Path, originCause(ctx, err))
+    }
+    if sum := hex.EncodeToString(h.Sum(nil)); n != e.Size || sum != e.SHA256 {
+        return fmt.Errorf("origin %s: got %d bytes with SHA-256 %s, manifest has %d bytes with %s", e.Path, n, sum, e.Size, e.SHA256)
+    }
+    mtime := time.Unix(e.ModTime, 0)
+    os.Chtimes(tmp.Name(), mtime, mtime)
+    if err := os.Rename(tmp.Name(), name); err != nil {
+        return err
+    }
+    s.originFetches.Add(1)
+    return nil
+}
+
+// errOriginIdle aborts a file download that stalled
+var errOriginIdle = fmt.Errorf("no data received for %s", originIdleTimeout)
+
+// originCause returns why ctx was canceled in place of err, e.g.
+// errOriginIdle
+func originCause(ctx context.Context, err error) error {
+    if cause := context.Cause(ctx); cause != nil {
+        return cause
+    }
+    return err
+}
+
+// idleReader restarts idle every time r returns data
+type idleReader struct {
+    r    io.Reader
+    idle *time.Timer
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+    n, err := ir.r.Read(p)
+    if n > 0 {
+        ir.idle.Reset(originIdleTimeout)
+    }
+    return n, err
+}
+
+// originFiles fetches manifest files missing from an edge's folder before
+// they are served. Archived versions are served from their objects.
+func (s *Server) originFiles(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.originEnabled() {
+            ch, data := s.manifestFor(r)
+            if e, ok := data.Lookup(r.URL.Path); ok && data.ObjectDir == "" {
+                if err := s.originFile(r.Context(), ch, e); err != nil {
+                    if r.Context().Err() != nil {
+                        return
+                    }
+                    logRequest(r, "Fetching %s from origin: %v", e.Path, err)
+                    http.Error(w, "file unavailable from origin", http.StatusBadGateway)
+                    return
+                }
+            }
+        }
+        h(w, r)
+    }
+}
+
+// originLoop rescans the channels whose manifest changed on the origin,
+// asking for the ETag only
+func (s *Server) originLoop() {
+    for range time.Tick(time.Duration(s.config.Origin.RefreshSeconds) * time.Second) {
+        for _, ch := range s.allChannels() {
+            req, err := s.originRequest(ch, http.MethodHead, "/check")
+            if err != nil {
+                continue
+            }
+            resp, err := originClient.Do(req)
+            if err != nil {
+                s.originErrors.Add(1)
+                log.Printf("Origin check of %s: %v", ch.name, err)
+                continue
+            }
+            resp.Body.Close()
+            etag := resp.Header.Get("ETag")
+            if data := ch.data.Load(); resp.StatusCode != http.StatusOK || etag == "" || data != nil && data.ChecksumHeader == etag {
+                continue
+            }
+            if err := s.loadChannel(ch); err != nil {
+                log.Printf("Following origin for %s: %v", ch.name, err)
+            }
+        }
+    }
+}
+
+// registerOrigin adds the origin fetch counters
+func (s *Server) registerOrigin() {
+    s.registerMetric("patch_origin_fetches_total", "counter", "Files downloaded from the origin", func() float64 {
+        return float64(s.originFetches.Load())
+    })
+    s.registerMetric("patch_origin_fetched_bytes_total", "counter", "Bytes downloaded from the origin", func() float64 {
+        return float64(s.originBytes.Load())
+    })
+    s.registerMetric("patch_origin_errors_total", "counter", "Failed origin manifest and file requests", func() float64 {
+        return float64(s.originErrors.Load())
+    })
+}
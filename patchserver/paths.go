@@ -0,0 +1,75 @@
+package patchserver
+
+import (
+    "log"
+    "net/http"
+    "strings"
+)
+
+// foldPath is the key of p in the case-insensitive index: lower case with
+// backslashes read as separators, the way Windows resolves names
+func foldPath(p string) string {
+    return strings.ToLower(strings.ReplaceAll(p, "\\", "/"))
+}
+
+// Resolve looks up a request path, falling back to a case-insensitive match
+// when CaseInsensitivePaths is set. Manifest comparisons use Lookup.
+func (d *DirData) Resolve(p string) (ManifestEntry, bool) {
+    if e, ok := d.Lookup(p); ok || d.foldIndex == nil {
+        return e, ok
+    }
+    i, ok := d.foldIndex[foldPath(p)]
+    if !ok {
+        return ManifestEntry{}, false
+    }
+    return d.Entries[i], true
+}
+
+// buildFoldIndex indexes entries case-insensitively, keeping the first of
+// paths that only differ in case
+func buildFoldIndex(entries []ManifestEntry) map[string]int {
+    index := make(map[string]int, len(entries))
+    for i, e := range entries {
+        key := foldPath(e.Path)
+        if _, dup := index[key]; !dup {
+            index[key] = i
+        }
+    }
+    return index
+}
+
+// warnPathConflicts logs the paths of root that Windows launchers cannot
+// store as served: names differing only in case, which collapse into one
+// file, and names containing a backslash, which become folders
+func warnPathConflicts(root string, entries []ManifestEntry) int {
+    seen := make(map[string]string, len(entries))
+    conflicts := 0
+    for _, e := range entries {
+        if strings.Contains(e.Path, "\\") {
+            log.Printf("Warning: %s%s contains a backslash, Windows clients will read it as a folder", root, e.Path)
+            conflicts++
+        }
+        key := foldPath(e.Path)
+        if other, dup := seen[key]; dup {
+            log.Printf("Warning: %s%s and %s%s only differ in case, Windows clients can keep only one", root, e.Path, root, other)
+            conflicts++
+            continue
+        }
+        seen[key] = e.Path
+    }
+    return conflicts
+}
+
+// canonicalFiles rewrites request paths that only match a manifest entry
+// case-insensitively to the entry's own path before serving them
+func (s *Server) canonicalFiles(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.config.CaseInsensitivePaths {
+            _, data := s.manifestFor(r)
+            if e, ok := data.Resolve(r.URL.Path); ok && e.Path != r.URL.Path {
+                r = withPath(r, e.Path)
+            }
+        }
+        h(w, r)
+    }
+}
@@ -0,0 +1,127 @@
+package patchserver
+
+import (
+    "compress/gzip"
+    "io"
+    "io/fs"
+    "log"
+    "mime"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// precompressMinRatio is the largest compressed/original size ratio worth
+// storing; anything above it (already compressed archives, images) is
+// served as is
+const precompressMinRatio = 0.9
+
+// precompressedPath returns where the encoding of the file with checksum
+// is stored. A ".none" marker records files not worth compressing so they
+// are not retried on every rescan.
+func (s *Server) precompressedPath(checksum, encoding string) string {
+    return filepath.Join(s.config.PrecompressFolder, checksum+"."+encoding)
+}
+
+// precompress makes sure the gzip variant of the "/"-rooted path p of fsys
+// exists in PrecompressFolder and returns the encodings available for it
+// with their sizes, nil if none
+func (s *Server) precompress(fsys fs.FS, p, checksum string, size int64) (map[string]int64, error) {
+    if s.config.PrecompressFolder == "" || size < int64(s.config.PrecompressMinKB)<<10 {
+        return nil, nil
+    }
+    dst := s.precompressedPath(checksum, "gz")
+    if info, err := os.Stat(dst); err == nil {
+        return map[string]int64{"gzip": info.Size()}, nil
+    }
+    if _, err := os.Stat(s.precompressedPath(checksum, "none")); err == nil {
+        return nil, nil
+    }
+    if err := os.MkdirAll(s.config.PrecompressFolder, 0755); err != nil {
+        return nil, err
+    }
+    src, err := fsys.Open(fsName(p))
+    if err != nil {
+        return nil, err
+    }
+    defer src.Close()
+    tmp, err := os.CreateTemp(s.config.PrecompressFolder, checksum+".tmp*")
+    if err != nil {
+        return nil, err
+    }
+    defer os.Remove(tmp.Name())
+    zw, _ := gzip.NewWriterLevel(tmp, gzip.BestCompression)
+    if _, err := io.Copy(zw, src); err != nil {
+        tmp.Close()
+        return nil, err
+    }
+    if err := zw.Close(); err != nil {
+        tmp.Close()
+        return nil, err
+    }
+    info, err := tmp.Stat()
+    tmp.Close()
+    if err != nil {
+        return nil, err
+    }
+    if float64(info.Size()) > float64(size)*precompressMinRatio {
+        return nil, os.WriteFile(s.precompressedPath(checksum, "none"), nil, 0644)
+    }
+    if err := os.Rename(tmp.Name(), dst); err != nil {
+        return nil, err
+    }
+    return map[string]int64{"gzip": info.Size()}, nil
+}
+
+// prunePrecompressed removes variants no served manifest refers to, see
+// servedChecksums. It does nothing until every channel has a manifest.
+func (s *Server) prunePrecompressed() {
+    if s.config.PrecompressFolder == "" {
+        return
+    }
+    used, ok := s.servedChecksums()
+    if !ok {
+        return
+    }
+    files, err := os.ReadDir(s.config.PrecompressFolder)
+    if err != nil {
+        log.Printf("Pruning precompressed files: %v", err)
+        return
+    }
+    for _, f := range files {
+        checksum, _, _ := strings.Cut(f.Name(), ".")
+        if !used[checksum] {
+            os.Remove(filepath.Join(s.config.PrecompressFolder, f.Name()))
+        }
+    }
+}
+
+// servePrecompressed serves the gzip variant of the manifest entry for r
+// when the client accepts it, reporting whether it did. Range requests get
+// the identity encoding so resumed downloads keep plain offsets.
+func (s *Server) servePrecompressed(w http.ResponseWriter, r *http.Request, data *DirData) bool {
+    if s.config.PrecompressFolder == "" || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+        return false
+    }
+    e, ok := data.Lookup(r.URL.Path)
+    if !ok || e.Encodings["gzip"] == 0 {
+        return false
+    }
+    f, err := os.Open(s.precompressedPath(e.SHA256, "gz"))
+    if err != nil {
+        return false
+    }
+    defer f.Close()
+    ctype := mime.TypeByExtension(path.Ext(e.Path))
+    if ctype == "" {
+        ctype = "application/octet-stream"
+    }
+    w.Header().Set("Content-Type", ctype)
+    w.Header().Set("Content-Encoding", "gzip")
+    w.Header().Add("Vary", "Accept-Encoding")
+    http.ServeContent(w, r, path.Base(e.Path), time.Unix(e.ModTime, 0), f)
+    return true
+}
@@ -0,0 +1,87 @@
+package patchserver
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "path"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// DefaultPriority is given to files no PriorityFile rule matches
+const DefaultPriority = 50
+
+type priorityRule struct {
+    pattern  string
+    priority int
+}
+
+type priorityList []priorityRule
+
+// priorityState holds the rules of PriorityFile; the first match wins
+type priorityState struct {
+    priorityRules atomic.Pointer[priorityList]
+}
+
+// matchPattern matches a manifest path against a PriorityFile pattern:
+// "/dir/**" matches everything under /dir, a pattern without "/" matches
+// the file name anywhere, anything else is a path.Match glob on the full
+// path
+func matchPattern(pattern, p string) bool {
+    if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+        return strings.HasPrefix(p, prefix+"/")
+    }
+    if !strings.Contains(pattern, "/") {
+        p = path.Base(p)
+    }
+    ok, _ := path.Match(pattern, p)
+    return ok
+}
+
+func (l *priorityList) priorityOf(p string) int {
+    if l != nil {
+        for _, r := range *l {
+            if matchPattern(r.pattern, p) {
+                return r.priority
+            }
+        }
+    }
+    return DefaultPriority
+}
+
+// loadPriorities reads PriorityFile, one "<priority> <pattern>" rule per
+// line, # starting a comment. Lower priorities are downloaded first.
+func (s *Server) loadPriorities() error {
+    rules := priorityList{}
+    if s.config.PriorityFile != "" {
+        f, err := os.Open(s.config.PriorityFile)
+        if err != nil {
+            return err
+        }
+        defer f.Close()
+        scanner := bufio.NewScanner(f)
+        for n := 1; scanner.Scan(); n++ {
+            line := strings.TrimSpace(scanner.Text())
+            if line == "" || strings.HasPrefix(line, "#") {
+                continue
+            }
+            prio, pattern, _ := strings.Cut(line, " ")
+            pattern = strings.TrimSpace(pattern)
+            priority, err := strconv.Atoi(prio)
+            if err != nil || pattern == "" {
+                return fmt.Errorf("%s:%d: want \"<priority> <pattern>\"", s.config.PriorityFile, n)
+            }
+            if _, err := path.Match(pattern, ""); err != nil {
+                return fmt.Errorf("%s:%d: %w", s.config.PriorityFile, n, err)
+            }
+            rules = append(rules, priorityRule{pattern, priority})
+        }
+        if err := scanner.Err(); err != nil {
+            return err
+        }
+    }
+    s.priorityRules.Store(&rules)
+    return nil
+}
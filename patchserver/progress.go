@@ -0,0 +1,181 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "html/template"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+const (
+    // progressSessionTTL drops sessions that stopped reporting
+    progressSessionTTL = 10 * time.Minute
+    // maxProgressSessions bounds memory used by reports
+    maxProgressSessions = 10000
+    maxProgressBody     = 4 << 10
+)
+
+// ProgressReport is what launchers POST to /progress during a patch session
+type ProgressReport struct {
+    Session        string `json:"session"`
+    ETag           string `json:"etag"`
+    FilesDone      int    `json:"files_done"`
+    FilesTotal     int    `json:"files_total"`
+    BytesRemaining int64  `json:"bytes_remaining"`
+    Errors         int    `json:"errors"`
+    Done           bool   `json:"done"`
+}
+
+type progressSession struct {
+    ProgressReport
+    Channel string
+    Updated time.Time
+}
+
+// ProgressSummary aggregates the live sessions of one channel and ETag
+type ProgressSummary struct {
+    Channel        string `json:"channel"`
+    ETag           string `json:"etag"`
+    Active         int    `json:"active"`
+    Completed      int    `json:"completed"`
+    WithErrors     int    `json:"with_errors"`
+    BytesRemaining int64  `json:"bytes_remaining"`
+}
+
+// progressState holds the download progress reported by launchers
+type progressState struct {
+    progressMu       sync.Mutex
+    progressSessions map[string]*progressSession
+}
+
+func (s *Server) progressHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var report ProgressReport
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxProgressBody)).Decode(&report); err != nil || report.Session == "" {
+        http.Error(w, "invalid progress report", http.StatusBadRequest)
+        return
+    }
+    now := time.Now()
+    s.progressMu.Lock()
+    defer s.progressMu.Unlock()
+    s.pruneProgress(now)
+    if _, ok := s.progressSessions[report.Session]; !ok && len(s.progressSessions) >= maxProgressSessions {
+        http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+        return
+    }
+    s.progressSessions[report.Session] = &progressSession{
+        ProgressReport: report,
+        Channel:        s.channelFor(r).name,
+        Updated:        now,
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// pruneProgress drops stale sessions, progressMu must be held
+func (s *Server) pruneProgress(now time.Time) {
+    for id, sess := range s.progressSessions {
+        if now.Sub(sess.Updated) > progressSessionTTL {
+            delete(s.progressSessions, id)
+        }
+    }
+}
+
+// progressSummaries groups live sessions by channel and ETag
+func (s *Server) progressSummaries() []ProgressSummary {
+    s.progressMu.Lock()
+    defer s.progressMu.Unlock()
+    s.pruneProgress(time.Now())
+    byKey := map[[2]string]*ProgressSummary{}
+    for _, sess := range s.progressSessions {
+        key := [2]string{sess.Channel, sess.ETag}
+        sum, ok := byKey[key]
+        if !ok {
+            sum = &ProgressSummary{Channel: sess.Channel, ETag: sess.ETag}
+            byKey[key] = sum
+        }
+        if sess.Done {
+            sum.Completed++
+        } else {
+            sum.Active++
+            sum.BytesRemaining += sess.BytesRemaining
+        }
+        if sess.Errors > 0 {
+            sum.WithErrors++
+        }
+    }
+    out := make([]ProgressSummary, 0, len(byKey))
+    for _, sum := range byKey {
+        out = append(out, *sum)
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Channel != out[j].Channel {
+            return out[i].Channel < out[j].Channel
+        }
+        return out[i].ETag < out[j].ETag
+    })
+    return out
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta http-equiv="refresh" content="10"><title>Patch server</title></head>
+<body>
+<h1>Patch server</h1>
+<h2>Channels</h2>
+<table border="1" cellpadding="4">
+<tr><th>Channel</th><th>ETag</th><th>Files</th></tr>
+{{range .Channels}}<tr><td>{{.Name}}</td><td>{{.ETag}}</td><td>{{.Files}}</td></tr>
+{{end}}</table>
+<h2>Patch sessions (last {{.TTL}})</h2>
+<table border="1" cellpadding="4">
+<tr><th>Channel</th><th>ETag</th><th>Active</th><th>Completed</th><th>With errors</th><th>Bytes remaining</th></tr>
+{{range .Progress}}<tr><td>{{.Channel}}</td><td>{{.ETag}}</td><td>{{.Active}}</td><td>{{.Completed}}</td><td>{{.WithErrors}}</td><td>{{.BytesRemaining}}</td></tr>
+{{end}}</table>
+<h2>Reported download errors</h2>
+<table border="1" cellpadding="4">
+<tr><th>Channel</th><th>Path</th><th>Expected</th><th>In manifest</th><th>Clients</th><th>Reports</th><th>Last stage</th></tr>
+{{range .Errors}}<tr><td>{{.Channel}}</td><td>{{.Path}}</td><td>{{.Expected}}</td><td>{{.Current}}</td><td>{{.Clients}}</td><td>{{.Reports}}</td><td>{{.LastStage}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/admin/" {
+        http.NotFound(w, r)
+        return
+    }
+    type channelRow struct {
+        Name  string
+        ETag  string
+        Files int
+    }
+    var rows []channelRow
+    for _, ch := range s.channels {
+        data := ch.data.Load()
+        rows = append(rows, channelRow{ch.name, data.ChecksumHeader, len(data.Entries)})
+    }
+    sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    dashboardTemplate.Execute(w, map[string]any{
+        "Channels": rows,
+        "Progress": s.progressSummaries(),
+        "Errors":   s.fileErrors("", 20),
+        "TTL":      progressSessionTTL,
+    })
+}
+
+func (s *Server) adminProgressHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(s.progressSummaries())
+}
+
+// registerProgress adds the dashboard and /admin/progress
+func (s *Server) registerProgress() {
+    s.adminMux.HandleFunc("/admin/", s.dashboardHandler)
+    s.adminMux.HandleFunc("/admin/progress", s.adminProgressHandler)
+}
@@ -0,0 +1,84 @@
+package patchserver
+
+import (
+    "net"
+    "net/http"
+    "strings"
+)
+
+// parseCIDRs accepts CIDRs or bare IPs, treating the latter as single hosts
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+    var nets []*net.IPNet
+    for _, s := range list {
+        if !strings.Contains(s, "/") {
+            if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+                s += "/32"
+            } else {
+                s += "/128"
+            }
+        }
+        _, n, err := net.ParseCIDR(s)
+        if err != nil {
+            return nil, err
+        }
+        nets = append(nets, n)
+    }
+    return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// remoteIP returns the IP part of r.RemoteAddr
+func remoteIP(r *http.Request) net.IP {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return net.ParseIP(host)
+}
+
+// realIP rewrites r.RemoteAddr to the client address from X-Forwarded-For
+// when the connection comes from a trusted proxy, walking the header from
+// the right past any further trusted hops
+func (s *Server) realIP(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ip := remoteIP(r)
+        if ip == nil || !containsIP(s.trustedProxies, ip) {
+            h.ServeHTTP(w, r)
+            return
+        }
+        hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+        for i := len(hops) - 1; i >= 0; i-- {
+            hop := net.ParseIP(strings.TrimSpace(hops[i]))
+            if hop == nil {
+                break
+            }
+            ip = hop
+            if !containsIP(s.trustedProxies, hop) {
+                break
+            }
+        }
+        r2 := new(http.Request)
+        *r2 = *r
+        r2.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+        h.ServeHTTP(w, r2)
+    })
+}
+
+// withProxySupport applies BasePath and trusted proxy handling to a server
+func (s *Server) withProxySupport(h http.Handler) http.Handler {
+    if s.config.BasePath != "" {
+        h = http.StripPrefix(s.config.BasePath, h)
+    }
+    if len(s.trustedProxies) > 0 {
+        h = s.realIP(h)
+    }
+    return h
+}
@@ -0,0 +1,128 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "hash/fnv"
+    "log"
+    "net/http"
+    "time"
+)
+
+// rollout is a staged publish of a channel: a growing share of clients,
+// picked by a hash of their IP, gets the current manifest while the rest
+// keep being served from, the version published before it
+type rollout struct {
+    from    *DirData
+    started time.Time
+}
+
+// rolloutShare returns the fraction of clients on the new version of ro at now
+func (s *Server) rolloutShare(ro *rollout, now time.Time) float64 {
+    start := float64(s.config.RolloutStartPercent) / 100
+    window := time.Duration(s.config.RolloutMinutes) * time.Minute
+    return start + (1-start)*float64(now.Sub(ro.started))/float64(window)
+}
+
+// startRollout holds clients back on old, the manifest ch served before
+// its latest publish. A rollout already running keeps its previous
+// version and pace, so clients are never moved backwards. rescanMu must be
+// held.
+func (s *Server) startRollout(ch *channel, old *DirData) {
+    if s.config.RolloutMinutes <= 0 || ch.rollout.Load() != nil {
+        return
+    }
+    from := *old
+    if from.ObjectDir == "" {
+        // The files of old are only left in the version archive
+        from.ObjectDir = s.objectsDir()
+    }
+    ch.rollout.Store(&rollout{from: &from, started: time.Now()})
+    log.Printf("Rolling out %s to %d%% of clients, all within %d minutes", ch.name, s.config.RolloutStartPercent, s.config.RolloutMinutes)
+}
+
+// rolloutBucket places a client in [0, 1), the same for every request and
+// release of a channel so the clients already updated stay updated
+func rolloutBucket(r *http.Request, ch *channel) float64 {
+    h := fnv.New32a()
+    h.Write([]byte(ch.name + "\x00" + remoteIP(r).String()))
+    return float64(h.Sum32()%10000) / 10000
+}
+
+// dataFor returns the manifest r is served: the current one, or during a
+// rollout the previous one for clients whose bucket is not reached yet
+func (ch *channel) dataFor(r *http.Request) *DirData {
+    data := ch.data.Load()
+    ro := ch.rollout.Load()
+    if ro == nil {
+        return data
+    }
+    share := ch.srv.rolloutShare(ro, time.Now())
+    if share >= 1 {
+        if ch.rollout.CompareAndSwap(ro, nil) {
+            log.Printf("Rollout of %s complete", ch.name)
+        }
+        return data
+    }
+    if r.Header.Get("If-None-Match") == data.ChecksumHeader || rolloutBucket(r, ch) < share {
+        return data
+    }
+    return ro.from
+}
+
+// rolloutStatus is one channel in /admin/rollout
+type rolloutStatus struct {
+    Channel string  `json:"channel"`
+    From    string  `json:"from"`
+    To      string  `json:"to"`
+    Started int64   `json:"started"`
+    Percent float64 `json:"percent"`
+}
+
+func (s *Server) adminRolloutHandler(w http.ResponseWriter, r *http.Request) {
+    list := []rolloutStatus{}
+    now := time.Now()
+    for _, ch := range s.allChannels() {
+        if ro := ch.rollout.Load(); ro != nil {
+            list = append(list, rolloutStatus{
+                Channel: ch.name,
+                From:    ro.from.ChecksumHeader,
+                To:      ch.data.Load().ChecksumHeader,
+                Started: ro.started.Unix(),
+                Percent: min(s.rolloutShare(ro, now), 1) * 100,
+            })
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+// adminRolloutCompleteHandler gives every client of a channel the current
+// manifest at once
+func (s *Server) adminRolloutCompleteHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    ro := ch.rollout.Swap(nil)
+    s.audit(adminActor(r), "rollout_complete", ch.name, "", nil)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"channel": ch.name, "was_rolling_out": ro != nil})
+}
+
+// registerRollout adds the rollout admin endpoints and gauge
+func (s *Server) registerRollout() {
+    s.adminMux.HandleFunc("/admin/rollout", s.adminRolloutHandler)
+    s.adminMux.HandleFunc("/admin/rollout/complete", s.adminRolloutCompleteHandler)
+    s.registerMetric("patch_rollouts_active", "gauge", "Channels with a staged rollout in progress", func() float64 {
+        n := 0
+        for _, ch := range s.allChannels() {
+            if ch.rollout.Load() != nil {
+                n++
+            }
+        }
+        return float64(n)
+    })
+}
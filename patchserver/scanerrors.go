@@ -0,0 +1,90 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ScanError is a file a scan could not read, e.g. one locked by an editor
+// on Windows
+type ScanError struct {
+    Path     string `json:"path"`
+    Error    string `json:"error"`
+    Attempts int    `json:"attempts"`
+}
+
+// scanErrorState holds the files the last scans could not read
+type scanErrorState struct {
+    scanErrorsMu sync.Mutex
+    // lastScanErrors holds the errors of the last scan of every folder
+    lastScanErrors   map[string][]ScanError
+    scanFilesSkipped atomic.Int64
+}
+
+// withScanRetries calls fn until it succeeds or ScanRetries retries have
+// failed, waiting ScanRetryMillis before the first retry and twice as long
+// before each next one. It returns the number of attempts made.
+func (s *Server) withScanRetries(fn func() error) (int, error) {
+    wait := time.Duration(s.config.ScanRetryMillis) * time.Millisecond
+    for attempt := 1; ; attempt++ {
+        err := fn()
+        if err == nil || attempt > s.config.ScanRetries {
+            return attempt, err
+        }
+        time.Sleep(wait)
+        wait *= 2
+    }
+}
+
+// applyScanErrors records and reports the files of root a scan could not
+// read, failing the scan unless ScanErrors is warn, in which case
+// scanFolder keeps their previous entries
+func (s *Server) applyScanErrors(root string, errs []ScanError) error {
+    sort.Slice(errs, func(i, j int) bool { return errs[i].Path < errs[j].Path })
+    s.scanErrorsMu.Lock()
+    if len(errs) > 0 {
+        s.lastScanErrors[root] = errs
+    } else {
+        delete(s.lastScanErrors, root)
+    }
+    s.scanErrorsMu.Unlock()
+    if len(errs) == 0 {
+        return nil
+    }
+    for _, e := range errs {
+        log.Printf("Warning: cannot read %s%s after %d attempt(s): %s", root, e.Path, e.Attempts, e.Error)
+    }
+    if s.config.ScanErrors != PolicyWarn {
+        return fmt.Errorf("%d file(s) in %s cannot be read, first %s: %s", len(errs), root, errs[0].Path, errs[0].Error)
+    }
+    s.scanFilesSkipped.Add(int64(len(errs)))
+    log.Printf("Publishing %s without rescanning %d unreadable path(s) (ScanErrors warn)", root, len(errs))
+    return nil
+}
+
+// adminScanErrorsHandler lists the files the last scan of each folder
+// could not read
+func (s *Server) adminScanErrorsHandler(w http.ResponseWriter, r *http.Request) {
+    s.scanErrorsMu.Lock()
+    out := make(map[string][]ScanError, len(s.lastScanErrors))
+    for root, errs := range s.lastScanErrors {
+        out[root] = errs
+    }
+    s.scanErrorsMu.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(out)
+}
+
+// registerScanErrors adds /admin/scan/errors and the skipped file counter
+func (s *Server) registerScanErrors() {
+    s.adminMux.HandleFunc("/admin/scan/errors", s.adminScanErrorsHandler)
+    s.registerMetric("patch_scan_files_skipped_total", "counter", "Unreadable paths not rescanned with ScanErrors warn", func() float64 {
+        return float64(s.scanFilesSkipped.Load())
+    })
+}
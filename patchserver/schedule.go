@@ -0,0 +1,166 @@
+package patchserver
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ScheduleWindow overrides limits between Start and End ("HH:MM" local
+// time, wrapping past midnight when End < Start). Zero keeps the base
+// value; BandwidthKBps -1 lifts the cap entirely.
+type ScheduleWindow struct {
+    Start         string `json:"Start"`
+    End           string `json:"End"`
+    MaxClients    int    `json:"MaxClients"`
+    BandwidthKBps int    `json:"BandwidthKBps"`
+}
+
+// bandwidthChunk bounds how much a single write may take from the bucket
+const bandwidthChunk = 16 << 10
+
+// bandwidthLimiter is a token bucket shared by every patch download with a
+// burst of one second worth of bytes
+type bandwidthLimiter struct {
+    rate   atomic.Int64 // bytes per second, 0 = unlimited
+    mu     sync.Mutex
+    tokens float64
+    last   time.Time
+}
+
+func (b *bandwidthLimiter) take(ctx context.Context, n int) error {
+    for {
+        rate := float64(b.rate.Load())
+        if rate <= 0 {
+            return nil
+        }
+        b.mu.Lock()
+        now := time.Now()
+        b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, rate)
+        b.last = now
+        if b.tokens >= float64(n) {
+            b.tokens -= float64(n)
+            b.mu.Unlock()
+            return nil
+        }
+        wait := time.Duration((float64(n) - b.tokens) / rate * float64(time.Second))
+        b.mu.Unlock()
+        timer := time.NewTimer(wait)
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            timer.Stop()
+            return ctx.Err()
+        }
+    }
+}
+
+type throttledWriter struct {
+    http.ResponseWriter
+    ctx       context.Context
+    bandwidth *bandwidthLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := min(len(p), bandwidthChunk, max(int(t.bandwidth.rate.Load()), 1))
+        if err := t.bandwidth.take(t.ctx, n); err != nil {
+            return written, err
+        }
+        m, err := t.ResponseWriter.Write(p[:n])
+        written += m
+        if err != nil {
+            return written, err
+        }
+        p = p[n:]
+    }
+    return written, nil
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+    return t.ResponseWriter
+}
+
+// throttle applies the global bandwidth cap to responses of h
+func (s *Server) throttle(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        h.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), bandwidth: &s.bandwidth}, r)
+    })
+}
+
+// parseClock converts "HH:MM" to minutes since midnight
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// inClockWindow reports whether minute, since midnight, is within
+// [start, end), wrapping past midnight when end < start
+func inClockWindow(start, end, minute int) bool {
+    if start <= end {
+        return minute >= start && minute < end
+    }
+    return minute >= start || minute < end
+}
+
+// activeWindow returns the first schedule window containing now, if any
+func (s *Server) activeWindow(now time.Time) *ScheduleWindow {
+    minute := now.Hour()*60 + now.Minute()
+    for i := range s.config.Schedule {
+        w := &s.config.Schedule[i]
+        start, _ := parseClock(w.Start)
+        end, _ := parseClock(w.End)
+        if inClockWindow(start, end, minute) {
+            return w
+        }
+    }
+    return nil
+}
+
+// applySchedule sets MaxClients of the default tenant and the bandwidth cap
+// for the window active at now
+func (s *Server) applySchedule(now time.Time) {
+    maxClients := s.config.MaxClients
+    rate := int64(s.config.BandwidthKBps) << 10
+    name := "base"
+    if w := s.activeWindow(now); w != nil {
+        name = w.Start + "-" + w.End
+        if w.MaxClients > 0 {
+            maxClients = w.MaxClients
+        }
+        switch {
+        case w.BandwidthKBps < 0:
+            rate = 0
+        case w.BandwidthKBps > 0:
+            rate = int64(w.BandwidthKBps) << 10
+        }
+    }
+    if s.defaultTenant.slots.getLimit() != maxClients || s.bandwidth.rate.Load() != rate {
+        log.Printf("Schedule %s: MaxClients %d, bandwidth %d KB/s (0 = unlimited)", name, maxClients, rate>>10)
+    }
+    s.defaultTenant.slots.setLimit(maxClients)
+    s.bandwidth.rate.Store(rate)
+}
+
+// scheduleLoop re-applies the schedule every 30 seconds
+func (s *Server) scheduleLoop() {
+    for {
+        s.applySchedule(time.Now())
+        time.Sleep(30 * time.Second)
+    }
+}
+
+// registerSchedule adds the bandwidth cap gauge
+func (s *Server) registerSchedule() {
+    s.registerMetric("patch_bandwidth_limit_bytes", "gauge", "Current global bandwidth cap in bytes per second, 0 when unlimited.", func() float64 {
+        return float64(s.bandwidth.rate.Load())
+    })
+}
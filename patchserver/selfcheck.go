@@ -0,0 +1,138 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "math/rand"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Self-check webhook events
+const (
+    EventIntegrityFailed = "integrity_failed"
+    EventDiskLow         = "disk_low"
+)
+
+// healthState is the outcome of the latest self-check, served by /healthz
+type healthState struct {
+    LastRun       time.Time `json:"last_run"`
+    FilesChecked  int       `json:"files_checked"`
+    Mismatches    []string  `json:"mismatches"`
+    DiskFreeBytes uint64    `json:"disk_free_bytes"`
+    DiskLow       bool      `json:"disk_low"`
+}
+
+// selfCheckState holds the result of the last self-check
+type selfCheckState struct {
+    healthMu sync.Mutex
+    health   healthState
+}
+
+// registerSelfCheck adds the self-check gauges
+func (s *Server) registerSelfCheck() {
+    s.registerMetric("patch_selfcheck_mismatches", "gauge", "Files whose checksum no longer matches the manifest.", func() float64 {
+        s.healthMu.Lock()
+        defer s.healthMu.Unlock()
+        return float64(len(s.health.Mismatches))
+    })
+    s.registerMetric("patch_disk_free_bytes", "gauge", "Free space on the GameFolder volume.", func() float64 {
+        s.healthMu.Lock()
+        defer s.healthMu.Unlock()
+        return float64(s.health.DiskFreeBytes)
+    })
+    s.registerMetric("patch_selfcheck_last_run_timestamp_seconds", "gauge", "Unix time of the last self-check.", func() float64 {
+        s.healthMu.Lock()
+        defer s.healthMu.Unlock()
+        if s.health.LastRun.IsZero() {
+            return 0
+        }
+        return float64(s.health.LastRun.Unix())
+    })
+}
+
+// selfCheckLoop runs selfCheck every interval until the process exits
+func (s *Server) selfCheckLoop(interval time.Duration) {
+    for {
+        s.selfCheck()
+        time.Sleep(interval)
+    }
+}
+
+// selfCheck re-hashes a random sample of each channel's files and checks
+// free disk space, alerting when either looks wrong
+func (s *Server) selfCheck() {
+    state := healthState{LastRun: time.Now(), Mismatches: []string{}}
+    for _, ch := range s.channels {
+        data := ch.data.Load()
+        entries := data.Entries
+        sample := s.config.SelfCheckSampleSize
+        if sample <= 0 || sample > len(entries) {
+            sample = len(entries)
+        }
+        for _, i := range rand.Perm(len(entries))[:sample] {
+            e := entries[i]
+            checksum, err := ch.hash(data, e)
+            state.FilesChecked++
+            if err == nil && checksum == e.SHA256 {
+                continue
+            }
+            name := ch.name + ":" + e.Path
+            state.Mismatches = append(state.Mismatches, name)
+            log.Printf("Self-check: %s does not match the manifest (err=%v)", name, err)
+            s.notify(EventIntegrityFailed, fmt.Sprintf("%s no longer matches the published manifest", name), map[string]any{
+                "channel": ch.name,
+                "path":    e.Path,
+            })
+        }
+    }
+
+    free, err := diskFree(s.config.GameFolder)
+    if err != nil {
+        log.Printf("Self-check: disk space: %v", err)
+    }
+    state.DiskFreeBytes = free
+    state.DiskLow = err == nil && s.config.MinFreeDiskMB > 0 && free < uint64(s.config.MinFreeDiskMB)<<20
+
+    s.healthMu.Lock()
+    wasLow := s.health.DiskLow
+    s.health = state
+    s.healthMu.Unlock()
+    if state.DiskLow && !wasLow {
+        s.notify(EventDiskLow, fmt.Sprintf("Only %d MB free on %s", free>>20, s.config.GameFolder), map[string]any{
+            "free_bytes": free,
+        })
+    }
+}
+
+// healthzHandler reports 200 when the last self-check found no problems
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+    s.healthMu.Lock()
+    state := s.health
+    s.healthMu.Unlock()
+    status := "ok"
+    code := http.StatusOK
+    if len(state.Mismatches) > 0 || state.DiskLow {
+        status = "degraded"
+        code = http.StatusServiceUnavailable
+    }
+    listeners := s.listenerStates()
+    for _, l := range listeners {
+        if !l.Up {
+            status = "degraded"
+        }
+    }
+    body := map[string]any{
+        "status":    status,
+        "selfcheck": state,
+        "listeners": listeners,
+    }
+    if s.failoverEnabled() {
+        body["failover"] = s.currentFailoverStatus()
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(body)
+}
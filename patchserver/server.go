@@ -0,0 +1,362 @@
+package patchserver
+
+import (
+    "fmt"
+    "io/fs"
+    "log"
+    "net"
+    "net/http"
+    "runtime"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// ManifestStore persists the manifest of every channel between rescans so
+// unchanged files are not hashed again. The default keeps it in StoreFile
+// and does nothing without one.
+type ManifestStore interface {
+    // File returns the record of a "/"-rooted path in the channel's last
+    // saved manifest, false when it is not known. Scans call it once per
+    // file, so stores need not load every record at once.
+    File(channel, path string) (StoredFile, bool)
+    // Save records data as the channel's manifest, replacing old, which is
+    // nil the first time a channel is loaded
+    Save(channel string, data, old *DirData) error
+}
+
+// FileSource opens the game folders. Scans, downloads, chunks, bundles,
+// torrents, snapshots and the version archive all read them through it.
+// Files must implement io.Seeker to serve ranges and io.ReaderAt to serve
+// chunks. Features that write to the game folder (Origin, StagingFolder
+// and hard linked snapshots) need the OS file system.
+type FileSource interface {
+    FS(root string) fs.FS
+}
+
+type osFiles struct{}
+
+func (osFiles) FS(root string) fs.FS { return osFolderOf(root) }
+
+// Middleware wraps the patch server handler
+type Middleware func(http.Handler) http.Handler
+
+// Server is a patch server configured from ConfigPath. It holds its own
+// configuration, channels, tenants and manifests, so one process can run
+// several Servers on different ports. The HTTP clients of origin fetches,
+// webhooks and tracing are shared, and SIGHUP rescans every Server.
+type Server struct {
+    ConfigPath string
+    Manifests  ManifestStore // default: StoreFile
+    Files      FileSource    // default: the OS file system
+
+    middleware []Middleware
+    handlers   map[string]http.Handler
+
+    config     Config
+    folderData atomic.Pointer[DirData]
+    cache      *fileCache
+    // downloadFiles serves plain downloads of the request's manifest files
+    // with every check they are subject to, for "/" and the torrent web seed
+    downloadFiles http.HandlerFunc
+    // rescanMu serialises manifest rebuilds
+    rescanMu sync.Mutex
+    // stagingMu serialises changes to the staging areas with publishes
+    stagingMu      sync.Mutex
+    trustedProxies []*net.IPNet
+    bandwidth      bandwidthLimiter
+
+    accessState
+    adminState
+    archiveState
+    auditState
+    authState
+    channelState
+    chunkState
+    deadlineState
+    errorPageState
+    failoverState
+    filePolicyState
+    histogramState
+    http3State
+    imageStoreState
+    keychainState
+    listenState
+    metricState
+    newsState
+    originState
+    priorityState
+    progressState
+    rescanScheduleState
+    scanErrorState
+    selfCheckState
+    sessionState
+    storeState
+    telemetryState
+    tenantState
+    torrentState
+    trackerState
+    tracingState
+    userAgentState
+    variantState
+}
+
+// New returns a Server reading its configuration from configPath
+func New(configPath string) *Server {
+    s := &Server{ConfigPath: configPath, Files: osFiles{}, handlers: map[string]http.Handler{}}
+    s.Manifests = boltManifests{s}
+    s.accessLists = map[string]*atomic.Pointer[accessList]{"patch": {}, "image": {}}
+    s.adminMux = http.NewServeMux()
+    s.archived = map[string]*DirData{}
+    s.authBackends = map[string]authBackend{}
+    s.authConfigs = map[string]AuthBackendConfig{}
+    s.authCache = map[[32]byte]cachedAuth{}
+    s.channels = map[string]*channel{}
+    s.variantSlots = make(chan struct{}, runtime.NumCPU())
+    s.variantsPending = map[string]chan struct{}{}
+    s.metrics = map[string]metric{}
+    s.originPending = map[string]*originFetch{}
+    s.progressSessions = map[string]*progressSession{}
+    s.lastScanErrors = map[string][]ScanError{}
+    s.sessions = map[string]*patchSession{}
+    s.sessionsByIP = map[string][]string{}
+    s.pendingDownloads = map[string]map[string]uint64{}
+    s.telemetryFiles = map[[3]string]*FileErrors{}
+    s.telemetryClients = map[string]*telemetryClient{}
+    s.tenants = map[string]*tenant{}
+    s.torrents = map[string]*torrentMeta{}
+    s.torrentBuilds = map[string]bool{}
+    s.swarms = map[string]map[string]*trackerPeer{}
+    s.spanQueue = make(chan otlpSpan, 4096)
+    s.following = map[string]*peerFollow{}
+    s.downloadFiles = s.canonicalFiles(s.filePolicyFiles(s.countingFiles(s.signedFiles(s.originFiles(s.channelFiles)))))
+
+    s.registerAccess()
+    s.registerAdminOps()
+    s.registerAudit()
+    s.registerAuth()
+    s.registerDeadlines()
+    s.registerDebug()
+    s.registerErrorPages()
+    s.registerFailover()
+    s.registerFilePolicy()
+    s.registerImageStore()
+    s.registerImageVariants()
+    s.registerOrigin()
+    s.registerProgress()
+    s.registerRescanSchedule()
+    s.registerRollout()
+    s.registerScanErrors()
+    s.registerSchedule()
+    s.registerSelfCheck()
+    s.registerSession()
+    s.registerStore()
+    s.registerTelemetry()
+    s.registerTorrent()
+    s.registerTracing()
+    s.registerUpload()
+    s.registerVersions()
+    return s
+}
+
+// Handle adds a handler to every channel of the patch server, next to
+// /check and the file downloads
+func (s *Server) Handle(pattern string, h http.Handler) {
+    s.handlers[pattern] = h
+}
+
+// HandleAdmin adds a handler under /admin/, behind AdminToken or AdminAuth
+// like the built-in admin API
+func (s *Server) HandleAdmin(pattern string, h http.Handler) {
+    s.adminMux.Handle(pattern, h)
+}
+
+// Use wraps the patch server in m. Middleware runs after access control
+// and request IDs, the first added outermost.
+func (s *Server) Use(m Middleware) {
+    s.middleware = append(s.middleware, m)
+}
+
+// Run loads the configuration and serves until the process exits. It only
+// returns when startup fails.
+func (s *Server) Run() error {
+    if err := s.prepare(); err != nil {
+        return err
+    }
+    go s.rescanOnSignal()
+    if s.config.TraceEndpoint != "" {
+        go s.traceExporter()
+    }
+    if s.config.SessionWindowSeconds > 0 {
+        go s.sessionSweepLoop()
+    }
+    if s.failoverEnabled() {
+        s.startFailover()
+    }
+    if s.originEnabled() {
+        go s.originLoop()
+    }
+    if len(s.config.RescanSchedule) > 0 {
+        s.startRescanSchedule()
+    }
+    if s.config.SelfCheckIntervalSeconds > 0 {
+        go s.selfCheckLoop(time.Duration(s.config.SelfCheckIntervalSeconds) * time.Second)
+    }
+    if s.config.BandwidthKBps > 0 || len(s.config.Schedule) > 0 {
+        go s.scheduleLoop()
+    }
+
+    inherited, err := systemdListeners()
+    if err != nil {
+        return err
+    }
+    patchRoot := s.patchHandler()
+    s.superviseListeners("patch", s.config.PatchListen, s.config.PatchPort, inherited["patch"],
+        fmt.Sprintf(" (max %d clients)", s.config.MaxClients), altSvc(s.config.PatchHTTP3Listen, patchRoot))
+    s.superviseHTTP3("patch", s.config.PatchHTTP3Listen, patchRoot)
+
+    // Image server for hosting, disabled by ImagePort 0 without ImageListen
+    if s.imageServerEnabled() {
+        if s.config.ImageMaxAgeDays > 0 || s.config.ImageMaxTotalMB > 0 {
+            go s.pruneImagesLoop()
+        }
+        if s.config.ImageVariants {
+            go s.pruneVariantsLoop()
+        }
+        for _, t := range s.allTenants() {
+            t.images = s.imageHandler(t.imageFolder)
+        }
+        imgHandler := s.withProxySupport(s.tracing("image", s.responseHeaders("image", s.accessGate("image", s.errorPages(s.tenantRouter(func(t *tenant) http.Handler { return t.images }))))))
+        s.superviseListeners("image", s.config.ImageListen, s.config.ImagePort, inherited["image"],
+            " serving "+s.config.ImageFolder, altSvc(s.config.ImageHTTP3Listen, imgHandler))
+        s.superviseHTTP3("image", s.config.ImageHTTP3Listen, imgHandler)
+    } else {
+        log.Printf("Image server disabled (ImagePort 0)")
+    }
+
+    // Admin and metrics, kept off the public listeners when AdminListen is set
+    if s.config.AdminListen != "" {
+        adminHandler := http.NewServeMux()
+        s.registerAdminRoutes(adminHandler)
+        s.superviseListener(&supervisedListener{name: "admin", addr: s.config.AdminListen, listen: s.listenAdmin}, nil, adminHandler)
+    }
+    select {}
+}
+
+// prepare loads the configuration, access rules, keys, store, tenants and
+// manifests, everything Run needs before it serves
+func (s *Server) prepare() error {
+    s.loadConfig(s.ConfigPath, false)
+    s.trustedProxies, _ = parseCIDRs(s.config.TrustedProxies)
+    if err := s.loadAccessRules(); err != nil {
+        return err
+    }
+    if err := s.loadSigners(); err != nil {
+        return err
+    }
+    s.initHistograms()
+    s.loadAuthBackends()
+    if s.config.CacheSizeMB > 0 {
+        s.cache = newFileCache(int64(s.config.CacheSizeMB)<<20, int64(s.config.CacheFileMaxKB)<<10)
+    }
+    if s.config.StoreFile != "" {
+        if err := s.openStore(s.config.StoreFile); err != nil {
+            return err
+        }
+    }
+    if _, ok := s.Files.(osFiles); !ok {
+        if err := s.needsOSFiles(); err != nil {
+            return err
+        }
+    }
+    s.setupTenants(func(root string) (fs.FS, http.Handler) {
+        fsys := s.Files.FS(root)
+        var h http.Handler = http.FileServer(http.FS(fsys))
+        if s.cache != nil {
+            h = cachedFileServer(root, fsys, s.cache, h)
+        }
+        return fsys, s.guardFiles(fsys, s.config.GameDirListing, h)
+    })
+    if err := s.loadPriorities(); err != nil {
+        return err
+    }
+    if err := s.loadFolderData(); err != nil {
+        return err
+    }
+    if err := s.loadNews(); err != nil {
+        return err
+    }
+    if err := s.loadErrorPages(); err != nil {
+        return err
+    }
+    s.maintenance.Store(s.config.MaintenanceMode)
+    s.maintenanceMessage.Store(&s.config.MaintenanceMessage)
+    return nil
+}
+
+// patchHandler builds the patch server of every tenant, behind the access
+// gate, tracing, middleware and limiters
+func (s *Server) patchHandler() http.Handler {
+    patchMux := http.NewServeMux()
+    patchMux.HandleFunc("/check", s.checkHandler)
+    patchMux.HandleFunc("/check.sig", s.checkSigHandler)
+    patchMux.HandleFunc("/check.sigs", s.checkSigsHandler)
+    patchMux.HandleFunc("/keys", s.keysHandler)
+    patchMux.HandleFunc("/check/v2", s.checkV2Handler)
+    patchMux.HandleFunc("/check/diff", s.checkDiffHandler)
+    patchMux.HandleFunc("/news", s.newsHandler)
+    patchMux.HandleFunc("/progress", s.progressHandler)
+    patchMux.HandleFunc("/telemetry/error", s.telemetryErrorHandler)
+    if s.config.ChunkSizeMB > 0 {
+        patchMux.HandleFunc("/chunks/", s.chunksHandler)
+    }
+    if s.config.TorrentPieceKB > 0 {
+        patchMux.HandleFunc("/torrent", s.torrentHandler)
+        patchMux.HandleFunc("/torrent/seed/", s.torrentSeedHandler)
+        patchMux.HandleFunc("/announce", s.announceHandler)
+    }
+    patchMux.HandleFunc("/v/", s.versionedHandler)
+    patchMux.HandleFunc("/bundle/", s.bundleHandler)
+    patchMux.HandleFunc("/bundle/"+DiffBundle+"/", s.diffBundleHandler)
+    patchMux.HandleFunc("/authorize", s.authorizeHandler)
+    for pattern, h := range s.handlers {
+        patchMux.Handle(pattern, h)
+    }
+    patchMux.HandleFunc("/", s.downloadFiles)
+
+    // Concurrency limits of each tenant
+    maxWait := time.Duration(s.config.QueueWaitSeconds) * time.Second
+    for _, t := range s.allTenants() {
+        labels := `tenant="` + t.name + `"`
+        router := s.channelRouter(t, patchMux)
+        t.patch = s.patchSessions(splitPools(t,
+            s.concurrencyLimiter(labels+`,pool="light"`, t.lightSlots, 0, maxWait, router),
+            s.concurrencyLimiter(labels, t.slots, s.config.QueueSize, maxWait, s.minSpeed(router))))
+    }
+    // /metrics, /healthz and /admin/ bypass the limiter so they stay reachable when saturated
+    handler := http.NewServeMux()
+    handler.HandleFunc("/healthz", s.healthzHandler)
+    if s.deviceFlowEnabled() {
+        handler.HandleFunc("/auth/device", s.authDeviceHandler)
+        handler.HandleFunc("/auth/token", s.authTokenHandler)
+    }
+    if s.config.AdminListen == "" {
+        s.registerAdminRoutes(handler)
+    }
+    var patchFiles http.Handler = s.tenantRouter(func(t *tenant) http.Handler { return t.patch })
+    if s.config.BandwidthKBps > 0 || len(s.config.Schedule) > 0 {
+        patchFiles = s.throttle(patchFiles)
+    }
+    if len(s.allowedUserAgents) > 0 || s.launcherVersionRe != nil {
+        patchFiles = s.userAgentGate(patchFiles)
+    }
+    handler.Handle("/", s.errorPages(s.maintenanceGate(patchFiles)))
+    var patchRoot http.Handler = handler
+    if s.config.WebhookErrorThreshold > 0 {
+        patchRoot = s.errorSpikeMonitor(s.config.WebhookErrorThreshold, handler)
+    }
+    for i := len(s.middleware) - 1; i >= 0; i-- {
+        patchRoot = s.middleware[i](patchRoot)
+    }
+    return s.withProxySupport(s.tracing("patch", s.responseHeaders("patch", s.accessGate("patch", patchRoot))))
+}
@@ -0,0 +1,50 @@
+package patchserver
+
+import (
+    "flag"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+)
+
+// serviceName is the default Windows service / systemd unit name
+const serviceName = "mhf-patch-server"
+
+// serviceCommand implements the install, uninstall, start and stop
+// subcommands, registering this binary as a Windows service or systemd
+// unit started with the given config file
+func serviceCommand(cmd string, args []string) {
+    fset := flag.NewFlagSet(cmd, flag.ExitOnError)
+    name := fset.String("name", serviceName, "service name")
+    cfg := fset.String("config", "./patch_config.json", "config file the service runs with (install only)")
+    fset.Parse(args)
+
+    var err error
+    switch cmd {
+    case "install":
+        var exe, cfgPath string
+        if exe, err = os.Executable(); err == nil {
+            exe, err = filepath.EvalSymlinks(exe)
+        }
+        if err == nil {
+            cfgPath, err = filepath.Abs(*cfg)
+        }
+        if err == nil {
+            if _, statErr := os.Stat(cfgPath); statErr != nil {
+                log.Printf("Warning: %v", statErr)
+            }
+            err = installService(*name, exe, cfgPath)
+        }
+    case "uninstall":
+        err = uninstallService(*name)
+    case "start":
+        err = startService(*name)
+    case "stop":
+        err = stopService(*name)
+    }
+    if err != nil {
+        log.Fatalf("%s %s: %v", cmd, *name, err)
+    }
+    fmt.Printf("%s: %s done\n", *name, cmd)
+}
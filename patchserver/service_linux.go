@@ -0,0 +1,69 @@
+//go:build linux
+
+package patchserver
+
+import (
+    "fmt"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+func unitPath(name string) string {
+    return filepath.Join(systemdUnitDir, name+".service")
+}
+
+func systemctl(args ...string) error {
+    out, err := exec.Command("systemctl", args...).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("systemctl %v: %w: %s", args, err, out)
+    }
+    return nil
+}
+
+func installService(name, exe, cfg string) error {
+    unit := fmt.Sprintf(`[Unit]
+Description=MHF patch server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=%s -config %s
+ExecReload=/bin/kill -HUP $MAINPID
+WorkingDirectory=%s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`, strconv.Quote(exe), strconv.Quote(cfg), filepath.Dir(cfg))
+    if err := os.WriteFile(unitPath(name), []byte(unit), 0644); err != nil {
+        return err
+    }
+    if err := systemctl("daemon-reload"); err != nil {
+        return err
+    }
+    return systemctl("enable", name)
+}
+
+func uninstallService(name string) error {
+    systemctl("disable", "--now", name)
+    if err := os.Remove(unitPath(name)); err != nil {
+        return err
+    }
+    return systemctl("daemon-reload")
+}
+
+func startService(name string) error {
+    return systemctl("start", name)
+}
+
+func stopService(name string) error {
+    return systemctl("stop", name)
+}
+
+// runAsService is a no-op: systemd runs the server as a plain process in
+// the config folder
+func runAsService(cfg string) {}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package patchserver
+
+import "errors"
+
+var errNoServiceManager = errors.New("service installation is only supported on Windows and Linux (systemd)")
+
+func installService(name, exe, cfg string) error { return errNoServiceManager }
+func uninstallService(name string) error         { return errNoServiceManager }
+func startService(name string) error             { return errNoServiceManager }
+func stopService(name string) error              { return errNoServiceManager }
+
+func runAsService(cfg string) {}
@@ -0,0 +1,130 @@
+//go:build windows
+
+package patchserver
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "time"
+
+    "golang.org/x/sys/windows/svc"
+    "golang.org/x/sys/windows/svc/mgr"
+)
+
+func installService(name, exe, cfg string) error {
+    m, err := mgr.Connect()
+    if err != nil {
+        return err
+    }
+    defer m.Disconnect()
+    if s, err := m.OpenService(name); err == nil {
+        s.Close()
+        return fmt.Errorf("service already exists")
+    }
+    s, err := m.CreateService(name, exe, mgr.Config{
+        DisplayName: "MHF patch server",
+        StartType:   mgr.StartAutomatic,
+    }, "-config", cfg)
+    if err != nil {
+        return err
+    }
+    defer s.Close()
+    return s.SetRecoveryActions([]mgr.RecoveryAction{
+        {Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+    }, 24*60*60)
+}
+
+func uninstallService(name string) error {
+    m, err := mgr.Connect()
+    if err != nil {
+        return err
+    }
+    defer m.Disconnect()
+    s, err := m.OpenService(name)
+    if err != nil {
+        return err
+    }
+    defer s.Close()
+    s.Control(svc.Stop)
+    return s.Delete()
+}
+
+func startService(name string) error {
+    m, err := mgr.Connect()
+    if err != nil {
+        return err
+    }
+    defer m.Disconnect()
+    s, err := m.OpenService(name)
+    if err != nil {
+        return err
+    }
+    defer s.Close()
+    return s.Start()
+}
+
+func stopService(name string) error {
+    m, err := mgr.Connect()
+    if err != nil {
+        return err
+    }
+    defer m.Disconnect()
+    s, err := m.OpenService(name)
+    if err != nil {
+        return err
+    }
+    defer s.Close()
+    status, err := s.Control(svc.Stop)
+    if err != nil {
+        return err
+    }
+    for deadline := time.Now().Add(30 * time.Second); status.State != svc.Stopped; {
+        if time.Now().After(deadline) {
+            return fmt.Errorf("timed out waiting for the service to stop")
+        }
+        time.Sleep(300 * time.Millisecond)
+        if status, err = s.Query(); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// windowsService answers the service control manager; the server itself
+// keeps running in main's goroutines until asked to stop
+type windowsService struct{}
+
+func (windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+    status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+    for req := range requests {
+        switch req.Cmd {
+        case svc.Interrogate:
+            status <- req.CurrentStatus
+        case svc.Stop, svc.Shutdown:
+            status <- svc.Status{State: svc.StopPending}
+            return false, 0
+        }
+    }
+    return false, 0
+}
+
+// runAsService reports to the service control manager when started as a
+// Windows service, exiting the process once the service is stopped. Services
+// start in System32, so relative paths are resolved from the config folder.
+func runAsService(cfg string) {
+    isService, err := svc.IsWindowsService()
+    if err != nil || !isService {
+        return
+    }
+    if err := os.Chdir(filepath.Dir(cfg)); err != nil {
+        log.Printf("Service: %v", err)
+    }
+    go func() {
+        if err := svc.Run(serviceName, windowsService{}); err != nil {
+            log.Printf("Service: %v", err)
+        }
+        os.Exit(0)
+    }()
+}
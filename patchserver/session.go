@@ -0,0 +1,134 @@
+package patchserver
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// maxSessions caps the open patch sessions; beyond it new clients are
+// served without one. maxSessionsPerIP caps those of one client IP, a new
+// one replacing the IP's oldest, so a client that never sends its token
+// back cannot fill the table.
+const (
+    maxSessions      = 100000
+    maxSessionsPerIP = 64
+)
+
+type patchSession struct {
+    ip      string
+    expires time.Time
+}
+
+// sessionState holds the open patch sessions by token
+type sessionState struct {
+    sessionsMu sync.Mutex
+    sessions   map[string]*patchSession
+    // sessionsByIP holds the session tokens of each client IP, oldest first
+    sessionsByIP    map[string][]string
+    sessionsGranted atomic.Int64
+}
+
+type sessionKey struct{}
+
+// inSession reports whether r belongs to a live patch session
+func inSession(r *http.Request) bool {
+    ok, _ := r.Context().Value(sessionKey{}).(bool)
+    return ok
+}
+
+// patchSessions gives each client a session token in X-Patch-Session.
+// Requests sending it back within SessionWindowSeconds of their previous
+// one are queued ahead of new arrivals, so a launcher halfway through a
+// long patch does not stall behind clients that only just connected.
+// Tokens are bound to the client IP.
+func (s *Server) patchSessions(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if s.config.SessionWindowSeconds <= 0 {
+            h.ServeHTTP(w, r)
+            return
+        }
+        token := r.Header.Get("X-Patch-Session")
+        if token == "" {
+            token = r.URL.Query().Get("session")
+        }
+        ip := remoteIP(r).String()
+        now := time.Now()
+        expires := now.Add(time.Duration(s.config.SessionWindowSeconds) * time.Second)
+        s.sessionsMu.Lock()
+        sess, ok := s.sessions[token]
+        live := ok && sess.ip == ip && now.Before(sess.expires)
+        switch {
+        case live:
+            sess.expires = expires
+        default:
+            token = s.newSession(ip, expires)
+        }
+        s.sessionsMu.Unlock()
+        if token != "" {
+            w.Header().Set("X-Patch-Session", token)
+        }
+        h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey{}, live)))
+    })
+}
+
+// newSession opens a session for ip, replacing the oldest of ip once it
+// has maxSessionsPerIP, and returns its token, or "" when the table is
+// full. sessionsMu must be held.
+func (s *Server) newSession(ip string, expires time.Time) string {
+    tokens := s.sessionsByIP[ip]
+    if len(tokens) >= maxSessionsPerIP {
+        delete(s.sessions, tokens[0])
+        tokens = tokens[1:]
+        s.sessionsByIP[ip] = tokens
+    }
+    if len(s.sessions) >= maxSessions {
+        return ""
+    }
+    token := randomHex(16)
+    s.sessions[token] = &patchSession{ip: ip, expires: expires}
+    s.sessionsByIP[ip] = append(tokens, token)
+    s.sessionsGranted.Add(1)
+    return token
+}
+
+// sessionSweepLoop forgets expired sessions
+func (s *Server) sessionSweepLoop() {
+    for range time.Tick(time.Duration(s.config.SessionWindowSeconds) * time.Second) {
+        now := time.Now()
+        s.sessionsMu.Lock()
+        for token, sess := range s.sessions {
+            if now.After(sess.expires) {
+                delete(s.sessions, token)
+            }
+        }
+        for ip, tokens := range s.sessionsByIP {
+            live := tokens[:0]
+            for _, token := range tokens {
+                if _, ok := s.sessions[token]; ok {
+                    live = append(live, token)
+                }
+            }
+            if len(live) == 0 {
+                delete(s.sessionsByIP, ip)
+            } else {
+                s.sessionsByIP[ip] = live
+            }
+        }
+        s.sessionsMu.Unlock()
+    }
+}
+
+// registerSession adds the session gauge and counter
+func (s *Server) registerSession() {
+    s.registerMetric("patch_sessions_open", "gauge", "Patch sessions whose window has not been swept yet.", func() float64 {
+        s.sessionsMu.Lock()
+        defer s.sessionsMu.Unlock()
+        return float64(len(s.sessions))
+    })
+    s.registerMetric("patch_sessions_granted_total", "counter", "Patch session tokens handed out.", func() float64 {
+        return float64(s.sessionsGranted.Load())
+    })
+}
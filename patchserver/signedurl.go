@@ -0,0 +1,133 @@
+package patchserver
+
+import (
+    "bufio"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// maxAuthorizePaths caps the paths one /authorize request may sign
+const maxAuthorizePaths = 100000
+
+// urlSignature is the hex HMAC of a manifest path of ch valid until expires
+func (s *Server) urlSignature(ch *channel, p string, expires int64) string {
+    mac := hmac.New(sha256.New, []byte(s.config.URLSigningKey))
+    mac.Write([]byte(ch.name + "\n" + p + "\n" + strconv.FormatInt(expires, 10)))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedURL returns the channel-relative URL of p with its signature
+func (s *Server) signedURL(ch *channel, p string, expires int64) string {
+    q := url.Values{"expires": {strconv.FormatInt(expires, 10)}, "sig": {s.urlSignature(ch, p, expires)}}
+    return (&url.URL{Path: p}).EscapedPath() + "?" + q.Encode()
+}
+
+// needsSignature reports whether downloads of size bytes must carry a
+// signature from /authorize
+func (s *Server) needsSignature(size int64) bool {
+    return s.config.URLSigningKey != "" && size >= int64(s.config.SignedURLMinKB)<<10
+}
+
+// allowDownload checks the expires and sig query of a download of the
+// manifest path p, answering 403 when they are required and not valid.
+// The signature of a file also covers its /v/ and /chunks/ URLs.
+func (s *Server) allowDownload(w http.ResponseWriter, r *http.Request, p string, size int64) bool {
+    if !s.needsSignature(size) {
+        return true
+    }
+    ch, _ := s.manifestFor(r)
+    query := r.URL.Query()
+    expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+    switch {
+    case err != nil || query.Get("sig") == "":
+        http.Error(w, "signed URL required, see /authorize", http.StatusForbidden)
+    case time.Now().Unix() > expires:
+        http.Error(w, "signed URL expired", http.StatusForbidden)
+    case !hmac.Equal([]byte(query.Get("sig")), []byte(s.urlSignature(ch, p, expires))):
+        http.Error(w, "invalid signature", http.StatusForbidden)
+    default:
+        return true
+    }
+    return false
+}
+
+// signedFiles guards the plain file downloads of h
+func (s *Server) signedFiles(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.config.URLSigningKey != "" {
+            _, data := s.manifestFor(r)
+            if e, ok := data.Lookup(r.URL.Path); ok && !s.allowDownload(w, r, e.Path, e.Size) {
+                return
+            }
+        }
+        h(w, r)
+    }
+}
+
+type authorizeResponse struct {
+    Expires int64             `json:"expires"`
+    URLs    map[string]string `json:"urls"`
+    Missing []string          `json:"missing,omitempty"`
+}
+
+// authorizeHandler signs download URLs for the manifest paths given as
+// path query values or, in a POST body, one per line. URLs are relative to
+// the channel base and valid for SignedURLTTLSeconds. Bundles are signed
+// as "/bundle/{group}" or "/bundle/diff/{fromEtag}".
+func (s *Server) authorizeHandler(w http.ResponseWriter, r *http.Request) {
+    if s.config.URLSigningKey == "" {
+        http.NotFound(w, r)
+        return
+    }
+    paths := r.URL.Query()["path"]
+    if r.Method == http.MethodPost {
+        scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxDiffBody))
+        for scanner.Scan() {
+            if p := strings.TrimSpace(scanner.Text()); p != "" {
+                paths = append(paths, p)
+            }
+        }
+        if err := scanner.Err(); err != nil {
+            http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    if len(paths) == 0 || len(paths) > maxAuthorizePaths {
+        http.Error(w, "give 1-"+strconv.Itoa(maxAuthorizePaths)+" paths", http.StatusBadRequest)
+        return
+    }
+    ch, data := s.manifestFor(r)
+    resp := authorizeResponse{
+        Expires: time.Now().Add(time.Duration(s.config.SignedURLTTLSeconds) * time.Second).Unix(),
+        URLs:    map[string]string{},
+    }
+    for _, p := range paths {
+        e, known := data.Resolve(p)
+        signed := e.Path
+        if group, ok := strings.CutPrefix(p, "/bundle/"); ok {
+            _, err := s.parseGroups(group)
+            known, signed = err == nil && !strings.Contains(group, ","), p
+            if from, ok := strings.CutPrefix(group, DiffBundle+"/"); ok {
+                signed = "/bundle/" + DiffBundle + "/" + versionID(from)
+                known = s.config.KeepVersions > 0 && versionID(from) != ""
+            }
+        }
+        if !known {
+            resp.Missing = append(resp.Missing, p)
+            continue
+        }
+        resp.URLs[p] = s.signedURL(ch, signed, resp.Expires)
+    }
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Type", "application/json")
+    enc := json.NewEncoder(w)
+    enc.SetEscapeHTML(false)
+    enc.Encode(resp)
+}
@@ -0,0 +1,72 @@
+package patchserver
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/base64"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+)
+
+// loadSigningKey reads a base64 encoded Ed25519 seed as written by genkey
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    if len(seed) != ed25519.SeedSize {
+        return nil, fmt.Errorf("%s: expected %d byte seed, got %d", path, ed25519.SeedSize, len(seed))
+    }
+    return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// genkeyCommand writes <name>.key (private seed) and <name>.pub (public key
+// for embedding in launchers), both base64 encoded
+func genkeyCommand(args []string) {
+    fset := flag.NewFlagSet("genkey", flag.ExitOnError)
+    name := fset.String("out", "manifest", "output file prefix")
+    fset.Parse(args)
+
+    pub, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        log.Fatal(err)
+    }
+    seed := base64.StdEncoding.EncodeToString(priv.Seed()) + "\n"
+    if err := os.WriteFile(*name+".key", []byte(seed), 0600); err != nil {
+        log.Fatal(err)
+    }
+    pubText := base64.StdEncoding.EncodeToString(pub)
+    if err := os.WriteFile(*name+".pub", []byte(pubText+"\n"), 0644); err != nil {
+        log.Fatal(err)
+    }
+    fmt.Printf("Wrote %s.key and %s.pub\nPublic key: %s\n", *name, *name, pubText)
+}
+
+// signManifest returns the base64 signature of body by the first of
+// signers, or nil if there is none
+func signManifest(signers []*signer, body []byte) []byte {
+    if len(signers) == 0 {
+        return nil
+    }
+    return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(signers[0].key, body)))
+}
+
+func (s *Server) checkSigHandler(w http.ResponseWriter, r *http.Request) {
+    _, data := s.manifestFor(r)
+    sig, _ := s.signatures(data)
+    if sig == nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("ETag", data.ChecksumHeader)
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Write(sig)
+}
@@ -0,0 +1,104 @@
+package patchserver
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// Snapshot modes
+const (
+    SnapshotCopy     = "copy"
+    SnapshotHardlink = "hardlink"
+)
+
+// snapshotManifest stores the files of a freshly built manifest in
+// SnapshotFolder by checksum and points data at it. Copies are immune to
+// anything the operator does to the originals; hard links cost no space
+// but share writes made in place, so their files are checked again before
+// they are served (see DirData.shared). Files whose size or mtime no longer
+// match what was hashed changed during the scan and fail it, keeping the
+// previous manifest.
+func (s *Server) snapshotManifest(ch *channel, data *DirData) error {
+    if s.config.SnapshotFolder == "" {
+        return nil
+    }
+    if err := os.MkdirAll(s.config.SnapshotFolder, 0755); err != nil {
+        return err
+    }
+    for _, e := range data.Entries {
+        dst := filepath.Join(s.config.SnapshotFolder, e.SHA256)
+        if _, err := os.Stat(dst); err == nil {
+            continue
+        }
+        if s.config.SnapshotMode == SnapshotCopy {
+            if err := copyInto(s.config.SnapshotFolder, ch, data, e); err != nil {
+                return err
+            }
+        } else if err := os.Link(ch.filePath(data, e), dst); err != nil {
+            // other file systems cannot link, fall back to copying
+            if errors.Is(err, os.ErrExist) {
+                continue
+            }
+            if err := copyInto(s.config.SnapshotFolder, ch, data, e); err != nil {
+                return err
+            }
+        }
+        info, err := ch.stat(data, e)
+        if err != nil || info.Size() != e.Size || info.ModTime().UnixNano() != e.modTimeNano {
+            os.Remove(dst)
+            return fmt.Errorf("%s changed while scanning", e.Path)
+        }
+    }
+    data.ObjectDir = s.config.SnapshotFolder
+    return nil
+}
+
+// servedChecksums returns the checksums of the files every channel
+// serves: those of its current manifest and, during a rollout, of the
+// version clients are held back on. ok is false until every channel has a
+// manifest.
+func (s *Server) servedChecksums() (used map[string]bool, ok bool) {
+    used = map[string]bool{}
+    for _, ch := range s.channels {
+        data := ch.data.Load()
+        if data == nil {
+            return nil, false
+        }
+        for _, e := range data.Entries {
+            used[e.SHA256] = true
+        }
+        if ro := ch.rollout.Load(); ro != nil {
+            for _, e := range ro.from.Entries {
+                used[e.SHA256] = true
+            }
+        }
+    }
+    return used, true
+}
+
+// pruneSnapshots removes snapshot files no served manifest refers to.
+// Downloads already in progress keep reading their open file.
+func (s *Server) pruneSnapshots() {
+    if s.config.SnapshotFolder == "" {
+        return
+    }
+    used, ok := s.servedChecksums()
+    if !ok {
+        return
+    }
+    files, err := os.ReadDir(s.config.SnapshotFolder)
+    if err != nil {
+        log.Printf("Pruning snapshots: %v", err)
+        return
+    }
+    for _, f := range files {
+        checksum, _, _ := strings.Cut(f.Name(), ".")
+        if !used[checksum] {
+            os.Remove(filepath.Join(s.config.SnapshotFolder, f.Name()))
+        }
+    }
+}
@@ -0,0 +1,322 @@
+package patchserver
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    bolt "go.etcd.io/bbolt"
+)
+
+// storeFlushInterval is how often download counts are written to the store
+const storeFlushInterval = 10 * time.Second
+
+// store keeps per-channel file metadata, publish history, download counts
+// and manifest bodies (see storeBodies) in StoreFile. Layout:
+// channels/<channel>/{files,history,downloads,bodies}.
+
+var (
+    bucketChannels  = []byte("channels")
+    bucketFiles     = []byte("files")
+    bucketHistory   = []byte("history")
+    bucketDownloads = []byte("downloads")
+)
+
+// StoredFile is the files record of one path; ModTimeNano lets rescans
+// reuse the checksum of files whose size and mtime did not change
+type StoredFile struct {
+    SHA256      string           `json:"sha256"`
+    Size        int64            `json:"size"`
+    ModTimeNano int64            `json:"mtime_ns"`
+    Encodings   map[string]int64 `json:"encodings,omitempty"`
+}
+
+// Stored returns the files record of e
+func (e ManifestEntry) Stored() StoredFile {
+    return StoredFile{e.SHA256, e.Size, e.modTimeNano, e.Encodings}
+}
+
+// boltManifests is the default ManifestStore, kept in StoreFile when it is
+// set and doing nothing otherwise
+type boltManifests struct{ s *Server }
+
+func (m boltManifests) File(channel, path string) (StoredFile, bool) {
+    return m.s.storedFile(channel, path)
+}
+
+func (m boltManifests) Save(channel string, data, old *DirData) error {
+    return m.s.saveManifest(channel, data, old)
+}
+
+// HistoryEntry records one publish of a channel
+type HistoryEntry struct {
+    ETag      string `json:"etag"`
+    Previous  string `json:"previous,omitempty"`
+    Published int64  `json:"published"`
+    Files     int    `json:"files"`
+    Bytes     int64  `json:"bytes"`
+}
+
+// storeState holds the StoreFile database and the download counts not
+// saved to it yet
+type storeState struct {
+    store            *bolt.DB
+    downloadsMu      sync.Mutex
+    pendingDownloads map[string]map[string]uint64 // channel -> path -> count
+}
+
+// openStore opens StoreFile and starts flushing download counts
+func (s *Server) openStore(path string) error {
+    db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+    if err != nil {
+        return fmt.Errorf("opening store %s: %w", path, err)
+    }
+    s.store = db
+    go func() {
+        for range time.Tick(storeFlushInterval) {
+            s.flushDownloads()
+        }
+    }()
+    return nil
+}
+
+// channelBucket returns the named bucket of ch, creating it in writable
+// transactions; it is nil when a read transaction finds nothing
+func channelBucket(tx *bolt.Tx, ch, name []byte) (*bolt.Bucket, error) {
+    if !tx.Writable() {
+        root := tx.Bucket(bucketChannels)
+        if root == nil || root.Bucket(ch) == nil {
+            return nil, nil
+        }
+        return root.Bucket(ch).Bucket(name), nil
+    }
+    root, err := tx.CreateBucketIfNotExists(bucketChannels)
+    if err != nil {
+        return nil, err
+    }
+    b, err := root.CreateBucketIfNotExists(ch)
+    if err != nil {
+        return nil, err
+    }
+    return b.CreateBucketIfNotExists(name)
+}
+
+// storedFile returns the record of path in the channel's last manifest,
+// false without a store
+func (s *Server) storedFile(channel, path string) (StoredFile, bool) {
+    if s.store == nil {
+        return StoredFile{}, false
+    }
+    var f StoredFile
+    found := false
+    err := s.store.View(func(tx *bolt.Tx) error {
+        b, err := channelBucket(tx, []byte(channel), bucketFiles)
+        if b == nil || err != nil {
+            return err
+        }
+        if v := b.Get([]byte(path)); v != nil {
+            found = json.Unmarshal(v, &f) == nil
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Reading %s%s from store: %v", channel, path, err)
+    }
+    return f, found
+}
+
+// saveManifest replaces the channel's file records with data and appends a
+// history entry when it was published
+func (s *Server) saveManifest(channel string, data *DirData, old *DirData) error {
+    if s.store == nil {
+        return nil
+    }
+    return s.store.Update(func(tx *bolt.Tx) error {
+        name := []byte(channel)
+        if _, err := channelBucket(tx, name, bucketFiles); err != nil {
+            return err
+        }
+        // recreate the bucket so removed files go away
+        b := tx.Bucket(bucketChannels).Bucket(name)
+        if err := b.DeleteBucket(bucketFiles); err != nil {
+            return err
+        }
+        files, err := b.CreateBucket(bucketFiles)
+        if err != nil {
+            return err
+        }
+        var total int64
+        for _, e := range data.Entries {
+            total += e.Size
+            v, _ := json.Marshal(e.Stored())
+            if err := files.Put([]byte(e.Path), v); err != nil {
+                return err
+            }
+        }
+        if old != nil && old.ChecksumHeader == data.ChecksumHeader {
+            return nil
+        }
+        history, err := channelBucket(tx, name, bucketHistory)
+        if err != nil {
+            return err
+        }
+        entry := HistoryEntry{ETag: data.ChecksumHeader, Published: time.Now().Unix(), Files: len(data.Entries), Bytes: total}
+        if old != nil {
+            entry.Previous = old.ChecksumHeader
+        }
+        v, _ := json.Marshal(entry)
+        return history.Put(binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())), v)
+    })
+}
+
+// countDownload records a completed download of path from ch
+func (s *Server) countDownload(ch *channel, path string) {
+    s.downloadsMu.Lock()
+    defer s.downloadsMu.Unlock()
+    counts := s.pendingDownloads[ch.name]
+    if counts == nil {
+        counts = map[string]uint64{}
+        s.pendingDownloads[ch.name] = counts
+    }
+    counts[path]++
+}
+
+// flushDownloads adds the pending download counts to the store
+func (s *Server) flushDownloads() {
+    s.downloadsMu.Lock()
+    pending := s.pendingDownloads
+    s.pendingDownloads = map[string]map[string]uint64{}
+    s.downloadsMu.Unlock()
+    if len(pending) == 0 {
+        return
+    }
+    err := s.store.Update(func(tx *bolt.Tx) error {
+        for name, counts := range pending {
+            b, err := channelBucket(tx, []byte(name), bucketDownloads)
+            if err != nil {
+                return err
+            }
+            for path, n := range counts {
+                if v := b.Get([]byte(path)); len(v) == 8 {
+                    n += binary.BigEndian.Uint64(v)
+                }
+                if err := b.Put([]byte(path), binary.BigEndian.AppendUint64(nil, n)); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        log.Printf("Saving download counts: %v", err)
+    }
+}
+
+// countingFiles counts complete (200) GETs of manifest files served by h
+func (s *Server) countingFiles(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.store == nil || r.Method != http.MethodGet {
+            h(w, r)
+            return
+        }
+        rec := &statusRecorder{ResponseWriter: w}
+        h(rec, r)
+        ch, data := s.manifestFor(r)
+        if _, ok := data.Lookup(r.URL.Path); ok && rec.status == http.StatusOK {
+            s.countDownload(ch, r.URL.Path)
+        }
+    }
+}
+
+type downloadCount struct {
+    Path      string `json:"path"`
+    Downloads uint64 `json:"downloads"`
+}
+
+// adminStatsHandler lists the most downloaded files of a channel
+func (s *Server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    limit, err := strconv.Atoi(r.FormValue("limit"))
+    if err != nil || limit <= 0 {
+        limit = 100
+    }
+    s.flushDownloads()
+    counts := []downloadCount{}
+    err = s.store.View(func(tx *bolt.Tx) error {
+        b, err := channelBucket(tx, []byte(ch.name), bucketDownloads)
+        if b == nil || err != nil {
+            return err
+        }
+        return b.ForEach(func(k, v []byte) error {
+            if len(v) == 8 {
+                counts = append(counts, downloadCount{string(k), binary.BigEndian.Uint64(v)})
+            }
+            return nil
+        })
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    sort.Slice(counts, func(i, j int) bool { return counts[i].Downloads > counts[j].Downloads })
+    if len(counts) > limit {
+        counts = counts[:limit]
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(counts)
+}
+
+// adminHistoryHandler lists the publishes of a channel, newest first
+func (s *Server) adminHistoryHandler(w http.ResponseWriter, r *http.Request) {
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    history := []HistoryEntry{}
+    err := s.store.View(func(tx *bolt.Tx) error {
+        b, err := channelBucket(tx, []byte(ch.name), bucketHistory)
+        if b == nil || err != nil {
+            return err
+        }
+        c := b.Cursor()
+        for k, v := c.Last(); k != nil; k, v = c.Prev() {
+            var e HistoryEntry
+            if json.Unmarshal(v, &e) == nil {
+                history = append(history, e)
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(history)
+}
+
+// requireStore answers 404 while no StoreFile is configured
+func (s *Server) requireStore(h http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.store == nil {
+            http.Error(w, "StoreFile is not configured", http.StatusNotFound)
+            return
+        }
+        h(w, r)
+    }
+}
+
+// registerStore adds /admin/stats and /admin/history
+func (s *Server) registerStore() {
+    s.adminMux.HandleFunc("/admin/stats", s.requireStore(s.adminStatsHandler))
+    s.adminMux.HandleFunc("/admin/history", s.requireStore(s.adminHistoryHandler))
+}
@@ -0,0 +1,235 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // telemetryMemory is how many error reports are kept
+    telemetryMemory = 1000
+    // maxTelemetryFiles and maxTelemetryClients bound the files errors are
+    // counted for and the IPs rate limited at once
+    maxTelemetryFiles   = 10000
+    maxTelemetryClients = 10000
+    maxTelemetryBody    = 4 << 10
+)
+
+// ErrorReport is what launchers POST to /telemetry/error when a download
+// fails. Stage is where it failed, e.g. "download", "verify" or "install".
+type ErrorReport struct {
+    Path     string `json:"path"`
+    Expected string `json:"expected"`
+    Actual   string `json:"actual,omitempty"`
+    Status   int    `json:"status,omitempty"`
+    Stage    string `json:"stage"`
+    ETag     string `json:"etag,omitempty"`
+    Message  string `json:"message,omitempty"`
+}
+
+// TelemetryEntry is a received ErrorReport
+type TelemetryEntry struct {
+    ErrorReport
+    Time    int64  `json:"time"`
+    Channel string `json:"channel"`
+}
+
+// FileErrors sums up the reports about one file of a channel. Current is
+// whether Expected is still the file's checksum in the manifest; reports
+// from many clients about a current file point at a corrupt copy on the
+// server rather than at flaky connections. Only a checksum the file had
+// in the manifest when reported gets its own FileErrors; the others are
+// summed up under an empty Expected, so made-up checksums cannot fill the
+// table.
+type FileErrors struct {
+    Channel    string `json:"channel"`
+    Path       string `json:"path"`
+    Expected   string `json:"expected"`
+    Current    bool   `json:"current"`
+    Reports    int    `json:"reports"`
+    Clients    int    `json:"clients"`
+    LastStage  string `json:"last_stage"`
+    LastStatus int    `json:"last_status,omitempty"`
+    LastActual string `json:"last_actual,omitempty"`
+    Last       int64  `json:"last"`
+    clients    map[string]bool
+    alerted    bool
+}
+
+// telemetryClient is the rate limit window of one IP
+type telemetryClient struct {
+    start time.Time
+    count int
+}
+
+// telemetryState holds the download errors reported by launchers
+type telemetryState struct {
+    telemetryMu      sync.Mutex
+    telemetryRecent  []TelemetryEntry
+    telemetryFiles   map[[3]string]*FileErrors
+    telemetryClients map[string]*telemetryClient
+    telemetryTotal   atomic.Int64
+    telemetryLimited atomic.Int64
+}
+
+// telemetryAllow applies TelemetryPerMinute to ip, telemetryMu must be
+// held
+func (s *Server) telemetryAllow(ip string, now time.Time) bool {
+    if len(s.telemetryClients) > maxTelemetryClients {
+        for k, c := range s.telemetryClients {
+            if now.Sub(c.start) >= time.Minute {
+                delete(s.telemetryClients, k)
+            }
+        }
+    }
+    c, ok := s.telemetryClients[ip]
+    if !ok || now.Sub(c.start) >= time.Minute {
+        c = &telemetryClient{start: now}
+        s.telemetryClients[ip] = c
+    }
+    c.count++
+    return c.count <= s.config.TelemetryPerMinute
+}
+
+func (s *Server) telemetryErrorHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var report ErrorReport
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTelemetryBody)).Decode(&report); err != nil || report.Path == "" || report.Stage == "" {
+        http.Error(w, "invalid error report, path and stage are required", http.StatusBadRequest)
+        return
+    }
+    ch, data := s.manifestFor(r)
+    e, known := data.Resolve(report.Path)
+    if !known {
+        http.Error(w, "unknown path", http.StatusNotFound)
+        return
+    }
+    ip := remoteIP(r).String()
+    now := time.Now()
+
+    s.telemetryMu.Lock()
+    defer s.telemetryMu.Unlock()
+    if !s.telemetryAllow(ip, now) {
+        s.telemetryLimited.Add(1)
+        w.Header().Set("Retry-After", "60")
+        http.Error(w, "too many error reports", http.StatusTooManyRequests)
+        return
+    }
+    s.telemetryTotal.Add(1)
+    report.Path = e.Path
+    s.telemetryRecent = append(s.telemetryRecent, TelemetryEntry{ErrorReport: report, Time: now.Unix(), Channel: ch.name})
+    if len(s.telemetryRecent) > telemetryMemory {
+        s.telemetryRecent = s.telemetryRecent[len(s.telemetryRecent)-telemetryMemory:]
+    }
+    key := [3]string{ch.name, e.Path, report.Expected}
+    f, ok := s.telemetryFiles[key]
+    if !ok && report.Expected != e.SHA256 {
+        key[2] = ""
+        f, ok = s.telemetryFiles[key]
+    }
+    if !ok {
+        if len(s.telemetryFiles) >= maxTelemetryFiles {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        f = &FileErrors{Channel: ch.name, Path: e.Path, Expected: key[2], clients: map[string]bool{}}
+        s.telemetryFiles[key] = f
+    }
+    f.Current = f.Expected == e.SHA256
+    f.Reports++
+    f.clients[ip] = true
+    f.Clients = len(f.clients)
+    f.LastStage, f.LastStatus, f.LastActual, f.Last = report.Stage, report.Status, report.Actual, now.Unix()
+    if s.config.TelemetryAlertClients > 0 && f.Current && !f.alerted && f.Clients >= s.config.TelemetryAlertClients {
+        f.alerted = true
+        s.notify(EventFileErrors, fmt.Sprintf("%d clients failed to download %s from %s", f.Clients, f.Path, ch.name), map[string]any{
+            "channel":  ch.name,
+            "path":     f.Path,
+            "expected": f.Expected,
+            "clients":  f.Clients,
+            "stage":    f.LastStage,
+        })
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// fileErrors returns the files with reported errors, those reported by the
+// most clients first, optionally of one channel and at most limit
+func (s *Server) fileErrors(channel string, limit int) []FileErrors {
+    s.telemetryMu.Lock()
+    defer s.telemetryMu.Unlock()
+    out := []FileErrors{}
+    for _, f := range s.telemetryFiles {
+        if channel == "" || f.Channel == channel {
+            out = append(out, *f)
+        }
+    }
+    sort.Slice(out, func(i, j int) bool {
+        if out[i].Clients != out[j].Clients {
+            return out[i].Clients > out[j].Clients
+        }
+        return out[i].Last > out[j].Last
+    })
+    if limit > 0 && len(out) > limit {
+        out = out[:limit]
+    }
+    return out
+}
+
+// adminTelemetryHandler lists the files with errors and the latest reports
+// (channel, limit)
+func (s *Server) adminTelemetryHandler(w http.ResponseWriter, r *http.Request) {
+    channel := r.URL.Query().Get("channel")
+    limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+    if limit <= 0 {
+        limit = 100
+    }
+    files := s.fileErrors(channel, limit)
+    s.telemetryMu.Lock()
+    recent := []TelemetryEntry{}
+    for i := len(s.telemetryRecent) - 1; i >= 0 && len(recent) < limit; i-- {
+        if channel == "" || s.telemetryRecent[i].Channel == channel {
+            recent = append(recent, s.telemetryRecent[i])
+        }
+    }
+    s.telemetryMu.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"files": files, "recent": recent})
+}
+
+// adminTelemetryClearHandler forgets every report, e.g. once a corrupt
+// file was replaced
+func (s *Server) adminTelemetryClearHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    s.telemetryMu.Lock()
+    n := len(s.telemetryFiles)
+    s.telemetryRecent = nil
+    s.telemetryFiles = map[[3]string]*FileErrors{}
+    s.telemetryMu.Unlock()
+    s.audit(adminActor(r), "telemetry_clear", "", fmt.Sprintf("%d files", n), nil)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// registerTelemetry adds the telemetry admin endpoints and counters
+func (s *Server) registerTelemetry() {
+    s.adminMux.HandleFunc("/admin/telemetry", s.adminTelemetryHandler)
+    s.adminMux.HandleFunc("/admin/telemetry/clear", s.adminTelemetryClearHandler)
+    s.registerMetric("patch_telemetry_errors_total", "counter", "Download errors reported by launchers", func() float64 {
+        return float64(s.telemetryTotal.Load())
+    })
+    s.registerMetric("patch_telemetry_rate_limited_total", "counter", "Error reports refused by TelemetryPerMinute", func() float64 {
+        return float64(s.telemetryLimited.Load())
+    })
+}
@@ -0,0 +1,110 @@
+package patchserver
+
+import (
+    "net"
+    "net/http"
+    "strings"
+    "sync/atomic"
+)
+
+// DefaultTenantName labels the tenant configured by the top-level fields
+const DefaultTenantName = "default"
+
+// TenantConfig is an additional game server hosted by this process,
+// selected by Host header or by a /{Name}/ path prefix on both servers
+type TenantConfig struct {
+    Name         string          `json:"Name"`
+    Hosts        []string        `json:"Hosts"`
+    GameFolder   string          `json:"GameFolder"`
+    ImageFolder  string          `json:"ImageFolder"`
+    MaxClients   int             `json:"MaxClients"`
+    ImageQuotaMB int             `json:"ImageQuotaMB"`
+    Force        bool            `json:"Force"`
+    Locales      []LocaleConfig  `json:"Locales"`
+    Channels     []ChannelConfig `json:"Channels"`
+}
+
+type tenant struct {
+    name           string
+    hosts          []string
+    imageFolder    string
+    imageQuota     int64  // bytes, 0 = unlimited
+    slots          *slots // file downloads
+    lightSlots     *slots // manifests and other small responses, see isLightRequest
+    channels       map[string]*channel
+    defaultChannel *channel
+    patch          http.Handler
+    images         http.Handler
+}
+
+// tenantState holds the default tenant and the configured ones by name
+type tenantState struct {
+    defaultTenant *tenant
+    tenants       map[string]*tenant
+}
+
+// setupTenants builds the default tenant and every configured one along
+// with their channels, opening each game root with folder
+func (s *Server) setupTenants(folder folderFiles) {
+    s.defaultTenant = &tenant{
+        name:        DefaultTenantName,
+        imageFolder: s.config.ImageFolder,
+        imageQuota:  int64(s.config.ImageQuotaMB) << 20,
+        slots:       newSlots(s.config.MaxClients),
+        lightSlots:  newSlots(s.config.LightMaxClients),
+        channels:    s.newChannels("", s.config.GameFolder, s.config.Force, s.config.Locales, s.config.Channels, &s.folderData, folder),
+    }
+    s.defaultTenant.defaultChannel = s.defaultTenant.channels[DefaultChannelName]
+    s.defaultChannel = s.defaultTenant.defaultChannel
+    for _, tc := range s.config.Tenants {
+        t := &tenant{
+            name:        tc.Name,
+            hosts:       tc.Hosts,
+            imageFolder: tc.ImageFolder,
+            imageQuota:  int64(tc.ImageQuotaMB) << 20,
+            slots:       newSlots(tc.MaxClients),
+            lightSlots:  newSlots(s.config.LightMaxClients),
+            channels:    s.newChannels(tc.Name+"/", tc.GameFolder, tc.Force, tc.Locales, tc.Channels, new(atomic.Pointer[DirData]), folder),
+        }
+        t.defaultChannel = t.channels[DefaultChannelName]
+        s.tenants[t.name] = t
+    }
+}
+
+// allTenants returns the default tenant followed by the configured ones
+func (s *Server) allTenants() []*tenant {
+    list := []*tenant{s.defaultTenant}
+    for _, tc := range s.config.Tenants {
+        list = append(list, s.tenants[tc.Name])
+    }
+    return list
+}
+
+// tenantFor matches the Host header first, then a /{tenant}/ path prefix,
+// which is stripped from the returned request
+func (s *Server) tenantFor(r *http.Request) (*tenant, *http.Request) {
+    host, _, err := net.SplitHostPort(r.Host)
+    if err != nil {
+        host = r.Host
+    }
+    for _, t := range s.tenants {
+        for _, h := range t.hosts {
+            if strings.EqualFold(h, host) {
+                return t, r
+            }
+        }
+    }
+    first, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+    if t, ok := s.tenants[first]; ok {
+        return t, withPath(r, "/"+rest)
+    }
+    return s.defaultTenant, r
+}
+
+// tenantRouter dispatches to the handler pick returns for the tenant
+func (s *Server) tenantRouter(pick func(*tenant) http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t, r := s.tenantFor(r)
+        pick(t).ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,466 @@
+package patchserver
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// trackerInterval is the announce interval given to peers; peers that miss
+// two announces are dropped
+const trackerInterval = 15 * time.Minute
+
+// torrentMeta is the bencoded info dictionary of one published version
+type torrentMeta struct {
+    info     []byte
+    infoHash [20]byte
+    // archived serves the web seed once the version is no longer current,
+    // looked up on first use
+    archived *DirData
+}
+
+// torrentState holds the torrents of every channel
+type torrentState struct {
+    torrentMu sync.Mutex
+    // torrents holds the metadata of the current and archived versions of
+    // each channel by "<channel> <version ID>"
+    torrents map[string]*torrentMeta
+    // torrentBuilds are the keys of the torrents being hashed
+    torrentBuilds map[string]bool
+}
+
+// bencode appends the bencoding of v (string, []byte, int, int64, []any or
+// map[string]any) to buf
+func bencode(buf *bytes.Buffer, v any) {
+    switch v := v.(type) {
+    case string:
+        fmt.Fprintf(buf, "%d:%s", len(v), v)
+    case []byte:
+        fmt.Fprintf(buf, "%d:", len(v))
+        buf.Write(v)
+    case int:
+        fmt.Fprintf(buf, "i%de", v)
+    case int64:
+        fmt.Fprintf(buf, "i%de", v)
+    case []any:
+        buf.WriteByte('l')
+        for _, item := range v {
+            bencode(buf, item)
+        }
+        buf.WriteByte('e')
+    case map[string]any:
+        keys := make([]string, 0, len(v))
+        for k := range v {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        buf.WriteByte('d')
+        for _, k := range keys {
+            bencode(buf, k)
+            bencode(buf, v[k])
+        }
+        buf.WriteByte('e')
+    default:
+        panic(fmt.Sprintf("bencode: unsupported type %T", v))
+    }
+}
+
+// torrentName is the top-level folder of a channel's torrent
+func torrentName(ch *channel) string {
+    return filepath.Base(ch.root)
+}
+
+// buildTorrentInfo hashes the files of data into TorrentPieceKB pieces,
+// treating them as one stream in manifest order
+func (s *Server) buildTorrentInfo(ch *channel, data *DirData) ([]byte, error) {
+    pieceLength := s.config.TorrentPieceKB << 10
+    var pieces []byte
+    var files []any
+    piece := make([]byte, 0, pieceLength)
+    h := sha1.New()
+    for _, e := range data.Entries {
+        f, err := ch.open(data, e)
+        if err != nil {
+            return nil, err
+        }
+        for {
+            n, err := io.ReadFull(f, piece[len(piece):pieceLength])
+            piece = piece[:len(piece)+n]
+            if len(piece) == pieceLength {
+                h.Reset()
+                h.Write(piece)
+                pieces = h.Sum(pieces)
+                piece = piece[:0]
+            }
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                break
+            }
+            if err != nil {
+                f.Close()
+                return nil, err
+            }
+        }
+        f.Close()
+        var path []any
+        for _, part := range strings.Split(strings.TrimPrefix(e.Path, "/"), "/") {
+            path = append(path, part)
+        }
+        files = append(files, map[string]any{"length": e.Size, "path": path})
+    }
+    if len(piece) > 0 {
+        h.Reset()
+        h.Write(piece)
+        pieces = h.Sum(pieces)
+    }
+    var buf bytes.Buffer
+    bencode(&buf, map[string]any{
+        "name":         torrentName(ch),
+        "piece length": pieceLength,
+        "pieces":       pieces,
+        "files":        files,
+    })
+    return buf.Bytes(), nil
+}
+
+// torrentFile is where the torrent of version id of ch is kept, next to
+// the archived version. The piece size is part of the name so changing
+// TorrentPieceKB rebuilds it.
+func (s *Server) torrentFile(ch *channel, id string) string {
+    return filepath.Join(s.versionsDir(ch), fmt.Sprintf("%s_%dk.torrent", id, s.config.TorrentPieceKB))
+}
+
+// buildTorrent hashes the torrent of data, which ch just published, unless
+// it is known already, then drops the torrents of versions ch no longer
+// serves or archives. It runs at publish time so /torrent never hashes
+// the game on a request.
+func (s *Server) buildTorrent(ch *channel, data *DirData) {
+    id := versionID(data.ChecksumHeader)
+    key := ch.name + " " + id
+    s.torrentMu.Lock()
+    if s.torrents[key] != nil || s.torrentBuilds[key] {
+        s.torrentMu.Unlock()
+        return
+    }
+    s.torrentBuilds[key] = true
+    s.torrentMu.Unlock()
+
+    m := &torrentMeta{}
+    if info, err := os.ReadFile(s.torrentFile(ch, id)); err == nil && s.config.KeepVersions > 0 {
+        m.info = info
+    } else {
+        start := time.Now()
+        if m.info, err = s.buildTorrentInfo(ch, data); err != nil {
+            log.Printf("Building torrent for %s %s failed: %v", ch.name, data.ChecksumHeader, err)
+            m = nil
+        } else {
+            log.Printf("Torrent for %s %s built in %s", ch.name, data.ChecksumHeader, time.Since(start).Round(time.Millisecond))
+            if s.config.KeepVersions > 0 {
+                if err := os.WriteFile(s.torrentFile(ch, id), m.info, 0644); err != nil {
+                    log.Printf("Saving torrent for %s %s failed: %v", ch.name, data.ChecksumHeader, err)
+                }
+            }
+        }
+    }
+    s.torrentMu.Lock()
+    delete(s.torrentBuilds, key)
+    if m != nil {
+        m.infoHash = sha1.Sum(m.info)
+        s.torrents[key] = m
+    }
+    s.torrentMu.Unlock()
+    s.retainTorrents(ch)
+}
+
+// retainTorrents keeps the torrents of the current and archived versions
+// of ch, loading those of archived versions saved before a restart
+func (s *Server) retainTorrents(ch *channel) {
+    keep := map[string]bool{}
+    if data := ch.data.Load(); data != nil {
+        keep[versionID(data.ChecksumHeader)] = true
+    }
+    if s.config.KeepVersions > 0 {
+        files, _ := s.listVersions(ch)
+        for _, file := range files {
+            _, id, _ := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".json"), "_")
+            keep[id] = true
+        }
+    }
+    loaded := map[string]*torrentMeta{}
+    for id := range keep {
+        s.torrentMu.Lock()
+        known := s.torrents[ch.name+" "+id] != nil
+        s.torrentMu.Unlock()
+        if known {
+            continue
+        }
+        if info, err := os.ReadFile(s.torrentFile(ch, id)); err == nil {
+            loaded[id] = &torrentMeta{info: info, infoHash: sha1.Sum(info)}
+        }
+    }
+    s.torrentMu.Lock()
+    for id, m := range loaded {
+        if s.torrents[ch.name+" "+id] == nil {
+            s.torrents[ch.name+" "+id] = m
+        }
+    }
+    for k := range s.torrents {
+        if name, id, _ := strings.Cut(k, " "); name == ch.name && !keep[id] {
+            delete(s.torrents, k)
+        }
+    }
+    s.torrentMu.Unlock()
+    if s.config.KeepVersions > 0 {
+        saved, _ := filepath.Glob(filepath.Join(s.versionsDir(ch), "*.torrent"))
+        for _, file := range saved {
+            if id, _, _ := strings.Cut(filepath.Base(file), "_"); !keep[id] || file != s.torrentFile(ch, id) {
+                os.Remove(file)
+            }
+        }
+    }
+}
+
+// torrentOf returns the torrent of version id of ch, or nil with whether
+// it is still being built
+func (s *Server) torrentOf(ch *channel, id string) (*torrentMeta, bool) {
+    s.torrentMu.Lock()
+    defer s.torrentMu.Unlock()
+    key := ch.name + " " + id
+    return s.torrents[key], s.torrentBuilds[key]
+}
+
+// seedData returns the manifest the web seed serves for m, version id of
+// ch: the current one, or the archived version, read on first use
+func (m *torrentMeta) seedData(ch *channel, id string) (*DirData, error) {
+    s := ch.srv
+    if current := ch.data.Load(); versionID(current.ChecksumHeader) == id {
+        return current, nil
+    }
+    s.torrentMu.Lock()
+    data := m.archived
+    s.torrentMu.Unlock()
+    if data != nil {
+        return data, nil
+    }
+    v, err := s.findVersion(ch, id)
+    if err != nil {
+        return nil, err
+    }
+    data = indexEntries(v.Files)
+    data.ChecksumHeader = v.ETag
+    data.ObjectDir = s.objectsDir()
+    s.torrentMu.Lock()
+    m.archived = data
+    s.torrentMu.Unlock()
+    return data, nil
+}
+
+// knownTorrent reports whether infoHash belongs to a torrent served here,
+// so the tracker is not open to arbitrary swarms
+func (s *Server) knownTorrent(infoHash string) bool {
+    s.torrentMu.Lock()
+    defer s.torrentMu.Unlock()
+    for _, m := range s.torrents {
+        if string(m.infoHash[:]) == infoHash {
+            return true
+        }
+    }
+    return false
+}
+
+// publicBase returns the URL the request's /torrent was fetched from, minus
+// "/torrent", so web seed and announce URLs keep any BasePath, tenant and
+// channel prefix
+func (s *Server) publicBase(r *http.Request) string {
+    base := s.config.TorrentPublicURL
+    if base == "" {
+        scheme := "http"
+        if r.TLS != nil {
+            scheme = "https"
+        }
+        base = scheme + "://" + r.Host
+    }
+    path, _, _ := strings.Cut(r.RequestURI, "?")
+    return strings.TrimSuffix(base, "/") + strings.TrimSuffix(path, "/torrent")
+}
+
+// torrentHandler serves the .torrent of the channel's current version, or
+// of the archived one in ?version=, with the patch server as web seed and
+// the embedded tracker
+func (s *Server) torrentHandler(w http.ResponseWriter, r *http.Request) {
+    ch, data := s.manifestFor(r)
+    id := versionID(data.ChecksumHeader)
+    if v := r.URL.Query().Get("version"); v != "" {
+        id = versionID(v)
+    }
+    m, building := s.torrentOf(ch, id)
+    if m == nil {
+        if building {
+            w.Header().Set("Retry-After", "30")
+            http.Error(w, "torrent is being built", http.StatusServiceUnavailable)
+            return
+        }
+        http.Error(w, "no torrent for this version", http.StatusNotFound)
+        return
+    }
+    base := s.publicBase(r)
+    var buf bytes.Buffer
+    buf.WriteString("d8:announce")
+    bencode(&buf, base+"/announce")
+    buf.WriteString("4:info")
+    buf.Write(m.info)
+    buf.WriteString("8:url-list")
+    bencode(&buf, []any{base + "/torrent/seed/" + id + "/"})
+    buf.WriteByte('e')
+    w.Header().Set("ETag", `"`+id+`"`)
+    w.Header().Set("Content-Type", "application/x-bittorrent")
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", torrentName(ch)+".torrent"))
+    w.Write(buf.Bytes())
+}
+
+// torrentSeedHandler serves web seed requests,
+// /torrent/seed/{version}/{name}/{path}, from the files of that version
+// like plain downloads. Web seeds cannot sign URLs, so files that need a
+// signature are left to peers.
+func (s *Server) torrentSeedHandler(w http.ResponseWriter, r *http.Request) {
+    id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/torrent/seed/"), "/")
+    _, path, ok := strings.Cut(rest, "/")
+    ch := s.channelFor(r)
+    m, _ := s.torrentOf(ch, id)
+    if !ok || m == nil {
+        http.NotFound(w, r)
+        return
+    }
+    data, err := m.seedData(ch, id)
+    if err != nil {
+        logRequest(r, "Web seed of %s %s: %v", ch.name, id, err)
+        http.NotFound(w, r)
+        return
+    }
+    s.downloadFiles(w, withManifest(withPath(r, "/"+path), data))
+}
+
+type trackerPeer struct {
+    ip   net.IP
+    port int
+    seed bool
+    seen time.Time
+}
+
+// trackerState holds the swarms of the embedded tracker
+type trackerState struct {
+    swarmMu sync.Mutex
+    swarms  map[string]map[string]*trackerPeer // info hash -> peer ID -> peer
+}
+
+func trackerFailure(w http.ResponseWriter, reason string) {
+    var buf bytes.Buffer
+    bencode(&buf, map[string]any{"failure reason": reason})
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write(buf.Bytes())
+}
+
+// announceHandler is a minimal HTTP tracker (BEP 3, compact peers from
+// BEP 23 and BEP 7) for the torrents served by /torrent
+func (s *Server) announceHandler(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    infoHash, peerID := q.Get("info_hash"), q.Get("peer_id")
+    port, err := strconv.Atoi(q.Get("port"))
+    if len(infoHash) != 20 || len(peerID) != 20 || err != nil || port <= 0 || port > 65535 {
+        trackerFailure(w, "invalid announce")
+        return
+    }
+    if !s.knownTorrent(infoHash) {
+        trackerFailure(w, "unknown torrent")
+        return
+    }
+    numWant, err := strconv.Atoi(q.Get("numwant"))
+    if err != nil || numWant <= 0 || numWant > 200 {
+        numWant = 50
+    }
+
+    s.swarmMu.Lock()
+    now := time.Now()
+    swarm := s.swarms[infoHash]
+    if swarm == nil {
+        swarm = map[string]*trackerPeer{}
+        s.swarms[infoHash] = swarm
+    }
+    if q.Get("event") == "stopped" {
+        delete(swarm, peerID)
+    } else {
+        swarm[peerID] = &trackerPeer{ip: remoteIP(r), port: port, seed: q.Get("left") == "0", seen: now}
+    }
+    complete, incomplete := 0, 0
+    var peers4, peers6 []byte
+    var peerList []any
+    for id, p := range swarm {
+        if now.Sub(p.seen) > 2*trackerInterval {
+            delete(swarm, id)
+            continue
+        }
+        if p.seed {
+            complete++
+        } else {
+            incomplete++
+        }
+        if id == peerID || len(peerList) >= numWant {
+            continue
+        }
+        peerList = append(peerList, map[string]any{"peer id": id, "ip": p.ip.String(), "port": p.port})
+        if ip4 := p.ip.To4(); ip4 != nil {
+            peers4 = binary.BigEndian.AppendUint16(append(peers4, ip4...), uint16(p.port))
+        } else {
+            peers6 = binary.BigEndian.AppendUint16(append(peers6, p.ip.To16()...), uint16(p.port))
+        }
+    }
+    if len(swarm) == 0 {
+        delete(s.swarms, infoHash)
+    }
+    s.swarmMu.Unlock()
+
+    resp := map[string]any{
+        "interval":   int(trackerInterval / time.Second),
+        "complete":   complete,
+        "incomplete": incomplete,
+    }
+    if q.Get("compact") == "0" {
+        if peerList == nil {
+            peerList = []any{}
+        }
+        resp["peers"] = peerList
+    } else {
+        resp["peers"] = peers4
+        if len(peers6) > 0 {
+            resp["peers6"] = peers6
+        }
+    }
+    var buf bytes.Buffer
+    bencode(&buf, resp)
+    w.Header().Set("Content-Type", "text/plain")
+    w.Write(buf.Bytes())
+}
+
+// registerTorrent adds the tracker peer gauge
+func (s *Server) registerTorrent() {
+    s.registerMetric("patch_torrent_peers", "gauge", "Peers announced to the embedded tracker.", func() float64 {
+        s.swarmMu.Lock()
+        defer s.swarmMu.Unlock()
+        n := 0
+        for _, swarm := range s.swarms {
+            n += len(swarm)
+        }
+        return float64(n)
+    })
+}
@@ -0,0 +1,251 @@
+package patchserver
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    // maxRequestIDLength caps the client X-Request-ID values that are kept
+    maxRequestIDLength = 128
+    // traceBatchSize and traceFlushInterval bound how long finished spans
+    // wait before they are exported
+    traceBatchSize     = 256
+    traceFlushInterval = 5 * time.Second
+)
+
+type requestIDKey struct{}
+
+// requestID returns the correlation ID of r, "" outside traced handlers
+func requestID(r *http.Request) string {
+    id, _ := r.Context().Value(requestIDKey{}).(string)
+    return id
+}
+
+// logRequest logs a message about r prefixed with its request ID
+func logRequest(r *http.Request, format string, args ...any) {
+    log.Printf("["+requestID(r)+"] "+format, args...)
+}
+
+func randomHex(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// validRequestID accepts client IDs of visible ASCII up to
+// maxRequestIDLength, so they cannot forge log lines
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for i := 0; i < len(id); i++ {
+        if id[i] <= ' ' || id[i] > '~' {
+            return false
+        }
+    }
+    return true
+}
+
+// parseTraceparent returns the trace and parent span IDs of a W3C
+// traceparent header, empty when it is missing or malformed
+func parseTraceparent(h string) (string, string) {
+    parts := strings.Split(h, "-")
+    if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+        return "", ""
+    }
+    if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil || strings.Trim(parts[1], "0") == "" {
+        return "", ""
+    }
+    return strings.ToLower(parts[1]), strings.ToLower(parts[2])
+}
+
+// sizeRecorder also counts the bytes written, for the access log
+type sizeRecorder struct {
+    statusRecorder
+    bytes int64
+}
+
+func (r *sizeRecorder) Write(b []byte) (int, error) {
+    n, err := r.statusRecorder.Write(b)
+    r.bytes += int64(n)
+    return n, err
+}
+
+// tracing gives every request of server an ID, taken from X-Request-ID
+// when the client or proxy sent a usable one, and echoes it in the
+// response. With AccessLog it logs each request under that ID; with
+// TraceEndpoint it exports a span per request; with Histograms it records
+// its latency and size.
+func (s *Server) tracing(server string, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = randomHex(16)
+        }
+        w.Header().Set("X-Request-ID", id)
+        r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+        if !s.config.AccessLog && s.config.TraceEndpoint == "" && !s.config.Histograms.Enabled {
+            h.ServeHTTP(w, r)
+            return
+        }
+        traceID, parent := parseTraceparent(r.Header.Get("traceparent"))
+        if traceID == "" && s.config.TraceEndpoint != "" {
+            traceID = randomHex(16)
+        }
+        start := time.Now()
+        rec := &sizeRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+        h.ServeHTTP(rec, r)
+        status := rec.status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        elapsed := time.Since(start)
+        if s.config.AccessLog {
+            log.Printf("[%s] %s %s %s %q %d %d %s", id, server, remoteIP(r), r.Method, r.URL.RequestURI(), status, rec.bytes, elapsed.Round(time.Millisecond))
+        }
+        if s.config.Histograms.Enabled {
+            s.observeRequest(server, r, status, rec.bytes, elapsed, s.exemplarLabels(traceID, id))
+        }
+        if s.config.TraceEndpoint != "" {
+            s.exportSpan(otlpSpan{
+                TraceID:      traceID,
+                SpanID:       randomHex(8),
+                ParentSpanID: parent,
+                Name:         server + " " + r.Method,
+                Kind:         2, // server
+                Start:        strconv.FormatInt(start.UnixNano(), 10),
+                End:          strconv.FormatInt(start.Add(elapsed).UnixNano(), 10),
+                Attributes: []otlpAttribute{
+                    stringAttribute("http.request.method", r.Method),
+                    stringAttribute("url.path", r.URL.Path),
+                    stringAttribute("client.address", fmt.Sprint(remoteIP(r))),
+                    stringAttribute("request.id", id),
+                    {Key: "http.response.status_code", Value: map[string]any{"intValue": strconv.Itoa(status)}},
+                },
+                Status: otlpStatus{Code: spanStatus(status)},
+            })
+        }
+    })
+}
+
+// otlpSpan and friends are the parts of the OTLP/JSON trace format used
+type otlpSpan struct {
+    TraceID      string          `json:"traceId"`
+    SpanID       string          `json:"spanId"`
+    ParentSpanID string          `json:"parentSpanId,omitempty"`
+    Name         string          `json:"name"`
+    Kind         int             `json:"kind"`
+    Start        string          `json:"startTimeUnixNano"`
+    End          string          `json:"endTimeUnixNano"`
+    Attributes   []otlpAttribute `json:"attributes"`
+    Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+    Key   string         `json:"key"`
+    Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+    Code int `json:"code"` // 0 unset, 2 error
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+    return otlpAttribute{Key: key, Value: map[string]any{"stringValue": value}}
+}
+
+// spanStatus marks server errors as failed spans
+func spanStatus(status int) int {
+    if status >= 500 {
+        return 2
+    }
+    return 0
+}
+
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+
+// tracingState holds the spans waiting for the exporter
+type tracingState struct {
+    spanQueue    chan otlpSpan
+    spansDropped atomic.Int64
+}
+
+// exportSpan queues a span, dropping it when the exporter is behind
+func (s *Server) exportSpan(span otlpSpan) {
+    select {
+    case s.spanQueue <- span:
+    default:
+        s.spansDropped.Add(1)
+    }
+}
+
+// traceExporter posts queued spans to TraceEndpoint (an OTLP/HTTP traces
+// URL such as http://collector:4318/v1/traces) in batches
+func (s *Server) traceExporter() {
+    ticker := time.NewTicker(traceFlushInterval)
+    defer ticker.Stop()
+    var batch []otlpSpan
+    for {
+        select {
+        case span := <-s.spanQueue:
+            batch = append(batch, span)
+            if len(batch) < traceBatchSize {
+                continue
+            }
+        case <-ticker.C:
+            if len(batch) == 0 {
+                continue
+            }
+        }
+        if err := s.postSpans(batch); err != nil {
+            log.Printf("Exporting %d spans: %v", len(batch), err)
+        }
+        batch = nil
+    }
+}
+
+func (s *Server) postSpans(spans []otlpSpan) error {
+    service := s.config.TraceServiceName
+    if service == "" {
+        service = "mhf-patch-server"
+    }
+    body, err := json.Marshal(map[string]any{
+        "resourceSpans": []any{map[string]any{
+            "resource": map[string]any{"attributes": []otlpAttribute{stringAttribute("service.name", service)}},
+            "scopeSpans": []any{map[string]any{
+                "scope": map[string]any{"name": "mhf-patch-server"},
+                "spans": spans,
+            }},
+        }},
+    })
+    if err != nil {
+        return err
+    }
+    resp, err := traceClient.Post(s.config.TraceEndpoint, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("%s returned %s", s.config.TraceEndpoint, resp.Status)
+    }
+    return nil
+}
+
+// registerTracing adds the dropped span counter
+func (s *Server) registerTracing() {
+    s.registerMetric("patch_trace_spans_dropped_total", "counter", "Spans dropped because the trace exporter fell behind", func() float64 {
+        return float64(s.spansDropped.Load())
+    })
+}
@@ -0,0 +1,469 @@
+package patchserver
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// stagingDeletions lists, one per line, the live files a publish removes.
+// Dot-prefixed names never clash with uploads, which safePath keeps
+// visible.
+const stagingDeletions = ".deletions"
+
+type stagedFile struct {
+    Path   string `json:"path"`
+    Size   int64  `json:"size"`
+    SHA256 string `json:"sha256,omitempty"`
+}
+
+func (s *Server) stagingDir(ch *channel) string {
+    return filepath.Join(s.config.StagingFolder, filepath.FromSlash(ch.name))
+}
+
+// stagedPath validates the upload path rel and returns where it is staged
+func (s *Server) stagedPath(ch *channel, rel string) (string, string, error) {
+    p := "/" + strings.TrimPrefix(rel, "/")
+    if p == "/" || !safePath(p) || path.Clean(p) != p {
+        return "", "", fmt.Errorf("invalid path %q", rel)
+    }
+    return filepath.Join(s.stagingDir(ch), filepath.FromSlash(p)), p, nil
+}
+
+// partialPath is where a resumable upload of file is assembled
+func partialPath(file string) string {
+    return filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".upload")
+}
+
+// stagingChannel resolves the channel query parameter without parsing the
+// body, which may be a large multipart upload
+func (s *Server) stagingChannel(w http.ResponseWriter, r *http.Request) (*channel, bool) {
+    if s.config.StagingFolder == "" {
+        http.Error(w, "StagingFolder is not configured", http.StatusNotFound)
+        return nil, false
+    }
+    name := r.URL.Query().Get("channel")
+    if name == "" {
+        name = DefaultChannelName
+    }
+    ch, ok := s.channels[name]
+    if !ok {
+        http.Error(w, "unknown channel", http.StatusNotFound)
+    }
+    return ch, ok
+}
+
+// writeStaged stores body at file through a temporary file, returning its
+// size and checksum
+func (s *Server) writeStaged(file string, body io.Reader) (int64, string, error) {
+    if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+        return 0, "", err
+    }
+    tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp*")
+    if err != nil {
+        return 0, "", err
+    }
+    defer os.Remove(tmp.Name())
+    h := sha256.New()
+    n, err := io.Copy(io.MultiWriter(tmp, h), body)
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return 0, "", err
+    }
+    s.stagingMu.Lock()
+    defer s.stagingMu.Unlock()
+    return n, hex.EncodeToString(h.Sum(nil)), os.Rename(tmp.Name(), file)
+}
+
+// adminUploadHandler stages the files of a multipart/form-data POST, each
+// part's form name being its path in the game folder
+func (s *Server) adminUploadHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.stagingChannel(w, r)
+    if !ok {
+        return
+    }
+    mr, err := r.MultipartReader()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    staged := []stagedFile{}
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err == nil && part.FileName() == "" {
+            continue
+        }
+        var file, rel string
+        if err == nil {
+            file, rel, err = s.stagedPath(ch, part.FormName())
+        }
+        var f stagedFile
+        if err == nil {
+            f.Path = rel
+            f.Size, f.SHA256, err = s.writeStaged(file, part)
+        }
+        if err != nil {
+            s.audit(adminActor(r), "upload", ch.name, fmt.Sprintf("%d files", len(staged)), err)
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        staged = append(staged, f)
+    }
+    s.audit(adminActor(r), "upload", ch.name, fmt.Sprintf("%d files", len(staged)), nil)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(staged)
+}
+
+// adminUploadFileHandler handles /admin/upload/{path} in the style of tus:
+// HEAD reports Upload-Offset, PATCH appends the body at Upload-Offset
+// towards Upload-Length and DELETE schedules removal of the live file
+func (s *Server) adminUploadFileHandler(w http.ResponseWriter, r *http.Request) {
+    ch, ok := s.stagingChannel(w, r)
+    if !ok {
+        return
+    }
+    file, rel, err := s.stagedPath(ch, strings.TrimPrefix(r.URL.Path, "/admin/upload/"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    partial := partialPath(file)
+    var offset int64
+    if info, err := os.Stat(partial); err == nil {
+        offset = info.Size()
+    }
+    w.Header().Set("Tus-Resumable", "1.0.0")
+    switch r.Method {
+    case http.MethodHead:
+        w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+        w.Header().Set("Cache-Control", "no-store")
+    case http.MethodPatch:
+        at, err1 := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+        length, err2 := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+        if err1 != nil || err2 != nil || length < 0 {
+            http.Error(w, "Upload-Offset and Upload-Length are required", http.StatusBadRequest)
+            return
+        }
+        if at != offset {
+            w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+            http.Error(w, "Upload-Offset does not match the stored upload", http.StatusConflict)
+            return
+        }
+        offset, err = appendPartial(partial, r.Body, length-offset)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+        if offset == length {
+            s.stagingMu.Lock()
+            err = os.Rename(partial, file)
+            s.stagingMu.Unlock()
+            s.audit(adminActor(r), "upload", ch.name, rel, err)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+            }
+        }
+        w.WriteHeader(http.StatusNoContent)
+    case http.MethodDelete:
+        s.stagingMu.Lock()
+        os.Remove(file)
+        os.Remove(partial)
+        err := s.appendDeletion(ch, rel)
+        s.stagingMu.Unlock()
+        s.audit(adminActor(r), "stage_delete", ch.name, rel, err)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// appendPartial appends at most max bytes of body to the partial upload
+// and returns its new size
+func appendPartial(partial string, body io.Reader, max int64) (int64, error) {
+    if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+        return 0, err
+    }
+    f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return 0, err
+    }
+    defer f.Close()
+    // a dropped connection keeps what arrived, so the client can resume
+    io.Copy(f, io.LimitReader(body, max))
+    info, err := f.Stat()
+    if err != nil {
+        return 0, err
+    }
+    return info.Size(), nil
+}
+
+func (s *Server) appendDeletion(ch *channel, rel string) error {
+    if err := os.MkdirAll(s.stagingDir(ch), 0755); err != nil {
+        return err
+    }
+    f, err := os.OpenFile(filepath.Join(s.stagingDir(ch), stagingDeletions), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    _, err = fmt.Fprintln(f, rel)
+    return err
+}
+
+// readStaging lists the staged files, unfinished uploads and deletions of ch
+func (s *Server) readStaging(ch *channel) (files, partial []stagedFile, deletions []string, err error) {
+    dir := s.stagingDir(ch)
+    err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+        if errors.Is(err, fs.ErrNotExist) && p == dir {
+            return filepath.SkipDir
+        }
+        if err != nil || d.IsDir() {
+            return err
+        }
+        info, err := d.Info()
+        if err != nil {
+            return err
+        }
+        rel := relPath(dir, p)
+        name := d.Name()
+        switch {
+        case strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".upload"):
+            rel = path.Join(path.Dir(rel), strings.TrimSuffix(name[1:], ".upload"))
+            partial = append(partial, stagedFile{Path: rel, Size: info.Size()})
+        case !strings.HasPrefix(name, "."):
+            files = append(files, stagedFile{Path: rel, Size: info.Size()})
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    f, err := os.Open(filepath.Join(dir, stagingDeletions))
+    if errors.Is(err, fs.ErrNotExist) {
+        return files, partial, deletions, nil
+    }
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        if line := strings.TrimSpace(scanner.Text()); line != "" {
+            deletions = append(deletions, line)
+        }
+    }
+    return files, partial, deletions, scanner.Err()
+}
+
+// adminStagingHandler lists what the next publish will change
+func (s *Server) adminStagingHandler(w http.ResponseWriter, r *http.Request) {
+    ch, ok := s.stagingChannel(w, r)
+    if !ok {
+        return
+    }
+    s.stagingMu.Lock()
+    files, partial, deletions, err := s.readStaging(ch)
+    s.stagingMu.Unlock()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{
+        "channel":   ch.name,
+        "files":     append([]stagedFile{}, files...),
+        "uploading": append([]stagedFile{}, partial...),
+        "deletions": append([]string{}, deletions...),
+    })
+}
+
+// moveFile renames src to dst, copying when they are on different volumes
+func moveFile(src, dst string) error {
+    if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+        return err
+    }
+    if os.Rename(src, dst) == nil {
+        return nil
+    }
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    _, err = io.Copy(tmp, in)
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return err
+    }
+    if err := os.Rename(tmp.Name(), dst); err != nil {
+        return err
+    }
+    return os.Remove(src)
+}
+
+// publishStaging moves the staged files into the channel's game folder,
+// applies the deletions and clears the staging area, returning how many
+// files it moved and deleted. The live files it replaces or deletes are
+// first set aside in a hidden folder of the game folder, so a failure part
+// way puts the game folder and the staging area back as they were.
+// Unfinished uploads stay staged.
+func (s *Server) publishStaging(ch *channel) (int, int, error) {
+    s.stagingMu.Lock()
+    defer s.stagingMu.Unlock()
+    files, _, deletions, err := s.readStaging(ch)
+    if err != nil {
+        return 0, 0, err
+    }
+    backup, err := os.MkdirTemp(ch.root, ".publish-*")
+    if err != nil {
+        return 0, 0, err
+    }
+    p := &stagingPublish{backup: backup}
+    deleted, err := p.apply(ch, files, deletions)
+    if err != nil {
+        if rerr := p.undo(); rerr != nil {
+            return 0, 0, fmt.Errorf("%w; restoring the game folder failed too, the replaced files are left in %s: %v", err, backup, rerr)
+        }
+        os.RemoveAll(backup)
+        return 0, 0, err
+    }
+    os.RemoveAll(backup)
+    os.Remove(filepath.Join(s.stagingDir(ch), stagingDeletions))
+    return len(files), deleted, nil
+}
+
+// stagingPublish records the moves of a publish so they can be undone
+type stagingPublish struct {
+    backup string
+    moves  []fileMove
+}
+
+type fileMove struct{ from, to string }
+
+func (p *stagingPublish) move(from, to string) error {
+    if err := moveFile(from, to); err != nil {
+        return err
+    }
+    p.moves = append(p.moves, fileMove{from, to})
+    return nil
+}
+
+// setAside moves the live file out of the way, reporting whether there
+// was one
+func (p *stagingPublish) setAside(live string) (bool, error) {
+    info, err := os.Lstat(live)
+    if errors.Is(err, fs.ErrNotExist) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    if info.IsDir() {
+        return false, fmt.Errorf("%s is a folder", live)
+    }
+    return true, p.move(live, filepath.Join(p.backup, strconv.Itoa(len(p.moves))))
+}
+
+// apply moves the staged files in and sets the deleted ones aside,
+// returning how many files it deleted
+func (p *stagingPublish) apply(ch *channel, files []stagedFile, deletions []string) (int, error) {
+    s := ch.srv
+    uploaded := map[string]bool{}
+    for _, f := range files {
+        uploaded[f.Path] = true
+        live := filepath.Join(ch.root, filepath.FromSlash(f.Path))
+        if _, err := p.setAside(live); err != nil {
+            return 0, err
+        }
+        if err := p.move(filepath.Join(s.stagingDir(ch), filepath.FromSlash(f.Path)), live); err != nil {
+            return 0, err
+        }
+    }
+    deleted := 0
+    for _, rel := range deletions {
+        // a file uploaded again after being deleted stays
+        if _, _, err := s.stagedPath(ch, rel); err != nil || uploaded[rel] {
+            continue
+        }
+        existed, err := p.setAside(filepath.Join(ch.root, filepath.FromSlash(rel)))
+        if err != nil {
+            return 0, err
+        }
+        if existed {
+            deleted++
+        }
+    }
+    return deleted, nil
+}
+
+// undo reverses the moves, newest first
+func (p *stagingPublish) undo() error {
+    var errs []error
+    for i := len(p.moves) - 1; i >= 0; i-- {
+        if err := moveFile(p.moves[i].to, p.moves[i].from); err != nil {
+            errs = append(errs, err)
+        }
+    }
+    return errors.Join(errs...)
+}
+
+// adminPublishHandler publishes the staging area and rescans the channel
+func (s *Server) adminPublishHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.stagingChannel(w, r)
+    if !ok {
+        return
+    }
+    moved, deleted, err := s.publishStaging(ch)
+    s.audit(adminActor(r), "publish_staging", ch.name, fmt.Sprintf("%d files, %d deletions", moved, deleted), err)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    results := s.rescanChannels(adminActor(r), []*channel{ch})
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"channel": ch.name, "files": moved, "deletions": deleted, "etag": results[ch.name]})
+}
+
+// registerUpload adds the upload, staging and publish admin endpoints
+func (s *Server) registerUpload() {
+    s.adminMux.HandleFunc("/admin/upload", s.adminUploadHandler)
+    s.adminMux.HandleFunc("/admin/upload/", s.adminUploadFileHandler)
+    s.adminMux.HandleFunc("/admin/staging", s.adminStagingHandler)
+    s.adminMux.HandleFunc("/admin/publish", s.adminPublishHandler)
+}
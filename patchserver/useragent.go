@@ -0,0 +1,104 @@
+package patchserver
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// userAgentState holds the compiled AllowedUserAgents and
+// LauncherVersionPattern
+type userAgentState struct {
+    allowedUserAgents []*regexp.Regexp
+    launcherVersionRe *regexp.Regexp
+}
+
+// compileUserAgentRules compiles the User-Agent patterns from config
+func (s *Server) compileUserAgentRules(cfg *Config) error {
+    s.allowedUserAgents = nil
+    for _, p := range cfg.AllowedUserAgents {
+        re, err := regexp.Compile(p)
+        if err != nil {
+            return err
+        }
+        s.allowedUserAgents = append(s.allowedUserAgents, re)
+    }
+    s.launcherVersionRe = nil
+    if cfg.LauncherVersionPattern != "" {
+        re, err := regexp.Compile(cfg.LauncherVersionPattern)
+        if err != nil {
+            return err
+        }
+        if re.NumSubexp() < 1 {
+            return errMissingVersionGroup
+        }
+        s.launcherVersionRe = re
+    }
+    return nil
+}
+
+var errMissingVersionGroup = errors.New("LauncherVersionPattern needs a capture group for the version")
+
+// compareVersions compares dotted numeric versions, missing parts being 0
+func compareVersions(a, b string) int {
+    as, bs := strings.Split(a, "."), strings.Split(b, ".")
+    for i := 0; i < max(len(as), len(bs)); i++ {
+        var x, y int
+        if i < len(as) {
+            x, _ = strconv.Atoi(as[i])
+        }
+        if i < len(bs) {
+            y, _ = strconv.Atoi(bs[i])
+        }
+        if x != y {
+            if x < y {
+                return -1
+            }
+            return 1
+        }
+    }
+    return 0
+}
+
+// userAgentGate rejects clients whose User-Agent matches none of
+// AllowedUserAgents with 403, and launchers older than MinLauncherVersion
+// with 426 Upgrade Required so they self-update before patching
+func (s *Server) userAgentGate(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ua := r.UserAgent()
+        if len(s.allowedUserAgents) > 0 {
+            allowed := false
+            for _, re := range s.allowedUserAgents {
+                if re.MatchString(ua) {
+                    allowed = true
+                    break
+                }
+            }
+            if !allowed {
+                http.Error(w, "unsupported client", http.StatusForbidden)
+                return
+            }
+        }
+        if s.launcherVersionRe != nil && s.config.MinLauncherVersion != "" {
+            version := ""
+            if m := s.launcherVersionRe.FindStringSubmatch(ua); m != nil {
+                version = m[1]
+            }
+            if version == "" || compareVersions(version, s.config.MinLauncherVersion) < 0 {
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusUpgradeRequired)
+                json.NewEncoder(w).Encode(map[string]string{
+                    "error":       "launcher_outdated",
+                    "version":     version,
+                    "min_version": s.config.MinLauncherVersion,
+                    "update_url":  s.config.LauncherUpdateURL,
+                })
+                return
+            }
+        }
+        h.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,487 @@
+package patchserver
+
+import (
+    "bytes"
+    "compress/gzip"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// verifier runs the protocol checks of verify-server against one server
+type verifier struct {
+    base    string
+    headers http.Header
+    http    *http.Client
+    maxSize int64 // largest file downloaded whole
+    out     io.Writer
+    failed  int
+    warned  int
+}
+
+func (v *verifier) pass(name string) {
+    fmt.Fprintf(v.out, "PASS  %s\n", name)
+}
+
+func (v *verifier) warn(name, format string, args ...any) {
+    v.warned++
+    fmt.Fprintf(v.out, "WARN  %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (v *verifier) fail(name, format string, args ...any) {
+    v.failed++
+    fmt.Fprintf(v.out, "FAIL  %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// do sends a request for p, which must already be escaped, and reads the
+// whole response
+func (v *verifier) do(method, p string, header http.Header) (*http.Response, []byte, error) {
+    req, err := http.NewRequest(method, v.base+p, nil)
+    if err != nil {
+        return nil, nil, err
+    }
+    for k, vals := range v.headers {
+        req.Header[k] = vals
+    }
+    for k, vals := range header {
+        req.Header[k] = vals
+    }
+    resp, err := v.http.Do(req)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    return resp, body, err
+}
+
+// verifyFile is a manifest file as the checks need it
+type verifyFile struct {
+    path      string
+    sha       string
+    size      int64 // -1 when only /check was available
+    encodings map[string]int64
+}
+
+func escapePath(p string) string {
+    return (&url.URL{Path: p}).EscapedPath()
+}
+
+// checkManifest fetches /check and checks its format and ETag
+func (v *verifier) checkManifest() (string, []byte, []verifyFile, bool) {
+    const name = "manifest /check"
+    resp, body, err := v.do(http.MethodGet, "/check", nil)
+    if err != nil {
+        v.fail(name, "%v", err)
+        return "", nil, nil, false
+    }
+    if resp.StatusCode != http.StatusOK {
+        v.fail(name, "status %s", resp.Status)
+        return "", nil, nil, false
+    }
+    etag := resp.Header.Get("ETag")
+    var files []verifyFile
+    seen := map[string]bool{}
+    for i, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+        if line == "" && len(body) == 0 {
+            break
+        }
+        sha, p, ok := strings.Cut(line, "\t")
+        if b, err := hex.DecodeString(sha); !ok || err != nil || len(b) != sha256.Size || !strings.HasPrefix(p, "/") {
+            v.fail(name, "line %d is not \"<sha256>\\t/<path>\": %q", i+1, line)
+            return etag, body, nil, false
+        }
+        if seen[p] {
+            v.fail(name, "%s is listed twice", p)
+            return etag, body, nil, false
+        }
+        seen[p] = true
+        files = append(files, verifyFile{path: p, sha: sha, size: -1})
+    }
+    if len(body) > 0 && !bytes.HasSuffix(body, []byte("\n")) {
+        v.fail(name, "the last line has no newline")
+    }
+    sum := sha256.Sum256(body)
+    switch {
+    case etag == "":
+        v.fail(name, "no ETag")
+    case etag != `"`+hex.EncodeToString(sum[:])+`"`:
+        v.fail(name, "ETag %s is not the quoted SHA-256 of the body", etag)
+    default:
+        v.pass(fmt.Sprintf("%s (%d files, ETag %s)", name, len(files), etag))
+    }
+    return etag, body, files, true
+}
+
+// checkConditional checks If-None-Match and HEAD on /check
+func (v *verifier) checkConditional(etag string) {
+    resp, body, err := v.do(http.MethodGet, "/check", http.Header{"If-None-Match": {etag}})
+    const name = "/check If-None-Match current ETag"
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode == http.StatusOK && resp.Header.Get("ETag") == etag:
+        v.warn(name, "200 instead of 304, the channel may force full manifests")
+    case resp.StatusCode != http.StatusNotModified:
+        v.fail(name, "status %s, want 304", resp.Status)
+    case len(body) > 0:
+        v.fail(name, "304 with a %d byte body", len(body))
+    default:
+        v.pass(name)
+    }
+
+    resp, _, err = v.do(http.MethodGet, "/check", http.Header{"If-None-Match": {`"0"`}})
+    const stale = "/check If-None-Match stale ETag"
+    switch {
+    case err != nil:
+        v.fail(stale, "%v", err)
+    case resp.StatusCode != http.StatusOK:
+        v.fail(stale, "status %s, want 200", resp.Status)
+    default:
+        v.pass(stale)
+    }
+
+    resp, body, err = v.do(http.MethodHead, "/check", nil)
+    const head = "HEAD /check"
+    switch {
+    case err != nil:
+        v.fail(head, "%v", err)
+    case resp.StatusCode != http.StatusOK:
+        v.fail(head, "status %s", resp.Status)
+    case resp.Header.Get("ETag") != etag:
+        v.fail(head, "ETag %q, GET has %s", resp.Header.Get("ETag"), etag)
+    case len(body) > 0:
+        v.fail(head, "%d byte body", len(body))
+    default:
+        v.pass(head)
+    }
+}
+
+// checkEncoding checks that /check is gzip compressed on request only and
+// decompresses to the identity body
+func (v *verifier) checkEncoding(identity []byte) {
+    const name = "/check Accept-Encoding gzip"
+    resp, body, err := v.do(http.MethodGet, "/check", http.Header{"Accept-Encoding": {"gzip"}})
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode != http.StatusOK:
+        v.fail(name, "status %s", resp.Status)
+    case resp.Header.Get("Content-Encoding") != "gzip":
+        v.warn(name, "sent uncompressed")
+    case !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Accept-Encoding"):
+        v.fail(name, "compressed without Vary: Accept-Encoding, caches may serve it to any client")
+    default:
+        zr, err := gzip.NewReader(bytes.NewReader(body))
+        if err != nil {
+            v.fail(name, "%v", err)
+            break
+        }
+        plain, err := io.ReadAll(zr)
+        switch {
+        case err != nil:
+            v.fail(name, "%v", err)
+        case !bytes.Equal(plain, identity):
+            v.fail(name, "decompresses to a different body than the identity response")
+        default:
+            v.pass(fmt.Sprintf("%s (%d -> %d bytes)", name, len(identity), len(body)))
+        }
+    }
+
+    const none = "/check Accept-Encoding gzip;q=0"
+    resp, _, err = v.do(http.MethodGet, "/check", http.Header{"Accept-Encoding": {"gzip;q=0"}})
+    switch {
+    case err != nil:
+        v.fail(none, "%v", err)
+    case resp.Header.Get("Content-Encoding") != "":
+        v.fail(none, "Content-Encoding %s for a client refusing it", resp.Header.Get("Content-Encoding"))
+    default:
+        v.pass(none)
+    }
+}
+
+// checkPages checks that a paginated /check matches its headers
+func (v *verifier) checkPages(files []verifyFile) {
+    const name = "/check?offset=0&limit=1"
+    resp, body, err := v.do(http.MethodGet, "/check?offset=0&limit=1", nil)
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode != http.StatusOK:
+        v.fail(name, "status %s", resp.Status)
+    case resp.Header.Get("X-Manifest-Total") == "":
+        v.warn(name, "no X-Manifest-Total, pagination is not supported")
+    case resp.Header.Get("X-Manifest-Total") != strconv.Itoa(len(files)):
+        v.fail(name, "X-Manifest-Total %s, /check has %d files", resp.Header.Get("X-Manifest-Total"), len(files))
+    default:
+        sum := sha256.Sum256(body)
+        if got := resp.Header.Get("X-Page-SHA256"); got != hex.EncodeToString(sum[:]) {
+            v.fail(name, "X-Page-SHA256 %s does not match the page", got)
+            return
+        }
+        v.pass(name)
+    }
+}
+
+// checkV2 checks that /check/v2 describes the same files as /check,
+// adding their sizes and encodings to files
+func (v *verifier) checkV2(etag string, files []verifyFile) {
+    const name = "manifest /check/v2"
+    resp, body, err := v.do(http.MethodGet, "/check/v2", nil)
+    if err != nil {
+        v.fail(name, "%v", err)
+        return
+    }
+    if resp.StatusCode == http.StatusNotFound {
+        v.warn(name, "not available, file sizes are not checked")
+        return
+    }
+    if resp.StatusCode != http.StatusOK {
+        v.fail(name, "status %s", resp.Status)
+        return
+    }
+    var m manifestV2
+    if err := json.Unmarshal(body, &m); err != nil {
+        v.fail(name, "%v", err)
+        return
+    }
+    if m.ETag != etag || resp.Header.Get("ETag") != etag {
+        v.fail(name, "ETag %s (header %s), /check has %s", m.ETag, resp.Header.Get("ETag"), etag)
+        return
+    }
+    if len(m.Files) != len(files) {
+        v.fail(name, "%d files, /check has %d", len(m.Files), len(files))
+        return
+    }
+    byPath := make(map[string]*verifyFile, len(files))
+    for i := range files {
+        byPath[files[i].path] = &files[i]
+    }
+    for _, e := range m.Files {
+        f, ok := byPath[e.Path]
+        if !ok || f.sha != e.SHA256 || e.Size < 0 {
+            v.fail(name, "%s does not match /check", e.Path)
+            return
+        }
+        f.size, f.encodings = e.Size, e.Encodings
+    }
+    v.pass(name)
+}
+
+// sampleFiles picks up to n files spread over the range of sizes
+func sampleFiles(files []verifyFile, n int) []verifyFile {
+    sorted := append([]verifyFile{}, files...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i].size < sorted[j].size })
+    if n >= len(sorted) {
+        return sorted
+    }
+    if n <= 1 {
+        return sorted[len(sorted)-n:]
+    }
+    out := make([]verifyFile, 0, n)
+    for i := 0; i < n; i++ {
+        out = append(out, sorted[i*(len(sorted)-1)/(n-1)])
+    }
+    return out
+}
+
+// checkFile downloads f whole, by ranges and conditionally
+func (v *verifier) checkFile(f verifyFile) {
+    p := escapePath(f.path)
+    name := "GET " + f.path
+    resp, body, err := v.do(http.MethodHead, p, nil)
+    if err != nil {
+        v.fail(name, "HEAD: %v", err)
+        return
+    }
+    if resp.StatusCode != http.StatusOK {
+        v.fail(name, "HEAD status %s", resp.Status)
+        return
+    }
+    size := resp.ContentLength
+    if f.size >= 0 && size >= 0 && size != f.size {
+        v.fail(name, "Content-Length %d, the manifest has %d", size, f.size)
+        return
+    }
+    if size < 0 {
+        size = f.size
+    }
+    if size < 0 || size <= v.maxSize {
+        resp, body, err = v.do(http.MethodGet, p, nil)
+        sum := sha256.Sum256(body)
+        switch {
+        case err != nil:
+            v.fail(name, "%v", err)
+            return
+        case resp.StatusCode != http.StatusOK:
+            v.fail(name, "status %s", resp.Status)
+            return
+        case hex.EncodeToString(sum[:]) != f.sha:
+            v.fail(name, "SHA-256 %s, the manifest has %s", hex.EncodeToString(sum[:]), f.sha)
+            return
+        }
+        size = int64(len(body))
+        v.pass(fmt.Sprintf("%s (%d bytes)", name, size))
+    } else {
+        v.warn(name, "%d bytes, over -max-mb, only ranges are checked", size)
+    }
+
+    if lm := resp.Header.Get("Last-Modified"); lm != "" {
+        v.checkNotModified(f.path+" If-Modified-Since", p, http.Header{"If-Modified-Since": {lm}})
+    }
+    if etag := resp.Header.Get("ETag"); etag != "" {
+        v.checkNotModified(f.path+" If-None-Match", p, http.Header{"If-None-Match": {etag}})
+    }
+    if size <= 0 {
+        return
+    }
+
+    total := strconv.FormatInt(size, 10)
+    last := strconv.FormatInt(size-1, 10)
+    ranges := []struct {
+        spec, want string
+        at         int64
+    }{
+        {"bytes=0-0", "bytes 0-0/" + total, 0},
+        {"bytes=-1", "bytes " + last + "-" + last + "/" + total, size - 1},
+    }
+    whole := int64(len(body)) == size
+    for _, rg := range ranges {
+        name := f.path + " Range " + rg.spec
+        resp, part, err := v.do(http.MethodGet, p, http.Header{"Range": {rg.spec}})
+        switch {
+        case err != nil:
+            v.fail(name, "%v", err)
+        case resp.StatusCode != http.StatusPartialContent:
+            v.fail(name, "status %s, want 206", resp.Status)
+        case resp.Header.Get("Content-Range") != rg.want:
+            v.fail(name, "Content-Range %q, want %q", resp.Header.Get("Content-Range"), rg.want)
+        case len(part) != 1:
+            v.fail(name, "%d bytes, want 1", len(part))
+        case whole && part[0] != body[rg.at]:
+            v.fail(name, "the byte differs from the full download")
+        default:
+            v.pass(name)
+        }
+    }
+    name = f.path + " Range past the end"
+    resp, _, err = v.do(http.MethodGet, p, http.Header{"Range": {"bytes=" + total + "-"}})
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+        v.fail(name, "status %s, want 416", resp.Status)
+    default:
+        v.pass(name)
+    }
+
+    if n := f.encodings["gzip"]; n > 0 {
+        name := f.path + " precompressed gzip"
+        resp, gz, err := v.do(http.MethodGet, p, http.Header{"Accept-Encoding": {"gzip"}})
+        switch {
+        case err != nil:
+            v.fail(name, "%v", err)
+        case resp.Header.Get("Content-Encoding") != "gzip":
+            v.fail(name, "listed with a gzip encoding but sent uncompressed")
+        case int64(len(gz)) != n:
+            v.fail(name, "%d bytes, the manifest has %d", len(gz), n)
+        default:
+            h := sha256.New()
+            zr, err := gzip.NewReader(bytes.NewReader(gz))
+            if err == nil {
+                _, err = io.Copy(h, zr)
+            }
+            if err != nil || hex.EncodeToString(h.Sum(nil)) != f.sha {
+                v.fail(name, "does not decompress to the file (%v)", err)
+                return
+            }
+            v.pass(name)
+        }
+    }
+}
+
+func (v *verifier) checkNotModified(name, p string, header http.Header) {
+    resp, _, err := v.do(http.MethodGet, p, header)
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode != http.StatusNotModified:
+        v.fail(name, "status %s, want 304", resp.Status)
+    default:
+        v.pass(name)
+    }
+}
+
+// checkNotFound checks that paths outside the manifest are not served
+func (v *verifier) checkNotFound() {
+    name := "unknown path"
+    p := "/verify-server-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+    resp, _, err := v.do(http.MethodGet, p, nil)
+    switch {
+    case err != nil:
+        v.fail(name, "%v", err)
+    case resp.StatusCode != http.StatusNotFound:
+        v.fail(name, "status %s, want 404", resp.Status)
+    default:
+        v.pass(name)
+    }
+}
+
+// run runs every check, downloading up to files manifest files
+func (v *verifier) run(files int) {
+    if etag, body, list, ok := v.checkManifest(); ok {
+        v.checkConditional(etag)
+        v.checkEncoding(body)
+        v.checkPages(list)
+        v.checkV2(etag, list)
+        for _, f := range sampleFiles(list, files) {
+            v.checkFile(f)
+        }
+    }
+    v.checkNotFound()
+}
+
+// verifyServerCommand checks that a running patch server, or a mirror of
+// one, speaks the protocol launchers expect, exiting 1 on any failure
+func verifyServerCommand(args []string) {
+    fset := flag.NewFlagSet("verify-server", flag.ExitOnError)
+    target := fset.String("url", defaultPatchURL, "patch server base URL, including any channel prefix")
+    files := fset.Int("files", 3, "manifest files to download and check, spread over their sizes")
+    maxMB := fset.Int64("max-mb", 64, "largest file downloaded whole; bigger ones only get range checks")
+    token := fset.String("token", "", "channel token (X-Patch-Token)")
+    userAgent := fset.String("user-agent", "mhf-verify-server", "User-Agent sent to the server")
+    timeout := fset.Duration("timeout", time.Minute, "timeout of each request")
+    fset.Parse(args)
+    if *files < 0 || *maxMB < 0 {
+        log.Fatal("-files and -max-mb must be >= 0")
+    }
+
+    v := &verifier{
+        base:    strings.TrimSuffix(*target, "/"),
+        headers: http.Header{"User-Agent": {*userAgent}},
+        // Encodings are negotiated by hand so responses arrive as sent
+        http:    &http.Client{Timeout: *timeout, Transport: &http.Transport{DisableCompression: true, Proxy: http.ProxyFromEnvironment}},
+        maxSize: *maxMB << 20,
+        out:     os.Stdout,
+    }
+    if *token != "" {
+        v.headers.Set("X-Patch-Token", *token)
+    }
+    fmt.Printf("Verifying %s\n\n", v.base)
+    v.run(*files)
+    fmt.Printf("\n%d failed, %d warnings\n", v.failed, v.warned)
+    if v.failed > 0 {
+        os.Exit(1)
+    }
+}
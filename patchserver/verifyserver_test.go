@@ -0,0 +1,206 @@
+package patchserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// conformanceFolder lays out a game folder with text, binary, empty and
+// escaped paths, returning it
+func conformanceFolder(t *testing.T) string {
+    t.Helper()
+    game := filepath.Join(t.TempDir(), "game")
+    random := make([]byte, 100<<10)
+    rand.New(rand.NewSource(1)).Read(random)
+    for name, body := range map[string][]byte{
+        "a.txt":                []byte(strings.Repeat("monster hunter frontier\n", 400)),
+        "dat/mhfdat.bin":       random,
+        "dat/with space ü.txt": []byte("escaped"),
+        "dat/100%.txt":         []byte("percent"),
+        "empty.bin":            nil,
+    } {
+        file := filepath.Join(game, filepath.FromSlash(name))
+        if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(file, body, 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return game
+}
+
+// conformanceServer starts the patch server of a Server configured by cfg
+// with game as GameFolder
+func conformanceServer(t *testing.T, game string, cfg map[string]any) (*Server, *httptest.Server) {
+    t.Helper()
+    cfg["GameFolder"] = game
+    // PatchPort is only validated, httptest picks the port
+    cfg["PatchPort"] = 8080
+    cfg["ImagePort"] = 0
+    cfg["MaxClients"] = 8
+    data, err := json.Marshal(cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "config.json")
+    if err := os.WriteFile(path, data, 0644); err != nil {
+        t.Fatal(err)
+    }
+    s := New(path)
+    if err := s.prepare(); err != nil {
+        t.Fatal(err)
+    }
+    ts := httptest.NewServer(s.patchHandler())
+    t.Cleanup(ts.Close)
+    return s, ts
+}
+
+// verify runs every verify-server check against ts, downloading all files
+func verify(ts *httptest.Server) (*verifier, string) {
+    var out bytes.Buffer
+    v := &verifier{
+        base:    ts.URL,
+        headers: http.Header{"User-Agent": {"mhf-verify-server"}},
+        http:    &http.Client{Transport: &http.Transport{DisableCompression: true}},
+        maxSize: 64 << 20,
+        out:     &out,
+    }
+    v.run(1000)
+    return v, out.String()
+}
+
+func TestVerifyServerConformance(t *testing.T) {
+    tests := []struct {
+        name string
+        cfg  map[string]any
+    }{
+        {"plain", map[string]any{}},
+        {"precompressed", map[string]any{"PrecompressMinKB": 0}},
+        {"cached", map[string]any{"CacheSizeMB": 16, "CacheFileMaxKB": 1024}},
+        {"stored", map[string]any{}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            switch tt.name {
+            case "precompressed":
+                tt.cfg["PrecompressFolder"] = t.TempDir()
+            case "stored":
+                tt.cfg["StoreFile"] = filepath.Join(t.TempDir(), "store.db")
+            }
+            s, ts := conformanceServer(t, conformanceFolder(t), tt.cfg)
+            if tt.name == "stored" && s.defaultChannel.data.Load().stored == nil {
+                t.Fatal("the manifest bodies were not moved to the store")
+            }
+            v, out := verify(ts)
+            if v.failed > 0 || v.warned > 0 {
+                t.Errorf("%d failed, %d warnings:\n%s", v.failed, v.warned, out)
+            }
+            if tt.name == "precompressed" && !strings.Contains(out, "PASS  /a.txt precompressed gzip") {
+                t.Errorf("/a.txt was not checked precompressed:\n%s", out)
+            }
+        })
+    }
+}
+
+func TestVerifyServerAfterRescan(t *testing.T) {
+    game := conformanceFolder(t)
+    s, ts := conformanceServer(t, game, map[string]any{})
+    before := s.defaultChannel.data.Load().ChecksumHeader
+    if err := os.WriteFile(filepath.Join(game, "a.txt"), []byte("patched"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Remove(filepath.Join(game, "dat", "mhfdat.bin")); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.loadFolderData(); err != nil {
+        t.Fatal(err)
+    }
+    if after := s.defaultChannel.data.Load().ChecksumHeader; after == before {
+        t.Fatalf("ETag %s unchanged by the rescan", after)
+    }
+    v, out := verify(ts)
+    if v.failed > 0 || v.warned > 0 {
+        t.Errorf("%d failed, %d warnings:\n%s", v.failed, v.warned, out)
+    }
+    if strings.Contains(out, "mhfdat.bin") {
+        t.Errorf("the deleted file is still listed:\n%s", out)
+    }
+}
+
+// TestVerifyServerDetects checks that the checks catch servers breaking
+// the protocol
+func TestVerifyServerDetects(t *testing.T) {
+    tests := []struct {
+        name string
+        wrap func(http.Handler) http.Handler
+        want string
+    }{
+        {"wrong ETag", func(h http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                h.ServeHTTP(headerRewriter{w, func(h http.Header) { h.Set("ETag", `"0"`) }}, r)
+            })
+        }, "FAIL  manifest /check"},
+        {"no conditional requests", func(h http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                r.Header.Del("If-None-Match")
+                r.Header.Del("If-Modified-Since")
+                h.ServeHTTP(w, r)
+            })
+        }, "FAIL  /a.txt If-Modified-Since: status 200 OK, want 304"},
+        {"no ranges", func(h http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                r.Header.Del("Range")
+                h.ServeHTTP(w, r)
+            })
+        }, "Range bytes=0-0: status 200 OK, want 206"},
+        {"gzip without Vary", func(h http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                h.ServeHTTP(headerRewriter{w, func(h http.Header) { h.Del("Vary") }}, r)
+            })
+        }, "without Vary"},
+        {"stale file", func(h http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Path == "/a.txt" && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+                    w.Write([]byte("stale"))
+                    return
+                }
+                h.ServeHTTP(w, r)
+            })
+        }, "FAIL  GET /a.txt"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, ts := conformanceServer(t, conformanceFolder(t), map[string]any{})
+            ts.Config.Handler = tt.wrap(ts.Config.Handler)
+            v, out := verify(ts)
+            if v.failed == 0 || !strings.Contains(out, tt.want) {
+                t.Errorf("no failure %q reported:\n%s", tt.want, out)
+            }
+        })
+    }
+}
+
+// headerRewriter applies rewrite to the response headers before they are
+// sent
+type headerRewriter struct {
+    http.ResponseWriter
+    rewrite func(http.Header)
+}
+
+func (w headerRewriter) WriteHeader(code int) {
+    w.rewrite(w.Header())
+    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w headerRewriter) Write(b []byte) (int, error) {
+    w.rewrite(w.Header())
+    return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,482 @@
+package patchserver
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// EventRollback is sent when an operator rolls a channel back
+const EventRollback = "rollback"
+
+// versionRecord is a published manifest kept under VersionsFolder. File
+// contents live in a content-addressed objects directory shared by every
+// version, so each new version only stores the files it changed.
+type versionRecord struct {
+    ETag      string          `json:"etag"`
+    Published int64           `json:"published"`
+    Files     []ManifestEntry `json:"files"`
+}
+
+// archiveState holds the archived versions /v/ URLs were served from
+type archiveState struct {
+    archiveMu sync.Mutex
+    // archived holds the versions parsed by archivedData by "<channel>
+    // <version ID>", until archiveVersion prunes them
+    archived map[string]*DirData
+}
+
+func (s *Server) objectsDir() string {
+    return filepath.Join(s.config.VersionsFolder, "objects")
+}
+
+func (s *Server) versionsDir(ch *channel) string {
+    return filepath.Join(s.config.VersionsFolder, "channels", ch.name)
+}
+
+// versionID is the ETag without quotes, as used in file names and the API
+func versionID(etag string) string {
+    return strings.Trim(etag, `"`)
+}
+
+// copyObject stores the file of e under its checksum unless it is already
+// present
+func (s *Server) copyObject(ch *channel, data *DirData, e ManifestEntry) error {
+    return copyInto(s.objectsDir(), ch, data, e)
+}
+
+// copyInto copies the file of e to dir/checksum through a temporary file
+// unless it is already present. The copy is hashed as it is written, so a
+// file that changed since it was hashed is refused rather than stored
+// under a checksum it no longer has.
+func copyInto(dir string, ch *channel, data *DirData, e ManifestEntry) error {
+    checksum := e.SHA256
+    dst := filepath.Join(dir, checksum)
+    if _, err := os.Stat(dst); err == nil {
+        return nil
+    }
+    in, err := ch.open(data, e)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+    tmp, err := os.CreateTemp(dir, checksum+".tmp*")
+    if err != nil {
+        return err
+    }
+    h := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(tmp, h), in); err != nil {
+        tmp.Close()
+        os.Remove(tmp.Name())
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        os.Remove(tmp.Name())
+        return err
+    }
+    if hex.EncodeToString(h.Sum(nil)) != checksum {
+        os.Remove(tmp.Name())
+        return fmt.Errorf("%s changed since it was hashed", e.Path)
+    }
+    return os.Rename(tmp.Name(), dst)
+}
+
+// listVersions returns the file names of a channel's versions, oldest first
+func (s *Server) listVersions(ch *channel) ([]string, error) {
+    files, err := filepath.Glob(filepath.Join(s.versionsDir(ch), "*.json"))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(files)
+    return files, nil
+}
+
+func readVersion(file string) (*versionRecord, error) {
+    raw, err := os.ReadFile(file)
+    if err != nil {
+        return nil, err
+    }
+    var v versionRecord
+    if err := json.Unmarshal(raw, &v); err != nil {
+        return nil, fmt.Errorf("%s: %w", file, err)
+    }
+    return &v, nil
+}
+
+// archiveVersion records data as the newest version of ch, copying the
+// files it changed, then prunes versions beyond KeepVersions. rescanMu
+// must be held.
+func (s *Server) archiveVersion(ch *channel, data *DirData) error {
+    if err := os.MkdirAll(s.objectsDir(), 0755); err != nil {
+        return err
+    }
+    if err := os.MkdirAll(s.versionsDir(ch), 0755); err != nil {
+        return err
+    }
+    files, err := s.listVersions(ch)
+    if err != nil {
+        return err
+    }
+    if n := len(files); n > 0 && strings.HasSuffix(files[n-1], "_"+versionID(data.ChecksumHeader)+".json") {
+        return nil
+    }
+    for _, e := range data.Entries {
+        if err := s.copyObject(ch, data, e); err != nil {
+            return err
+        }
+    }
+    now := time.Now()
+    raw, err := json.Marshal(versionRecord{ETag: data.ChecksumHeader, Published: now.Unix(), Files: data.Entries})
+    if err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%020d_%s.json", now.UnixNano(), versionID(data.ChecksumHeader))
+    if err := os.WriteFile(filepath.Join(s.versionsDir(ch), name), raw, 0644); err != nil {
+        return err
+    }
+    files = append(files, filepath.Join(s.versionsDir(ch), name))
+    if len(files) > s.config.KeepVersions {
+        for _, old := range files[:len(files)-s.config.KeepVersions] {
+            os.Remove(old)
+            _, id, _ := strings.Cut(strings.TrimSuffix(filepath.Base(old), ".json"), "_")
+            s.archiveMu.Lock()
+            delete(s.archived, ch.name+" "+id)
+            s.archiveMu.Unlock()
+        }
+        return s.pruneObjects()
+    }
+    return nil
+}
+
+// pruneObjects deletes objects no retained version of any channel uses
+func (s *Server) pruneObjects() error {
+    used := map[string]bool{}
+    for _, ch := range s.channels {
+        files, err := s.listVersions(ch)
+        if err != nil {
+            return err
+        }
+        for _, file := range files {
+            v, err := readVersion(file)
+            if err != nil {
+                return err
+            }
+            for _, e := range v.Files {
+                used[e.SHA256] = true
+            }
+        }
+    }
+    objects, err := os.ReadDir(s.objectsDir())
+    if err != nil {
+        return err
+    }
+    for _, o := range objects {
+        if !used[o.Name()] {
+            os.Remove(filepath.Join(s.objectsDir(), o.Name()))
+        }
+    }
+    return nil
+}
+
+// pinFile holds the version a channel is rolled back to
+func (s *Server) pinFile(ch *channel) string {
+    return filepath.Join(s.versionsDir(ch), "pinned")
+}
+
+// pinnedVersion returns the version ch is rolled back to, empty when it
+// serves its game folder
+func (s *Server) pinnedVersion(ch *channel) string {
+    if s.config.KeepVersions == 0 {
+        return ""
+    }
+    raw, err := os.ReadFile(s.pinFile(ch))
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(raw))
+}
+
+// rollback pins ch to its archived version id, which rescans, restarts
+// and failover keep serving until unpin
+func (s *Server) rollback(ch *channel, id string) (*DirData, error) {
+    s.rescanMu.Lock()
+    defer s.rescanMu.Unlock()
+    v, err := s.findVersion(ch, id)
+    if err != nil {
+        return nil, err
+    }
+    // The pin only replaces the previous one once the version is served,
+    // so a failed rollback is not retried by every rescan and restart
+    tmp := s.pinFile(ch) + ".tmp"
+    if err := os.WriteFile(tmp, []byte(id+"\n"), 0644); err != nil {
+        return nil, err
+    }
+    old := ch.data.Load()
+    data, err := s.servePinned(ch, v)
+    if err == nil {
+        err = os.Rename(tmp, s.pinFile(ch))
+    }
+    if err != nil {
+        os.Remove(tmp)
+        return nil, err
+    }
+    s.notify(EventRollback, fmt.Sprintf("Rolled %s back to %s", ch.name, data.ChecksumHeader), map[string]any{
+        "channel":  ch.name,
+        "etag":     data.ChecksumHeader,
+        "previous": old.ChecksumHeader,
+    })
+    return data, nil
+}
+
+// loadPinned serves the version ch is pinned to in place of a rescan,
+// unless it already does. rescanMu must be held.
+func (s *Server) loadPinned(ch *channel, id string) error {
+    if current := ch.data.Load(); current != nil && current.ObjectDir == s.objectsDir() && versionID(current.ChecksumHeader) == id {
+        return nil
+    }
+    v, err := s.findVersion(ch, id)
+    if err != nil {
+        return fmt.Errorf("pinned version %s: %w", id, err)
+    }
+    data, err := s.servePinned(ch, v)
+    if err == nil {
+        log.Printf("Serving %s pinned to version %s, see /admin/rollback/clear", ch.name, data.ChecksumHeader)
+    }
+    return err
+}
+
+// servePinned swaps in the archived version v of ch, ending any rollout.
+// rescanMu must be held.
+func (s *Server) servePinned(ch *channel, v *versionRecord) (*DirData, error) {
+    data, err := s.newDirData(v.Files)
+    if err != nil {
+        return nil, err
+    }
+    data.ObjectDir = s.objectsDir()
+    if err := s.setPrevious(data, ch.data.Load()); err != nil {
+        return nil, err
+    }
+    if err := s.storeBodies(ch, data); err != nil {
+        log.Printf("Keeping %s manifest %s in memory, storing it failed: %v", ch.name, data.ChecksumHeader, err)
+    }
+    old := ch.data.Swap(data)
+    ch.rollout.Store(nil)
+    s.pruneBodies(ch, old)
+    if s.cache != nil {
+        s.cache.purge()
+    }
+    if old != nil {
+        s.purgeCDNs(ch, old, data)
+    }
+    if s.config.TorrentPieceKB > 0 {
+        go s.buildTorrent(ch, data)
+    }
+    return data, nil
+}
+
+// unpin clears the rollback of ch and rescans its game folder
+func (s *Server) unpin(ch *channel) error {
+    if err := os.Remove(s.pinFile(ch)); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    return s.loadChannel(ch)
+}
+
+// lastArchived returns the newest archived version of ch other than etag,
+// as a DirData that only supports Lookup, or nil
+func (s *Server) lastArchived(ch *channel, etag string) *DirData {
+    if s.config.KeepVersions == 0 {
+        return nil
+    }
+    files, err := s.listVersions(ch)
+    if err != nil {
+        return nil
+    }
+    for i := len(files) - 1; i >= 0; i-- {
+        if strings.HasSuffix(files[i], "_"+versionID(etag)+".json") {
+            continue
+        }
+        v, err := readVersion(files[i])
+        if err != nil {
+            return nil
+        }
+        prev := indexEntries(v.Files)
+        prev.ChecksumHeader = v.ETag
+        return prev
+    }
+    return nil
+}
+
+// archivedData returns the archived version id of ch as a DirData that
+// only supports Lookup and Resolve, parsed on first use
+func (s *Server) archivedData(ch *channel, id string) (*DirData, error) {
+    key := ch.name + " " + id
+    s.archiveMu.Lock()
+    data := s.archived[key]
+    s.archiveMu.Unlock()
+    if data != nil {
+        return data, nil
+    }
+    v, err := s.findVersion(ch, id)
+    if err != nil {
+        return nil, err
+    }
+    data = indexEntries(v.Files)
+    data.ChecksumHeader = v.ETag
+    data.ObjectDir = s.objectsDir()
+    if s.config.CaseInsensitivePaths {
+        data.foldIndex = buildFoldIndex(v.Files)
+    }
+    s.archiveMu.Lock()
+    s.archived[key] = data
+    s.archiveMu.Unlock()
+    return data, nil
+}
+
+// errUnknownVersion is returned for IDs that are not archived for a channel
+var errUnknownVersion = errors.New("unknown version")
+
+// findVersion reads the archived version id of ch
+func (s *Server) findVersion(ch *channel, id string) (*versionRecord, error) {
+    files, err := s.listVersions(ch)
+    if err != nil {
+        return nil, err
+    }
+    for _, file := range files {
+        if strings.HasSuffix(file, "_"+id+".json") {
+            return readVersion(file)
+        }
+    }
+    return nil, errUnknownVersion
+}
+
+// serveArchived serves a file of a rolled back or snapshotted manifest from
+// its ObjectDir
+func (s *Server) serveArchived(w http.ResponseWriter, r *http.Request, data *DirData) {
+    name := path.Clean("/" + r.URL.Path)
+    e, ok := data.Lookup(name)
+    if !ok || !safePath(name) {
+        http.NotFound(w, r)
+        return
+    }
+    if s.shared(data) && !verifiedFile(s.channelFor(r), data, e) {
+        // a hard linked snapshot written to in place: fall back to the
+        // archived copy
+        logRequest(r, "Snapshot of %s changed since it was published", name)
+        s.serveObject(w, r, e)
+        return
+    }
+    f, err := os.Open(filepath.Join(data.ObjectDir, e.SHA256))
+    if err != nil {
+        logRequest(r, "Archived object for %s: %v", name, err)
+        http.Error(w, "archived file missing", http.StatusInternalServerError)
+        return
+    }
+    defer f.Close()
+    http.ServeContent(w, r, name, time.Unix(e.ModTime, 0), f)
+}
+
+// adminChannel resolves the channel form value, defaulting to stable
+func (s *Server) adminChannel(w http.ResponseWriter, r *http.Request) (*channel, bool) {
+    name := r.FormValue("channel")
+    if name == "" {
+        name = DefaultChannelName
+    }
+    ch, ok := s.channels[name]
+    if !ok {
+        http.Error(w, "unknown channel", http.StatusNotFound)
+    }
+    return ch, ok
+}
+
+func (s *Server) adminVersionsHandler(w http.ResponseWriter, r *http.Request) {
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    files, err := s.listVersions(ch)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    type version struct {
+        ID        string `json:"id"`
+        Published int64  `json:"published"`
+        Files     int    `json:"files"`
+        Active    bool   `json:"active"`
+        Pinned    bool   `json:"pinned"`
+    }
+    current := ch.data.Load().ChecksumHeader
+    pinned := s.pinnedVersion(ch)
+    list := []version{}
+    for i := len(files) - 1; i >= 0; i-- {
+        v, err := readVersion(files[i])
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        list = append(list, version{versionID(v.ETag), v.Published, len(v.Files), v.ETag == current, versionID(v.ETag) == pinned})
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(list)
+}
+
+func (s *Server) adminRollbackHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    data, err := s.rollback(ch, r.FormValue("version"))
+    s.audit(adminActor(r), "rollback", ch.name, r.FormValue("version"), err)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    log.Printf("Rolled %s back to %s", ch.name, data.ChecksumHeader)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"channel": ch.name, "etag": data.ChecksumHeader})
+}
+
+// adminRollbackClearHandler ends a rollback, publishing the game folder
+// again
+func (s *Server) adminRollbackClearHandler(w http.ResponseWriter, r *http.Request) {
+    if !requirePost(w, r) {
+        return
+    }
+    ch, ok := s.adminChannel(w, r)
+    if !ok {
+        return
+    }
+    err := s.unpin(ch)
+    s.audit(adminActor(r), "rollback_clear", ch.name, "", err)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    data := ch.data.Load()
+    log.Printf("Cleared the rollback of %s, now serving %s", ch.name, data.ChecksumHeader)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]any{"channel": ch.name, "etag": data.ChecksumHeader})
+}
+
+// registerVersions adds the version and rollback admin endpoints
+func (s *Server) registerVersions() {
+    s.adminMux.HandleFunc("/admin/versions", s.adminVersionsHandler)
+    s.adminMux.HandleFunc("/admin/rollback", s.adminRollbackHandler)
+    s.adminMux.HandleFunc("/admin/rollback/clear", s.adminRollbackClearHandler)
+}
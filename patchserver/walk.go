@@ -0,0 +1,121 @@
+package patchserver
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "log"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+)
+
+// Symlink policies
+const (
+    SymlinkFollow = "follow"
+    SymlinkSkip   = "skip"
+    SymlinkError  = "error"
+)
+
+// walkFolder calls fn for every regular file of fsys in lexical order,
+// like fs.WalkDir, leaving out hidden names; fn and onErr get the
+// slash-separated name of the file. Symbolic links and Windows junctions
+// are followed, skipped or refused as SymlinkPolicy says; info describes the
+// file a link points to. A folder linking back to one above it is skipped
+// instead of walked forever. A file or folder that cannot be read is passed
+// to onErr, and the walk goes on unless it returns an error. root is the
+// folder fsys serves, named in log messages.
+func (s *Server) walkFolder(root string, fsys fs.FS, fn func(name string, info fs.FileInfo) error, onErr func(name string, err error) error) error {
+    info, err := fs.Stat(fsys, ".")
+    if err != nil {
+        return err
+    }
+    w := &folderWalk{root: root, fsys: fsys, policy: s.config.SymlinkPolicy, fn: fn, onErr: onErr}
+    return w.walkDir(".", []fs.FileInfo{info})
+}
+
+type folderWalk struct {
+    root   string
+    fsys   fs.FS
+    policy string // SymlinkPolicy
+    fn     func(string, fs.FileInfo) error
+    onErr  func(string, error) error
+}
+
+// display returns name as an OS path for log messages
+func (w *folderWalk) display(name string) string {
+    return filepath.Join(w.root, filepath.FromSlash(name))
+}
+
+// walkDir walks dir, parents being the folders from the root down to it
+func (w *folderWalk) walkDir(dir string, parents []fs.FileInfo) error {
+    entries, err := fs.ReadDir(w.fsys, dir)
+    if err != nil {
+        // An unreadable root fails the walk
+        if len(parents) == 1 {
+            return err
+        }
+        return w.onErr(dir, err)
+    }
+    for _, d := range entries {
+        if strings.HasPrefix(d.Name(), ".") {
+            continue
+        }
+        name := path.Join(dir, d.Name())
+        var info fs.FileInfo
+        // Junctions are symlinks to os.Lstat, or irregular files with
+        // winsymlink=1
+        if d.Type()&(fs.ModeSymlink|fs.ModeIrregular) != 0 {
+            switch w.policy {
+            case SymlinkSkip:
+                log.Printf("Skipping link %s (SymlinkPolicy skip)", w.display(name))
+                continue
+            case SymlinkError:
+                return fmt.Errorf("%s is a symbolic link or junction, refused by SymlinkPolicy", w.display(name))
+            }
+            if info, err = fs.Stat(w.fsys, name); err != nil {
+                if errors.Is(err, fs.ErrNotExist) {
+                    log.Printf("Warning: skipping %s, it links to a missing file", w.display(name))
+                    continue
+                }
+                if err := w.onErr(name, err); err != nil {
+                    return err
+                }
+                continue
+            }
+        } else if info, err = d.Info(); err != nil {
+            if err := w.onErr(name, err); err != nil {
+                return err
+            }
+            continue
+        }
+        switch {
+        case info.IsDir():
+            if loopsBack(parents, info) {
+                log.Printf("Warning: skipping %s, it links back to a folder above it", w.display(name))
+                continue
+            }
+            if err := w.walkDir(name, append(parents, info)); err != nil {
+                return err
+            }
+        case info.Mode().IsRegular():
+            if err := w.fn(name, info); err != nil {
+                return err
+            }
+        default:
+            log.Printf("Warning: skipping %s, not a regular file", w.display(name))
+        }
+    }
+    return nil
+}
+
+// loopsBack reports whether dir is one of parents
+func loopsBack(parents []fs.FileInfo, dir fs.FileInfo) bool {
+    for _, p := range parents {
+        if os.SameFile(p, dir) {
+            return true
+        }
+    }
+    return false
+}
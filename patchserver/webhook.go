@@ -0,0 +1,137 @@
+package patchserver
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Webhook events
+const (
+    EventPublish      = "publish"
+    EventRescanFailed = "rescan_failed"
+    EventErrorSpike   = "error_spike"
+    EventFailover     = "failover"
+    EventFileErrors   = "file_errors"
+)
+
+// WebhookConfig is one notification target. Kind selects the payload
+// format: "discord", "slack" or "json" (the default). Events limits which
+// events are sent, empty means all of them.
+type WebhookConfig struct {
+    URL    string   `json:"URL"`
+    Kind   string   `json:"Kind"`
+    Events []string `json:"Events"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h WebhookConfig) wants(event string) bool {
+    if len(h.Events) == 0 {
+        return true
+    }
+    for _, e := range h.Events {
+        if e == event {
+            return true
+        }
+    }
+    return false
+}
+
+// notify posts event to every configured webhook in the background
+func (s *Server) notify(event, message string, data map[string]any) {
+    for _, hook := range s.config.Webhooks {
+        if !hook.wants(event) {
+            continue
+        }
+        go sendWebhook(hook, event, message, data)
+    }
+}
+
+func sendWebhook(hook WebhookConfig, event, message string, data map[string]any) {
+    var payload any
+    switch hook.Kind {
+    case "discord":
+        payload = map[string]string{"content": fmt.Sprintf("[%s] %s", event, message)}
+    case "slack":
+        payload = map[string]string{"text": fmt.Sprintf("[%s] %s", event, message)}
+    default:
+        payload = map[string]any{
+            "event":   event,
+            "message": message,
+            "time":    time.Now().Unix(),
+            "data":    data,
+        }
+    }
+    body, err := json.Marshal(payload)
+    if err != nil {
+        log.Printf("webhook %s: %v", event, err)
+        return
+    }
+    resp, err := webhookClient.Post(hook.URL, "application/json", bytes.NewReader(body))
+    if err != nil {
+        log.Printf("webhook %s: %v", event, err)
+        return
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        log.Printf("webhook %s: %s returned %s", event, hook.URL, resp.Status)
+    }
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+    if r.status == 0 {
+        r.status = code
+    }
+    r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+    if r.status == 0 {
+        r.status = http.StatusOK
+    }
+    return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+    return r.ResponseWriter
+}
+
+// errorSpikeMonitor counts 5xx responses per minute and fires an
+// error_spike webhook the first time a window reaches threshold
+func (s *Server) errorSpikeMonitor(threshold int, h http.Handler) http.Handler {
+    var mu sync.Mutex
+    var window time.Time
+    var count int
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rec := &statusRecorder{ResponseWriter: w}
+        h.ServeHTTP(rec, r)
+        if rec.status < 500 {
+            return
+        }
+        mu.Lock()
+        defer mu.Unlock()
+        now := time.Now().Truncate(time.Minute)
+        if !now.Equal(window) {
+            window = now
+            count = 0
+        }
+        count++
+        if count == threshold {
+            s.notify(EventErrorSpike, fmt.Sprintf("%d server errors in the last minute", count), map[string]any{
+                "errors": count,
+                "window": window.Unix(),
+            })
+        }
+    })
+}
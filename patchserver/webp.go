@@ -0,0 +1,447 @@
+package patchserver
+
+import (
+    "encoding/binary"
+    "errors"
+    "image"
+    "image/draw"
+    "io"
+    "sort"
+)
+
+// The standard library and golang.org/x/image only decode WebP, so image
+// variants are written by this lossless (VP8L) encoder. Images of at most
+// 256 colors are written as palette indices, packed several to a pixel
+// when there are 16 colors or fewer, so flat images stay small. Others get
+// the subtract-green and predictor transforms, and every residual is coded
+// as a literal: simple and fast, at the cost of the size LZ77 references
+// and a color cache would save.
+
+// vp8lMaxSize is the largest width or height VP8L can store
+const vp8lMaxSize = 1 << 14
+
+// codeLengthOrder is the order code length code lengths are written in
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// bitWriter packs values least significant bit first
+type bitWriter struct {
+    buf  []byte
+    acc  uint64
+    bits uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+    b.acc |= uint64(v) << b.bits
+    b.bits += n
+    for b.bits >= 8 {
+        b.buf = append(b.buf, byte(b.acc))
+        b.acc >>= 8
+        b.bits -= 8
+    }
+}
+
+func (b *bitWriter) flush() []byte {
+    if b.bits > 0 {
+        b.buf = append(b.buf, byte(b.acc))
+        b.acc, b.bits = 0, 0
+    }
+    return b.buf
+}
+
+// prefixCode is a Huffman code as written to the stream. A code with a
+// single symbol takes no bits.
+type prefixCode struct {
+    lengths []uint8
+    codes   []uint16 // bit reversed, ready for bitWriter
+    single  bool
+}
+
+func (c *prefixCode) write(b *bitWriter, sym int) {
+    if !c.single {
+        b.write(uint32(c.codes[sym]), uint(c.lengths[sym]))
+    }
+}
+
+// huffmanLengths returns code lengths of at most maxLen bits for counts,
+// zero for unused symbols. Counts are flattened until the tree fits.
+func huffmanLengths(counts []int, maxLen int) []uint8 {
+    c := append([]int(nil), counts...)
+    for {
+        lengths := make([]uint8, len(c))
+        var leaves []int
+        for sym, n := range c {
+            if n > 0 {
+                leaves = append(leaves, sym)
+            }
+        }
+        if len(leaves) < 2 {
+            for _, sym := range leaves {
+                lengths[sym] = 1
+            }
+            return lengths
+        }
+        sort.SliceStable(leaves, func(i, j int) bool { return c[leaves[i]] < c[leaves[j]] })
+        // Two queue construction: leaves sorted by weight, then the
+        // internal nodes, which are created in increasing weight
+        weight := make([]int, len(leaves), 2*len(leaves)-1)
+        parent := make([]int, 2*len(leaves)-1)
+        for i, sym := range leaves {
+            weight[i] = c[sym]
+        }
+        leaf, inner := 0, len(leaves)
+        next := func() int {
+            if leaf < len(leaves) && (inner >= len(weight) || weight[leaf] <= weight[inner]) {
+                leaf++
+                return leaf - 1
+            }
+            inner++
+            return inner - 1
+        }
+        for len(weight) < cap(weight) {
+            a, b := next(), next()
+            parent[a], parent[b] = len(weight), len(weight)
+            weight = append(weight, weight[a]+weight[b])
+        }
+        depth := make([]int, len(weight))
+        fits := true
+        for n := len(weight) - 2; n >= 0; n-- {
+            depth[n] = depth[parent[n]] + 1
+            if n < len(leaves) {
+                lengths[leaves[n]] = uint8(depth[n])
+                fits = fits && depth[n] <= maxLen
+            }
+        }
+        if fits {
+            return lengths
+        }
+        for sym, n := range c {
+            if n > 0 {
+                c[sym] = (n + 1) / 2
+            }
+        }
+    }
+}
+
+// newPrefixCode assigns canonical codes to lengths
+func newPrefixCode(lengths []uint8) *prefixCode {
+    var count, next [16]int
+    used := 0
+    for _, l := range lengths {
+        if l > 0 {
+            count[l]++
+            used++
+        }
+    }
+    code := 0
+    for l := 1; l < 16; l++ {
+        code = (code + count[l-1]) << 1
+        next[l] = code
+    }
+    c := &prefixCode{lengths: lengths, codes: make([]uint16, len(lengths)), single: used < 2}
+    for sym, l := range lengths {
+        if l == 0 {
+            continue
+        }
+        v := next[l]
+        next[l]++
+        var rev uint16
+        for i := uint8(0); i < l; i++ {
+            rev = rev<<1 | uint16(v>>i&1)
+        }
+        c.codes[sym] = rev
+    }
+    return c
+}
+
+// writePrefixCode writes the code for symbols counted in counts and
+// returns it
+func writePrefixCode(b *bitWriter, counts []int) *prefixCode {
+    var used []int
+    for sym, n := range counts {
+        if n > 0 {
+            used = append(used, sym)
+        }
+    }
+    if len(used) < 2 {
+        // Simple code of one symbol; every alphabet written here keeps
+        // its only symbol below 256
+        sym := 0
+        if len(used) == 1 {
+            sym = used[0]
+        }
+        b.write(1, 1)
+        b.write(0, 1)
+        if sym < 2 {
+            b.write(0, 1)
+            b.write(uint32(sym), 1)
+        } else {
+            b.write(1, 1)
+            b.write(uint32(sym), 8)
+        }
+        return &prefixCode{single: true}
+    }
+    lengths := huffmanLengths(counts, 15)
+    lengthCounts := make([]int, 19)
+    for _, l := range lengths {
+        lengthCounts[l]++
+    }
+    lengthCode := newPrefixCode(huffmanLengths(lengthCounts, 7))
+    n := len(codeLengthOrder)
+    for n > 4 && lengthCode.lengths[codeLengthOrder[n-1]] == 0 {
+        n--
+    }
+    b.write(0, 1)
+    b.write(uint32(n-4), 4)
+    for _, sym := range codeLengthOrder[:n] {
+        b.write(uint32(lengthCode.lengths[sym]), 3)
+    }
+    b.write(0, 1) // every symbol's length follows
+    for _, l := range lengths {
+        lengthCode.write(b, int(l))
+    }
+    return newPrefixCode(lengths)
+}
+
+// predictorBits sets the 32x32 blocks the predictor mode is chosen for
+const predictorBits = 5
+
+// predictorModes are the VP8L predictors tried per block: left, top,
+// average of both and clamped gradient
+var predictorModes = []uint8{1, 2, 7, 12}
+
+// predict returns the mode's prediction of channel c at x, y from the
+// already coded pixels of pix
+func predict(pix []byte, width, x, y, c int, mode uint8) byte {
+    left := int(pix[(y*width+x-1)*4+c])
+    top := int(pix[((y-1)*width+x)*4+c])
+    switch mode {
+    case 1:
+        return byte(left)
+    case 2:
+        return byte(top)
+    case 7:
+        return byte((left + top) / 2)
+    }
+    topLeft := int(pix[((y-1)*width+x-1)*4+c])
+    return byte(min(max(left+top-topLeft, 0), 255))
+}
+
+// residuals applies the predictor transform to pix, returning the mode of
+// every block and the residual pixels
+func residuals(pix []byte, width, height int) ([]uint8, []byte) {
+    bw := (width + 1<<predictorBits - 1) >> predictorBits
+    bh := (height + 1<<predictorBits - 1) >> predictorBits
+    modes := make([]uint8, bw*bh)
+    for by := 0; by < bh; by++ {
+        for bx := 0; bx < bw; bx++ {
+            best := -1
+            for _, mode := range predictorModes {
+                cost := 0
+                for y := max(by<<predictorBits, 1); y < min((by+1)<<predictorBits, height); y++ {
+                    for x := max(bx<<predictorBits, 1); x < min((bx+1)<<predictorBits, width); x++ {
+                        for c := 0; c < 4; c++ {
+                            d := int(int8(pix[(y*width+x)*4+c] - predict(pix, width, x, y, c, mode)))
+                            cost += max(d, -d)
+                        }
+                    }
+                }
+                if best < 0 || cost < best {
+                    best = cost
+                    modes[by*bw+bx] = mode
+                }
+            }
+        }
+    }
+    out := make([]byte, len(pix))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            i := (y*width + x) * 4
+            for c := 0; c < 4; c++ {
+                var p byte
+                switch {
+                case x == 0 && y == 0:
+                    if c == 3 {
+                        p = 0xff
+                    }
+                case y == 0:
+                    p = pix[i-4+c]
+                case x == 0:
+                    p = pix[i-width*4+c]
+                default:
+                    p = predict(pix, width, x, y, c, modes[(y>>predictorBits)*bw+x>>predictorBits])
+                }
+                out[i+c] = pix[i+c] - p
+            }
+        }
+    }
+    return modes, out
+}
+
+// writeEntropyImage writes the prefix codes for pix, pixels as green, red,
+// blue and alpha, then the pixels as literals
+func writeEntropyImage(b *bitWriter, pix []byte) {
+    green, red, blue, alpha := make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)
+    for i := 0; i < len(pix); i += 4 {
+        green[pix[i]]++
+        red[pix[i+1]]++
+        blue[pix[i+2]]++
+        alpha[pix[i+3]]++
+    }
+    codes := [4]*prefixCode{
+        writePrefixCode(b, green),
+        writePrefixCode(b, red),
+        writePrefixCode(b, blue),
+        writePrefixCode(b, alpha),
+    }
+    writePrefixCode(b, make([]int, 40)) // distances, unused
+    for i := 0; i < len(pix); i += 4 {
+        for c, code := range codes {
+            code.write(b, int(pix[i+c]))
+        }
+    }
+}
+
+// maxPaletteColors is the most colors the color indexing transform holds
+const maxPaletteColors = 256
+
+// paletteOf returns the distinct colors of pix in order of first use and
+// the index of every pixel, false when there are more than
+// maxPaletteColors
+func paletteOf(pix []byte) ([][4]byte, []uint8, bool) {
+    var colors [][4]byte
+    known := map[[4]byte]uint8{}
+    index := make([]uint8, len(pix)/4)
+    for i := range index {
+        c := [4]byte(pix[i*4 : i*4+4])
+        n, ok := known[c]
+        if !ok {
+            if len(colors) == maxPaletteColors {
+                return nil, nil, false
+            }
+            n = uint8(len(colors))
+            known[c] = n
+            colors = append(colors, c)
+        }
+        index[i] = n
+    }
+    return colors, index, true
+}
+
+// paletteBits returns log2 of how many indices share a pixel for a
+// palette of n colors
+func paletteBits(n int) int {
+    switch {
+    case n <= 2:
+        return 3
+    case n <= 4:
+        return 2
+    case n <= 16:
+        return 1
+    }
+    return 0
+}
+
+// packIndices returns the pixels of the index image, 1<<bits indices to a
+// green value
+func packIndices(index []uint8, width, height, bits int) []byte {
+    packed := (width + 1<<bits - 1) >> bits
+    perIndex := 8 >> bits
+    pix := make([]byte, packed*height*4)
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            i := (y*packed + x>>bits) * 4
+            pix[i] |= index[y*width+x] << ((x & (1<<bits - 1)) * perIndex)
+            pix[i+3] = 0xff
+        }
+    }
+    return pix
+}
+
+// encodeWebP writes img as a lossless WebP
+func encodeWebP(w io.Writer, img image.Image) error {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    if width < 1 || height < 1 || width > vp8lMaxSize || height > vp8lMaxSize {
+        return errors.New("webp: image size out of range")
+    }
+    rgba, ok := img.(*image.NRGBA)
+    if !ok || rgba.Rect.Min != (image.Point{}) {
+        rgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+        draw.Draw(rgba, rgba.Rect, img, bounds.Min, draw.Src)
+    }
+
+    // Pixels as green, red, blue, alpha
+    pix := make([]byte, 0, width*height*4)
+    alpha := false
+    for y := 0; y < height; y++ {
+        row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+width*4]
+        for x := 0; x < len(row); x += 4 {
+            pix = append(pix, row[x+1], row[x], row[x+2], row[x+3])
+            alpha = alpha || row[x+3] != 0xff
+        }
+    }
+
+    b := &bitWriter{}
+    b.write(0x2f, 8)
+    b.write(uint32(width-1), 14)
+    b.write(uint32(height-1), 14)
+    if alpha {
+        b.write(1, 1)
+    } else {
+        b.write(0, 1)
+    }
+    b.write(0, 3) // version
+    if colors, index, ok := paletteOf(pix); ok {
+        b.write(1, 1) // transform: color indexing
+        b.write(3, 2)
+        b.write(uint32(len(colors)-1), 8)
+        // The color table is coded as the difference to the previous color
+        table := make([]byte, 0, len(colors)*4)
+        var prev [4]byte
+        for _, c := range colors {
+            table = append(table, c[0]-prev[0], c[1]-prev[1], c[2]-prev[2], c[3]-prev[3])
+            prev = c
+        }
+        b.write(0, 1) // no color cache
+        writeEntropyImage(b, table)
+        pix = packIndices(index, width, height, paletteBits(len(colors)))
+    } else {
+        for i := 0; i < len(pix); i += 4 {
+            pix[i+1] -= pix[i]
+            pix[i+2] -= pix[i]
+        }
+        var modes []uint8
+        modes, pix = residuals(pix, width, height)
+        b.write(1, 1) // transform: subtract green
+        b.write(2, 2)
+        b.write(1, 1) // transform: predictor
+        b.write(0, 2)
+        b.write(predictorBits-2, 3)
+        modeImage := make([]byte, 0, len(modes)*4)
+        for _, m := range modes {
+            modeImage = append(modeImage, m, 0, 0, 0xff)
+        }
+        b.write(0, 1) // no color cache
+        writeEntropyImage(b, modeImage)
+    }
+    b.write(0, 1) // no further transforms
+    b.write(0, 1) // no color cache
+    b.write(0, 1) // one prefix code group
+    writeEntropyImage(b, pix)
+    data := b.flush()
+
+    chunk := len(data) + len(data)&1
+    header := make([]byte, 20)
+    copy(header, "RIFF")
+    binary.LittleEndian.PutUint32(header[4:], uint32(12+chunk))
+    copy(header[8:], "WEBPVP8L")
+    binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+    if len(data)&1 == 1 {
+        data = append(data, 0)
+    }
+    if _, err := w.Write(header); err != nil {
+        return err
+    }
+    _, err := w.Write(data)
+    return err
+}
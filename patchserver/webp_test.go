@@ -0,0 +1,73 @@
+package patchserver
+
+import (
+    "bytes"
+    "image"
+    "image/color"
+    "testing"
+
+    "golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+    fill := func(w, h int, at func(x, y int) color.NRGBA) *image.NRGBA {
+        img := image.NewNRGBA(image.Rect(0, 0, w, h))
+        for y := 0; y < h; y++ {
+            for x := 0; x < w; x++ {
+                img.SetNRGBA(x, y, at(x, y))
+            }
+        }
+        return img
+    }
+    tests := []struct {
+        name    string
+        img     *image.NRGBA
+        maxSize int // 0 for no limit
+    }{
+        {"solid", fill(300, 200, func(x, y int) color.NRGBA { return color.NRGBA{200, 40, 90, 255} }), 100},
+        {"two colors", fill(300, 200, func(x, y int) color.NRGBA {
+            if (x/10+y/10)%2 == 0 {
+                return color.NRGBA{255, 255, 255, 255}
+            }
+            return color.NRGBA{0, 0, 0, 255}
+        }), 0},
+        {"sixteen colors", fill(97, 61, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x % 16 * 16), 0, uint8(y % 4), 255} }), 0},
+        {"palette", fill(64, 48, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x * 4), uint8(y), 7, 255} }), 0},
+        {"gradient", fill(300, 200, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255} }), 0},
+        {"alpha", fill(120, 80, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x * 2), 128, uint8(y * 3), uint8(x + y)} }), 0},
+        {"alpha palette", fill(40, 40, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, uint8(x % 3 * 100)} }), 0},
+        {"odd size", fill(33, 17, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x * y), uint8(x ^ y), uint8(3 * x), 255} }), 0},
+        {"one pixel", fill(1, 1, func(x, y int) color.NRGBA { return color.NRGBA{1, 2, 3, 4} }), 0},
+        {"one column", fill(1, 37, func(x, y int) color.NRGBA { return color.NRGBA{uint8(y * 7), uint8(y), 0, 255} }), 0},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        if err := encodeWebP(&buf, tt.img); err != nil {
+            t.Errorf("%s: encode: %v", tt.name, err)
+            continue
+        }
+        if tt.maxSize > 0 && buf.Len() > tt.maxSize {
+            t.Errorf("%s: %d bytes, want at most %d", tt.name, buf.Len(), tt.maxSize)
+        }
+        got, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+        if err != nil {
+            t.Errorf("%s: decode: %v", tt.name, err)
+            continue
+        }
+        if got.Bounds() != tt.img.Bounds() {
+            t.Errorf("%s: bounds %v, want %v", tt.name, got.Bounds(), tt.img.Bounds())
+            continue
+        }
+        b := tt.img.Bounds()
+    pixels:
+        for y := b.Min.Y; y < b.Max.Y; y++ {
+            for x := b.Min.X; x < b.Max.X; x++ {
+                want := tt.img.NRGBAAt(x, y)
+                if c := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA); c != want {
+                    t.Errorf("%s: pixel %d,%d is %v, want %v", tt.name, x, y, c, want)
+                    break pixels
+                }
+            }
+        }
+    }
+}